@@ -0,0 +1,10 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package simplescp
+
+import "golang.org/x/sys/unix"
+
+// Whether we can create files in (or write to) path, going by its permissions
+func canWrite(path string) error {
+	return unix.Access(path, unix.W_OK)
+}
@@ -0,0 +1,242 @@
+package simplescp
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"time"
+)
+
+// AdminConfig sets up the admin API, an HTTP server with JSON endpoints to
+// look at and manage the running server:
+//
+//	GET /sessions: Sessions logged in, with the transfers they're doing
+//	GET /transfers: The last transfers that finished, newest first
+//	DELETE /sessions/{id}: Close a session
+//	GET /bans: Client IPs and usernames banned after failed logins
+//	DELETE /bans, DELETE /bans/{target}: Lift all bans, or the one on an IP or username
+//	GET /quota/{user}: Disk space a user is using, and how much they can
+//	GET /healthz, GET /readyz: Whether the server is live and ready (see Health), without the token
+//	GET /debug/pprof/...: CPU, heap, goroutine and other profiles from net/http/pprof, with Pprof
+//
+// It also sets up the gRPC control service (see controlpb), which can do the
+// same along with changing settings and draining the server.
+type AdminConfig struct {
+	Listen       string `yaml:"listen" toml:"listen"`               // Address to listen on, e.g. 127.0.0.1:8223. Default: No admin API
+	GRPCListen   string `yaml:"grpc_listen" toml:"grpc_listen"`     // Address to serve the control service on, e.g. 127.0.0.1:8224. Default: No control service
+	Token        string `yaml:"token" toml:"token"`                 // Requests need to come with it as a bearer token (Authorization: Bearer <token>)
+	HealthListen string `yaml:"health_listen" toml:"health_listen"` // Address to serve just the health endpoints on, e.g. :8226. They don't need the token, so it can listen anywhere. Default: Only in the admin API
+	Pprof        bool   `yaml:"pprof" toml:"pprof"`                 // Serve profiles for go tool pprof under /debug/pprof/, with the rest of the admin API. Default: false
+}
+
+// How long admin requests get to be read and answered
+const adminTimeout = 30 * time.Second
+
+func (a AdminConfig) validate() error {
+	if err := a.validateListen("admin API", a.Listen); err != nil {
+		return err
+	}
+	if err := a.validateListen("control service", a.GRPCListen); err != nil {
+		return err
+	}
+	if len(a.HealthListen) > 0 {
+		if _, _, err := net.SplitHostPort(a.HealthListen); err != nil {
+			return fmt.Errorf("Invalid health endpoints listen address %q: %v", a.HealthListen, err)
+		}
+	}
+	return nil
+}
+
+// Without a token, what's served on addr can only be reached from localhost
+func (a AdminConfig) validateListen(what, addr string) error {
+	if len(addr) == 0 {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("Invalid %s listen address %q: %v", what, addr, err)
+	}
+	if ip := net.ParseIP(host); len(a.Token) == 0 && host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("The %s needs a token to listen on %s, or to only listen on localhost", what, addr)
+	}
+	return nil
+}
+
+// QuotaUsage is how much disk space a user is using
+type QuotaUsage struct {
+	User  string `json:"user"`
+	Dir   string `json:"dir"`
+	Used  int64  `json:"used"`
+	Quota int64  `json:"quota"` // 0 if there's no limit
+}
+
+// Sessions returns the sessions logged in, oldest first
+func (s *Server) Sessions() []Session {
+	return s.Config().sessions.list()
+}
+
+// RecentTransfers returns the last transfers that finished, newest first
+func (s *Server) RecentTransfers() []FinishedTransfer {
+	return s.Config().sessions.finished()
+}
+
+// CloseSession closes the connection of the session with the given id,
+// returns whether there was one
+func (s *Server) CloseSession(id string) bool {
+	if !s.Config().sessions.close(id) {
+		return false
+	}
+	s.Config().logger().Info("Closed session", "session", id)
+	return true
+}
+
+// Quota returns the disk space used by user and their quota. It's
+// ErrNoSuchUser for users that aren't User or in the user store
+func (s *Server) Quota(user string) (QuotaUsage, error) {
+	c := *s.Config()
+	var u *User
+	if user != c.User {
+		if u = c.lookupStoreUser(user); u == nil {
+			return QuotaUsage{}, ErrNoSuchUser
+		}
+	}
+	dir, err := c.userDir(user, u)
+	if err != nil {
+		return QuotaUsage{}, err
+	}
+	return QuotaUsage{
+		User:  user,
+		Dir:   dir,
+		Used:  c.usage.current(c.fileSystem(), dir),
+		Quota: int64(c.userQuota(u)),
+	}, nil
+}
+
+// AdminHandler returns the handler of the admin API (see AdminConfig), for
+// programs that want to serve it themselves. ListenAndServe serves it on
+// Admin.Listen
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sessions", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, http.StatusOK, s.Sessions())
+	})
+	mux.HandleFunc("GET /transfers", func(w http.ResponseWriter, r *http.Request) {
+		transfers := s.RecentTransfers()
+		if transfers == nil {
+			transfers = []FinishedTransfer{}
+		}
+		writeAdminJSON(w, http.StatusOK, transfers)
+	})
+	mux.HandleFunc("DELETE /sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if !s.CloseSession(r.PathValue("id")) {
+			writeAdminError(w, http.StatusNotFound, "No such session")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /bans", func(w http.ResponseWriter, r *http.Request) {
+		bans := s.Bans()
+		if bans == nil {
+			bans = []Ban{}
+		}
+		writeAdminJSON(w, http.StatusOK, bans)
+	})
+	unban := func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, http.StatusOK, map[string]int{"lifted": s.Unban(r.PathValue("target"))})
+	}
+	mux.HandleFunc("DELETE /bans", unban)
+	mux.HandleFunc("DELETE /bans/{target}", unban)
+	profiles := func(h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			// It can be turned on and off with a reload
+			if !s.Config().Admin.Pprof {
+				http.NotFound(w, r)
+				return
+			}
+			h(w, r)
+		}
+	}
+	mux.HandleFunc("GET /debug/pprof/", profiles(pprof.Index))
+	mux.HandleFunc("GET /debug/pprof/cmdline", profiles(pprof.Cmdline))
+	mux.HandleFunc("GET /debug/pprof/profile", profiles(pprof.Profile))
+	mux.HandleFunc("GET /debug/pprof/symbol", profiles(pprof.Symbol))
+	mux.HandleFunc("POST /debug/pprof/symbol", profiles(pprof.Symbol))
+	mux.HandleFunc("GET /debug/pprof/trace", profiles(pprof.Trace))
+	mux.HandleFunc("GET /quota/{user}", func(w http.ResponseWriter, r *http.Request) {
+		usage, err := s.Quota(r.PathValue("user"))
+		if errors.Is(err, ErrNoSuchUser) {
+			writeAdminError(w, http.StatusNotFound, "No such user")
+			return
+		} else if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, usage)
+	})
+
+	health := s.HealthHandler()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isHealthPath(r.URL.Path) {
+			// Probes don't get to have the token, and there's nothing to hide there
+			health.ServeHTTP(w, r)
+			return
+		}
+		// The token can change with a reload
+		config := s.Config()
+		if token := config.Admin.Token; len(token) > 0 {
+			given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				config.logger().Info("Rejected admin request", "remote_addr", r.RemoteAddr, "method", r.Method, "path", r.URL.Path)
+				writeAdminError(w, http.StatusUnauthorized, "Invalid token")
+				return
+			}
+		}
+		config.logger().Debug("Admin request", "remote_addr", r.RemoteAddr, "method", r.Method, "path", r.URL.Path)
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, msg string) {
+	writeAdminJSON(w, status, map[string]string{"error": msg})
+}
+
+// Start serving the admin API on Admin.Listen, if it's set, until Shutdown
+func (s *Server) startAdmin() error {
+	addr := s.Config().Admin.Listen
+	if len(addr) == 0 {
+		return nil
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Can't start admin API: %v", err)
+	}
+	server := &http.Server{
+		Handler:      s.AdminHandler(),
+		ReadTimeout:  adminTimeout,
+		WriteTimeout: adminTimeout,
+	}
+	s.mu.Lock()
+	if s.inShutdown {
+		s.mu.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	s.admin = server
+	s.mu.Unlock()
+
+	s.Config().logger().Info("Serving admin API", "addr", listener.Addr().String(), "pprof", s.Config().Admin.Pprof)
+	go server.Serve(listener)
+	return nil
+}
@@ -0,0 +1,158 @@
+package simplescp
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Makes a request to the admin API at url, decoding what it answers into v
+func adminRequest(t *testing.T, method, url, token string, v any) int {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, nil)
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		json.NewDecoder(resp.Body).Decode(v)
+	}
+	return resp.StatusCode
+}
+
+func TestAdminAPI(t *testing.T) {
+	c := newTestConfig(t)
+	c.Quota = 1024 * 1024
+	c.BanThreshold = 1
+	c.Admin.Token = "s3cret"
+	addr := startTestServer(t, c)
+	server := NewServer(c)
+	api := httptest.NewServer(server.AdminHandler())
+	defer api.Close()
+
+	if status := adminRequest(t, "GET", api.URL+"/sessions", "wrong", nil); status != http.StatusUnauthorized {
+		t.Errorf("Got %d with the wrong token", status)
+	}
+
+	client := dialSFTP(t, addr)
+	f, err := client.Create("/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("hello"))
+	var sessions []Session
+	if status := adminRequest(t, "GET", api.URL+"/sessions", "s3cret", &sessions); status != http.StatusOK {
+		t.Fatalf("Got %d listing sessions", status)
+	}
+	if len(sessions) != 1 || sessions[0].User != "scpuser" || !strings.HasPrefix(sessions[0].RemoteAddr, "127.0.0.1:") || sessions[0].BytesIn == 0 {
+		t.Fatalf("Unexpected sessions %+v", sessions)
+	}
+	expected := Transfer{Protocol: "sftp", Direction: "upload", Path: filepath.Join(c.Dir, "file.txt"), Bytes: 5}
+	if transfers := sessions[0].Transfers; len(transfers) != 1 || transfers[0].Start.IsZero() {
+		t.Errorf("Unexpected transfers %+v", transfers)
+	} else if transfers[0].Start = (time.Time{}); transfers[0] != expected {
+		t.Errorf("Got transfer %+v, expected %+v", transfers[0], expected)
+	}
+	f.Close()
+
+	var usage QuotaUsage
+	if status := adminRequest(t, "GET", api.URL+"/quota/scpuser", "s3cret", &usage); status != http.StatusOK {
+		t.Errorf("Got %d looking up quota", status)
+	}
+	if usage.User != "scpuser" || usage.Used != 5 || usage.Quota != 1024*1024 {
+		t.Errorf("Unexpected quota usage %+v", usage)
+	}
+	if status := adminRequest(t, "GET", api.URL+"/quota/nobody", "s3cret", nil); status != http.StatusNotFound {
+		t.Errorf("Got %d for the quota of an unknown user", status)
+	}
+
+	c.bans.failure("192.0.2.10", "mallory", slog.Default())
+	var bans []Ban
+	adminRequest(t, "GET", api.URL+"/bans", "s3cret", &bans)
+	if len(bans) != 2 {
+		t.Errorf("Unexpected bans %+v", bans)
+	}
+	var lifted map[string]int
+	adminRequest(t, "DELETE", api.URL+"/bans/mallory", "s3cret", &lifted)
+	if lifted["lifted"] != 1 || !c.bans.bannedIP("192.0.2.10") || c.bans.bannedUser("mallory") {
+		t.Errorf("Expected just mallory unbanned, got %v", lifted)
+	}
+	adminRequest(t, "DELETE", api.URL+"/bans", "s3cret", &lifted)
+	if lifted["lifted"] != 1 || len(c.bans.list()) != 0 {
+		t.Errorf("Expected all bans lifted, got %v", lifted)
+	}
+
+	if status := adminRequest(t, "DELETE", api.URL+"/sessions/"+sessions[0].ID, "s3cret", nil); status != http.StatusNoContent {
+		t.Errorf("Got %d closing session", status)
+	}
+	if _, err := client.Stat("/file.txt"); err == nil {
+		t.Error("Session still works after being closed")
+	}
+	for i := 0; i < 50 && len(server.Sessions()) > 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if sessions := server.Sessions(); len(sessions) != 0 {
+		t.Errorf("Closed session still listed: %+v", sessions)
+	}
+	if status := adminRequest(t, "DELETE", api.URL+"/sessions/"+sessions[0].ID, "s3cret", nil); status != http.StatusNotFound {
+		t.Errorf("Got %d closing a session that's gone", status)
+	}
+}
+
+func TestAdminConfigValidate(t *testing.T) {
+	for _, a := range []AdminConfig{
+		{},
+		{Listen: "127.0.0.1:8223"},
+		{Listen: "localhost:8223"},
+		{Listen: "[::1]:8223"},
+		{Listen: ":8223", Token: "s3cret"},
+		{Listen: "127.0.0.1:8223", GRPCListen: "127.0.0.1:8224"},
+		{GRPCListen: ":8224", Token: "s3cret"},
+	} {
+		if err := a.validate(); err != nil {
+			t.Errorf("%+v not valid: %v", a, err)
+		}
+	}
+	for _, a := range []AdminConfig{
+		{Listen: ":8223"},
+		{Listen: "192.0.2.1:8223"},
+		{Listen: "127.0.0.1"},
+		{Listen: "127.0.0.1:8223", GRPCListen: ":8224"},
+	} {
+		if err := a.validate(); err == nil {
+			t.Errorf("%+v valid", a)
+		}
+	}
+}
+
+func TestAdminPprof(t *testing.T) {
+	c := newTestConfig(t)
+	c.Admin.Token = "s3cret"
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	api := httptest.NewServer(NewServer(c).AdminHandler())
+	defer api.Close()
+
+	if status := adminRequest(t, "GET", api.URL+"/debug/pprof/goroutine?debug=1", "s3cret", nil); status != http.StatusNotFound {
+		t.Errorf("Got %d for profiles without pprof", status)
+	}
+	c.Admin.Pprof = true
+	if status := adminRequest(t, "GET", api.URL+"/debug/pprof/goroutine?debug=1", "", nil); status != http.StatusUnauthorized {
+		t.Errorf("Got %d for profiles without the token", status)
+	}
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/goroutine?debug=1", "/debug/pprof/heap", "/debug/pprof/cmdline"} {
+		if status := adminRequest(t, "GET", api.URL+path, "s3cret", nil); status != http.StatusOK {
+			t.Errorf("Got %d for %s", status, path)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package simplescp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// agentHostKey signs with a host key kept in an ssh-agent, so the private key
+// never has to be on the server's disk. It connects to the agent every time,
+// handshakes only need one signature and it keeps working if the agent restarts
+type agentHostKey struct {
+	pub  ssh.PublicKey
+	sock string
+}
+
+func dialAgent(sock string) (agent.ExtendedAgent, io.Closer, error) {
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Can't connect to ssh-agent: %v", err)
+	}
+	return agent.NewClient(conn), conn, nil
+}
+
+func (k *agentHostKey) PublicKey() ssh.PublicKey {
+	return k.pub
+}
+
+func (k *agentHostKey) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return k.SignWithAlgorithm(rand, data, "")
+}
+
+func (k *agentHostKey) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	var flags agent.SignatureFlags
+	switch algorithm {
+	case ssh.KeyAlgoRSASHA256:
+		flags = agent.SignatureFlagRsaSha256
+	case ssh.KeyAlgoRSASHA512:
+		flags = agent.SignatureFlagRsaSha512
+	}
+	client, conn, err := dialAgent(k.sock)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return client.SignWithFlags(k.pub, data, flags)
+}
+
+// RSA keys can sign with SHA-2 too, which is all recent clients accept
+func (k *agentHostKey) Algorithms() []string {
+	if k.pub.Type() == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{k.pub.Type()}
+}
+
+// Host keys from the ssh-agent at SSH_AUTH_SOCK: the ones in HostKeyAgentKeys,
+// or all of them if it's empty
+func (c *Config) agentHostKeys() ([]ssh.Signer, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if len(sock) == 0 {
+		return nil, errors.New("Can't use host keys from ssh-agent: SSH_AUTH_SOCK isn't set")
+	}
+	client, conn, err := dialAgent(sock)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	keys, err := client.List()
+	if err != nil {
+		return nil, fmt.Errorf("Can't list ssh-agent keys: %v", err)
+	}
+
+	var signers []ssh.Signer
+	for _, key := range keys {
+		pub, err := ssh.ParsePublicKey(key.Blob)
+		if err != nil {
+			continue
+		}
+		if _, isCert := pub.(*ssh.Certificate); isCert {
+			continue
+		}
+		if len(c.HostKeyAgentKeys) > 0 && !slices.Contains(c.HostKeyAgentKeys, ssh.FingerprintSHA256(pub)) {
+			continue
+		}
+		signers = append(signers, &agentHostKey{pub: pub, sock: sock})
+	}
+	if len(signers) == 0 {
+		return nil, errors.New("Can't use host keys from ssh-agent: it doesn't have any of them")
+	}
+	return signers, nil
+}
@@ -0,0 +1,76 @@
+package simplescp
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Starts an ssh-agent holding key, and points SSH_AUTH_SOCK at it
+func startTestAgent(t *testing.T, key interface{}) {
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				agent.ServeAgent(keyring, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", sock)
+}
+
+func TestAgentHostKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTestAgent(t, key)
+	pub, _ := ssh.NewPublicKey(&key.PublicKey)
+
+	c := newTestConfig(t)
+	c.HostKeyAgent = true
+	c.HostKeyAgentKeys = []string{"SHA256:somethingelse"}
+	if err := c.initPrivateKey(); err == nil {
+		t.Error("Agent keys not filtered by fingerprint")
+	}
+	c.HostKeyAgentKeys = []string{ssh.FingerprintSHA256(pub)}
+	addr := startTestServer(t, c)
+
+	// The handshake only works if the agent signs with SHA-2
+	var hostKey ssh.PublicKey
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:              "scpuser",
+		Auth:              []ssh.AuthMethod{ssh.Password("hunter2")},
+		HostKeyAlgorithms: []string{ssh.KeyAlgoRSASHA256},
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKey = key
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if hostKey == nil || !keysEqual(hostKey, pub) {
+		t.Errorf("Server didn't identify itself with the agent's key")
+	}
+}
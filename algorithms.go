@@ -0,0 +1,35 @@
+package simplescp
+
+import (
+	"fmt"
+	"slices"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Check that the key exchanges, ciphers and MACs in the config are ones we can
+// actually use, warning about the ones with known weaknesses
+func (c Config) validateAlgorithms() error {
+	supported := ssh.SupportedAlgorithms()
+	insecure := ssh.InsecureAlgorithms()
+	for _, list := range []struct {
+		kind                string
+		algos               []string
+		supported, insecure []string
+	}{
+		{"key exchange", c.KeyExchanges, supported.KeyExchanges, insecure.KeyExchanges},
+		{"cipher", c.Ciphers, supported.Ciphers, insecure.Ciphers},
+		{"MAC", c.MACs, supported.MACs, insecure.MACs},
+	} {
+		for _, algo := range list.algos {
+			if slices.Contains(list.insecure, algo) {
+				c.logger().Warn("Insecure algorithm enabled", "type", list.kind, "algorithm", algo)
+				continue
+			}
+			if !slices.Contains(list.supported, algo) {
+				return fmt.Errorf("Unsupported %s algorithm %q, it should be one of %v", list.kind, algo, list.supported)
+			}
+		}
+	}
+	return nil
+}
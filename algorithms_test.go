@@ -0,0 +1,20 @@
+package simplescp
+
+import "testing"
+
+func TestValidateAlgorithms(t *testing.T) {
+	c := Config{
+		KeyExchanges: []string{"curve25519-sha256", "diffie-hellman-group1-sha1"},
+		Ciphers:      []string{"chacha20-poly1305@openssh.com", "aes128-ctr"},
+		MACs:         []string{"hmac-sha2-256-etm@openssh.com"},
+	}
+	if err := c.validateAlgorithms(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (Config{Ciphers: []string{"rot13"}}).validateAlgorithms(); err == nil {
+		t.Error("Unknown cipher accepted")
+	}
+	if err := (Config{MACs: []string{"curve25519-sha256"}}).validateAlgorithms(); err == nil {
+		t.Error("Key exchange accepted as a MAC")
+	}
+}
@@ -0,0 +1,92 @@
+package simplescp
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// AnonymousConfig holds the settings for letting clients in without any
+// credentials, as long as they log in as User. They all share Dir, where
+// they can only read (or only write, for drop boxes).
+type AnonymousConfig struct {
+	Enabled     bool     `yaml:"enabled" toml:"enabled"`
+	User        string   `yaml:"user" toml:"user"`               // Default: anonymous
+	Dir         string   `yaml:"dir" toml:"dir"`                 // Shared by every anonymous client
+	Permissions string   `yaml:"permissions" toml:"permissions"` // read (the default) or write, to only allow uploads
+	Quota       ByteSize `yaml:"quota" toml:"quota"`             // How much space anonymous uploads can take up, 0 for no limit. Default: 100M
+	MaxFileSize ByteSize `yaml:"max_file_size" toml:"max_file_size"`
+}
+
+// Anyone can upload as the anonymous user, so they can't fill up the disk
+// unless the quota's turned off
+const defaultAnonymousQuota = 100 << 20
+
+// Anonymous sessions are marked in the connection's permissions
+const permAnonymous = "simplescp-anonymous"
+
+func (a AnonymousConfig) user() string {
+	if len(a.User) > 0 {
+		return a.User
+	}
+	return "anonymous"
+}
+
+func (a AnonymousConfig) permissions() (Permission, error) {
+	if len(a.Permissions) == 0 {
+		return permReadAll, nil
+	}
+	return ParsePermissions(a.Permissions)
+}
+
+func (c Config) validateAnonymous() error {
+	a := c.Anonymous
+	if len(a.Dir) == 0 {
+		return errors.New("Invalid anonymous settings: dir has to be set")
+	}
+	if a.user() == c.User {
+		return fmt.Errorf("Invalid anonymous settings: %s is also the regular user", a.user())
+	}
+	perms, err := a.permissions()
+	if err != nil {
+		return fmt.Errorf("Invalid anonymous permissions: %v", err)
+	}
+	if perms.Has(PermRead) && perms.Has(PermWrite) {
+		c.logger().Warn("Anonymous clients can both upload and download files, make sure that's what you want")
+	}
+	return nil
+}
+
+// Lets in clients logging in as the anonymous user without asking them for
+// anything. Everyone else has to authenticate as usual
+func (c Config) anonymousAuth(conn ssh.ConnMetadata) (*ssh.Permissions, error) {
+	if !c.Anonymous.Enabled || conn.User() != c.Anonymous.user() {
+		return nil, errors.New("authentication needed")
+	}
+	c.logger().Info("Accepted anonymous login", "user", conn.User(), "remote_addr", conn.RemoteAddr().String())
+	return &ssh.Permissions{Extensions: map[string]string{permAnonymous: "1"}}, nil
+}
+
+// Everything anonymous clients do happens in the anonymous directory, with
+// the anonymous permissions and limits
+func (c *Config) setupAnonymousSession(username string) error {
+	perms, err := c.Anonymous.permissions()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Clean(c.Anonymous.Dir)
+	if err := c.fileSystem().MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	c.Dir = dir
+	c.username = username
+	c.perms = c.userPermissions(&User{Permissions: perms})
+	c.quotaLimit = c.Anonymous.Quota
+	c.idleTimeout = c.IdleTimeout
+	if c.Anonymous.MaxFileSize > 0 {
+		c.MaxFileSize = c.Anonymous.MaxFileSize
+	}
+	return nil
+}
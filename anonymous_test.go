@@ -0,0 +1,35 @@
+package simplescp
+
+import "testing"
+
+func TestAnonymousAuth(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{User: "scpuser", Dir: dir + "/%u", Anonymous: AnonymousConfig{Enabled: true, Dir: dir + "/pub", Permissions: "write", Quota: 1 << 20}}
+	if err := c.validateAnonymous(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.anonymousAuth(testConnMetadata{"scpuser"}); err == nil {
+		t.Error("Regular user let in without credentials")
+	}
+	perms, err := c.anonymousAuth(testConnMetadata{"anonymous"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.setupSession("anonymous", perms); err != nil {
+		t.Fatal(err)
+	}
+	if c.Dir != dir+"/pub" || c.perms != permWriteAll || c.quotaLimit != 1<<20 {
+		t.Errorf("Unexpected anonymous session dir %s, permissions %v, quota %v", c.Dir, c.perms, c.quotaLimit)
+	}
+
+	// Anyone can log in, so there's a limit unless it's turned off
+	if quota := NewConfig().Anonymous.Quota; quota <= 0 {
+		t.Errorf("Anonymous uploads aren't limited by default, quota %v", quota)
+	}
+
+	c.Anonymous.User = "scpuser"
+	if err := c.validateAnonymous(); err == nil {
+		t.Error("Expected an error for an anonymous user that's also the regular user")
+	}
+}
@@ -0,0 +1,173 @@
+package simplescp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// Suffix of the files uploads are written to until they're complete
+const partialSuffix = ".part"
+
+// Whether uploads are written somewhere else until they're complete, with
+// atomic uploads or when they have to be scanned first
+func (c Config) stagedUploads() bool {
+	return c.AtomicUploads || c.Scan.enabled()
+}
+
+// Where an upload to name is written while it's in progress with atomic
+// uploads: a hidden file next to it, so renaming it into place doesn't have to
+// move it across file systems. Uploads waiting to be scanned go to the quarantine
+func (c Config) partialPath(name string) (string, error) {
+	b := make([]byte, 4)
+	rand.Read(b)
+	base := "." + filepath.Base(name) + "." + hex.EncodeToString(b) + partialSuffix
+	if !c.Scan.enabled() {
+		return filepath.Join(filepath.Dir(name), base), nil
+	}
+	dir := filepath.Join(c.Dir, quarantineDir)
+	if err := c.fileSystem().MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, base), nil
+}
+
+// Whether name is the base name of a file partialPath made
+func partialFile(name string) bool {
+	rest, ok := strings.CutSuffix(name, partialSuffix)
+	if !ok || !strings.HasPrefix(rest, ".") || len(rest) < 11 || rest[len(rest)-9] != '.' {
+		return false
+	}
+	_, err := hex.DecodeString(rest[len(rest)-8:])
+	return err == nil
+}
+
+// Open the file an upload to name is written to with flag, name itself unless
+// uploads are staged. Returns where it really is too
+func (c Config) createUpload(name string, flag int, perm os.FileMode) (File, string, error) {
+	fsys := c.fileSystem()
+	if !c.stagedUploads() {
+		f, err := fsys.OpenFile(name, flag, perm)
+		return f, name, err
+	}
+	part, err := c.partialPath(name)
+	if err != nil {
+		return nil, "", err
+	}
+	f, err := fsys.OpenFile(part, flag&^os.O_TRUNC|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		// Errors are about the file being uploaded as far as clients know
+		if pathErr, ok := err.(*os.PathError); ok {
+			pathErr.Path = name
+		}
+	}
+	return f, part, err
+}
+
+// What's done with what's left of uploads that didn't finish, like when the
+// client goes away halfway through
+const (
+	partialKeep   = "keep"
+	partialDelete = "delete"
+	partialMove   = "move"
+)
+
+// Where partial uploads are moved to in the user's directory, with the move policy
+const partialDir = ".partial"
+
+func validatePartialUploads(policy string) error {
+	switch policy {
+	case "", partialKeep, partialDelete, partialMove:
+		return nil
+	}
+	return fmt.Errorf("Invalid partial uploads policy %q, it should be %s, %s or %s", policy, partialKeep, partialDelete, partialMove)
+}
+
+// Get rid of an upload to name, written to part, that didn't finish. By
+// default the hidden files of atomic uploads are removed, and other files are
+// left as they are in case the client wants to resume them
+func (c Config) discardUpload(part, name string) {
+	policy := c.PartialUploads
+	if len(policy) == 0 {
+		policy = partialKeep
+		if part != name {
+			policy = partialDelete
+		}
+	}
+	fsys := c.fileSystem()
+	if _, err := fsys.Lstat(part); err != nil {
+		// Already taken care of, like infected files
+		return
+	}
+	log := c.logger().With("file", name)
+	switch policy {
+	case partialDelete:
+		size := c.existingSize(part)
+		if err := fsys.Remove(part); err != nil {
+			log.Warn("Can't remove partial upload", "err", err)
+			return
+		}
+		c.reserveSpace(-size)
+		log.Info("Removed partial upload")
+	case partialMove:
+		rel, err := filepath.Rel(c.Dir, name)
+		if err != nil {
+			log.Warn("Can't move partial upload", "err", err)
+			return
+		}
+		dest := filepath.Join(c.Dir, partialDir, rel)
+		err = fsys.MkdirAll(filepath.Dir(dest), 0755)
+		if err == nil {
+			err = fsys.Rename(part, dest)
+		}
+		if err != nil {
+			log.Warn("Can't move partial upload", "err", err)
+			return
+		}
+		log.Info("Moved partial upload", "to", dest)
+	}
+}
+
+// uploadFile is a file open through sftp for writing, which is discarded if
+// the client goes away without closing it. With atomic uploads it's written to
+// part and moved to name once it's closed
+type uploadFile struct {
+	sftpFile
+	config  Config
+	part    string
+	name    string
+	oldSize int64 // Of the file an atomic upload replaces
+	done    func()
+	aborted atomic.Bool
+}
+
+// Called by the request server for the files still open when the connection's
+// dropped, before closing them
+func (f *uploadFile) TransferError(err error) {
+	f.aborted.Store(true)
+}
+
+func (f *uploadFile) Close() error {
+	if f.done != nil {
+		defer f.done()
+	}
+	err := f.sftpFile.Close()
+	if f.aborted.Load() {
+		f.config.discardUpload(f.part, f.name)
+		return err
+	}
+	if err == nil && f.part != f.name {
+		err = f.config.completeUpload(f.part, f.name)
+		if err != nil {
+			f.config.discardUpload(f.part, f.name)
+			return err
+		}
+		// The file it replaced, if any, is gone now
+		f.config.reserveSpace(-f.oldSize)
+	}
+	return err
+}
@@ -0,0 +1,162 @@
+package simplescp
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The partial files of uploads in dir
+func partialFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, ".*"+partialSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestSinkAtomicUploads(t *testing.T) {
+	c := newTestConfig(t)
+	c.AtomicUploads = true
+	file := filepath.Join(c.Dir, "file.txt")
+	os.WriteFile(file, []byte("old"), 0644)
+	addr := startTestServer(t, c)
+
+	scp := startTestSCP(t, addr, "scp -t file.txt")
+	scp.ack()
+	if err := scp.send("C0600 5 file.txt\n"); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(scp.stdin, "hel")
+	// Nothing's changed until it's all there
+	if files := partialFiles(t, c.Dir); len(files) != 1 {
+		t.Errorf("Upload going to %v", files)
+	}
+	if data, _ := os.ReadFile(file); string(data) != "old" {
+		t.Errorf("File changed to %q while it was uploaded", data)
+	}
+	if err := scp.send("lo\x00"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(file); string(data) != "hello" {
+		t.Errorf("File has %q after the upload", data)
+	}
+	if fi, _ := os.Stat(file); fi.Mode().Perm() != 0600 {
+		t.Errorf("File has mode %v", fi.Mode())
+	}
+
+	// Failed uploads are thrown away
+	scp = startTestSCP(t, addr, "scp -t file.txt")
+	scp.ack()
+	scp.send("C0644 5 file.txt\n")
+	io.WriteString(scp.stdin, "bye")
+	scp.stdin.Close()
+	scp.session.Wait()
+	if data, _ := os.ReadFile(file); string(data) != "hello" {
+		t.Errorf("Failed upload changed the file to %q", data)
+	}
+	if files := partialFiles(t, c.Dir); len(files) > 0 {
+		t.Errorf("Failed upload left %v behind", files)
+	}
+}
+
+func TestSFTPAtomicUploads(t *testing.T) {
+	c := newTestConfig(t)
+	c.AtomicUploads = true
+	client := dialSFTP(t, startTestServer(t, c))
+
+	f, err := client.Create("/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("hello"))
+	if _, err := os.Stat(filepath.Join(c.Dir, "file.txt")); err == nil {
+		t.Error("File there before it was closed")
+	}
+	// Like clients preserving the permissions of what they upload
+	if err := client.Chmod("/file.txt", 0600); err != nil {
+		t.Errorf("Can't set the mode of the upload: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(filepath.Join(c.Dir, "file.txt"))
+	if err != nil || fi.Size() != 5 || fi.Mode().Perm() != 0600 {
+		t.Errorf("Uploaded file is %v (%v)", fi, err)
+	}
+	if files := partialFiles(t, c.Dir); len(files) > 0 {
+		t.Errorf("Upload left %v behind", files)
+	}
+}
+
+func TestPartialUploads(t *testing.T) {
+	for policy, expected := range map[string]string{
+		"":            filepath.Join("dir", "file.txt"),
+		partialKeep:   filepath.Join("dir", "file.txt"),
+		partialDelete: "",
+		partialMove:   filepath.Join(partialDir, "dir", "file.txt"),
+	} {
+		c := newTestConfig(t)
+		c.PartialUploads = policy
+		os.Mkdir(filepath.Join(c.Dir, "dir"), 0755)
+		addr := startTestServer(t, c)
+
+		scp := startTestSCP(t, addr, "scp -t dir/file.txt")
+		scp.ack()
+		scp.send("C0644 5 file.txt\n")
+		io.WriteString(scp.stdin, "hel")
+		scp.stdin.Close()
+		scp.session.Wait()
+
+		var left []string
+		filepath.Walk(c.Dir, func(p string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				rel, _ := filepath.Rel(c.Dir, p)
+				left = append(left, rel)
+			}
+			return nil
+		})
+		if strings.Join(left, " ") != expected {
+			t.Errorf("Partial upload left %v with %q, expected %q", left, policy, expected)
+		}
+	}
+}
+
+func TestSFTPPartialUploads(t *testing.T) {
+	c := newTestConfig(t)
+	c.PartialUploads = partialDelete
+	os.WriteFile(filepath.Join(c.Dir, "existing.txt"), []byte("hello"), 0644)
+	client := dialSFTP(t, startTestServer(t, c))
+
+	f, err := client.Create("/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("hel"))
+	// Modifying files isn't uploading them, they stay whatever happens
+	existing, err := client.OpenFile("/existing.txt", os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing.Write([]byte("j"))
+	// Going away without closing them
+	client.Close()
+
+	for i := 0; i < 50; i++ {
+		if _, err := os.Stat(filepath.Join(c.Dir, "file.txt")); err != nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if _, err := os.Stat(filepath.Join(c.Dir, "file.txt")); err == nil {
+		t.Error("Partial upload left behind")
+	}
+	if data, _ := os.ReadFile(filepath.Join(c.Dir, "existing.txt")); string(data) != "jello" {
+		t.Errorf("Modified file has %q", data)
+	}
+}
@@ -1,43 +1,299 @@
-package main
+package simplescp
 
 import (
 	"bytes"
 	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/FranGM/simplelog"
+	"github.com/go-ldap/ldap/v3"
 	"golang.org/x/crypto/ssh"
 )
 
-func (c scpConfig) passwordAuth(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+func (c Config) passwordAuth(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
 	username := conn.User()
-	simplelog.Debug.Printf("Doing password authentication for user %v", username)
-	// Consider using hashes for the comparison instead of a straight equality check
-	if username == c.User && string(pass) == c.passwords[username] {
-		simplelog.Info.Printf("Accepted password for %v", username)
-		return nil, nil
+	log := c.logger().With("user", username, "remote_addr", conn.RemoteAddr().String())
+	log.Debug("Doing password authentication")
+	if !c.allowAuthAttempt(conn, log) {
+		return nil, fmt.Errorf("too many authentication attempts for %v", username)
+	}
+	totpSecret, perms, ok := c.checkPassword(conn, pass)
+	if ok && len(totpSecret) > 0 {
+		// Users with a second factor have to go through keyboard-interactive authentication
+		log.Info("Rejected password, a verification code is needed")
+		return nil, fmt.Errorf("verification code needed for %v", username)
+	}
+	if ok {
+		log.Info("Accepted password")
+		return perms, nil
 	}
 
-	simplelog.Info.Printf("Rejected password for %v", username)
+	log.Info("Rejected password")
 	return nil, fmt.Errorf("password rejected for %v", username)
 }
 
-func (c scpConfig) keyAuth(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+// Checks the user's password, returning the user's TOTP secret if they have
+// one, and the permissions to hand over to the session
+func (c Config) checkPassword(conn ssh.ConnMetadata, pass []byte) (string, *ssh.Permissions, bool) {
 	username := conn.User()
+	// Tokens aren't passwords, they don't get checked anywhere else
+	if c.JWT.enabled() && looksLikeJWT(pass) {
+		limit, err := c.JWT.authenticate(c.jwks, username, string(pass))
+		if err != nil {
+			c.logger().Info("Rejected token", "user", username, "err", err)
+			return "", nil, false
+		}
+		return "", limitPermissions(limit), true
+	}
+
+	if username == c.User && checkConfigPassword(c.passwords[username], pass) {
+		return c.TOTPSecret, nil, true
+	}
+
+	u := c.lookupStoreUser(username)
+	if u != nil && u.checkPassword(pass) {
+		return u.TOTPSecret, nil, true
+	}
+
+	// Any system account PAM lets in can log in, still needing the second
+	// factor if we've got one for them
+	if len(c.PAMService) > 0 {
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		err := pamAuthenticate(c.PAMService, username, string(pass), host)
+		if err == nil {
+			return c.externalTOTPSecret(username, u), nil, true
+		}
+		c.logger().Debug("PAM authentication failed", "user", username, "err", err)
+	}
+
+	if c.RADIUS.enabled() {
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		err := c.RADIUS.authenticate(username, string(pass), host)
+		if err == nil {
+			return c.externalTOTPSecret(username, u), nil, true
+		}
+		if err == errRADIUSReject {
+			c.logger().Debug("RADIUS authentication failed", "user", username, "err", err)
+		} else {
+			c.logger().Error("RADIUS authentication failed", "user", username, "err", err)
+		}
+	}
+
+	// Same for the LDAP directory, which can also say where their files are
+	if c.LDAP.enabled() {
+		ldapUser, err := c.LDAP.authenticate(username, string(pass))
+		if err == nil {
+			return c.externalTOTPSecret(username, u), homeDirPermissions(ldapUser.HomeDir), true
+		}
+		switch {
+		case err == ErrNoSuchUser || ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials):
+			c.logger().Debug("LDAP authentication failed", "user", username, "err", err)
+		case err == errLDAPGroup:
+			c.logger().Info("LDAP authentication failed", "user", username, "err", err)
+		default:
+			c.logger().Error("LDAP authentication failed", "user", username, "err", err)
+		}
+	}
+	return "", nil, false
+}
+
+// TOTP secret for users whose password is checked somewhere else (PAM, LDAP)
+func (c Config) externalTOTPSecret(username string, u *User) string {
+	if username == c.User {
+		return c.TOTPSecret
+	}
+	if u != nil {
+		return u.TOTPSecret
+	}
+	return ""
+}
 
-	simplelog.Debug.Printf("authenticating with key of type %q", key.Type())
+// Users whose home directory comes from authentication (e.g. from LDAP) hand
+// it over to the session in the connection's permissions
+const permHomeDir = "simplescp-home-dir"
+
+func homeDirPermissions(homeDir string) *ssh.Permissions {
+	if len(homeDir) == 0 {
+		return nil
+	}
+	return &ssh.Permissions{Extensions: map[string]string{permHomeDir: homeDir}}
+}
+
+// Same for the permissions granted by a token, which limit the user's own
+const permLimit = "simplescp-permissions"
+
+func limitPermissions(limit Permission) *ssh.Permissions {
+	return &ssh.Permissions{Extensions: map[string]string{permLimit: strconv.FormatUint(uint64(limit), 10)}}
+}
+
+// Asks for the password and, for users that have a TOTP secret, a
+// verification code from their authenticator app
+func (c Config) keyboardInteractiveAuth(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	username := conn.User()
+	log := c.logger().With("user", username, "remote_addr", conn.RemoteAddr().String())
+	log.Debug("Doing keyboard-interactive authentication")
+	if !c.allowAuthAttempt(conn, log) {
+		return nil, fmt.Errorf("too many authentication attempts for %v", username)
+	}
 
-	listKeys, ok := c.AuthKeys[username]
+	answers, err := client(username, "", []string{"Password: "}, []bool{false})
+	if err != nil || len(answers) != 1 {
+		return nil, fmt.Errorf("keyboard-interactive authentication failed for %v: %v", username, err)
+	}
+	totpSecret, perms, ok := c.checkPassword(conn, []byte(answers[0]))
 	if !ok {
-		return nil, fmt.Errorf("No keys for %q", username)
+		log.Info("Rejected password")
+		return nil, fmt.Errorf("password rejected for %v", username)
+	}
+	if len(totpSecret) == 0 {
+		log.Info("Accepted password")
+		return perms, nil
+	}
+
+	answers, err = client(username, "", []string{"Verification code: "}, []bool{false})
+	if err != nil || len(answers) != 1 {
+		return nil, fmt.Errorf("keyboard-interactive authentication failed for %v: %v", username, err)
+	}
+	if !checkTOTP(totpSecret, answers[0], time.Now()) {
+		log.Info("Rejected verification code")
+		return nil, fmt.Errorf("verification code rejected for %v", username)
+	}
+	log.Info("Accepted password and verification code")
+	return perms, nil
+}
+
+func (c Config) keyAuth(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	username := conn.User()
+	log := c.logger().With("user", username, "remote_addr", conn.RemoteAddr().String())
+
+	log.Debug("Doing key authentication", "key_type", key.Type())
+	if !c.allowAuthAttempt(conn, log) {
+		return nil, fmt.Errorf("too many authentication attempts for %v", username)
 	}
 
-	for _, authorizedKey := range listKeys {
-		if bytes.Compare(key.Marshal(), authorizedKey.Marshal()) == 0 {
-			simplelog.Info.Printf("Access granted for user %v", username)
+	if c.revokedKeys.keyRevoked(key) {
+		log.Warn("Rejected revoked key", "key_type", key.Type(), "fingerprint", ssh.FingerprintSHA256(key))
+		return nil, fmt.Errorf("key revoked for %v", username)
+	}
+
+	if cert, ok := key.(*ssh.Certificate); ok {
+		return c.certAuth(conn, cert, log)
+	}
+
+	for _, authorizedKey := range c.AuthKeys[username] {
+		if keysEqual(key, authorizedKey) {
+			log.Info("Accepted key", "key_type", key.Type())
 			return nil, nil
 		}
 	}
 
-	simplelog.Info.Printf("Rejected key authentication for user %v", username)
+	if u := c.lookupStoreUser(username); u != nil && u.hasKey(key) {
+		log.Info("Accepted key", "key_type", key.Type())
+		return nil, nil
+	}
+
+	if len(c.AuthKeysCommand) > 0 && c.commandAuthorizesKey(username, key, log) {
+		log.Info("Accepted key", "key_type", key.Type(), "source", "command")
+		return nil, nil
+	}
+
+	log.Info("Rejected key", "key_type", key.Type())
 	return nil, fmt.Errorf("key rejected for %v", username)
 }
+
+// Whether the authorized keys command lists the key for the user. It's only
+// asked about users that exist, the same as certificates
+func (c Config) commandAuthorizesKey(username string, key ssh.PublicKey, log *slog.Logger) bool {
+	if username != c.User && c.lookupStoreUser(username) == nil {
+		return false
+	}
+	keys, err := c.commandAuthKeys(username, key)
+	if err != nil {
+		log.Error("Error looking up authorized keys", "err", err)
+		return false
+	}
+	for _, authorizedKey := range keys {
+		if keysEqual(key, authorizedKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check a user certificate against the trusted CAs. The certificate needs to
+// name the user as one of its principals and be within its validity window,
+// and the user needs to exist (like OpenSSH, certificates don't create users)
+func (c Config) certAuth(conn ssh.ConnMetadata, cert *ssh.Certificate, log *slog.Logger) (*ssh.Permissions, error) {
+	username := conn.User()
+	log = log.With("key_type", cert.Type(), "key_id", cert.KeyId, "serial", cert.Serial)
+
+	reject := func(reason string) (*ssh.Permissions, error) {
+		log.Info("Rejected certificate", "reason", reason)
+		return nil, fmt.Errorf("certificate rejected for %v: %v", username, reason)
+	}
+	if len(c.userCAKeys) == 0 {
+		return reject("no trusted CAs")
+	}
+	if len(cert.ValidPrincipals) == 0 {
+		return reject("certificate has no principals")
+	}
+	if username != c.User && c.lookupStoreUser(username) == nil {
+		return reject("no such user")
+	}
+
+	checker := ssh.CertChecker{IsUserAuthority: c.isUserCA, IsRevoked: c.revokedKeys.certRevoked}
+	perms, err := checker.Authenticate(conn, cert)
+	if err != nil {
+		return reject(err.Error())
+	}
+	log.Info("Accepted certificate", "ca", ssh.FingerprintSHA256(cert.SignatureKey))
+	return certPermissions(perms), nil
+}
+
+// The permissions a certificate grants, without anything the CA put in its
+// extensions that we'd take for our own (e.g. permHomeDir). Only the standard
+// permit-* extensions and the critical options are kept
+func certPermissions(perms *ssh.Permissions) *ssh.Permissions {
+	if perms == nil {
+		return nil
+	}
+	kept := &ssh.Permissions{CriticalOptions: perms.CriticalOptions, Extensions: map[string]string{}}
+	for name, value := range perms.Extensions {
+		if strings.HasPrefix(name, "permit-") {
+			kept.Extensions[name] = value
+		}
+	}
+	return kept
+}
+
+func (c Config) isUserCA(auth ssh.PublicKey) bool {
+	for _, ca := range c.userCAKeys {
+		if keysEqual(auth, ca) {
+			return true
+		}
+	}
+	return false
+}
+
+// Look up a user in the user store, if there's one configured
+func (c Config) lookupStoreUser(username string) *User {
+	if c.UserStore == nil {
+		return nil
+	}
+
+	u, err := c.UserStore.LookupUser(username)
+	if err != nil {
+		if err != ErrNoSuchUser {
+			c.logger().Error("Error looking up user", "user", username, "err", err)
+		}
+		return nil
+	}
+	return u
+}
+
+func keysEqual(a, b ssh.PublicKey) bool {
+	return bytes.Compare(a.Marshal(), b.Marshal()) == 0
+}
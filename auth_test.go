@@ -0,0 +1,197 @@
+package simplescp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type testConnMetadata struct {
+	user string
+}
+
+func (m testConnMetadata) User() string          { return m.user }
+func (m testConnMetadata) SessionID() []byte     { return nil }
+func (m testConnMetadata) ClientVersion() []byte { return nil }
+func (m testConnMetadata) ServerVersion() []byte { return nil }
+func (m testConnMetadata) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 1234}
+}
+func (m testConnMetadata) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 2222}
+}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestCertAuth(t *testing.T) {
+	ca := newTestSigner(t)
+	otherCA := newTestSigner(t)
+	user := newTestSigner(t)
+
+	c := Config{User: "scpuser"}
+	c.userCAKeys = []ssh.PublicKey{ca.PublicKey()}
+
+	now := time.Now()
+	cert := func(signer ssh.Signer, principals []string, after, before time.Time) *ssh.Certificate {
+		cert := &ssh.Certificate{
+			Key:             user.PublicKey(),
+			CertType:        ssh.UserCert,
+			KeyId:           "test",
+			ValidPrincipals: principals,
+			ValidAfter:      uint64(after.Unix()),
+			ValidBefore:     uint64(before.Unix()),
+		}
+		if err := cert.SignCert(rand.Reader, signer); err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+
+	tests := []struct {
+		name string
+		user string
+		cert *ssh.Certificate
+		ok   bool
+	}{
+		{"valid", "scpuser", cert(ca, []string{"scpuser"}, now.Add(-time.Hour), now.Add(time.Hour)), true},
+		{"wrong principal", "scpuser", cert(ca, []string{"someone"}, now.Add(-time.Hour), now.Add(time.Hour)), false},
+		{"no principals", "scpuser", cert(ca, nil, now.Add(-time.Hour), now.Add(time.Hour)), false},
+		{"unknown user", "someone", cert(ca, []string{"someone"}, now.Add(-time.Hour), now.Add(time.Hour)), false},
+		{"expired", "scpuser", cert(ca, []string{"scpuser"}, now.Add(-2*time.Hour), now.Add(-time.Hour)), false},
+		{"not yet valid", "scpuser", cert(ca, []string{"scpuser"}, now.Add(time.Hour), now.Add(2*time.Hour)), false},
+		{"untrusted CA", "scpuser", cert(otherCA, []string{"scpuser"}, now.Add(-time.Hour), now.Add(time.Hour)), false},
+	}
+	for _, test := range tests {
+		_, err := c.keyAuth(testConnMetadata{user: test.user}, test.cert)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: expected success %v, got %v", test.name, test.ok, err)
+		}
+	}
+
+	// The user's key on its own isn't enough
+	if _, err := c.keyAuth(testConnMetadata{user: "scpuser"}, user.PublicKey()); err == nil {
+		t.Error("Expected the key without a certificate to be rejected")
+	}
+}
+
+func TestCertExtensionsIgnored(t *testing.T) {
+	ca := newTestSigner(t)
+	user := newTestSigner(t)
+
+	c := Config{User: "scpuser", Dir: t.TempDir(), ReadOnly: true}
+	c.Anonymous.Dir = t.TempDir()
+	c.userCAKeys = []ssh.PublicKey{ca.PublicKey()}
+	dir := c.Dir
+
+	// A CA can put whatever it likes in the extensions, including the names
+	// we use to pass things from authentication to the session
+	cert := &ssh.Certificate{
+		Key:             user.PublicKey(),
+		CertType:        ssh.UserCert,
+		KeyId:           "test",
+		ValidPrincipals: []string{"scpuser"},
+		ValidBefore:     ssh.CertTimeInfinity,
+		Permissions: ssh.Permissions{Extensions: map[string]string{
+			"permit-pty":  "",
+			permHomeDir:   "/",
+			permLimit:     "0",
+			permAnonymous: "1",
+		}},
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	perms, err := c.keyAuth(testConnMetadata{user: "scpuser"}, cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := perms.Extensions["permit-pty"]; !ok || len(perms.Extensions) != 1 {
+		t.Errorf("Unexpected extensions %v", perms.Extensions)
+	}
+	if err := c.setupSession("scpuser", perms); err != nil {
+		t.Fatal(err)
+	}
+	if c.Dir != dir || c.perms != c.userPermissions(nil) {
+		t.Errorf("Session set up in %s with permissions %v, expected %s read-only", c.Dir, c.perms, dir)
+	}
+}
+
+func TestAuthKeysCommand(t *testing.T) {
+	good := newTestSigner(t)
+	bad := newTestSigner(t)
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key.pub")
+	if err := os.WriteFile(keyFile, ssh.MarshalAuthorizedKey(good.PublicKey()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(dir, "keys.sh")
+	err := os.WriteFile(script, []byte("#!/bin/sh\n[ \"$1\" = scpuser ] && [ \"$2\" = ssh-ed25519 ] && cat "+keyFile+"\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := Config{User: "scpuser", AuthKeysCommand: script + " %u %t"}
+	tests := []struct {
+		user     string
+		key      ssh.PublicKey
+		accepted bool
+	}{
+		{"scpuser", good.PublicKey(), true},
+		{"scpuser", bad.PublicKey(), false},
+		{"nobody", good.PublicKey(), false},
+	}
+	for _, test := range tests {
+		_, err := c.keyAuth(testConnMetadata{test.user}, test.key)
+		if (err == nil) != test.accepted {
+			t.Errorf("%s with key %s: expected accepted %v, got error %v", test.user, ssh.FingerprintSHA256(test.key), test.accepted, err)
+		}
+	}
+
+	c.AuthKeysCommand = "/nonexistent"
+	if _, err := c.keyAuth(testConnMetadata{"scpuser"}, good.PublicKey()); err == nil {
+		t.Error("Key accepted with a broken authorized keys command")
+	}
+}
+
+func TestBannerFile(t *testing.T) {
+	c := newTestConfig(t)
+	c.BannerFile = filepath.Join(t.TempDir(), "banner")
+	if err := os.WriteFile(c.BannerFile, []byte("Authorized use only"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	addr := startTestServer(t, c)
+
+	var banner string
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "scpuser",
+		Auth:            []ssh.AuthMethod{ssh.Password("hunter2")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		BannerCallback: func(message string) error {
+			banner = message
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if banner != "Authorized use only\n" {
+		t.Errorf("Unexpected banner %q", banner)
+	}
+}
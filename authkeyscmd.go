@@ -0,0 +1,101 @@
+package simplescp
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/flynn/go-shlex"
+	"golang.org/x/crypto/ssh"
+)
+
+// How long the authorized keys command gets before it's killed and the key rejected
+const authKeysCommandTimeout = 10 * time.Second
+
+// Split the authorized keys command into its arguments. Like OpenSSH's
+// AuthorizedKeysCommand, a command without arguments gets the username
+func parseAuthKeysCommand(command string) ([]string, error) {
+	args, err := shlex.Split(command)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid authorized keys command: %v", err)
+	}
+	if len(args) == 0 {
+		return nil, errors.New("Invalid authorized keys command: it's empty")
+	}
+	if len(args) == 1 {
+		args = append(args, "%u")
+	}
+	return args, nil
+}
+
+// Expand the placeholders in an authorized keys command argument:
+//
+//	%u: User trying to log in
+//	%t: Type of the key being offered
+//	%f: SHA256 fingerprint of the key
+//	%k: The key itself, base64 encoded as in authorized_keys
+//	%%: A literal %
+func expandAuthKeysArg(arg string, user string, key ssh.PublicKey) string {
+	var b strings.Builder
+	for i := 0; i < len(arg); i++ {
+		if arg[i] != '%' || i == len(arg)-1 {
+			b.WriteByte(arg[i])
+			continue
+		}
+		i++
+		switch arg[i] {
+		case 'u':
+			b.WriteString(user)
+		case 't':
+			b.WriteString(key.Type())
+		case 'f':
+			b.WriteString(ssh.FingerprintSHA256(key))
+		case 'k':
+			b.WriteString(base64.StdEncoding.EncodeToString(key.Marshal()))
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(arg[i])
+		}
+	}
+	return b.String()
+}
+
+// Run the authorized keys command for a user and return the keys it prints.
+// The command doesn't get to see our own settings, which include passwords
+func (c Config) commandAuthKeys(user string, key ssh.PublicKey) ([]ssh.PublicKey, error) {
+	args, err := parseAuthKeysCommand(c.AuthKeysCommand)
+	if err != nil {
+		return nil, err
+	}
+	for i := range args {
+		args[i] = expandAuthKeysArg(args[i], user, key)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), authKeysCommandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "SIMPLESCP_") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("authorized keys command timed out after %v", authKeysCommandTimeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("authorized keys command failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return c.readKeys(bytes.NewReader(output), args[0]), nil
+}
@@ -0,0 +1,106 @@
+package simplescp
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/time/rate"
+)
+
+// Default for AuthRateBurst
+const defaultAuthRateBurst = 10
+
+// authLimiter limits how many authentication attempts each client IP can
+// make, with a token bucket per IP. It's shared by all connections
+type authLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu        sync.Mutex
+	clients   map[string]*authClient
+	lastSweep time.Time
+}
+
+type authClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+	limited  bool // Whether we've already logged it's over the limit
+}
+
+// perMinute attempts per minute, up to burst at once
+func newAuthLimiter(perMinute float64, burst int) *authLimiter {
+	if burst <= 0 {
+		burst = defaultAuthRateBurst
+	}
+	return &authLimiter{
+		limit:   rate.Limit(perMinute / 60),
+		burst:   burst,
+		clients: make(map[string]*authClient),
+	}
+}
+
+func (l *authLimiter) sameSettings(perMinute float64, burst int) bool {
+	if burst <= 0 {
+		burst = defaultAuthRateBurst
+	}
+	return l.limit == rate.Limit(perMinute/60) && l.burst == burst
+}
+
+// Takes a token from the IP's bucket, logging when it first runs out of them
+func (l *authLimiter) allow(ip string, log *slog.Logger) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+	client, ok := l.clients[ip]
+	if !ok {
+		client = &authClient{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[ip] = client
+	}
+	client.lastSeen = now
+
+	if client.limiter.AllowN(now, 1) {
+		client.limited = false
+		return true
+	}
+	if !client.limited {
+		client.limited = true
+		log.Warn("Too many authentication attempts, rejecting them", "ip", ip)
+	}
+	return false
+}
+
+// Forget about clients whose buckets would have filled up again anyway
+func (l *authLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	full := time.Duration(float64(l.burst) / float64(l.limit) * float64(time.Second))
+	for ip, client := range l.clients {
+		if now.Sub(client.lastSeen) > full {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+// Whether the client can make another authentication attempt: it can't if the
+// username or IP is banned, or it's going over the rate limit
+func (c Config) allowAuthAttempt(conn ssh.ConnMetadata, log *slog.Logger) bool {
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		ip = conn.RemoteAddr().String()
+	}
+	if c.bans != nil && (c.bans.bannedUser(conn.User()) || c.bans.bannedIP(ip)) {
+		log.Debug("Rejected attempt from banned user or address")
+		return false
+	}
+	if c.authLimiter == nil {
+		return true
+	}
+	return c.authLimiter.allow(ip, log)
+}
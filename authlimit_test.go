@@ -0,0 +1,21 @@
+package simplescp
+
+import "testing"
+
+func TestAuthRateLimit(t *testing.T) {
+	c := Config{User: "scpuser", passwords: map[string]string{"scpuser": "hunter2"}}
+	c.authLimiter = newAuthLimiter(1, 3)
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.passwordAuth(testConnMetadata{"scpuser"}, []byte("wrong")); err == nil {
+			t.Fatal("Wrong password accepted")
+		}
+	}
+	// Out of attempts, even with the right password
+	if _, err := c.passwordAuth(testConnMetadata{"scpuser"}, []byte("hunter2")); err == nil {
+		t.Error("Attempt over the limit accepted")
+	}
+	if !c.authLimiter.allow("192.0.2.11", c.logger()) {
+		t.Error("Other addresses should have their own limit")
+	}
+}
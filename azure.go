@@ -0,0 +1,361 @@
+package simplescp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+)
+
+// AzureConfig holds the settings for the Azure Blob Storage backend
+type AzureConfig struct {
+	Account   string `yaml:"account" toml:"account"`
+	Container string `yaml:"container" toml:"container"`
+	Prefix    string `yaml:"prefix" toml:"prefix"` // Everything is stored under this prefix
+	// Credentials are taken from the usual Azure environment variables,
+	// managed identity or az login if neither the key nor the connection
+	// string are set
+	Key              string `yaml:"key" toml:"key"`
+	ConnectionString string `yaml:"connection_string" toml:"connection_string"`
+	Endpoint         string `yaml:"endpoint" toml:"endpoint"` // Default: https://<account>.blob.core.windows.net
+}
+
+const (
+	// Files are uploaded in blocks of this size, which caps them at 750GiB
+	azureBlockSize = 16 << 20
+	// How often to check whether a copy has finished when renaming
+	azureCopyPoll = 200 * time.Millisecond
+)
+
+// azureFileSystem stores files as blobs in an Azure container, the same way
+// s3FileSystem does
+type azureFileSystem struct {
+	container *container.Client
+	prefix    string
+
+	mu      sync.Mutex
+	writing map[string]*objectWriter // Files being uploaded, so they can be seen before they're done
+}
+
+func newAzureFileSystem(conf AzureConfig) (*azureFileSystem, error) {
+	if len(conf.Container) == 0 {
+		return nil, errors.New("Azure backend needs a container")
+	}
+
+	var client *container.Client
+	var err error
+	if len(conf.ConnectionString) > 0 {
+		client, err = container.NewClientFromConnectionString(conf.ConnectionString, conf.Container, nil)
+	} else {
+		if len(conf.Account) == 0 {
+			return nil, errors.New("Azure backend needs an account or connection string")
+		}
+		endpoint := conf.Endpoint
+		if len(endpoint) == 0 {
+			endpoint = "https://" + conf.Account + ".blob.core.windows.net"
+		}
+		url := strings.TrimSuffix(endpoint, "/") + "/" + conf.Container
+		if len(conf.Key) > 0 {
+			var cred *container.SharedKeyCredential
+			cred, err = container.NewSharedKeyCredential(conf.Account, conf.Key)
+			if err == nil {
+				client, err = container.NewClientWithSharedKeyCredential(url, cred, nil)
+			}
+		} else {
+			var cred *azidentity.DefaultAzureCredential
+			cred, err = azidentity.NewDefaultAzureCredential(nil)
+			if err == nil {
+				client, err = container.NewClient(url, cred, nil)
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Can't set up Azure client: %v", err)
+	}
+
+	if _, err := client.GetProperties(context.Background(), nil); err != nil {
+		if bloberror.HasCode(err, bloberror.ContainerNotFound) {
+			return nil, fmt.Errorf("Azure container %q doesn't exist", conf.Container)
+		}
+		return nil, fmt.Errorf("Can't access Azure container %q: %v", conf.Container, err)
+	}
+	return &azureFileSystem{container: client, prefix: strings.Trim(conf.Prefix, "/"), writing: make(map[string]*objectWriter)}, nil
+}
+
+// Name of the blob holding a file. The root directory is the empty name
+func (a *azureFileSystem) key(name string) string {
+	return strings.TrimPrefix(path.Join(a.prefix, filepath.ToSlash(name)), "/")
+}
+
+// Turn Azure errors into the errors we'd get from a local filesystem
+func azureError(op string, name string, err error) error {
+	switch {
+	case bloberror.HasCode(err, bloberror.BlobNotFound, bloberror.ContainerNotFound, bloberror.ResourceNotFound):
+		err = os.ErrNotExist
+	case bloberror.HasCode(err, bloberror.AuthorizationFailure, bloberror.AuthorizationPermissionMismatch):
+		err = os.ErrPermission
+	}
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+func (a *azureFileSystem) Stat(name string) (os.FileInfo, error) {
+	key := a.key(name)
+	base := filepath.Base(name)
+	if len(key) == 0 || key == a.prefix {
+		return objectInfo{name: base, dir: true}, nil
+	}
+
+	a.mu.Lock()
+	w, ok := a.writing[key]
+	a.mu.Unlock()
+	if ok {
+		return w.Stat()
+	}
+
+	ctx := context.Background()
+	props, err := a.container.NewBlobClient(key).GetProperties(ctx, nil)
+	if err == nil {
+		return objectInfo{name: base, size: *props.ContentLength, modTime: *props.LastModified}, nil
+	}
+	if !bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return nil, azureError("stat", name, err)
+	}
+
+	// Maybe it's a directory
+	prefix := dirPrefix(key)
+	maxResults := int32(1)
+	pager := a.container.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{Prefix: &prefix, MaxResults: &maxResults})
+	page, err := pager.NextPage(ctx)
+	if err != nil {
+		return nil, azureError("stat", name, err)
+	}
+	if len(page.Segment.BlobItems) == 0 {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return objectInfo{name: base, dir: true, modTime: *page.Segment.BlobItems[0].Properties.LastModified}, nil
+}
+
+// There are no symlinks in Azure
+func (a *azureFileSystem) Lstat(name string) (os.FileInfo, error) {
+	return a.Stat(name)
+}
+
+func (a *azureFileSystem) ReadDir(name string) ([]os.FileInfo, error) {
+	prefix := dirPrefix(a.key(name))
+	var files []os.FileInfo
+	pager := a.container.NewListBlobsHierarchyPager("/", &container.ListBlobsHierarchyOptions{Prefix: &prefix})
+	for pager.More() {
+		page, err := pager.NextPage(context.Background())
+		if err != nil {
+			return nil, azureError("readdir", name, err)
+		}
+		for _, p := range page.Segment.BlobPrefixes {
+			files = append(files, objectInfo{name: strings.TrimSuffix(strings.TrimPrefix(*p.Name, prefix), "/"), dir: true})
+		}
+		for _, b := range page.Segment.BlobItems {
+			if *b.Name == prefix {
+				// The directory's own marker
+				continue
+			}
+			files = append(files, objectInfo{name: strings.TrimPrefix(*b.Name, prefix), size: *b.Properties.ContentLength, modTime: *b.Properties.LastModified})
+		}
+	}
+
+	if len(files) == 0 {
+		// Make sure the directory exists at all
+		fi, err := a.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			return nil, &os.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+		}
+	}
+	return files, nil
+}
+
+func (a *azureFileSystem) Open(name string) (File, error) {
+	fi, err := a.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	b := a.container.NewBlobClient(a.key(name))
+	return newObjectReader(name, fi, func(off int64, length int64) (io.ReadCloser, error) {
+		if length < 0 {
+			length = blob.CountToEnd
+		}
+		resp, err := b.DownloadStream(context.Background(), &blob.DownloadStreamOptions{Range: blob.HTTPRange{Offset: off, Count: length}})
+		if err != nil {
+			return nil, azureError("read", name, err)
+		}
+		return resp.Body, nil
+	}), nil
+}
+
+// Blobs are written in one go, so files can be opened either for reading or
+// creating/replacing them, but not for updating them in place
+func (a *azureFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return a.Open(name)
+	}
+	if flag&(os.O_RDWR|os.O_APPEND) != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errors.ErrUnsupported}
+	}
+
+	fi, err := a.Stat(name)
+	if err == nil {
+		if fi.IsDir() {
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		}
+		if flag&os.O_EXCL != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+		}
+	} else if flag&os.O_CREATE == 0 {
+		return nil, err
+	}
+
+	key := a.key(name)
+	w, pr := newObjectWriter(name)
+	a.mu.Lock()
+	a.writing[key] = w
+	a.mu.Unlock()
+
+	go func() {
+		// Blocks only become the blob once they're all there, so a failed
+		// upload leaves nothing behind
+		_, err := a.container.NewBlockBlobClient(key).UploadStream(context.Background(), pr, &blockblob.UploadStreamOptions{BlockSize: azureBlockSize})
+		pr.CloseWithError(err)
+
+		a.mu.Lock()
+		if a.writing[key] == w {
+			delete(a.writing, key)
+		}
+		a.mu.Unlock()
+		if err != nil {
+			err = azureError("close", name, err)
+		}
+		w.done <- err
+	}()
+	return w, nil
+}
+
+func (a *azureFileSystem) Mkdir(name string, perm os.FileMode) error {
+	if _, err := a.Stat(name); err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	return a.putMarker("mkdir", name)
+}
+
+// Parent directories don't need creating, they're implied by the blob names
+func (a *azureFileSystem) MkdirAll(name string, perm os.FileMode) error {
+	if fi, err := a.Stat(name); err == nil {
+		if !fi.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	return a.putMarker("mkdir", name)
+}
+
+func (a *azureFileSystem) putMarker(op string, name string) error {
+	body := streaming.NopCloser(bytes.NewReader(nil))
+	if _, err := a.container.NewBlockBlobClient(dirPrefix(a.key(name))).Upload(context.Background(), body, nil); err != nil {
+		return azureError(op, name, err)
+	}
+	return nil
+}
+
+func (a *azureFileSystem) Remove(name string) error {
+	fi, err := a.Stat(name)
+	if err != nil {
+		return err
+	}
+	key := a.key(name)
+	if fi.IsDir() {
+		files, err := a.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		if len(files) > 0 {
+			return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+		key = dirPrefix(key)
+	}
+	_, err = a.container.NewBlobClient(key).Delete(context.Background(), nil)
+	if err != nil && !(fi.IsDir() && bloberror.HasCode(err, bloberror.BlobNotFound)) {
+		return azureError("remove", name, err)
+	}
+	return nil
+}
+
+// Blobs can't be renamed, so they're copied and then removed. Renaming a
+// directory means doing that for everything inside of it.
+func (a *azureFileSystem) Rename(oldname, newname string) error {
+	fi, err := a.Stat(oldname)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return a.move(oldname, a.key(oldname), a.key(newname))
+	}
+
+	oldPrefix := dirPrefix(a.key(oldname))
+	newPrefix := dirPrefix(a.key(newname))
+	pager := a.container.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{Prefix: &oldPrefix})
+	for pager.More() {
+		page, err := pager.NextPage(context.Background())
+		if err != nil {
+			return azureError("rename", oldname, err)
+		}
+		for _, b := range page.Segment.BlobItems {
+			if err := a.move(oldname, *b.Name, newPrefix+strings.TrimPrefix(*b.Name, oldPrefix)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Copies within an account are usually done straight away, but they might
+// still need waiting for
+func (a *azureFileSystem) move(name string, from string, to string) error {
+	ctx := context.Background()
+	src := a.container.NewBlobClient(from)
+	dst := a.container.NewBlobClient(to)
+	resp, err := dst.StartCopyFromURL(ctx, src.URL(), nil)
+	if err != nil {
+		return azureError("rename", name, err)
+	}
+	status := resp.CopyStatus
+	for status != nil && *status == blob.CopyStatusTypePending {
+		time.Sleep(azureCopyPoll)
+		props, err := dst.GetProperties(ctx, nil)
+		if err != nil {
+			return azureError("rename", name, err)
+		}
+		status = props.CopyStatus
+	}
+	if status != nil && *status != blob.CopyStatusTypeSuccess {
+		return &os.PathError{Op: "rename", Path: name, Err: fmt.Errorf("copy %s", *status)}
+	}
+
+	if _, err := src.Delete(ctx, nil); err != nil {
+		return azureError("rename", name, err)
+	}
+	return nil
+}
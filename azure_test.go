@@ -0,0 +1,259 @@
+package simplescp
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAzure is just enough of the Blob Storage API for azureFileSystem, with
+// a single container called files
+type fakeAzure struct {
+	mu     sync.Mutex
+	blobs  map[string][]byte
+	blocks map[string][]byte // Staged, by blob and block ID
+}
+
+type fakeAzureBlob struct {
+	Name       string `xml:"Name"`
+	Properties struct {
+		LastModified  string `xml:"Last-Modified"`
+		ContentLength int64  `xml:"Content-Length"`
+		BlobType      string `xml:"BlobType"`
+	} `xml:"Properties"`
+}
+
+type fakeAzurePrefix struct {
+	Name string `xml:"Name"`
+}
+
+type fakeAzureList struct {
+	XMLName       xml.Name          `xml:"EnumerationResults"`
+	ContainerName string            `xml:"ContainerName,attr"`
+	Prefix        string            `xml:"Prefix"`
+	Blobs         []fakeAzureBlob   `xml:"Blobs>Blob"`
+	Prefixes      []fakeAzurePrefix `xml:"Blobs>BlobPrefix"`
+	NextMarker    string            `xml:"NextMarker"`
+}
+
+// Everything was changed just now, as far as anyone asks
+var fakeAzureModTime = time.Now().UTC().Format(http.TimeFormat)
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w.Header().Set("x-ms-version", r.Header.Get("x-ms-version"))
+	name, isBlob := strings.CutPrefix(r.URL.Path, "/files/")
+	if !isBlob {
+		if r.URL.Path != "/files" {
+			f.fail(w, http.StatusNotFound, "ContainerNotFound")
+		} else if r.URL.Query().Get("comp") == "list" {
+			f.list(w, r)
+		}
+		return
+	}
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodHead:
+		data, ok := f.blobs[name]
+		if !ok {
+			f.fail(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", fakeAzureModTime)
+		w.Header().Set("x-ms-blob-type", "BlockBlob")
+	case r.Method == http.MethodGet:
+		data, ok := f.blobs[name]
+		if !ok {
+			f.fail(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		start, end := 0, len(data)
+		if ranges, ok := strings.CutPrefix(r.Header.Get("x-ms-range"), "bytes="); ok {
+			from, to, _ := strings.Cut(ranges, "-")
+			start, _ = strconv.Atoi(from)
+			if n, err := strconv.Atoi(to); err == nil && n+1 < end {
+				end = n + 1
+			}
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(end-start))
+		w.Header().Set("Last-Modified", fakeAzureModTime)
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[start:end])
+	case r.Method == http.MethodPut && query.Get("comp") == "block":
+		data, _ := io.ReadAll(r.Body)
+		f.blocks[name+"\x00"+query.Get("blockid")] = data
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && query.Get("comp") == "blocklist":
+		var list struct {
+			Latest []string `xml:"Latest"`
+		}
+		xml.NewDecoder(r.Body).Decode(&list)
+		var data []byte
+		for _, id := range list.Latest {
+			data = append(data, f.blocks[name+"\x00"+id]...)
+			delete(f.blocks, name+"\x00"+id)
+		}
+		f.blobs[name] = data
+		w.Header().Set("Last-Modified", fakeAzureModTime)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && len(r.Header.Get("x-ms-copy-source")) > 0:
+		src, err := url.Parse(r.Header.Get("x-ms-copy-source"))
+		data, ok := f.blobs[strings.TrimPrefix(src.Path, "/files/")]
+		if err != nil || !ok {
+			f.fail(w, http.StatusNotFound, "CannotVerifyCopySource")
+			return
+		}
+		f.blobs[name] = data
+		w.Header().Set("x-ms-copy-status", "success")
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		f.blobs[name] = data
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodDelete:
+		if _, ok := f.blobs[name]; !ok {
+			f.fail(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		delete(f.blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		f.fail(w, http.StatusBadRequest, "UnsupportedHttpVerb")
+	}
+}
+
+func (f *fakeAzure) fail(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.WriteHeader(status)
+}
+
+// The blobs under the prefix, in one page, as directories too with a delimiter
+func (f *fakeAzure) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	list := fakeAzureList{ContainerName: "files", Prefix: query.Get("prefix")}
+	delimiter := query.Get("delimiter")
+	var names []string
+	for name := range f.blobs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		rest, ok := strings.CutPrefix(name, list.Prefix)
+		if !ok {
+			continue
+		}
+		if i := strings.Index(rest, delimiter); len(delimiter) > 0 && i >= 0 {
+			prefix := list.Prefix + rest[:i+len(delimiter)]
+			if !slices.Contains(list.Prefixes, fakeAzurePrefix{prefix}) {
+				list.Prefixes = append(list.Prefixes, fakeAzurePrefix{prefix})
+			}
+			continue
+		}
+		blob := fakeAzureBlob{Name: name}
+		blob.Properties.LastModified = fakeAzureModTime
+		blob.Properties.ContentLength = int64(len(f.blobs[name]))
+		blob.Properties.BlobType = "BlockBlob"
+		list.Blobs = append(list.Blobs, blob)
+	}
+	if max, err := strconv.Atoi(query.Get("maxresults")); err == nil && len(list.Blobs) > max {
+		list.Blobs = list.Blobs[:max]
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(list)
+}
+
+func TestAzureFileSystem(t *testing.T) {
+	ts := httptest.NewServer(&fakeAzure{blobs: make(map[string][]byte), blocks: make(map[string][]byte)})
+	defer ts.Close()
+	conf := AzureConfig{Account: "account", Key: "a2V5", Endpoint: ts.URL, Container: "missing", Prefix: "/srv/"}
+	if _, err := newAzureFileSystem(conf); err == nil || !strings.Contains(err.Error(), "doesn't exist") {
+		t.Errorf("Expected a missing container error, got %v", err)
+	}
+	conf.Container = "files"
+	fsys, err := newAzureFileSystem(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fsys.MkdirAll("/scpuser", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Mkdir("/scpuser", 0755); !os.IsExist(err) {
+		t.Errorf("Expected Mkdir to fail with an exists error, got %v", err)
+	}
+
+	// sftp clients can send writes out of order
+	f, err := fsys.OpenFile("/scpuser/file.txt", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("world\n"), 6)
+	f.WriteAt([]byte("hello "), 0)
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := fsys.Stat("/scpuser/file.txt")
+	if err != nil || fi.Size() != 12 || fi.IsDir() {
+		t.Fatalf("Unexpected stat result %+v, %v", fi, err)
+	}
+	if fi, err := fsys.Stat("/scpuser"); err != nil || !fi.IsDir() {
+		t.Fatalf("Expected a directory, got %+v, %v", fi, err)
+	}
+	if _, err := fsys.Stat("/nothing"); !os.IsNotExist(err) {
+		t.Errorf("Expected a not exist error, got %v", err)
+	}
+
+	// And read them out of order too
+	r, err := fsys.Open("/scpuser/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 6)
+	// A read up to the end can say it's the end
+	if n, err := r.ReadAt(buf, 6); (err != nil && err != io.EOF) || string(buf[:n]) != "world\n" {
+		t.Errorf("Unexpected ReadAt result %q, %v", buf[:n], err)
+	}
+	if n, err := r.ReadAt(buf, 0); err != nil || string(buf[:n]) != "hello " {
+		t.Errorf("Unexpected ReadAt result %q, %v", buf[:n], err)
+	}
+	if _, err := r.ReadAt(buf, 12); err != io.EOF {
+		t.Errorf("Expected EOF reading past the end, got %v", err)
+	}
+	r.Close()
+
+	if err := fsys.Rename("/scpuser", "/other"); err != nil {
+		t.Fatal(err)
+	}
+	files, err := fsys.ReadDir("/other")
+	if err != nil || len(files) != 1 || files[0].Name() != "file.txt" {
+		t.Errorf("Unexpected directory contents %v, %v", files, err)
+	}
+	if _, err := fsys.Stat("/scpuser/file.txt"); !os.IsNotExist(err) {
+		t.Errorf("Expected the file to be gone from where it was, got %v", err)
+	}
+	if err := fsys.Remove("/other"); err == nil {
+		t.Error("Expected an error removing a directory that isn't empty")
+	}
+	if err := fsys.Remove("/other/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Remove("/other"); err != nil {
+		t.Fatal(err)
+	}
+	if files, err := fsys.ReadDir("/"); err != nil || len(files) != 0 {
+		t.Errorf("Expected an empty container, got %v, %v", files, err)
+	}
+}
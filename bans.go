@@ -0,0 +1,179 @@
+package simplescp
+
+import (
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for BanDuration and BanMaxDuration
+const (
+	defaultBanDuration    = 10 * time.Minute
+	defaultBanMaxDuration = 24 * time.Hour
+)
+
+// Ban is a client IP or username that can't log in for now
+type Ban struct {
+	IP    string    `json:"ip,omitempty"`   // Empty for bans on a username
+	User  string    `json:"user,omitempty"` // Empty for bans on an IP
+	Until time.Time `json:"until"`
+}
+
+// banList keeps track of consecutive failed logins for client IPs and
+// usernames, banning them for a while once they reach the threshold. Each
+// new ban lasts twice as long as the last one. It's shared by all connections
+type banList struct {
+	mu          sync.Mutex
+	threshold   int
+	duration    time.Duration
+	maxDuration time.Duration
+	entries     map[string]*banEntry // Keyed by "ip:" or "user:" and the address or name
+	lastSweep   time.Time
+}
+
+type banEntry struct {
+	failures    int
+	bans        int // How many times it's been banned, for working out the next ban
+	until       time.Time
+	lastFailure time.Time
+}
+
+func newBanList() *banList {
+	return &banList{entries: make(map[string]*banEntry)}
+}
+
+// Change the settings, keeping the bans and failures so far
+func (b *banList) configure(threshold int, duration, maxDuration time.Duration) {
+	if duration <= 0 {
+		duration = defaultBanDuration
+	}
+	if maxDuration <= 0 {
+		maxDuration = defaultBanMaxDuration
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.threshold = threshold
+	b.duration = duration
+	b.maxDuration = maxDuration
+}
+
+func (b *banList) bannedIP(ip string) bool {
+	return b.banned("ip:" + ip)
+}
+
+func (b *banList) bannedUser(user string) bool {
+	return b.banned("user:" + user)
+}
+
+func (b *banList) banned(key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e := b.entries[key]
+	return e != nil && time.Now().Before(e.until)
+}
+
+// Record a failed login for the client IP and the username it tried
+func (b *banList) failure(ip, user string, log *slog.Logger) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.sweep(now)
+	b.fail("ip:"+ip, now, log)
+	if len(user) > 0 {
+		b.fail("user:"+user, now, log)
+	}
+}
+
+func (b *banList) fail(key string, now time.Time, log *slog.Logger) {
+	e := b.entries[key]
+	if e == nil {
+		e = &banEntry{}
+		b.entries[key] = e
+	}
+	if now.Before(e.until) {
+		// Already banned, it doesn't need to get any worse
+		return
+	}
+	e.failures++
+	e.lastFailure = now
+	if e.failures < b.threshold {
+		return
+	}
+
+	duration := b.duration << e.bans
+	if duration > b.maxDuration || duration <= 0 {
+		duration = b.maxDuration
+	}
+	e.bans++
+	e.failures = 0
+	e.until = now.Add(duration)
+	kind, target, _ := strings.Cut(key, ":")
+	log.Warn("Too many failed logins, banning", kind, target, "duration", duration.String(), "bans", e.bans)
+}
+
+// A successful login resets the count of consecutive failures
+func (b *banList) success(ip, user string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, key := range []string{"ip:" + ip, "user:" + user} {
+		if e := b.entries[key]; e != nil {
+			e.failures = 0
+		}
+	}
+}
+
+// Forget about entries that haven't failed in a long time, including the
+// number of times they've been banned
+func (b *banList) sweep(now time.Time) {
+	if now.Sub(b.lastSweep) < time.Minute {
+		return
+	}
+	b.lastSweep = now
+	for key, e := range b.entries {
+		if now.After(e.until) && now.Sub(e.lastFailure) > b.maxDuration {
+			delete(b.entries, key)
+		}
+	}
+}
+
+func (b *banList) list() []Ban {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	var bans []Ban
+	for key, e := range b.entries {
+		if !now.Before(e.until) {
+			continue
+		}
+		kind, target, _ := strings.Cut(key, ":")
+		if kind == "ip" {
+			bans = append(bans, Ban{IP: target, Until: e.until})
+		} else {
+			bans = append(bans, Ban{User: target, Until: e.until})
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Until.Before(bans[j].Until) })
+	return bans
+}
+
+// Lift the bans on an IP or username (or all of them, for an empty target),
+// forgetting about their failures too. Returns how many were lifted
+func (b *banList) clear(target string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	n := 0
+	for key, e := range b.entries {
+		_, name, _ := strings.Cut(key, ":")
+		if len(target) > 0 && name != target {
+			continue
+		}
+		if now.Before(e.until) {
+			n++
+		}
+		delete(b.entries, key)
+	}
+	return n
+}
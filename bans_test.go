@@ -0,0 +1,48 @@
+package simplescp
+
+import (
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestBans(t *testing.T) {
+	b := newBanList()
+	b.configure(3, time.Minute, time.Hour)
+	log := slog.Default()
+
+	b.failure("192.0.2.10", "alice", log)
+	b.failure("192.0.2.10", "alice", log)
+	b.success("192.0.2.10", "alice")
+	b.failure("192.0.2.10", "alice", log)
+	b.failure("192.0.2.10", "alice", log)
+	if b.bannedIP("192.0.2.10") || b.bannedUser("alice") {
+		t.Fatal("Banned before reaching the threshold of consecutive failures")
+	}
+	b.failure("192.0.2.10", "alice", log)
+	if !b.bannedIP("192.0.2.10") || !b.bannedUser("alice") {
+		t.Fatal("Not banned after reaching the threshold")
+	}
+	if b.bannedIP("192.0.2.11") || b.bannedUser("bob") {
+		t.Error("Others banned too")
+	}
+	if bans := b.list(); len(bans) != 2 || time.Until(bans[0].Until) > time.Minute {
+		t.Errorf("Unexpected bans %+v", bans)
+	}
+
+	// Once the ban's over, the next one is longer
+	b.entries["ip:192.0.2.10"].until = time.Now()
+	for i := 0; i < 3; i++ {
+		b.failure("192.0.2.10", "", log)
+	}
+	if until := time.Until(b.entries["ip:192.0.2.10"].until); until < time.Minute || until > 2*time.Minute {
+		t.Errorf("Expected a ban of 2m, got %v", until)
+	}
+
+	if n := b.clear("alice"); n != 1 || b.bannedUser("alice") || !b.bannedIP("192.0.2.10") {
+		t.Errorf("Expected just alice unbanned, lifted %d", n)
+	}
+	if n := b.clear(""); n != 1 || len(b.list()) != 0 {
+		t.Errorf("Expected all bans lifted, lifted %d", n)
+	}
+}
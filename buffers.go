@@ -0,0 +1,28 @@
+package simplescp
+
+import (
+	"sync"
+)
+
+// Size of the buffers files are copied through with scp. Big enough to make
+// the most of each read from the channel, which can have up to a whole
+// window of data waiting
+const copyBufferSize = 256 * 1024
+
+// Buffers files are copied through, shared by all sessions so hundreds of
+// them streaming at once don't each need their own
+var copyBuffers = sync.Pool{
+	New: func() any {
+		b := make([]byte, copyBufferSize)
+		return &b
+	},
+}
+
+// A buffer to copy a file through, to be given back with putCopyBuffer
+func getCopyBuffer() *[]byte {
+	return copyBuffers.Get().(*[]byte)
+}
+
+func putCopyBuffer(b *[]byte) {
+	copyBuffers.Put(b)
+}
@@ -0,0 +1,43 @@
+package simplescp
+
+import "testing"
+
+func TestParseByteSize(t *testing.T) {
+	cases := map[string]ByteSize{
+		"0":     0,
+		"512":   512,
+		"64k":   64 * 1024,
+		"10M":   10 * 1024 * 1024,
+		"10MB":  10 * 1024 * 1024,
+		"10MiB": 10 * 1024 * 1024,
+		"1.5G":  1536 * 1024 * 1024,
+		"2T":    2 << 40,
+		"100B":  100,
+	}
+	for s, expected := range cases {
+		size, err := ParseByteSize(s)
+		if err != nil || size != expected {
+			t.Errorf("ParseByteSize(%q) = %d, %v. Expected %d", s, size, err, expected)
+		}
+	}
+
+	for _, s := range []string{"", "M", "ten", "-1K"} {
+		if _, err := ParseByteSize(s); err == nil {
+			t.Errorf("Expected an error parsing %q", s)
+		}
+	}
+}
+
+func TestByteSizeString(t *testing.T) {
+	cases := map[ByteSize]string{
+		0:                "0",
+		1536:             "1536",
+		64 * 1024:        "64K",
+		10 * 1024 * 1024: "10M",
+	}
+	for size, expected := range cases {
+		if size.String() != expected {
+			t.Errorf("String() = %q, expected %q", size.String(), expected)
+		}
+	}
+}
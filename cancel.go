@@ -0,0 +1,52 @@
+package simplescp
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// Why a connection or channel's context got cancelled. Transfers cut short by
+// it fail with these, so logs say what stopped them
+var (
+	errServerShutdown = errors.New("Server shutting down")
+	errConnectionTime = errors.New("Connection open for too long")
+	errSessionClosed  = errors.New("Session closed")
+	errIdleTimeout    = errors.New("Session idle for too long")
+)
+
+// ctxReader stops reading once ctx is cancelled, failing with its cause. Data
+// that's already buffered in a channel doesn't get written out after that
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := context.Cause(r.ctx); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// ctxWriter stops writing once ctx is cancelled, failing with its cause
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w ctxWriter) Write(p []byte) (int, error) {
+	if err := context.Cause(w.ctx); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// The cause of ctx being cancelled if it has been, which is what err is down
+// to (a closed connection isn't much of an explanation). Otherwise err
+func cancelCause(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); cause != nil && err != nil {
+		return cause
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+package simplescp
+
+import (
+	"errors"
+	"io"
+
+	"github.com/pkg/sftp"
+)
+
+// Smallest block size check-file can be asked for, other than 0 for the
+// whole range at once
+const minCheckFileBlock = 256
+
+// Hash length bytes of the file at p (as the client sees it) from offset, up
+// to the end of it if length is 0, with the first of algorithms we know. With
+// a block size each block of the range gets its own hash, one after the other
+func (h *sftpHandler) checkFile(p string, algorithms []string, offset, length uint64, blockSize uint32) (string, []byte, error) {
+	if !h.config.perms.Has(PermRead) {
+		return "", nil, sftp.ErrSSHFxPermissionDenied
+	}
+	var algorithm string
+	for _, name := range algorithms {
+		if _, ok := checksumAlgorithms[name]; ok {
+			algorithm = name
+			break
+		}
+	}
+	if algorithm == "" {
+		return "", nil, sftp.ErrSSHFxOpUnsupported
+	}
+	if blockSize != 0 && blockSize < minCheckFileBlock {
+		return "", nil, errors.New("Invalid block size")
+	}
+
+	real, err := h.realPath(p)
+	if err != nil {
+		return "", nil, err
+	}
+	f, err := h.fs.Open(h.uploadPath(real))
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", nil, err
+	}
+	if fi.IsDir() {
+		return "", nil, errIsDirectory
+	}
+
+	end := uint64(fi.Size())
+	if length > 0 && offset+length > offset && offset+length < end {
+		end = offset + length
+	}
+	offset = min(offset, end)
+	block := end - offset
+	blocks := uint64(1)
+	if blockSize > 0 {
+		block = uint64(blockSize)
+		blocks = (end - offset + block - 1) / block
+	}
+	hash := checksumAlgorithms[algorithm]()
+	if blocks*uint64(hash.Size()) > maxSFTPPacket-sftpWriteOverhead {
+		return "", nil, errors.New("Too many blocks to hash")
+	}
+
+	var hashes []byte
+	for i := uint64(0); i < blocks; i++ {
+		start := offset + i*block
+		hash.Reset()
+		if _, err := io.Copy(hash, io.NewSectionReader(f, int64(start), int64(min(block, end-start)))); err != nil {
+			return "", nil, err
+		}
+		hashes = hash.Sum(hashes)
+	}
+	h.config.logger().Debug("Hashed file for check-file", "file", p, "algorithm", algorithm, "offset", offset, "blocks", blocks)
+	return algorithm, hashes, nil
+}
@@ -0,0 +1,140 @@
+package simplescp
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+)
+
+// Checksum algorithms transfers can be recorded with
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+const (
+	defaultChecksum = "sha256"
+	checksumNone    = "none"
+)
+
+// How much of what sftp clients send or read out of order is held on to
+// while waiting for the rest, before giving up on checksumming it on the fly
+const maxPendingChecksum = 16 * 1024 * 1024
+
+func validateChecksum(algorithm string) error {
+	if _, ok := checksumAlgorithms[algorithm]; ok || algorithm == "" || algorithm == checksumNone {
+		return nil
+	}
+	return fmt.Errorf("Invalid checksum algorithm %q, it should be md5, sha1, sha256, sha512 or none", algorithm)
+}
+
+func (c Config) checksumAlgorithm() string {
+	if c.Checksum == "" {
+		return defaultChecksum
+	}
+	return c.Checksum
+}
+
+// A new hash for a transfer, or nil if there's no one to tell its checksum to
+func (c Config) transferChecksum() hash.Hash {
+	newHash, ok := checksumAlgorithms[c.checksumAlgorithm()]
+	if !ok || (c.transferLog == nil && len(c.Webhooks) == 0) {
+		return nil
+	}
+	return newHash()
+}
+
+// Checksum the file at path by reading it back, for when it couldn't be done
+// while it was transferred
+func (c Config) fileChecksum(path string) (string, error) {
+	newHash, ok := checksumAlgorithms[c.checksumAlgorithm()]
+	if !ok {
+		return "", nil
+	}
+	f, err := c.fileSystem().Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hexSum(h hash.Hash) string {
+	if h == nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// offsetChecksum hashes what's read or written at any offset, as sftp clients
+// do, as long as it adds up to the file from its start without gaps or
+// overlaps. Anything ahead of what's been hashed so far is kept until the
+// gap's filled in
+type offsetChecksum struct {
+	mu      sync.Mutex
+	h       hash.Hash
+	next    int64
+	pending map[int64][]byte
+	held    int
+	broken  bool
+}
+
+func (o *offsetChecksum) add(p []byte, off int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.broken || len(p) == 0 {
+		return
+	}
+	switch {
+	case off < o.next:
+		// Read or written again, there's no telling what the file ends up like
+		o.broken = true
+	case off > o.next:
+		if o.held+len(p) > maxPendingChecksum {
+			o.broken = true
+			o.pending = nil
+			return
+		}
+		if o.pending == nil {
+			o.pending = make(map[int64][]byte)
+		}
+		o.pending[off] = append([]byte(nil), p...)
+		o.held += len(p)
+	default:
+		o.h.Write(p)
+		o.next += int64(len(p))
+		for {
+			b, ok := o.pending[o.next]
+			if !ok {
+				break
+			}
+			delete(o.pending, o.next)
+			o.held -= len(b)
+			o.h.Write(b)
+			o.next += int64(len(b))
+		}
+	}
+}
+
+// The checksum of the first size bytes, if that's exactly what was hashed
+func (o *offsetChecksum) sum(size int64) (string, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.broken || len(o.pending) > 0 || o.next != size {
+		return "", false
+	}
+	return hexSum(o.h), true
+}
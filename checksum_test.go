@@ -0,0 +1,109 @@
+package simplescp
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOffsetChecksum(t *testing.T) {
+	sum := func(s string) string {
+		h := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(h[:])
+	}
+
+	o := &offsetChecksum{h: sha256.New()}
+	o.add([]byte("world"), 6)
+	o.add([]byte("!"), 11)
+	if _, ok := o.sum(12); ok {
+		t.Error("Checksum with a gap at the start")
+	}
+	o.add([]byte("hello "), 0)
+	if s, ok := o.sum(12); !ok || s != sum("hello world!") {
+		t.Errorf("Unexpected checksum %q", s)
+	}
+	if _, ok := o.sum(20); ok {
+		t.Error("Checksum of part of the file")
+	}
+
+	o = &offsetChecksum{h: sha256.New()}
+	o.add([]byte("hello"), 0)
+	o.add([]byte("j"), 0)
+	if _, ok := o.sum(5); ok {
+		t.Error("Checksum of a file written over")
+	}
+
+	if err := validateChecksum("crc32"); err == nil {
+		t.Error("Expected an error for an unknown algorithm")
+	}
+}
+
+func TestTransferChecksums(t *testing.T) {
+	c := newTestConfig(t)
+	c.TransferLog = filepath.Join(t.TempDir(), "xfer.csv")
+	c.TransferLogFormat = "csv"
+	os.WriteFile(filepath.Join(c.Dir, "down.txt"), []byte("download me"), 0644)
+	addr := startTestServer(t, c)
+
+	scp := startTestSCP(t, addr, "scp -t .")
+	scp.ack()
+	if err := scp.sendFile("up.txt", "upload me"); err != nil {
+		t.Fatal(err)
+	}
+	scp.stdin.Close()
+	scp.session.Wait()
+	scp = startTestSCP(t, addr, "scp -f down.txt")
+	if _, _, err := scp.receive(); err != nil {
+		t.Fatal(err)
+	}
+	scp.receive()
+	scp.session.Wait()
+
+	client := dialSFTP(t, addr)
+	f, err := client.Create("/sftp.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Out of order, like clients writing in parallel do
+	f.WriteAt([]byte("order"), 4)
+	f.WriteAt([]byte("out "), 0)
+	f.Close()
+	// Written over, so it has to be read back
+	f, err = client.Create("/again.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("first"), 0)
+	f.WriteAt([]byte("again"), 0)
+	f.Close()
+	f, err = client.Open("/down.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(f)
+	f.Close()
+
+	log, err := os.Open(c.TransferLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	records, err := csv.NewReader(log).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"upload me", "download me", "out order", "again", "download me"}
+	if len(records) != len(expected)+1 {
+		t.Fatalf("Got %d transfers logged, expected %d", len(records)-1, len(expected))
+	}
+	for i, contents := range expected {
+		h := sha256.Sum256([]byte(contents))
+		if sum := records[i+1][9]; sum != hex.EncodeToString(h[:]) {
+			t.Errorf("Transfer of %q logged with checksum %q", contents, sum)
+		}
+	}
+}
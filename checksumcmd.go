@@ -0,0 +1,118 @@
+package simplescp
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Commands clients (like WinSCP) run to check a file they've transferred,
+// with the algorithm each one uses
+var checksumCommands = map[string]string{
+	"md5sum":    "md5",
+	"sha1sum":   "sha1",
+	"sha256sum": "sha256",
+	"sha512sum": "sha512",
+}
+
+// What md5sum says about the files it can't read
+var (
+	errNoSuchFile  = errors.New("No such file or directory")
+	errIsDirectory = errors.New("Is a directory")
+)
+
+// Do what md5sum and friends would against the shared directory: print the
+// checksum of each file named, or of stdin if there are none, as
+// "<checksum>  <name>". Only reading files is supported, not checking them (-c)
+func (c Config) runChecksumCommand(channel ssh.Channel, req *ssh.Request, args []string) {
+	cmd := args[0]
+	log := c.logger().With("command", cmd)
+	newHash := checksumAlgorithms[checksumCommands[cmd]]
+	req.Reply(true, nil)
+
+	var files []string
+	parseOpts := true
+	for _, arg := range args[1:] {
+		if parseOpts && strings.HasPrefix(arg, "-") && arg != "-" {
+			switch arg {
+			case "-b", "--binary", "-t", "--text":
+				// Files are always read as they are
+			case "--":
+				parseOpts = false
+			default:
+				fmt.Fprintf(channel.Stderr(), "%s: unsupported option %s\n", cmd, arg)
+				closeChannel(channel, 1)
+				return
+			}
+			continue
+		}
+		files = append(files, arg)
+	}
+
+	if !c.perms.Has(PermRead) {
+		for _, name := range files {
+			fmt.Fprintf(channel.Stderr(), "%s: %s: Permission denied\n", cmd, name)
+		}
+		closeChannel(channel, 1)
+		return
+	}
+
+	if len(files) == 0 {
+		h := newHash()
+		if _, err := io.Copy(h, channel); err != nil {
+			log.Error("Error reading stdin", "err", err)
+			closeChannel(channel, 1)
+			return
+		}
+		fmt.Fprintf(channel, "%s  -\n", hexSum(h))
+		closeChannel(channel, 0)
+		return
+	}
+
+	var exitStatus uint8
+	for _, name := range files {
+		sum, err := c.checksumFile(name, newHash())
+		if err != nil {
+			log.Info("Can't checksum file", "file", name, "err", err)
+			fmt.Fprintf(channel.Stderr(), "%s: %s: %s\n", cmd, name, err)
+			exitStatus = 1
+			continue
+		}
+		log.Debug("Checksummed file", "file", name)
+		fmt.Fprintf(channel, "%s  %s\n", sum, name)
+	}
+	closeChannel(channel, exitStatus)
+}
+
+// The checksum of the file at p as the client sees it, with an error put the
+// way the real commands would
+func (c Config) checksumFile(p string, h hash.Hash) (string, error) {
+	if c.deniedFile(p) {
+		return "", errNoSuchFile
+	}
+	resolved, err := c.resolvePath(p)
+	if err != nil {
+		return "", errNoSuchFile
+	}
+	fsys := c.fileSystem()
+	fi, err := fsys.Stat(resolved)
+	if err != nil {
+		return "", errNoSuchFile
+	}
+	if fi.IsDir() {
+		return "", errIsDirectory
+	}
+	f, err := fsys.Open(resolved)
+	if err != nil {
+		return "", pathErrReason(err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", pathErrReason(err)
+	}
+	return hexSum(h), nil
+}
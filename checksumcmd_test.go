@@ -0,0 +1,64 @@
+package simplescp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestChecksumCommands(t *testing.T) {
+	c := newTestConfig(t)
+	c.DenyFiles = []string{"*.key"}
+	os.Mkdir(filepath.Join(c.Dir, "dir"), 0755)
+	os.WriteFile(filepath.Join(c.Dir, "dir", "a.txt"), []byte("hello\n"), 0644)
+	os.WriteFile(filepath.Join(c.Dir, "secret.key"), []byte("secret"), 0644)
+	addr := startTestServer(t, c)
+
+	cmd := startTestSCP(t, addr, `sha256sum "dir/a.txt" /dir/a.txt`)
+	cmd.stdin.Close()
+	output, _ := io.ReadAll(cmd.stdout)
+	sum := "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"
+	if expected := sum + "  dir/a.txt\n" + sum + "  /dir/a.txt\n"; string(output) != expected {
+		t.Errorf("Got %q, expected %q", output, expected)
+	}
+	if err := cmd.session.Wait(); err != nil {
+		t.Error(err)
+	}
+
+	cmd = startTestSCP(t, addr, "md5sum -b dir/a.txt")
+	cmd.stdin.Close()
+	if output, _ := io.ReadAll(cmd.stdout); string(output) != "b1946ac92492d2347c6235b4d2611184  dir/a.txt\n" {
+		t.Errorf("Got %q from md5sum", output)
+	}
+
+	// Own stdin
+	cmd = startTestSCP(t, addr, "md5sum")
+	cmd.stdin.Write([]byte("hello\n"))
+	cmd.stdin.Close()
+	if output, _ := io.ReadAll(cmd.stdout); string(output) != "b1946ac92492d2347c6235b4d2611184  -\n" {
+		t.Errorf("Got %q from md5sum of stdin", output)
+	}
+
+	for _, name := range []string{"secret.key", "missing", "../../etc/passwd", "dir"} {
+		cmd := startTestSCP(t, addr, "sha1sum "+name)
+		cmd.stdin.Close()
+		var exitErr *ssh.ExitError
+		if output, _ := io.ReadAll(cmd.stdout); len(output) > 0 {
+			t.Errorf("Checksummed %s: %q", name, output)
+		}
+		if err := cmd.session.Wait(); !errors.As(err, &exitErr) || exitErr.ExitStatus() != 1 {
+			t.Errorf("Unexpected exit for %s: %v", name, err)
+		}
+	}
+
+	cmd = startTestSCP(t, addr, "sha1sum -c sums")
+	cmd.stdin.Close()
+	if err := cmd.session.Wait(); err == nil || !strings.Contains(err.Error(), "status 1") {
+		t.Errorf("Checking sums didn't fail: %v", err)
+	}
+}
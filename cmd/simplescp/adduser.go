@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jjch99/simplescp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// Add a user to the user database (user_db) from the command line
+func adduser(args []string) {
+	flags := flag.NewFlagSet("adduser", flag.ExitOnError)
+	configFile := flags.String("config", "", "YAML or TOML file to find user_db in")
+	db := flags.String("db", "", "User database to add the user to. Default: user_db from the config")
+	home := flags.String("home", "", "Directory the user shares files out of, relative to dir unless it's absolute. Default: dir")
+	perms := flags.String("permissions", "read,write", "Comma separated permissions: read, write, list, delete, rename, mkdir, symlink, chmod or all")
+	keys := flags.String("keys", "", "authorized_keys file with the user's public keys")
+	passwordStdin := flags.Bool("password-stdin", false, "Read the password from stdin instead of asking for it")
+	var quota simplescp.ByteSize
+	flags.TextVar(&quota, "quota", simplescp.ByteSize(0), "How much the user can store (e.g. 10G). Default: the server's quota")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s adduser [flags] <username>\n", filepath.Base(os.Args[0]))
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	path := *db
+	if len(path) == 0 {
+		config, err := simplescp.ReadConfig(*configFile)
+		if err != nil {
+			fatal("Can't read config", err)
+		}
+		if path = config.UserDB; len(path) == 0 {
+			fatal("Can't add user", errors.New("no user database, set user_db or pass -db"))
+		}
+	}
+
+	u := &simplescp.User{Name: flags.Arg(0), HomeDir: *home, Quota: quota}
+	var err error
+	if u.Permissions, err = simplescp.ParsePermissions(*perms); err != nil {
+		fatal("Can't add user", err)
+	}
+	if len(*keys) > 0 {
+		if u.PublicKeys, err = readPublicKeys(*keys); err != nil {
+			fatal("Can't read public keys", err)
+		}
+	}
+	// It can be empty, for users that only log in with keys
+	password, err := readNewPassword(*passwordStdin, "Password (empty for none): ")
+	if err != nil {
+		fatal("Can't read password", err)
+	}
+	if len(password) > 0 {
+		if u.PasswordHash, err = simplescp.HashPassword(password); err != nil {
+			fatal("Can't hash password", err)
+		}
+	} else if len(u.PublicKeys) == 0 {
+		fatal("Can't add user", errors.New("the user needs a password or public keys to log in"))
+	}
+
+	store, err := simplescp.OpenSQLiteUserStore(path)
+	if err != nil {
+		fatal("Can't add user", err)
+	}
+	defer store.Close()
+	if err := store.AddUser(u); err != nil {
+		fatal("Failed to update user database", err)
+	}
+	fmt.Printf("Added user %s to %s\n", u.Name, path)
+}
+
+// The public keys in an authorized_keys file
+func readPublicKeys(file string) ([]ssh.PublicKey, error) {
+	contents, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var keys []ssh.PublicKey
+	for len(contents) > 0 {
+		var key ssh.PublicKey
+		key, _, _, contents, err = ssh.ParseAuthorizedKey(contents)
+		if err != nil {
+			break
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no public keys in %s", file)
+	}
+	return keys, nil
+}
+
+// Ask for a password twice on the terminal, with prompt the first time, or read
+// it from the first line of stdin
+func readNewPassword(fromStdin bool, prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if fromStdin || !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && len(line) == 0 {
+			return "", nil
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil || len(password) == 0 {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "Password again: ")
+	again, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(again) != string(password) {
+		return "", errors.New("the passwords don't match")
+	}
+	return string(password), nil
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jjch99/simplescp"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Measure how fast files go through a server started just for it, so changes
+// that slow transfers down show up in numbers
+func bench(args []string) {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	configFile := flags.String("config", "", "YAML or TOML file with the settings to benchmark, e.g. to try out encryption or checksums. Default: the defaults")
+	sizesFlag := flags.String("sizes", "64K,1M,64M", "Comma separated sizes of the files to transfer")
+	concurrency := flags.Int("concurrency", 4, "Transfers at the same time, each over its own connection")
+	count := flags.Int("count", 32, "Transfers of each size in each direction")
+	direction := flags.String("direction", "both", "Transfers to time: upload, download or both")
+	protocol := flags.String("protocol", "scp", "Protocol to transfer files with: scp or sftp")
+	backend := flags.String("backend", "", "Storage backend, e.g. mem to leave disks out of it. Default: the config's, os")
+	dir := flags.String("dir", "", "Directory to store the files in with the os backend. Default: a temporary one, removed afterwards")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s bench [flags]\n", filepath.Base(os.Args[0]))
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var sizes []int64
+	for _, s := range strings.Split(*sizesFlag, ",") {
+		size, err := simplescp.ParseByteSize(s)
+		if err != nil || size == 0 {
+			fatal("Invalid sizes", fmt.Errorf("invalid size %q", s))
+		}
+		sizes = append(sizes, int64(size))
+	}
+	if *concurrency < 1 || *count < 1 {
+		fatal("Can't benchmark", errors.New("concurrency and count have to be at least 1"))
+	}
+	opts := benchOptions{sizes: sizes, concurrency: *concurrency, count: *count}
+	opts.upload, opts.download = *direction == "upload" || *direction == "both", *direction == "download" || *direction == "both"
+	if !opts.upload && !opts.download {
+		fatal("Can't benchmark", fmt.Errorf("unknown direction %q, it should be upload, download or both", *direction))
+	}
+	switch *protocol {
+	case "scp":
+		opts.transfer = scpBenchTransfer{}
+	case "sftp":
+		opts.transfer = sftpBenchTransfer{}
+	default:
+		fatal("Can't benchmark", fmt.Errorf("unknown protocol %q, it should be scp or sftp", *protocol))
+	}
+
+	config := simplescp.NewConfig()
+	if len(*configFile) > 0 {
+		var err error
+		if config, err = simplescp.ReadConfig(*configFile); err != nil {
+			fatal("Can't read config", err)
+		}
+	}
+	if len(*backend) > 0 {
+		config.Backend = *backend
+	}
+	if len(config.Backend) == 0 {
+		config.Backend = "os"
+	}
+	config.Dir = *dir
+	if len(config.Dir) == 0 && config.Backend == "os" {
+		tmp, err := os.MkdirTemp("", "simplescp-bench")
+		if err != nil {
+			fatal("Can't benchmark", err)
+		}
+		defer os.RemoveAll(tmp)
+		config.Dir = tmp
+	}
+	secret := make([]byte, 16)
+	rand.Read(secret)
+	config.User, config.Password = "bench", hex.EncodeToString(secret)
+	config.PrivateKeyFile, config.HostKeyFiles, config.AuthKeysFile, config.UserDB = "", nil, "", ""
+	config.Anonymous.Enabled = false
+	var err error
+	if config.Logger, err = simplescp.NewLogger(os.Stderr, config.LogFormat, "warn"); err != nil {
+		fatal("Invalid config", err)
+	}
+	if err := config.Init(); err != nil {
+		fatal("Invalid config", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fatal("Can't listen", err)
+	}
+	server := simplescp.NewServer(config)
+	go server.Serve(listener)
+	defer server.Shutdown(context.Background())
+
+	fmt.Printf("%d transfers of each size over %s, %d at a time, %s backend\n\n", *count, *protocol, *concurrency, config.Backend)
+	if err := runBenchmarks(os.Stdout, listener.Addr().String(), config.User, config.Password, opts); err != nil {
+		fatal("Can't connect", err)
+	}
+}
+
+// What to time
+type benchOptions struct {
+	sizes       []int64
+	concurrency int
+	count       int
+	upload      bool
+	download    bool
+	transfer    benchTransfer
+}
+
+// Time the transfers to and from the server at addr, logging in as user,
+// writing a row of results to w for each size and direction
+func runBenchmarks(w io.Writer, addr, user, password string, opts benchOptions) error {
+	// Each worker keeps its connection, and its own file of each size
+	clients := make([]*benchClient, opts.concurrency)
+	for i := range clients {
+		var err error
+		if clients[i], err = dialBenchClient(addr, user, password); err != nil {
+			return err
+		}
+		defer clients[i].Close()
+	}
+
+	fmt.Fprintf(w, benchRow, "SIZE", "DIRECTION", "TRANSFERS", "FAILED", "MB/S", "P50", "P90", "P99", "MAX")
+	for _, size := range opts.sizes {
+		// Downloads need files to download, uploaded (and timed or not) first
+		r := runBench(clients, opts.count, func(c *benchClient, worker int) error {
+			return opts.transfer.upload(c, benchFile(size, worker), size)
+		})
+		if opts.upload {
+			r.print(w, size, "upload")
+		}
+		if opts.download {
+			r = runBench(clients, opts.count, func(c *benchClient, worker int) error {
+				return opts.transfer.download(c, benchFile(size, worker), size)
+			})
+			r.print(w, size, "download")
+		}
+	}
+	return nil
+}
+
+func benchFile(size int64, worker int) string {
+	return fmt.Sprintf("bench-%s-%d", simplescp.ByteSize(size), worker)
+}
+
+// A connection to the benchmarked server, with sftp started on it
+type benchClient struct {
+	*ssh.Client
+	sftp *sftp.Client
+}
+
+func dialBenchClient(addr, user, password string) (*benchClient, error) {
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.Password(password)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &benchClient{Client: conn, sftp: client}, nil
+}
+
+func (c *benchClient) Close() error {
+	c.sftp.Close()
+	return c.Client.Close()
+}
+
+// How long each of the transfers of a workload took
+type benchResult struct {
+	elapsed   time.Duration
+	latencies []time.Duration
+	failed    int
+	err       error // The first one
+}
+
+// Run count transfers, spread over the clients
+func runBench(clients []*benchClient, count int, transfer func(c *benchClient, worker int) error) benchResult {
+	jobs := make(chan int, count)
+	for i := 0; i < count; i++ {
+		jobs <- i
+	}
+	close(jobs)
+
+	var r benchResult
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	start := time.Now()
+	for worker, c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				begin := time.Now()
+				err := transfer(c, worker)
+				took := time.Since(begin)
+				mu.Lock()
+				if err != nil {
+					r.failed++
+					if r.err == nil {
+						r.err = err
+					}
+				} else {
+					r.latencies = append(r.latencies, took)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	r.elapsed = time.Since(start)
+	slices.Sort(r.latencies)
+	return r
+}
+
+// Each line of results, printed as soon as they're in
+const benchRow = "%6s %9s %9s %6s %8s %10s %10s %10s %10s\n"
+
+func (r benchResult) print(w io.Writer, size int64, direction string) {
+	if r.err != nil {
+		slog.Error("Transfers failed", "size", simplescp.ByteSize(size), "direction", direction, "failed", r.failed, "err", r.err)
+	}
+	throughput := float64(size) * float64(len(r.latencies)) / r.elapsed.Seconds() / 1e6
+	fmt.Fprintf(w, benchRow, simplescp.ByteSize(size), direction, strconv.Itoa(len(r.latencies)+r.failed), strconv.Itoa(r.failed),
+		strconv.FormatFloat(throughput, 'f', 1, 64), r.percentile(0.5), r.percentile(0.9), r.percentile(0.99), r.percentile(1))
+}
+
+func (r benchResult) percentile(p float64) string {
+	if len(r.latencies) == 0 {
+		return "-"
+	}
+	i := int(math.Ceil(p*float64(len(r.latencies)))) - 1
+	return r.latencies[max(i, 0)].Round(10 * time.Microsecond).String()
+}
+
+// Moves files of a given size to and from the server
+type benchTransfer interface {
+	upload(c *benchClient, name string, size int64) error
+	download(c *benchClient, name string, size int64) error
+}
+
+// Random bytes, a buffer of them over and over
+type benchData struct {
+	buf []byte
+	pos int
+}
+
+var benchBuffer = func() []byte {
+	buf := make([]byte, 1<<20)
+	rand.Read(buf)
+	return buf
+}()
+
+func newBenchData(size int64) io.Reader {
+	return io.LimitReader(&benchData{buf: benchBuffer}, size)
+}
+
+func (d *benchData) Read(p []byte) (int, error) {
+	n := copy(p, d.buf[d.pos:])
+	d.pos = (d.pos + n) % len(d.buf)
+	return n, nil
+}
+
+type sftpBenchTransfer struct{}
+
+func (sftpBenchTransfer) upload(c *benchClient, name string, size int64) error {
+	f, err := c.sftp.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, newBenchData(size))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (sftpBenchTransfer) download(c *benchClient, name string, size int64) error {
+	f, err := c.sftp.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := io.Copy(io.Discard, f)
+	if err == nil && n != size {
+		err = fmt.Errorf("got %d bytes instead of %d", n, size)
+	}
+	return err
+}
+
+// Speaks the scp protocol like the scp command does, a session for each file
+type scpBenchTransfer struct{}
+
+func (scpBenchTransfer) upload(c *benchClient, name string, size int64) error {
+	session, stdin, r, err := startSCP(c.Client, "-t "+name)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	return finishSCP(session, stdin, func() error {
+		if err := scpAck(r); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdin, "C0644 %d %s\n", size, path.Base(name))
+		if err := scpAck(r); err != nil {
+			return err
+		}
+		if _, err := io.Copy(stdin, newBenchData(size)); err != nil {
+			return err
+		}
+		stdin.Write([]byte{0})
+		return scpAck(r)
+	})
+}
+
+func (scpBenchTransfer) download(c *benchClient, name string, size int64) error {
+	session, stdin, r, err := startSCP(c.Client, "-f "+name)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	return finishSCP(session, stdin, func() error {
+		stdin.Write([]byte{0})
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(header)
+		if len(fields) < 3 || !strings.HasPrefix(fields[0], "C") {
+			return errors.New(strings.TrimSpace(strings.TrimLeft(header, "\x01\x02")))
+		}
+		if n, err := strconv.ParseInt(fields[1], 10, 64); err != nil || n != size {
+			return fmt.Errorf("got a file of %s bytes instead of %d", fields[1], size)
+		}
+		stdin.Write([]byte{0})
+		if _, err := io.CopyN(io.Discard, r, size); err != nil {
+			return err
+		}
+		if err := scpAck(r); err != nil {
+			return err
+		}
+		_, err = stdin.Write([]byte{0})
+		return err
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jjch99/simplescp"
+	"github.com/jjch99/simplescp/simplescptest"
+)
+
+func TestRunBenchmarks(t *testing.T) {
+	server := simplescptest.NewServer(t)
+	alice := server.AddUser(t, "alice")
+	for protocol, transfer := range map[string]benchTransfer{"scp": scpBenchTransfer{}, "sftp": sftpBenchTransfer{}} {
+		var out bytes.Buffer
+		opts := benchOptions{sizes: []int64{1000, 64 << 10}, concurrency: 2, count: 3, upload: true, download: true, transfer: transfer}
+		if err := runBenchmarks(&out, server.Addr, alice.Name, alice.Password, opts); err != nil {
+			t.Fatal(err)
+		}
+
+		// A header, then a row for each size and direction
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if len(lines) != 5 {
+			t.Fatalf("Expected 5 lines over %s, got %q", protocol, lines)
+		}
+		i := 1
+		for _, size := range []string{"1000", "64K"} {
+			for _, direction := range []string{"upload", "download"} {
+				fields := strings.Fields(lines[i])
+				if len(fields) != 9 || fields[0] != size || fields[1] != direction || fields[2] != "3" || fields[3] != "0" {
+					t.Errorf("Expected 3 %ss of %s over %s, got %q", direction, size, protocol, lines[i])
+				}
+				i++
+			}
+		}
+
+		// What was uploaded is the size it should be
+		for _, size := range opts.sizes {
+			files, _ := filepath.Glob(filepath.Join(alice.Dir, "bench-"+simplescp.ByteSize(size).String()+"-*"))
+			if len(files) == 0 {
+				t.Errorf("No %d byte files uploaded over %s", size, protocol)
+			}
+			for _, file := range files {
+				if info, err := os.Stat(file); err != nil || info.Size() != size {
+					t.Errorf("%s isn't %d bytes: %v", file, size, err)
+				}
+			}
+		}
+	}
+
+	// Transfers that fail are counted apart
+	bob := server.AddUser(t, "bob", func(u *simplescp.User) { u.Permissions = simplescp.PermRead | simplescp.PermList })
+	var out bytes.Buffer
+	opts := benchOptions{sizes: []int64{1000}, concurrency: 1, count: 2, upload: true, transfer: sftpBenchTransfer{}}
+	if err := runBenchmarks(&out, server.Addr, bob.Name, bob.Password, opts); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if fields := strings.Fields(lines[len(lines)-1]); len(lines) != 2 || len(fields) != 9 || fields[2] != "2" || fields[3] != "2" {
+		t.Errorf("Expected 2 failed uploads, got %q", lines)
+	}
+}
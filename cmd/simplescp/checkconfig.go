@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/jjch99/simplescp"
+)
+
+// Load the config serve would run with and check everything in it, without
+// serving anything or creating any files, so mistakes show up (all of them at
+// once) before the server is (re)started
+func checkconfig(args []string) {
+	// It takes the same flags as serve, they override the config the same way
+	serveFlags.Init("checkconfig", flag.ExitOnError)
+	noBind := serveFlags.Bool("no-bind", false, "Don't check the addresses to listen on can be bound, e.g. while the server is running")
+	serveFlags.Parse(args)
+
+	config, err := simplescp.ReadConfig(*configFile)
+	if err != nil {
+		fatal("Can't read config", err)
+	}
+	applyFlags(config)
+	if config.Logger, err = simplescp.NewLogger(os.Stderr, config.LogFormat, "warn"); err != nil {
+		fatal("Invalid config", err)
+	}
+	problems := config.Check(!*noBind)
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintln(os.Stderr, p.Error())
+		}
+		if len(problems) == 1 {
+			fmt.Fprintln(os.Stderr, "Found 1 problem")
+		} else {
+			fmt.Fprintf(os.Stderr, "Found %d problems\n", len(problems))
+		}
+		os.Exit(1)
+	}
+	fmt.Println("Config OK")
+}
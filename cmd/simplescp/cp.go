@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/term"
+)
+
+// Copy files to or from an SSH server (this one or any other) over sftp, or
+// scp for servers without it, so the one binary is all a container needs to
+// both serve and send files
+func cp(args []string) {
+	flags := flag.NewFlagSet("cp", flag.ExitOnError)
+	var c copier
+	flags.BoolVar(&c.recursive, "r", false, "Copy directories and everything in them")
+	flags.BoolVar(&c.preserve, "p", false, "Keep the modification times and modes of the files")
+	port := flags.String("P", "22", "Port to connect to")
+	useSCP := flags.Bool("O", false, "Copy with the scp protocol instead of sftp, for servers that don't have sftp")
+	var identities []string
+	flags.Func("i", "Private key to log in with, can be repeated. Default: the ssh-agent and ~/.ssh/id_ed25519, id_ecdsa and id_rsa", func(file string) error {
+		identities = append(identities, file)
+		return nil
+	})
+	knownHosts := flags.String("known-hosts", "", "known_hosts file to check the server's host key against. Default: ~/.ssh/known_hosts")
+	fingerprint := flags.String("fingerprint", "", "SHA256 fingerprint the server's host key has to have, instead of checking known_hosts")
+	insecure := flags.Bool("insecure", false, "Don't check the server's host key at all")
+	passwordStdin := flags.Bool("password-stdin", false, "Read the password from stdin instead of asking for it")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s cp [flags] <source>... <destination>\n\n", filepath.Base(os.Args[0]))
+		fmt.Fprintln(flags.Output(), "Remote files are given as [user@]host:path, like with scp. Either the sources or the destination can be remote.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() < 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var sources []location
+	for _, arg := range flags.Args()[:flags.NArg()-1] {
+		sources = append(sources, parseLocation(arg))
+	}
+	dst := parseLocation(flags.Arg(flags.NArg() - 1))
+	for _, src := range sources[1:] {
+		if src.host != sources[0].host || src.user != sources[0].user {
+			fatal("Can't copy", errors.New("all the sources have to be on the same host"))
+		}
+	}
+	if len(sources[0].host) > 0 && len(dst.host) > 0 {
+		fatal("Can't copy", errors.New("copying from one remote host to another isn't supported"))
+	}
+
+	from, to := cpFS(localFS{}), cpFS(localFS{})
+	remote := dst
+	if len(sources[0].host) > 0 {
+		remote = sources[0]
+	}
+	if len(remote.host) > 0 {
+		hostKeys, err := newHostKeyCheck(*knownHosts, *fingerprint, *insecure)
+		if err != nil {
+			fatal("Can't check host keys", err)
+		}
+		login := clientLogin{identities: identities, passwordStdin: *passwordStdin}
+		conn, err := dialSSHServer(remote, *port, hostKeys, &login)
+		if err != nil {
+			fatal("Can't connect", err)
+		}
+		defer conn.Close()
+		if *useSCP {
+			c.copySCP(conn, sources, dst)
+			if c.failed {
+				os.Exit(1)
+			}
+			return
+		}
+		client, err := sftp.NewClient(conn, sftp.UseConcurrentWrites(true))
+		if err != nil {
+			fatal("Can't start sftp", err)
+		}
+		defer client.Close()
+		if len(dst.host) > 0 {
+			to = sftpFS{client}
+		} else {
+			from = sftpFS{client}
+		}
+	}
+
+	info, err := to.Stat(dst.path)
+	toDir := err == nil && info.IsDir()
+	if len(sources) > 1 && !toDir {
+		fatal("Can't copy", fmt.Errorf("%s isn't a directory", dst.path))
+	}
+	for _, src := range sources {
+		target := dst.path
+		if toDir {
+			target = to.Join(dst.path, from.Base(src.path))
+		}
+		c.copy(from, src.path, to, target)
+	}
+	if c.failed {
+		os.Exit(1)
+	}
+}
+
+// Where files are copied from or to: a local path, or a path on host
+type location struct {
+	user string
+	host string
+	path string
+}
+
+// Parse [user@]host:path (host can be an IPv6 address in brackets) like scp,
+// anything else is a local path. So are the ones with a slash before the
+// colon, like ./file:name, and Windows ones with drive letters. An empty remote
+// path is the directory the server starts sessions in
+func parseLocation(s string) location {
+	if len(filepath.VolumeName(s)) > 0 {
+		return location{path: s}
+	}
+	var user string
+	rest := s
+	if at := strings.Index(s, "@"); at > 0 && !strings.ContainsAny(s[:at], "/:") {
+		user, rest = s[:at], s[at+1:]
+	}
+	if strings.HasPrefix(rest, "[") {
+		end := strings.Index(rest, "]:")
+		if end < 0 {
+			return location{path: s}
+		}
+		return remoteLocation(user, rest[1:end], rest[end+2:])
+	}
+	colon := strings.Index(rest, ":")
+	if colon <= 0 || strings.Contains(rest[:colon], "/") {
+		return location{path: s}
+	}
+	return remoteLocation(user, rest[:colon], rest[colon+1:])
+}
+
+func remoteLocation(user, host, path string) location {
+	if len(path) == 0 {
+		path = "."
+	}
+	return location{user: user, host: host, path: path}
+}
+
+// How to log in: with the keys given with -i (or the agent's and the default
+// ones), then the password if the server asks for one
+type clientLogin struct {
+	identities    []string
+	passwordStdin bool
+	password      string
+}
+
+func (l *clientLogin) authMethods() ([]ssh.AuthMethod, error) {
+	var signers []ssh.Signer
+	files := l.identities
+	if len(files) == 0 {
+		if sock := os.Getenv("SSH_AUTH_SOCK"); len(sock) > 0 {
+			// The agent signs while logging in, so it stays connected until we're done
+			if conn, err := net.Dial("unix", sock); err == nil {
+				if agentSigners, err := agent.NewClient(conn).Signers(); err == nil {
+					signers = append(signers, agentSigners...)
+				}
+			}
+		}
+		if home, err := os.UserHomeDir(); err == nil {
+			for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+				if file := filepath.Join(home, ".ssh", name); fileExists(file) {
+					files = append(files, file)
+				}
+			}
+		}
+	}
+	for _, file := range files {
+		contents, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(contents)
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			var passphrase []byte
+			if passphrase, err = readSecret(fmt.Sprintf("Passphrase for %s: ", file)); err == nil {
+				signer, err = ssh.ParsePrivateKeyWithPassphrase(contents, passphrase)
+			}
+		}
+		if err != nil {
+			// Keys we only found lying around don't stop us from trying passwords
+			if len(l.identities) == 0 {
+				continue
+			}
+			return nil, fmt.Errorf("can't use key %s: %v", file, err)
+		}
+		signers = append(signers, signer)
+	}
+
+	methods := []ssh.AuthMethod{ssh.PasswordCallback(l.readPassword)}
+	if len(signers) > 0 {
+		methods = append([]ssh.AuthMethod{ssh.PublicKeys(signers...)}, methods...)
+	}
+	// Servers asking for more than a password, like a verification code. It
+	// needs someone at a terminal to answer
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return methods, nil
+	}
+	methods = append(methods, ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		if len(instruction) > 0 {
+			fmt.Fprintln(os.Stderr, instruction)
+		}
+		answers := make([]string, len(questions))
+		for i, question := range questions {
+			answer, err := readSecret(question)
+			if err != nil {
+				return nil, err
+			}
+			answers[i] = string(answer)
+		}
+		return answers, nil
+	}))
+	return methods, nil
+}
+
+// The password, asked for once however many times the server asks for it
+func (l *clientLogin) readPassword() (string, error) {
+	if len(l.password) > 0 {
+		return l.password, nil
+	}
+	if l.passwordStdin {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && len(line) == 0 {
+			return "", errors.New("no password on stdin")
+		}
+		l.password = strings.TrimRight(line, "\r\n")
+		return l.password, nil
+	}
+	password, err := readSecret("Password: ")
+	l.password = string(password)
+	return l.password, err
+}
+
+// Ask for something on the terminal without showing what's typed
+func readSecret(prompt string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, errors.New("there's no terminal to ask for it on")
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	secret, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return secret, err
+}
+
+func fileExists(file string) bool {
+	_, err := os.Stat(file)
+	return err == nil
+}
+
+// How the server's host key is checked: against a fingerprint or known_hosts,
+// or not at all
+type hostKeyCheck struct {
+	file  string
+	known ssh.HostKeyCallback // From known_hosts
+	check ssh.HostKeyCallback
+}
+
+func newHostKeyCheck(knownHostsFile, fingerprint string, insecure bool) (*hostKeyCheck, error) {
+	if insecure {
+		return &hostKeyCheck{check: ssh.InsecureIgnoreHostKey()}, nil
+	}
+	if len(fingerprint) > 0 {
+		return &hostKeyCheck{check: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if got := ssh.FingerprintSHA256(key); got != fingerprint {
+				return fmt.Errorf("the host key of %s is %s, not %s", hostname, got, fingerprint)
+			}
+			return nil
+		}}, nil
+	}
+	if len(knownHostsFile) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	h := &hostKeyCheck{file: knownHostsFile}
+	if fileExists(knownHostsFile) {
+		var err error
+		if h.known, err = knownhosts.New(knownHostsFile); err != nil {
+			return nil, err
+		}
+	}
+	h.check = h.checkKnownHosts
+	return h, nil
+}
+
+func (h *hostKeyCheck) checkKnownHosts(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if h.known == nil {
+		return fmt.Errorf("can't check the host key of %s without %s, pass -fingerprint %s if it's the right one",
+			hostname, h.file, ssh.FingerprintSHA256(key))
+	}
+	err := h.known(hostname, remote, key)
+	var keyErr *knownhosts.KeyError
+	if errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+		return fmt.Errorf("%s isn't in %s, pass -fingerprint %s if that's its host key",
+			hostname, h.file, ssh.FingerprintSHA256(key))
+	}
+	if errors.As(err, &keyErr) {
+		return fmt.Errorf("the host key of %s (%s) isn't the one in %s, someone could be impersonating it",
+			hostname, ssh.FingerprintSHA256(key), h.file)
+	}
+	return err
+}
+
+// The kinds of host keys known_hosts has for addr, so the server doesn't show
+// another one it has that we don't know about
+func (h *hostKeyCheck) algorithms(addr string) []string {
+	if h.known == nil {
+		return nil
+	}
+	var keyErr *knownhosts.KeyError
+	if err := h.known(addr, &net.TCPAddr{}, unknownKey{}); !errors.As(err, &keyErr) {
+		return nil
+	}
+	var algorithms []string
+	for _, known := range keyErr.Want {
+		switch keyType := known.Key.Type(); keyType {
+		case ssh.KeyAlgoRSA:
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algorithms = append(algorithms, keyType)
+		}
+	}
+	slices.Sort(algorithms)
+	return slices.Compact(algorithms)
+}
+
+// Log in to the server at loc
+func dialSSHServer(loc location, port string, hostKeys *hostKeyCheck, login *clientLogin) (*ssh.Client, error) {
+	user := loc.user
+	if len(user) == 0 {
+		user = currentUsername()
+	}
+	auth, err := login.authMethods()
+	if err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(loc.host, port)
+	return ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:              user,
+		Auth:              auth,
+		HostKeyCallback:   hostKeys.check,
+		HostKeyAlgorithms: hostKeys.algorithms(addr),
+		Timeout:           30 * time.Second,
+	})
+}
+
+// A key nobody has, to find out which ones known_hosts has
+type unknownKey struct{}
+
+func (unknownKey) Type() string                                 { return "unknown" }
+func (unknownKey) Marshal() []byte                              { return []byte("unknown") }
+func (unknownKey) Verify(data []byte, sig *ssh.Signature) error { return errors.New("unknown key") }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jjch99/simplescp/simplescptest"
+)
+
+func TestParseLocation(t *testing.T) {
+	for s, expected := range map[string]location{
+		"file.txt":                 {path: "file.txt"},
+		"./file:name":              {path: "./file:name"},
+		"/tmp/a:b":                 {path: "/tmp/a:b"},
+		"host:":                    {host: "host", path: "."},
+		"host:dir/file":            {host: "host", path: "dir/file"},
+		"alice@host:file":          {user: "alice", host: "host", path: "file"},
+		"alice@host":               {path: "alice@host"},
+		"[::1]:file":               {host: "::1", path: "file"},
+		"alice@[fe80::1%eth0]:dir": {user: "alice", host: "fe80::1%eth0", path: "dir"},
+		"[::1]":                    {path: "[::1]"},
+		":file":                    {path: ":file"},
+	} {
+		if loc := parseLocation(s); loc != expected {
+			t.Errorf("%s parsed to %+v, expected %+v", s, loc, expected)
+		}
+	}
+}
+
+// A few files in a directory to copy, with a modification time -p keeps
+func makeTestTree(t *testing.T) (string, time.Time) {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "tree")
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("aaa"), 0644)
+	os.WriteFile(filepath.Join(dir, "sub", "b.txt"), []byte("bb"), 0600)
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	os.Chtimes(filepath.Join(dir, "a.txt"), mtime, mtime)
+	return dir, mtime
+}
+
+func checkTestTree(t *testing.T, dir string, mtime time.Time) {
+	t.Helper()
+	for name, expected := range map[string]string{"a.txt": "aaa", "sub/b.txt": "bb"} {
+		if contents, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(contents) != expected {
+			t.Errorf("%s has %q (%v), expected %q", name, contents, err, expected)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(dir, "a.txt")); err != nil || !info.ModTime().Equal(mtime) {
+		t.Errorf("Modification time wasn't kept: %v", err)
+	}
+}
+
+func TestCopySFTP(t *testing.T) {
+	server := simplescptest.NewServer(t)
+	alice := server.AddUser(t, "alice")
+	client := server.DialSFTP(t, alice)
+	src, mtime := makeTestTree(t)
+
+	c := copier{recursive: true, preserve: true}
+	c.copy(localFS{}, src, sftpFS{client}, "/tree")
+	if c.failed {
+		t.Fatal("Upload failed")
+	}
+	checkTestTree(t, filepath.Join(alice.Dir, "tree"), mtime)
+
+	dst := filepath.Join(t.TempDir(), "copy")
+	c.copy(sftpFS{client}, "/tree", localFS{}, dst)
+	if c.failed {
+		t.Fatal("Download failed")
+	}
+	checkTestTree(t, dst, mtime)
+
+	// Directories need -r
+	c = copier{}
+	c.copy(localFS{}, src, sftpFS{client}, "/other")
+	if !c.failed {
+		t.Error("Directory copied without -r")
+	}
+}
+
+func TestCopySCP(t *testing.T) {
+	server := simplescptest.NewServer(t)
+	alice := server.AddUser(t, "alice")
+	conn := server.Dial(t, alice)
+	src, mtime := makeTestTree(t)
+
+	c := copier{recursive: true, preserve: true}
+	c.copySCP(conn, []location{{path: src}}, location{host: "server", path: "it's here"})
+	if c.failed {
+		t.Fatal("Upload failed")
+	}
+	checkTestTree(t, filepath.Join(alice.Dir, "it's here"), mtime)
+
+	// Into a directory that's there, with the names they had
+	dst := t.TempDir()
+	c.copySCP(conn, []location{{host: "server", path: "it's here"}}, location{path: dst})
+	if c.failed {
+		t.Fatal("Download failed")
+	}
+	checkTestTree(t, filepath.Join(dst, "it's here"), mtime)
+
+	// A file that isn't there doesn't stop the others
+	dst = t.TempDir()
+	c.copySCP(conn, []location{{host: "server", path: "missing"}, {host: "server", path: "it's here/a.txt"}}, location{path: dst})
+	if !c.failed {
+		t.Error("Downloading a missing file didn't fail")
+	}
+	if contents, err := os.ReadFile(filepath.Join(dst, "a.txt")); err != nil || string(contents) != "aaa" {
+		t.Errorf("Got %q (%v) after a missing file", contents, err)
+	}
+}
+
+// What a server could send scp clients to write files where they weren't asked to
+func TestSCPReceiveNames(t *testing.T) {
+	for _, stream := range []string{
+		"C0644 3 ../evil\n",
+		"C0644 3 ..\n",
+		"C0644 3 sub/evil\n",
+		"C0644 3 sub\\evil\n",
+		"D0755 0 .\n",
+		// Not what was asked for
+		"C0644 3 .bashrc\n",
+	} {
+		dst := t.TempDir()
+		s := scpReceiver{copier: &copier{recursive: true}, w: io.Discard, r: bufio.NewReader(strings.NewReader(stream + "bad\x00")), sources: []string{"dir/*.txt"}}
+		if err := s.receive(dst); err == nil {
+			t.Errorf("%q received", stream)
+		}
+		if entries, _ := os.ReadDir(dst); len(entries) > 0 {
+			t.Errorf("%q wrote %s", stream, entries[0].Name())
+		}
+	}
+
+	dst := t.TempDir()
+	s := scpReceiver{copier: &copier{}, w: io.Discard, r: bufio.NewReader(strings.NewReader("C0644 3 a.txt\nabc\x00")), sources: []string{"dir/*.txt"}}
+	if err := s.receive(dst); err != nil || s.failed {
+		t.Errorf("Matching file not received: %v", err)
+	}
+}
+
+// Lists made up names in a directory, like a server could
+type badNamesFS struct {
+	localFS
+	names []string
+}
+
+func (f badNamesFS) ReadDir(name string) ([]fs.FileInfo, error) {
+	var entries []fs.FileInfo
+	for _, n := range f.names {
+		entries = append(entries, scpFileInfo{name: n, mode: 0644})
+	}
+	return entries, nil
+}
+
+func TestCopyDirNames(t *testing.T) {
+	src := t.TempDir()
+	os.WriteFile(filepath.Join(src, "ok.txt"), []byte("ok"), 0644)
+	parent := t.TempDir()
+	dst := filepath.Join(parent, "dst")
+
+	c := copier{recursive: true}
+	c.copy(badNamesFS{names: []string{"..", ".", "../escaped", `..\escaped`, "ok.txt"}}, src, localFS{}, dst)
+	if !c.failed {
+		t.Error("Bad names didn't fail")
+	}
+	if entries, _ := os.ReadDir(parent); len(entries) != 1 {
+		t.Errorf("Files copied next to the destination: %v", entries)
+	}
+	if contents, err := os.ReadFile(filepath.Join(dst, "ok.txt")); err != nil || string(contents) != "ok" {
+		t.Errorf("Got %q (%v) for the file with a good name", contents, err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// The files on either side of a copy, local ones or the server's
+type cpFS interface {
+	Stat(name string) (fs.FileInfo, error)
+	ReadDir(name string) ([]fs.FileInfo, error)
+	Open(name string) (io.ReadCloser, error)
+	Create(name string, perm fs.FileMode) (io.WriteCloser, error)
+	Mkdir(name string, perm fs.FileMode) error
+	Chmod(name string, mode fs.FileMode) error
+	Chtimes(name string, atime, mtime time.Time) error
+	Join(elem ...string) string
+	Base(name string) string
+}
+
+type localFS struct{}
+
+func (localFS) Stat(name string) (fs.FileInfo, error) { return os.Stat(name) }
+
+func (localFS) ReadDir(name string) ([]fs.FileInfo, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdir(-1)
+}
+
+func (localFS) Open(name string) (io.ReadCloser, error) { return os.Open(name) }
+
+func (localFS) Create(name string, perm fs.FileMode) (io.WriteCloser, error) {
+	return os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+}
+
+func (localFS) Mkdir(name string, perm fs.FileMode) error { return os.Mkdir(name, perm) }
+
+func (localFS) Chmod(name string, mode fs.FileMode) error { return os.Chmod(name, mode) }
+
+func (localFS) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (localFS) Join(elem ...string) string { return filepath.Join(elem...) }
+
+func (localFS) Base(name string) string { return filepath.Base(name) }
+
+// The server's files, over sftp. New files and directories get the server's
+// default mode, which is what -p is for
+type sftpFS struct {
+	*sftp.Client
+}
+
+func (s sftpFS) Open(name string) (io.ReadCloser, error) { return s.Client.Open(name) }
+
+func (s sftpFS) Create(name string, perm fs.FileMode) (io.WriteCloser, error) {
+	return s.Client.Create(name)
+}
+
+func (s sftpFS) Mkdir(name string, perm fs.FileMode) error { return s.Client.Mkdir(name) }
+
+func (sftpFS) Base(name string) string { return path.Base(name) }
+
+// Copies files and directories, carrying on with the rest when one can't be
+type copier struct {
+	recursive bool
+	preserve  bool
+	failed    bool
+}
+
+func (c *copier) fail(name string, err error) {
+	slog.Error("Can't copy", "file", name, "err", err)
+	c.failed = true
+}
+
+// Copy src to dst, which is what it'll be called (not the directory it goes in)
+func (c *copier) copy(from cpFS, src string, to cpFS, dst string) {
+	info, err := from.Stat(src)
+	if err != nil {
+		c.fail(src, err)
+		return
+	}
+	switch {
+	case info.IsDir() && !c.recursive:
+		c.fail(src, errors.New("it's a directory, use -r to copy it"))
+	case info.IsDir():
+		c.copyDir(from, src, to, dst, info)
+	case info.Mode().IsRegular():
+		c.copyFile(from, src, to, dst, info)
+	default:
+		c.fail(src, errors.New("not a regular file"))
+	}
+}
+
+func (c *copier) copyFile(from cpFS, src string, to cpFS, dst string, info fs.FileInfo) {
+	r, err := from.Open(src)
+	if err != nil {
+		c.fail(src, err)
+		return
+	}
+	defer r.Close()
+	w, err := to.Create(dst, info.Mode().Perm())
+	if err != nil {
+		c.fail(dst, err)
+		return
+	}
+	_, err = io.Copy(w, r)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		c.fail(src, err)
+		return
+	}
+	c.keepAttributes(to, dst, info)
+}
+
+func (c *copier) copyDir(from cpFS, src string, to cpFS, dst string, info fs.FileInfo) {
+	if existing, err := to.Stat(dst); err == nil && !existing.IsDir() {
+		c.fail(src, fmt.Errorf("%s is there already and isn't a directory", dst))
+		return
+	} else if err != nil {
+		// Writable by us for now, so it can be filled in
+		if err := to.Mkdir(dst, info.Mode().Perm()|0700); err != nil {
+			c.fail(dst, err)
+			return
+		}
+	}
+	entries, err := from.ReadDir(src)
+	if err != nil {
+		c.fail(src, err)
+		return
+	}
+	for _, entry := range entries {
+		// The server picks the names, which mustn't take the copy out of dst
+		if !safeName(entry.Name()) {
+			c.fail(src, fmt.Errorf("it has an entry called %q", entry.Name()))
+			continue
+		}
+		name := from.Join(src, entry.Name())
+		// Symlinks to files are followed like scp does, but not to
+		// directories, which could lead back up to this one
+		if entry.Mode()&fs.ModeSymlink != 0 {
+			if target, err := from.Stat(name); err == nil && target.IsDir() {
+				slog.Warn("Skipping symlink to a directory", "file", name)
+				continue
+			}
+		}
+		c.copy(from, name, to, to.Join(dst, entry.Name()))
+	}
+	c.keepAttributes(to, dst, info)
+}
+
+// Whether name can be the name of a file in a directory, and nothing else
+func safeName(name string) bool {
+	return len(name) > 0 && name != "." && name != ".." && !strings.ContainsAny(name, "/\\")
+}
+
+// With -p copies get the mode and modification time of the originals
+func (c *copier) keepAttributes(to cpFS, dst string, info fs.FileInfo) {
+	if !c.preserve {
+		return
+	}
+	if err := to.Chmod(dst, info.Mode().Perm()); err != nil {
+		c.fail(dst, err)
+	}
+	if err := to.Chtimes(dst, info.ModTime(), info.ModTime()); err != nil {
+		c.fail(dst, err)
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Start scp on the server with args
+func startSCP(c *ssh.Client, args string) (*ssh.Session, io.WriteCloser, *bufio.Reader, error) {
+	session, err := c.NewSession()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, nil, nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, nil, nil, err
+	}
+	if err := session.Start("scp " + args); err != nil {
+		session.Close()
+		return nil, nil, nil, err
+	}
+	return session, stdin, bufio.NewReader(stdout), nil
+}
+
+// An error the other side of scp carries on after, about one of the files
+type scpWarning struct {
+	error
+}
+
+// Wait for the other side to say it's ready for more
+func scpAck(r *bufio.Reader) error {
+	b, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b != 0 {
+		msg, _ := r.ReadString('\n')
+		err := errors.New(strings.TrimSpace(msg))
+		if b == 1 {
+			return scpWarning{err}
+		}
+		return err
+	}
+	return nil
+}
+
+// Run the steps of a transfer, then let the server finish and send its exit
+// status (which is an error too if it failed)
+func finishSCP(session *ssh.Session, stdin io.WriteCloser, steps func() error) error {
+	err := steps()
+	stdin.Close()
+	if werr := session.Wait(); err == nil {
+		err = werr
+	}
+	return err
+}
+
+// Quote s for the server's shell, which splits the scp command line
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Copy sources to dst with the server's scp, for servers that don't have
+// sftp. One of them is on the server, the other local
+func (c *copier) copySCP(conn *ssh.Client, sources []location, dst location) {
+	args := "-f"
+	if len(dst.host) > 0 {
+		args = "-t"
+		if len(sources) > 1 {
+			args += " -d"
+		}
+	}
+	if c.recursive {
+		args += " -r"
+	}
+	if c.preserve {
+		args += " -p"
+	}
+	args += " --"
+	var paths []string
+	for _, src := range sources {
+		paths = append(paths, src.path)
+	}
+	if len(dst.host) > 0 {
+		args += " " + shellQuote(dst.path)
+	} else {
+		for _, p := range paths {
+			args += " " + shellQuote(p)
+		}
+	}
+
+	session, stdin, r, err := startSCP(conn, args)
+	if err != nil {
+		c.fail(dst.path, err)
+		return
+	}
+	defer session.Close()
+	err = finishSCP(session, stdin, func() error {
+		if len(dst.host) > 0 {
+			s := scpSender{copier: c, w: stdin, r: r}
+			return s.sendAll(paths)
+		}
+		s := scpReceiver{copier: c, w: stdin, r: r, sources: paths}
+		return s.receive(dst.path)
+	})
+	// The server exits with an error for the files it's told us about too
+	if err != nil && !c.failed {
+		c.fail(dst.path, err)
+	}
+}
+
+// Sends local files to scp -t on the server
+type scpSender struct {
+	*copier
+	w io.Writer
+	r *bufio.Reader
+}
+
+// Send each of names. Returns an error when the copy can't go on at all,
+// ones about a file are just reported
+func (s scpSender) sendAll(names []string) error {
+	if err := scpAck(s.r); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := s.send(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s scpSender) send(name string) error {
+	info, err := os.Stat(name)
+	if err != nil {
+		s.fail(name, err)
+		return nil
+	}
+	if strings.ContainsAny(info.Name(), "\r\n") {
+		s.fail(name, errors.New("its name can't be sent over scp"))
+		return nil
+	}
+	switch {
+	case info.IsDir() && !s.recursive:
+		s.fail(name, errors.New("it's a directory, use -r to copy it"))
+		return nil
+	case info.IsDir():
+		return s.sendDir(name, info)
+	case info.Mode().IsRegular():
+		return s.sendFile(name, info)
+	}
+	s.fail(name, errors.New("not a regular file"))
+	return nil
+}
+
+// Send a line of the protocol about name, and wait for the server to take it
+func (s scpSender) record(name, format string, args ...any) (bool, error) {
+	if _, err := fmt.Fprintf(s.w, format, args...); err != nil {
+		return false, err
+	}
+	return s.ack(name)
+}
+
+// Whether the server's ready for more about name. If it isn't, the error's
+// only returned when it won't take anything else either
+func (s scpSender) ack(name string) (bool, error) {
+	err := scpAck(s.r)
+	if errors.As(err, new(scpWarning)) {
+		s.fail(name, err)
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// With -p, the times the next file or directory is to have
+func (s scpSender) times(name string, info fs.FileInfo) (bool, error) {
+	if !s.preserve {
+		return true, nil
+	}
+	mtime := info.ModTime().Unix()
+	return s.record(name, "T%d 0 %d 0\n", mtime, mtime)
+}
+
+func (s scpSender) sendFile(name string, info fs.FileInfo) error {
+	f, err := os.Open(name)
+	if err != nil {
+		s.fail(name, err)
+		return nil
+	}
+	defer f.Close()
+	if ok, err := s.times(name, info); !ok {
+		return err
+	}
+	if ok, err := s.record(name, "C%04o %d %s\n", info.Mode().Perm(), info.Size(), info.Name()); !ok {
+		return err
+	}
+	n, err := io.Copy(s.w, io.LimitReader(f, info.Size()))
+	if err == nil && n < info.Size() {
+		// The server's waiting for the rest of what it was told it'd get
+		err = fmt.Errorf("%s got smaller while it was being sent", name)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := s.w.Write([]byte{0}); err != nil {
+		return err
+	}
+	_, err = s.ack(name)
+	return err
+}
+
+func (s scpSender) sendDir(name string, info fs.FileInfo) error {
+	entries, err := localFS{}.ReadDir(name)
+	if err != nil {
+		s.fail(name, err)
+		return nil
+	}
+	if ok, err := s.times(name, info); !ok {
+		return err
+	}
+	if ok, err := s.record(name, "D%04o 0 %s\n", info.Mode().Perm(), info.Name()); !ok {
+		return err
+	}
+	for _, entry := range entries {
+		entryName := filepath.Join(name, entry.Name())
+		// Like copying over sftp, symlinks to directories aren't followed
+		if entry.Mode()&fs.ModeSymlink != 0 {
+			if target, err := os.Stat(entryName); err == nil && target.IsDir() {
+				slog.Warn("Skipping symlink to a directory", "file", entryName)
+				continue
+			}
+		}
+		if err := s.send(entryName); err != nil {
+			return err
+		}
+	}
+	_, err = s.record(name, "E\n")
+	return err
+}
+
+// Takes in files from scp -f on the server
+type scpReceiver struct {
+	*copier
+	w       io.Writer
+	r       *bufio.Reader
+	sources []string // What was asked for, which is all the server may send
+}
+
+// A directory being received, and what it's to be like once it's filled in
+type scpDir struct {
+	path string
+	info scpFileInfo
+	skip bool // It couldn't be made, what's in it is thrown away
+}
+
+// What scp tells about a file or directory before sending it
+type scpFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i scpFileInfo) Name() string       { return i.name }
+func (i scpFileInfo) Size() int64        { return i.size }
+func (i scpFileInfo) Mode() fs.FileMode  { return i.mode }
+func (i scpFileInfo) ModTime() time.Time { return i.modTime }
+func (i scpFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i scpFileInfo) Sys() any           { return nil }
+
+// Receive what the server sends into dst, which is what the file's called
+// unless it's a directory already
+func (s scpReceiver) receive(dst string) error {
+	existing, err := os.Stat(dst)
+	toDir := err == nil && existing.IsDir()
+	var dirs []scpDir
+	var modTime time.Time
+	if _, err := s.w.Write([]byte{0}); err != nil {
+		return err
+	}
+	for {
+		line, err := s.r.ReadString('\n')
+		if err == io.EOF && len(line) == 0 && len(dirs) == 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		kind, rest := line[0], strings.TrimSuffix(line[1:], "\n")
+		switch kind {
+		case 1:
+			// Like a file that isn't there, there may be others that are
+			s.fail(dst, errors.New(rest))
+			continue
+		case 2:
+			return errors.New(rest)
+		case 'T':
+			var mtime, atime int64
+			if _, err := fmt.Sscanf(rest, "%d 0 %d 0", &mtime, &atime); err != nil {
+				return fmt.Errorf("the server sent invalid times %q", rest)
+			}
+			modTime = time.Unix(mtime, 0)
+		case 'E':
+			if len(dirs) == 0 {
+				return errors.New("the server ended a directory it hadn't started")
+			}
+			dir := dirs[len(dirs)-1]
+			dirs = dirs[:len(dirs)-1]
+			if !dir.skip {
+				s.keepAttributes(localFS{}, dir.path, dir.info)
+			}
+		case 'C', 'D':
+			info, err := parseSCPRecord(rest)
+			if err != nil {
+				return err
+			}
+			info.modTime, modTime = modTime, time.Time{}
+			target := dst
+			skip := false
+			switch {
+			case len(dirs) > 0:
+				target = filepath.Join(dirs[len(dirs)-1].path, info.name)
+				skip = dirs[len(dirs)-1].skip
+			case toDir:
+				// Only what was asked for can be put in it
+				if !s.requested(info.name) {
+					return fmt.Errorf("the server sent %q, which wasn't asked for", info.name)
+				}
+				target = filepath.Join(dst, info.name)
+			}
+			if kind == 'D' {
+				if !s.recursive {
+					return fmt.Errorf("the server sent directory %q without -r", info.name)
+				}
+				info.mode |= fs.ModeDir
+				dirs = append(dirs, scpDir{path: target, info: info, skip: skip || !s.makeDir(target, info)})
+				if _, err := s.w.Write([]byte{0}); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := s.receiveFile(target, info, skip); err != nil {
+				return err
+			}
+			continue
+		default:
+			return fmt.Errorf("the server sent %q, which isn't scp", strings.TrimSpace(line))
+		}
+		if _, err := s.w.Write([]byte{0}); err != nil {
+			return err
+		}
+	}
+}
+
+// Parse the mode, size and name of a C or D line
+func parseSCPRecord(rest string) (scpFileInfo, error) {
+	fields := strings.SplitN(rest, " ", 3)
+	if len(fields) < 3 {
+		return scpFileInfo{}, fmt.Errorf("the server sent an invalid file %q", rest)
+	}
+	mode, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil {
+		return scpFileInfo{}, fmt.Errorf("the server sent an invalid mode %q", fields[0])
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < 0 {
+		return scpFileInfo{}, fmt.Errorf("the server sent an invalid size %q", fields[1])
+	}
+	// The name's picked by the server, and it mustn't take the copy out of dst
+	if !safeName(fields[2]) {
+		return scpFileInfo{}, fmt.Errorf("the server sent a file called %q", fields[2])
+	}
+	return scpFileInfo{name: fields[2], size: size, mode: fs.FileMode(mode).Perm()}, nil
+}
+
+// Whether name is one of the files the server was asked for, or matches
+// one of the patterns it was
+func (s scpReceiver) requested(name string) bool {
+	for _, src := range s.sources {
+		if ok, _ := path.Match(path.Base(src), name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Make a directory to receive into like copying over sftp does. Whether it's there
+func (s scpReceiver) makeDir(name string, info scpFileInfo) bool {
+	if existing, err := os.Stat(name); err == nil && !existing.IsDir() {
+		s.fail(name, errors.New("it's there already and isn't a directory"))
+		return false
+	} else if err != nil {
+		if err := os.Mkdir(name, info.mode.Perm()|0700); err != nil {
+			s.fail(name, err)
+			return false
+		}
+	}
+	return true
+}
+
+// Write a file the server's sending to name, or throw it away. What goes
+// wrong on our side doesn't concern the server, it's just told to carry on
+func (s scpReceiver) receiveFile(name string, info scpFileInfo, skip bool) error {
+	var f io.WriteCloser
+	w := &scpFileWriter{}
+	if !skip {
+		var err error
+		if f, err = (localFS{}).Create(name, info.mode); err != nil {
+			s.fail(name, err)
+		} else {
+			w.w = f
+		}
+	}
+	if _, err := s.w.Write([]byte{0}); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(w, s.r, info.size); err != nil {
+		return err
+	}
+	// Then whether the server managed to send all of it
+	err := scpAck(s.r)
+	if err != nil && !errors.As(err, new(scpWarning)) {
+		return err
+	}
+	if f != nil {
+		if cerr := f.Close(); w.err == nil {
+			w.err = cerr
+		}
+		switch {
+		case err != nil:
+			s.fail(name, err)
+		case w.err != nil:
+			s.fail(name, w.err)
+		default:
+			s.keepAttributes(localFS{}, name, info)
+		}
+	}
+	_, err = s.w.Write([]byte{0})
+	return err
+}
+
+// Writes to a file until that fails, then throws the rest away so the
+// transfer can go on
+type scpFileWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *scpFileWriter) Write(p []byte) (int, error) {
+	if w.w != nil && w.err == nil {
+		_, w.err = w.w.Write(p)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	osuser "os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/jjch99/simplescp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Generate a host key, or a client's key pair, so setting up a server (and
+// trying it out) doesn't need ssh-keygen
+func genkey(args []string) {
+	flags := flag.NewFlagSet("genkey", flag.ExitOnError)
+	keyType := flags.String("type", "ed25519", "Key type: ed25519, ecdsa or rsa")
+	bits := flags.Int("bits", 0, "Size of RSA keys (default 3072) or ECDSA ones (256, 384 or 521, default 256)")
+	out := flags.String("out", "", "File to save the private key to, the public key goes next to it with .pub added. Default: ssh_host_<type>_key, or id_<type> with -client")
+	client := flags.Bool("client", false, "Make a key for a client to log in with instead of a host key")
+	comment := flags.String("comment", "", "Comment saved with the key. Default: user@host for client keys")
+	authKeys := flags.String("authorized-keys", "", "authorized_keys file to add the public key to, so the client can log in with it")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s genkey [flags]\n", filepath.Base(os.Args[0]))
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	file := *out
+	if len(file) == 0 {
+		file = "ssh_host_" + *keyType + "_key"
+		if *client {
+			file = "id_" + *keyType
+		}
+	}
+	opts := simplescp.KeyOptions{Type: *keyType, Bits: *bits, Comment: *comment}
+	if *client && len(opts.Comment) == 0 {
+		opts.Comment = defaultKeyComment()
+	}
+	signer, err := simplescp.GenerateKeyFile(file, opts)
+	if err != nil {
+		fatal("Can't generate key", err)
+	}
+	fmt.Printf("Saved %s key to %s and its public key to %s.pub\n", signer.PublicKey().Type(), file, file)
+	fmt.Println(ssh.FingerprintSHA256(signer.PublicKey()))
+
+	if len(*authKeys) > 0 {
+		f, err := os.OpenFile(*authKeys, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err == nil {
+			_, err = f.Write(simplescp.AuthorizedKey(signer.PublicKey(), opts.Comment))
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			fatal("Can't add key to authorized keys", err)
+		}
+		fmt.Printf("Added it to %s\n", *authKeys)
+	}
+}
+
+// user@host, like ssh-keygen puts on keys
+func defaultKeyComment() string {
+	name := currentUsername()
+	host, err := os.Hostname()
+	if err != nil {
+		return name
+	}
+	return name + "@" + host
+}
+
+// The name of the user we're running as
+func currentUsername() string {
+	u, err := osuser.Current()
+	if err != nil {
+		return "user"
+	}
+	// Windows usernames come with the domain or computer name
+	return u.Username[strings.LastIndex(u.Username, `\`)+1:]
+}
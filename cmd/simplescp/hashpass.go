@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/jjch99/simplescp"
+)
+
+// Hash a password for the config or the user database, so it doesn't have to
+// be kept there in plain text
+func hashpass(args []string) {
+	flags := flag.NewFlagSet("hashpass", flag.ExitOnError)
+	algorithm := flags.String("algorithm", "argon2id", "Hash to make: argon2id or bcrypt")
+	cost := flags.Int("cost", 0, "bcrypt cost. Default: 10")
+	passwordStdin := flags.Bool("password-stdin", false, "Read the password from stdin instead of asking for it")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s hashpass [flags]\n", filepath.Base(os.Args[0]))
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if *algorithm != "argon2id" && *algorithm != "bcrypt" {
+		fatal("Can't hash password", fmt.Errorf("unknown algorithm %q, it should be argon2id or bcrypt", *algorithm))
+	}
+
+	password, err := readNewPassword(*passwordStdin, "Password: ")
+	if err == nil && len(password) == 0 {
+		err = errors.New("the password is empty")
+	}
+	if err != nil {
+		fatal("Can't read password", err)
+	}
+	var hash string
+	if *algorithm == "bcrypt" {
+		hash, err = simplescp.HashPasswordBcrypt(password, *cost)
+	} else {
+		hash, err = simplescp.HashPassword(password)
+	}
+	if err != nil {
+		fatal("Can't hash password", err)
+	}
+	fmt.Println(hash)
+}
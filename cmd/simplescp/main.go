@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"github.com/jjch99/simplescp"
+)
+
+// Flags of serve, which is also what runs without a subcommand
+var (
+	serveFlags    = flag.NewFlagSet("serve", flag.ExitOnError)
+	configFile    = serveFlags.String("config", "", "YAML or TOML file to load settings from")
+	dir           = serveFlags.String("dir", "", "Directory to share")
+	port          = serveFlags.String("port", "", "Port to listen on")
+	listen        = serveFlags.String("listen", "", "Addresses to listen on, comma separated (e.g. 127.0.0.1:22,[::1]:2222)")
+	user          = serveFlags.String("user", "", "Username allowed to log in")
+	privateKey    = serveFlags.String("private-key", "", "Private key identifying this server")
+	authKeys      = serveFlags.String("authorized-keys", "", "Authorized keys file for pubkey authentication")
+	shutdownGrace = serveFlags.Duration("shutdown-grace", 0, "How long to wait for active sessions when shutting down")
+	logLevel      = serveFlags.String("log-level", "", "Log level: debug, info, warn or error")
+	logFormat     = serveFlags.String("log-format", "", "Log format: text or json")
+	backend       = serveFlags.String("backend", "", "Where files are stored: os, s3, gcs, azure or mem")
+	service       = serveFlags.String("service", "", "Manage the Windows service: install, uninstall, start or stop")
+	pprofOn       = serveFlags.Bool("pprof", false, "Serve profiles under /debug/pprof/ in the admin API")
+	maxRate       simplescp.ByteSize
+)
+
+func init() {
+	serveFlags.TextVar(&maxRate, "max-rate", simplescp.ByteSize(0), "Bandwidth limit for each session in bytes per second (e.g. 10M)")
+}
+
+// Flags that have been explicitly set take precedence over the config file and environment
+func applyFlags(config *simplescp.Config) {
+	serveFlags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "dir":
+			config.Dir = *dir
+		case "port":
+			config.Port = *port
+		case "listen":
+			config.Listen = strings.Split(*listen, ",")
+		case "user":
+			config.User = *user
+		case "private-key":
+			config.PrivateKeyFile = *privateKey
+		case "authorized-keys":
+			config.AuthKeysFile = *authKeys
+		case "shutdown-grace":
+			config.ShutdownGrace = *shutdownGrace
+		case "max-rate":
+			config.MaxRate = maxRate
+		case "log-level":
+			config.LogLevel = *logLevel
+		case "log-format":
+			config.LogFormat = *logFormat
+		case "backend":
+			config.Backend = *backend
+		case "pprof":
+			config.Admin.Pprof = *pprofOn
+		}
+	})
+}
+
+// A subcommand, run with the arguments after its name
+type command struct {
+	name    string
+	summary string
+	run     func(args []string)
+}
+
+var commands = []command{
+	{"serve", "Serve scp and sftp (what runs without a subcommand)", serve},
+	{"genkey", "Generate a host key", genkey},
+	{"adduser", "Add a user to the user database", adduser},
+	{"hashpass", "Hash a password for the config or user database", hashpass},
+	{"checkconfig", "Check the config without starting the server", checkconfig},
+	{"cp", "Copy files to or from an SSH server over sftp or scp", cp},
+	{"bench", "Measure transfer speeds against a server started for it", bench},
+	{"replay", "Play back a session recorded in record_dir", replay},
+	{"version", "Print the version", version},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", filepath.Base(os.Args[0]))
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun %s <command> -h for the flags of each one\n", filepath.Base(os.Args[0]))
+}
+
+func main() {
+	// Just flags, the way it was run before there were subcommands
+	if len(os.Args) < 2 || (strings.HasPrefix(os.Args[1], "-") && os.Args[1] != "-h" && os.Args[1] != "-help" && os.Args[1] != "--help") {
+		serve(os.Args[1:])
+		return
+	}
+	for _, c := range commands {
+		if c.name == os.Args[1] {
+			c.run(os.Args[2:])
+			return
+		}
+	}
+	if os.Args[1] == "help" || strings.HasPrefix(os.Args[1], "-") {
+		usage()
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", os.Args[1])
+	usage()
+	os.Exit(2)
+}
+
+// Run the server until it's shut down
+func serve(args []string) {
+	serveFlags.Parse(args)
+	if serveFlags.NArg() > 0 {
+		fatal("Can't serve", fmt.Errorf("unexpected arguments %v", serveFlags.Args()))
+	}
+
+	if len(*service) > 0 {
+		if err := controlService(*service); err != nil {
+			fatal("Can't "+*service+" service", err)
+		}
+		return
+	}
+	inService := isWindowsService()
+	if inService {
+		if err := redirectServiceLogs(); err != nil {
+			fatal("Can't open log file", err)
+		}
+	}
+
+	config, err := simplescp.ReadConfig(*configFile)
+	if err != nil {
+		fatal("Can't read config", err)
+	}
+	applyFlags(config)
+
+	err = config.Init()
+	if err != nil {
+		fatal("Can't initialize config", err)
+	}
+	slog.SetDefault(config.Logger)
+
+	server := simplescp.NewServer(config)
+	if inService {
+		runService(server)
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleSignals(server)
+	}()
+
+	err = server.ListenAndServe()
+	if err != simplescp.ErrServerClosed {
+		fatal("Failed to serve connections", err)
+	}
+	// Shutting down on a signal, or a Drain through the control service
+	select {
+	case <-done:
+	case <-server.Done():
+	}
+	slog.Info("Server stopped")
+}
+
+// Re-read the config file and swap it into the running server
+func reload(server *simplescp.Server) {
+	config, err := simplescp.ReadConfig(*configFile)
+	if err != nil {
+		slog.Error("Not reloading config", "err", err)
+		return
+	}
+	applyFlags(config)
+
+	err = server.Reload(config)
+	if err != nil {
+		slog.Error("Not reloading config", "err", err)
+		return
+	}
+	slog.SetDefault(server.Config().Logger)
+}
+
+// Stop accepting connections and wait up to ShutdownGrace for active sessions
+// to finish before closing them
+func shutdown(server *simplescp.Server, logArgs ...any) {
+	grace := server.Config().ShutdownGrace
+	slog.Info("Waiting for active sessions to finish", append(logArgs, "grace", grace.String())...)
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		slog.Warn("Closed remaining sessions after grace period", "err", err)
+	}
+}
+
+// Play back a recorded session
+func replay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := flags.Float64("speed", 0, "Play it back this many times as fast as it went, 0 to write it out at once")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s replay [flags] <file>\n", filepath.Base(os.Args[0]))
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fatal("Can't replay session", err)
+	}
+	defer f.Close()
+	if err := simplescp.ReplayRecording(f, os.Stdout, *speed); err != nil {
+		fatal("Can't replay session", err)
+	}
+}
+
+// Print the version simplescp was built as, with the commit it was built from
+func version(args []string) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		fmt.Println("simplescp (unknown version)", runtime.Version())
+		return
+	}
+	v := info.Main.Version
+	settings := make(map[string]string)
+	for _, s := range info.Settings {
+		settings[s.Key] = s.Value
+	}
+	// Binaries built in a checkout don't get a version, only the commit
+	if revision := settings["vcs.revision"]; v == "(devel)" && len(revision) > 0 {
+		v += " " + revision[:min(12, len(revision))]
+		if settings["vcs.modified"] == "true" {
+			v += "-dirty"
+		}
+	}
+	fmt.Printf("simplescp %s %s %s/%s\n", v, info.GoVersion, runtime.GOOS, runtime.GOARCH)
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
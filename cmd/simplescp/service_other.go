@@ -0,0 +1,23 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+
+	"github.com/jjch99/simplescp"
+)
+
+func isWindowsService() bool {
+	return false
+}
+
+func redirectServiceLogs() error {
+	return nil
+}
+
+func runService(server *simplescp.Server) {}
+
+func controlService(action string) error {
+	return errors.New("services are only supported on Windows, use a systemd unit (see support/systemd) elsewhere")
+}
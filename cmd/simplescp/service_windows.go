@@ -0,0 +1,170 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jjch99/simplescp"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const serviceName = "simplescp"
+
+func isWindowsService() bool {
+	inService, err := svc.IsWindowsService()
+	return err == nil && inService
+}
+
+// Services don't have anywhere to write to, so logs go to simplescp.log next
+// to the executable
+func redirectServiceLogs() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(filepath.Dir(exe), "simplescp.log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	os.Stderr = f
+	return nil
+}
+
+// windowsService runs the server for the service control manager
+type windowsService struct {
+	server *simplescp.Server
+}
+
+func (s windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	errs := make(chan error, 1)
+	go func() { errs <- s.server.ListenAndServe() }()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange}
+
+	for {
+		select {
+		case err := <-errs:
+			if err == simplescp.ErrServerClosed {
+				// Drained through the control service
+				status <- svc.Status{State: svc.StopPending}
+				<-s.server.Done()
+				slog.Info("Server stopped")
+				return false, 0
+			}
+			slog.Error("Failed to serve connections", "err", err)
+			return true, 1
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.ParamChange:
+				slog.Info("Reloading config")
+				reload(s.server)
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				shutdown(s.server)
+				<-errs
+				slog.Info("Server stopped")
+				return false, 0
+			}
+		}
+	}
+}
+
+func runService(server *simplescp.Server) {
+	if err := svc.Run(serviceName, windowsService{server}); err != nil {
+		fatal("Service failed", err)
+	}
+}
+
+// The arguments the service should be started with: serve and the flags set
+// now, except for -service itself
+func serviceArgs() ([]string, error) {
+	args := []string{"serve"}
+	var err error
+	serveFlags.Visit(func(f *flag.Flag) {
+		value := f.Value.String()
+		// The service starts in C:\Windows\System32
+		if f.Name == "config" || f.Name == "dir" || f.Name == "private-key" || f.Name == "authorized-keys" {
+			if value, err = filepath.Abs(value); err != nil {
+				return
+			}
+		}
+		if f.Name != "service" {
+			args = append(args, "-"+f.Name+"="+value)
+		}
+	})
+	return args, err
+}
+
+// Install, uninstall, start or stop the simplescp service
+func controlService(action string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	if action == "install" {
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		args, err := serviceArgs()
+		if err != nil {
+			return err
+		}
+		service, err := m.CreateService(serviceName, exe, mgr.Config{
+			DisplayName: "simplescp",
+			Description: "scp and sftp server",
+			StartType:   mgr.StartAutomatic,
+		}, args...)
+		if err != nil {
+			return err
+		}
+		service.Close()
+		slog.Info("Installed service", "name", serviceName, "args", args)
+		return nil
+	}
+
+	service, err := m.OpenService(serviceName)
+	if err != nil {
+		return err
+	}
+	defer service.Close()
+	switch action {
+	case "uninstall":
+		err = service.Delete()
+	case "start":
+		err = service.Start()
+	case "stop":
+		err = stopService(service)
+	default:
+		return fmt.Errorf("Unknown action %q, it should be install, uninstall, start or stop", action)
+	}
+	if err == nil {
+		slog.Info("Done", "service", serviceName, "action", action)
+	}
+	return err
+}
+
+// Ask the service to stop, and wait for it to finish its active sessions
+func stopService(service *mgr.Service) error {
+	status, err := service.Control(svc.Stop)
+	if err != nil {
+		return err
+	}
+	for status.State != svc.Stopped {
+		time.Sleep(500 * time.Millisecond)
+		if status, err = service.Query(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
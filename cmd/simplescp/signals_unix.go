@@ -0,0 +1,55 @@
+//go:build !windows
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jjch99/simplescp"
+)
+
+// Reload the config on SIGHUP, lift bans on SIGUSR1, hand over to a new
+// process running the (maybe upgraded) binary on SIGUSR2, shut down gracefully
+// on SIGTERM/SIGINT
+func handleSignals(server *simplescp.Server) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGTERM, syscall.SIGINT)
+
+	for sig := range sigs {
+		if sig == syscall.SIGHUP {
+			slog.Info("Reloading config", "signal", sig.String())
+			reload(server)
+			continue
+		}
+		if sig == syscall.SIGUSR1 {
+			server.Unban("")
+			continue
+		}
+		if sig == syscall.SIGUSR2 && !upgrade(server) {
+			continue
+		}
+		signal.Stop(sigs)
+		shutdown(server, "signal", sig.String())
+		return
+	}
+}
+
+// Start the binary again, handing it our listening sockets. Returns whether it
+// took over, we should shut down then
+func upgrade(server *simplescp.Server) bool {
+	exe, err := os.Executable()
+	if err != nil {
+		slog.Error("Not upgrading", "err", err)
+		return false
+	}
+	process, err := server.Upgrade(exe, os.Args[1:]...)
+	if err != nil {
+		slog.Error("Not upgrading", "err", err)
+		return false
+	}
+	slog.Info("New process took over", "pid", process.Pid)
+	return true
+}
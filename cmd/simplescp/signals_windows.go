@@ -0,0 +1,19 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jjch99/simplescp"
+)
+
+// Shut down gracefully on Ctrl+C. There are no SIGHUP or SIGUSR1 on Windows,
+// the service reloads the config when asked to instead (sc control simplescp paramchange)
+func handleSignals(server *simplescp.Server) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	sig := <-sigs
+	signal.Stop(sigs)
+	shutdown(server, "signal", sig.String())
+}
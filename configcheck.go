@@ -0,0 +1,351 @@
+package simplescp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// ConfigProblem is something found wrong with a config by Check. File and
+// Line point at the line it's about, for problems in files the config refers
+// to, like a public key that can't be parsed in authorized_keys
+type ConfigProblem struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (p ConfigProblem) Error() string {
+	if p.Line > 0 {
+		return fmt.Sprintf("%s:%d: %v", p.File, p.Line, p.Err)
+	}
+	if len(p.File) > 0 {
+		return fmt.Sprintf("%s: %v", p.File, p.Err)
+	}
+	return p.Err.Error()
+}
+
+func (p ConfigProblem) Unwrap() error {
+	return p.Err
+}
+
+// Check goes through everything Init would load and set up, and returns all
+// the problems it finds instead of stopping at the first one: invalid
+// settings, host keys and authorized keys that can't be read or parsed,
+// directories that don't exist or can't be written to, and (with bind)
+// addresses that can't be listened on. Unlike Init it doesn't change anything,
+// host keys and directories created on start are only checked to be creatable.
+// Addresses a running server is listening on can't be bound again, leave bind
+// out to check the config of a server that's about to be reloaded.
+func (c *Config) Check(bind bool) []ConfigProblem {
+	var problems []ConfigProblem
+	add := func(err error) {
+		if err != nil {
+			problems = append(problems, ConfigProblem{Err: err})
+		}
+	}
+
+	if isPasswordHash(c.Password) {
+		if err := validatePasswordHash(c.Password); err != nil {
+			add(fmt.Errorf("Can't use password hash for %s: %v", c.User, err))
+		}
+	}
+	if len(c.TOTPSecret) > 0 {
+		if _, err := decodeTOTPSecret(c.TOTPSecret); err != nil {
+			add(fmt.Errorf("Can't use TOTP secret for %s: %v", c.User, err))
+		}
+	}
+	if len(c.PAMService) > 0 && !pamSupported {
+		add(fmt.Errorf("Can't use PAM service %s: PAM support not built in, build with -tags pam", c.PAMService))
+	}
+	if c.LDAP.enabled() {
+		add(c.LDAP.validate())
+	}
+	if c.RADIUS.enabled() {
+		add(c.RADIUS.validate())
+	}
+	if c.Anonymous.Enabled {
+		add(c.validateAnonymous())
+	}
+	if c.JWT.enabled() {
+		add(c.JWT.validate())
+	}
+	if c.Scan.enabled() {
+		add(c.Scan.validate())
+	}
+	add(c.validateRsync())
+	if c.GeoIP.enabled() {
+		if err := c.GeoIP.validate(); err != nil {
+			add(err)
+		} else if db, err := openGeoIPDB(c.GeoIP.Database); err != nil {
+			add(err)
+		} else {
+			db.reader.Close()
+		}
+	}
+	if len(c.BannerFile) > 0 {
+		if _, err := os.ReadFile(c.BannerFile); err != nil {
+			add(fmt.Errorf("Can't read banner: %v", err))
+		}
+	}
+
+	add(c.validateAlgorithms())
+	add(c.validateListen())
+	add(validateOutsideSymlinks(c.OutsideSymlinks))
+	add(validateSymlinks(c.Symlinks))
+	add(validatePartialUploads(c.PartialUploads))
+	add(c.FileNames.validate())
+	add(c.SFTP.validate())
+	add(c.Admin.validate())
+	add(c.Dashboard.validate())
+	add(validateChecksum(c.Checksum))
+	for _, w := range c.Webhooks {
+		add(w.validate())
+	}
+	if len(c.DenyFiles) > 0 {
+		_, err := newFileFilter(c.DenyFiles)
+		add(err)
+	}
+	if len(c.HideFiles) > 0 {
+		_, err := newFileFilter(c.HideFiles)
+		add(err)
+	}
+	if len(c.AllowCIDRs) > 0 || len(c.DenyCIDRs) > 0 {
+		_, err := newIPFilter(c.AllowCIDRs, c.DenyCIDRs)
+		add(err)
+	}
+	if c.ProxyProtocol && len(c.ProxyProtocolFrom) == 0 {
+		add(errProxyProtocolFrom)
+	}
+	if len(c.ProxyProtocolFrom) > 0 {
+		_, err := newIPFilter(c.ProxyProtocolFrom, nil)
+		add(err)
+	}
+	if len(c.AuthKeysCommand) > 0 {
+		_, err := parseAuthKeysCommand(c.AuthKeysCommand)
+		add(err)
+	}
+	if len(c.UploadCommand) > 0 {
+		_, err := parseUploadCommand(c.UploadCommand)
+		add(err)
+	}
+
+	problems = append(problems, c.checkHostKeys()...)
+	if len(c.AuthKeysFile) > 0 {
+		problems = append(problems, checkKeysFile(c.AuthKeysFile, "authorized keys")...)
+	}
+	if len(c.TrustedUserCAKeys) > 0 {
+		problems = append(problems, checkKeysFile(c.TrustedUserCAKeys, "trusted user CA keys")...)
+	}
+	if len(c.RevokedKeysFile) > 0 {
+		_, err := loadRevokedKeys(c.RevokedKeysFile)
+		add(err)
+	}
+
+	// The storage backend is set up on a copy, so the config's stays as it is
+	backend := *c
+	if err := backend.initFileSystem(); err != nil {
+		add(err)
+	} else if _, local := backend.FileSystem.(osFileSystem); local {
+		problems = append(problems, c.checkDirs()...)
+	}
+	if len(c.TransferLog) > 0 {
+		add(checkCreatable("transfer_log", c.TransferLog))
+	}
+	if len(c.UserDB) > 0 {
+		add(checkCreatable("user_db", c.UserDB))
+	}
+	if len(c.RecordDir) > 0 {
+		add(checkCreatable("record_dir", c.RecordDir))
+	}
+
+	if bind {
+		problems = append(problems, c.checkBind()...)
+	}
+	return problems
+}
+
+// Host keys have to parse and be kept away from other users, like sshd wants
+// them. A missing PrivateKeyFile is generated on start, so it only needs to be
+// possible to create it
+func (c *Config) checkHostKeys() []ConfigProblem {
+	var problems []ConfigProblem
+	if err := validateHostKeyType(c.HostKeyType); err != nil {
+		problems = append(problems, ConfigProblem{Err: err})
+	}
+	files := c.HostKeyFiles
+	if len(c.PrivateKeyFile) > 0 {
+		files = append([]string{c.PrivateKeyFile}, files...)
+	}
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if errors.Is(err, fs.ErrNotExist) && file == c.PrivateKeyFile {
+			if err := checkCreatable("private_key_file", file); err != nil {
+				problems = append(problems, ConfigProblem{Err: err})
+			}
+			continue
+		}
+		if err != nil {
+			problems = append(problems, ConfigProblem{Err: fmt.Errorf("Can't load private key: %v", err)})
+			continue
+		}
+		if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+			problems = append(problems, ConfigProblem{File: file,
+				Err: fmt.Errorf("Private key can be accessed by other users (mode %04o), it should only be readable by its owner", info.Mode().Perm())})
+		}
+		privateBytes, err := os.ReadFile(file)
+		if err == nil {
+			_, err = c.parseHostKey(file, privateBytes)
+		}
+		if err != nil {
+			problems = append(problems, ConfigProblem{Err: err})
+		}
+	}
+	if c.HostKeyAgent {
+		if _, err := c.agentHostKeys(); err != nil {
+			problems = append(problems, ConfigProblem{Err: err})
+		}
+	}
+	return problems
+}
+
+// Every line of a file of public keys in authorized_keys format has to parse.
+// Init skips the ones that don't, Check points them out
+func checkKeysFile(file string, what string) []ConfigProblem {
+	f, err := os.Open(file)
+	if err != nil {
+		return []ConfigProblem{{Err: fmt.Errorf("Can't open %s: %v", what, err)}}
+	}
+	defer f.Close()
+
+	var problems []ConfigProblem
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := parsePubKey(line); err != nil {
+			problems = append(problems, ConfigProblem{File: file, Line: n, Err: fmt.Errorf("Invalid public key: %v", err)})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		problems = append(problems, ConfigProblem{File: file, Err: fmt.Errorf("Can't read %s: %v", what, err)})
+	}
+	return problems
+}
+
+// The shared directory has to be there, and be writable unless the server is
+// read only. With a %u in it, what's before it has to be there instead, the
+// user directories get created in it as users log in
+func (c *Config) checkDirs() []ConfigProblem {
+	var problems []ConfigProblem
+	check := func(what, dir string, createIn bool) {
+		if err := checkDir(what, dir, createIn); err != nil {
+			problems = append(problems, ConfigProblem{Err: err})
+		}
+	}
+
+	if i := strings.Index(c.Dir, userPlaceholder); i >= 0 {
+		check("dir", filepath.Dir(c.Dir[:i]+"x"), true)
+	} else {
+		check("dir", c.Dir, !c.ReadOnly)
+	}
+	if c.Anonymous.Enabled && len(c.Anonymous.Dir) > 0 {
+		// It's created on the first anonymous login, like user directories
+		if _, err := os.Stat(c.Anonymous.Dir); errors.Is(err, fs.ErrNotExist) {
+			check("anonymous dir", filepath.Dir(filepath.Clean(c.Anonymous.Dir)), true)
+		} else {
+			check("anonymous dir", c.Anonymous.Dir, false)
+		}
+	}
+	return problems
+}
+
+// The directory has to exist and be listable, and with write be somewhere
+// files can be created
+func checkDir(what, dir string, write bool) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("Can't use %s: %v", what, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("Can't use %s: %s isn't a directory", what, dir)
+	}
+	f, err := os.Open(dir)
+	if err == nil {
+		_, err = f.Readdirnames(1)
+		f.Close()
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("Can't use %s: %v", what, err)
+	}
+	if write {
+		if err := canWrite(dir); err != nil {
+			return fmt.Errorf("Can't use %s: %s isn't writable: %v", what, dir, err)
+		}
+	}
+	return nil
+}
+
+// A file or directory the server creates on start, and appends to or adds to
+// after that if it's already there
+func checkCreatable(what, file string) error {
+	if _, err := os.Stat(file); err == nil {
+		if err := canWrite(file); err != nil {
+			return fmt.Errorf("Can't use %s: %s isn't writable: %v", what, file, err)
+		}
+		return nil
+	}
+	return checkDir(what, filepath.Dir(filepath.Clean(file)), true)
+}
+
+// Listen on every address the server would, and let go of them straight away
+func (c *Config) checkBind() []ConfigProblem {
+	var problems []ConfigProblem
+	bind := func(what, addr string, listen func(string) ([]net.Listener, error)) {
+		listeners, err := listen(addr)
+		if err != nil {
+			problems = append(problems, ConfigProblem{Err: fmt.Errorf("Can't listen on %s %s: %v", what, addr, err)})
+		}
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+	plain := func(addr string) ([]net.Listener, error) {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+
+	if c.validateListen() == nil {
+		for _, addr := range c.listenAddresses() {
+			bind("address", addr, c.listen)
+		}
+	}
+	// Invalid addresses have been pointed out already
+	if c.Admin.validate() == nil {
+		if len(c.Admin.Listen) > 0 {
+			bind("admin address", c.Admin.Listen, plain)
+		}
+		if len(c.Admin.GRPCListen) > 0 {
+			bind("gRPC address", c.Admin.GRPCListen, plain)
+		}
+		if len(c.Admin.HealthListen) > 0 {
+			bind("health endpoints address", c.Admin.HealthListen, plain)
+		}
+	}
+	if c.Dashboard.validate() == nil && len(c.Dashboard.Listen) > 0 {
+		bind("dashboard address", c.Dashboard.Listen, plain)
+	}
+	return problems
+}
@@ -0,0 +1,68 @@
+package simplescp
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestConfigCheck(t *testing.T) {
+	c := newTestConfig(t)
+	c.Listen = []string{"127.0.0.1:0"}
+	if problems := c.Check(true); len(problems) > 0 {
+		t.Fatalf("Problems with a good config: %v", problems)
+	}
+
+	dir := t.TempDir()
+	keys := filepath.Join(dir, "authorized_keys")
+	os.WriteFile(keys, []byte("# Comment\n\nssh-ed25519 nope\n"), 0600)
+	key := filepath.Join(dir, "host_key")
+	if _, err := GenerateKeyFile(key, KeyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(key, 0644)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	c.AuthKeysFile = keys
+	c.PrivateKeyFile = filepath.Join(dir, "new_host_key")
+	c.HostKeyFiles = []string{key, filepath.Join(dir, "missing")}
+	c.Dir = filepath.Join(dir, "missing")
+	c.Symlinks = "sometimes"
+	c.Listen = []string{listener.Addr().String()}
+	problems := c.Check(true)
+	expected := []string{
+		"Invalid symlinks",
+		keys + ":3: Invalid public key",
+		"missing: no such file",
+		"Can't use dir",
+		"Can't listen on address",
+	}
+	if runtime.GOOS != "windows" {
+		expected = append(expected, key+": Private key can be accessed by other users")
+	}
+	if len(problems) != len(expected) {
+		t.Errorf("Expected %d problems, got %v", len(expected), problems)
+	}
+	for _, e := range expected {
+		found := false
+		for _, p := range problems {
+			found = found || strings.Contains(p.Error(), e)
+		}
+		if !found {
+			t.Errorf("No problem with %q in %v", e, problems)
+		}
+	}
+	if _, err := os.Stat(c.PrivateKeyFile); err == nil {
+		t.Error("Checking created the host key")
+	}
+	if problems := c.Check(false); len(problems) != len(expected)-1 {
+		t.Errorf("Unexpected problems without binding: %v", problems)
+	}
+}
@@ -0,0 +1,57 @@
+package simplescp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// LoadConfigFile reads settings from a YAML or TOML file into config.
+// The format is chosen based on the file extension (.yaml, .yml or .toml).
+// Settings not present in the file keep whatever value config already had.
+func LoadConfigFile(path string, config *Config) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Can't read config file: %v", err)
+	}
+
+	format := strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	if format != "yaml" && format != "yml" && format != "toml" {
+		return fmt.Errorf("Unknown config file format %q, expected .yaml, .yml or .toml", filepath.Ext(path))
+	}
+	err = decodeConfig(contents, format, config)
+	if err != nil {
+		return fmt.Errorf("Failed to parse config file %s: %v", path, err)
+	}
+	return nil
+}
+
+// Decode settings in the given format (yaml, yml or toml) into config,
+// rejecting unknown ones
+func decodeConfig(contents []byte, format string, config *Config) error {
+	switch format {
+	case "yaml", "yml":
+		dec := yaml.NewDecoder(bytes.NewReader(contents))
+		dec.KnownFields(true)
+		err := dec.Decode(config)
+		if err == io.EOF {
+			// Empty file, nothing to override
+			err = nil
+		}
+		return err
+	case "toml":
+		md, err := toml.Decode(string(contents), config)
+		if err == nil && len(md.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown settings %v", md.Undecoded())
+		}
+		return err
+	default:
+		return fmt.Errorf("unknown format %q, expected yaml or toml", format)
+	}
+}
@@ -0,0 +1,29 @@
+package simplescp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	for _, file := range []string{"support/config/simplescp.yaml", "support/config/simplescp.toml"} {
+		c := NewConfig()
+		err := LoadConfigFile(file, c)
+		if err != nil {
+			t.Fatalf("Error loading %s: %v", file, err)
+		}
+		if c.User != "scpuser" || c.Dir != "/srv/scp" || c.Port != "8222" {
+			t.Errorf("%s: unexpected settings %+v", file, c)
+		}
+		if c.AuthKeysFile != "/etc/simplescp/authorized_keys" || c.ShutdownGrace != 30*time.Second {
+			t.Errorf("%s: unexpected settings %+v", file, c)
+		}
+	}
+}
+
+func TestLoadConfigFileUnknownFormat(t *testing.T) {
+	err := LoadConfigFile("support/ssh_pass.sh", NewConfig())
+	if err == nil {
+		t.Errorf("Expected an error loading a file with an unknown extension")
+	}
+}
@@ -0,0 +1,103 @@
+package simplescp
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// How long clients over the connection limits get to read why before they're dropped
+const connRejectTimeout = 10 * time.Second
+
+// connCounter keeps track of the connections open from each client IP, and the
+// sessions open for each user, so MaxConnections, MaxConnectionsPerIP and
+// MaxSessionsPerUser can be enforced. It's shared by all connections
+type connCounter struct {
+	mu       sync.Mutex
+	total    int
+	perIP    map[string]int
+	sessions map[string]int
+}
+
+func newConnCounter() *connCounter {
+	return &connCounter{perIP: make(map[string]int), sessions: make(map[string]int)}
+}
+
+// Counts a new connection from ip, unless it would go over the limits (0 is
+// no limit). Returns why it can't be served otherwise
+func (cc *connCounter) addConn(ip string, maxTotal, maxPerIP int) string {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if maxTotal > 0 && cc.total >= maxTotal {
+		return "Too many connections to this server, try again later"
+	}
+	if maxPerIP > 0 && cc.perIP[ip] >= maxPerIP {
+		return "Too many connections from your address, try again later"
+	}
+	cc.total++
+	cc.perIP[ip]++
+	return ""
+}
+
+func (cc *connCounter) removeConn(ip string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.total--
+	if cc.perIP[ip]--; cc.perIP[ip] <= 0 {
+		delete(cc.perIP, ip)
+	}
+}
+
+// Counts a new session for the user, unless they already have max of them
+func (cc *connCounter) addSession(user string, max int) bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if max > 0 && cc.sessions[user] >= max {
+		return false
+	}
+	cc.sessions[user]++
+	return true
+}
+
+func (cc *connCounter) removeSession(user string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.sessions[user]--; cc.sessions[user] <= 0 {
+		delete(cc.sessions, user)
+	}
+}
+
+// How many sessions are open, for all users
+func (cc *connCounter) activeSessions() int {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	n := 0
+	for _, sessions := range cc.sessions {
+		n += sessions
+	}
+	return n
+}
+
+// Turns away a connection over the limits. It still goes through the handshake
+// so the client gets to show the reason, as a banner, but every login fails
+func rejectConn(nConn net.Conn, config *ssh.ServerConfig, reason string) {
+	nConn.SetDeadline(time.Now().Add(connRejectTimeout))
+	rejectConfig := *config
+	rejectConfig.PasswordCallback = nil
+	rejectConfig.PublicKeyCallback = nil
+	rejectConfig.KeyboardInteractiveCallback = nil
+	rejectConfig.NoClientAuth = true
+	rejectConfig.NoClientAuthCallback = func(ssh.ConnMetadata) (*ssh.Permissions, error) {
+		return nil, errors.New(reason)
+	}
+	rejectConfig.AuthLogCallback = nil
+	rejectConfig.BannerCallback = func(ssh.ConnMetadata) string {
+		return reason + "\r\n"
+	}
+	if sshConn, _, _, err := ssh.NewServerConn(nConn, &rejectConfig); err == nil {
+		sshConn.Close()
+	}
+}
@@ -0,0 +1,134 @@
+package simplescp
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestConnCounter(t *testing.T) {
+	cc := newConnCounter()
+	if reason := cc.addConn("192.0.2.10", 2, 1); len(reason) > 0 {
+		t.Fatal(reason)
+	}
+	if reason := cc.addConn("192.0.2.10", 2, 1); !strings.Contains(reason, "your address") {
+		t.Errorf("Second connection from the same address not limited: %q", reason)
+	}
+	if reason := cc.addConn("192.0.2.11", 2, 1); len(reason) > 0 {
+		t.Fatal(reason)
+	}
+	if reason := cc.addConn("192.0.2.12", 2, 1); !strings.Contains(reason, "this server") {
+		t.Errorf("Connection over the total not limited: %q", reason)
+	}
+	cc.removeConn("192.0.2.10")
+	if reason := cc.addConn("192.0.2.10", 2, 1); len(reason) > 0 {
+		t.Errorf("Closed connection still counted: %q", reason)
+	}
+
+	if !cc.addSession("alice", 1) || cc.addSession("alice", 1) || !cc.addSession("bob", 1) {
+		t.Error("Sessions per user not limited")
+	}
+	cc.removeSession("alice")
+	if !cc.addSession("alice", 1) {
+		t.Error("Closed session still counted")
+	}
+}
+
+// Config for a server letting scpuser in with the password hunter2
+func newTestConfig(t *testing.T) *Config {
+	c := NewConfig()
+	c.User, c.Password, c.Dir = "scpuser", "hunter2", t.TempDir()
+	c.PrivateKeyFile, c.AuthKeysFile = "", ""
+	return c
+}
+
+// Starts serving c on a random port, until the test is over
+func startTestServer(t *testing.T, c *Config) string {
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(c)
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Shutdown(context.Background()) })
+	return listener.Addr().String()
+}
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	c := newTestConfig(t)
+	c.MaxConnectionsPerIP = 1
+	addr := startTestServer(t, c)
+
+	var banner string
+	clientConfig := &ssh.ClientConfig{
+		User:            "scpuser",
+		Auth:            []ssh.AuthMethod{ssh.Password("hunter2")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		BannerCallback: func(message string) error {
+			banner = message
+			return nil
+		},
+	}
+	first, err := ssh.Dial("tcp", addr, clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	if second, err := ssh.Dial("tcp", addr, clientConfig); err == nil {
+		second.Close()
+		t.Fatal("Second connection from the same address let in")
+	}
+	if !strings.Contains(banner, "Too many connections") {
+		t.Errorf("Unexpected banner %q", banner)
+	}
+}
+
+func TestLoginGraceTime(t *testing.T) {
+	c := newTestConfig(t)
+	c.LoginGraceTime = 200 * time.Millisecond
+	addr := startTestServer(t, c)
+
+	// Connect without ever starting the handshake
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		t.Errorf("Connection not dropped after the login grace time: %v", err)
+	}
+}
+
+func TestMaxConnectionTime(t *testing.T) {
+	c := newTestConfig(t)
+	c.MaxConnectionTime = 300 * time.Millisecond
+	c.TCPKeepAlive = time.Second
+	addr := startTestServer(t, c)
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "scpuser",
+		Auth:            []ssh.AuthMethod{ssh.Password("hunter2")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	closed := make(chan error)
+	go func() { closed <- client.Wait() }()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Error("Connection not closed after the max connection time")
+	}
+}
@@ -0,0 +1,171 @@
+package simplescp
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/jjch99/simplescp/controlpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// controlService serves the gRPC control service (see controlpb) for a Server
+type controlService struct {
+	controlpb.UnimplementedControlServer
+	server *Server
+}
+
+// RegisterControl registers the gRPC control service (see controlpb) for the
+// server on r, for programs that want to serve it themselves. ListenAndServe
+// serves it on Admin.GRPCListen. Calls need to come with Admin.Token as a
+// bearer token in their authorization metadata, see ControlInterceptor
+func (s *Server) RegisterControl(r grpc.ServiceRegistrar) {
+	controlpb.RegisterControlServer(r, controlService{server: s})
+}
+
+// ControlInterceptor returns the interceptor checking calls to the control
+// service come with Admin.Token, to be passed to grpc.UnaryInterceptor
+func (s *Server) ControlInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		// The token can change with a reload
+		config := s.Config()
+		remoteAddr := ""
+		if p, ok := peer.FromContext(ctx); ok {
+			remoteAddr = p.Addr.String()
+		}
+		if token := config.Admin.Token; len(token) > 0 {
+			md, _ := metadata.FromIncomingContext(ctx)
+			var given string
+			if values := md.Get("authorization"); len(values) > 0 {
+				given, _ = strings.CutPrefix(values[0], "Bearer ")
+			}
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				config.logger().Info("Rejected control call", "remote_addr", remoteAddr, "method", info.FullMethod)
+				return nil, status.Error(codes.Unauthenticated, "Invalid token")
+			}
+		}
+		config.logger().Debug("Control call", "remote_addr", remoteAddr, "method", info.FullMethod)
+		return handler(ctx, req)
+	}
+}
+
+func (c controlService) ListSessions(ctx context.Context, req *controlpb.ListSessionsRequest) (*controlpb.ListSessionsResponse, error) {
+	resp := &controlpb.ListSessionsResponse{}
+	for _, session := range c.server.Sessions() {
+		pb := &controlpb.Session{
+			Id:         session.ID,
+			User:       session.User,
+			RemoteAddr: session.RemoteAddr,
+			Start:      timestamppb.New(session.Start),
+			BytesIn:    session.BytesIn,
+			BytesOut:   session.BytesOut,
+		}
+		for _, t := range session.Transfers {
+			pb.Transfers = append(pb.Transfers, &controlpb.Transfer{
+				Protocol:  t.Protocol,
+				Direction: t.Direction,
+				Path:      t.Path,
+				Start:     timestamppb.New(t.Start),
+				Bytes:     t.Bytes,
+			})
+		}
+		resp.Sessions = append(resp.Sessions, pb)
+	}
+	return resp, nil
+}
+
+func (c controlService) CloseSession(ctx context.Context, req *controlpb.CloseSessionRequest) (*controlpb.CloseSessionResponse, error) {
+	if !c.server.CloseSession(req.GetId()) {
+		return nil, status.Error(codes.NotFound, "No such session")
+	}
+	return &controlpb.CloseSessionResponse{}, nil
+}
+
+func (c controlService) ListBans(ctx context.Context, req *controlpb.ListBansRequest) (*controlpb.ListBansResponse, error) {
+	resp := &controlpb.ListBansResponse{}
+	for _, ban := range c.server.Bans() {
+		resp.Bans = append(resp.Bans, &controlpb.Ban{Ip: ban.IP, User: ban.User, Until: timestamppb.New(ban.Until)})
+	}
+	return resp, nil
+}
+
+func (c controlService) Unban(ctx context.Context, req *controlpb.UnbanRequest) (*controlpb.UnbanResponse, error) {
+	return &controlpb.UnbanResponse{Lifted: int32(c.server.Unban(req.GetTarget()))}, nil
+}
+
+func (c controlService) GetQuota(ctx context.Context, req *controlpb.GetQuotaRequest) (*controlpb.QuotaUsage, error) {
+	usage, err := c.server.Quota(req.GetUser())
+	if errors.Is(err, ErrNoSuchUser) {
+		return nil, status.Error(codes.NotFound, "No such user")
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &controlpb.QuotaUsage{User: usage.User, Dir: usage.Dir, Used: usage.Used, Quota: usage.Quota}, nil
+}
+
+func (c controlService) UpdateConfig(ctx context.Context, req *controlpb.UpdateConfigRequest) (*controlpb.UpdateConfigResponse, error) {
+	// Without a token, any local user could change how we serve files
+	if len(c.server.Config().Admin.Token) == 0 {
+		return nil, status.Error(codes.PermissionDenied, "Changing settings needs admin.token to be set")
+	}
+	format := req.GetFormat()
+	if len(format) == 0 {
+		format = "yaml"
+	}
+	if err := c.server.UpdateConfig(req.GetConfig(), format); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &controlpb.UpdateConfigResponse{}, nil
+}
+
+func (c controlService) Drain(ctx context.Context, req *controlpb.DrainRequest) (*controlpb.DrainResponse, error) {
+	grace := c.server.Config().ShutdownGrace
+	if req.GetGrace() != nil {
+		grace = req.GetGrace().AsDuration()
+	}
+	active := c.server.activeConns()
+	c.server.Config().logger().Info("Draining", "grace", grace.String())
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
+		defer cancel()
+		if err := c.server.Shutdown(ctx); err != nil {
+			c.server.Config().logger().Warn("Closed remaining sessions after grace period", "err", err)
+		}
+	}()
+	return &controlpb.DrainResponse{ActiveConnections: int32(active)}, nil
+}
+
+// Start serving the control service on Admin.GRPCListen, if it's set, until
+// Shutdown
+func (s *Server) startControl() error {
+	addr := s.Config().Admin.GRPCListen
+	if len(addr) == 0 {
+		return nil
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Can't start control service: %v", err)
+	}
+	server := grpc.NewServer(grpc.UnaryInterceptor(s.ControlInterceptor()), grpc.ConnectionTimeout(adminTimeout))
+	s.RegisterControl(server)
+	s.mu.Lock()
+	if s.inShutdown {
+		s.mu.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	s.control = server
+	s.mu.Unlock()
+
+	s.Config().logger().Info("Serving control service", "addr", listener.Addr().String())
+	go server.Serve(listener)
+	return nil
+}
@@ -0,0 +1,141 @@
+package simplescp
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jjch99/simplescp/controlpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func TestControlService(t *testing.T) {
+	c := newTestConfig(t)
+	c.BanThreshold = 1
+	c.Admin.Token = "s3cret"
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(c)
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(listener) }()
+	t.Cleanup(func() { server.Shutdown(context.Background()) })
+
+	grpcListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(server.ControlInterceptor()))
+	server.RegisterControl(grpcServer)
+	go grpcServer.Serve(grpcListener)
+	defer grpcServer.Stop()
+	conn, err := grpc.NewClient(grpcListener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	control := controlpb.NewControlClient(conn)
+
+	wrong := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer wrong")
+	if _, err := control.ListSessions(wrong, &controlpb.ListSessionsRequest{}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Got %v with the wrong token", err)
+	}
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer s3cret")
+
+	client := dialSFTP(t, listener.Addr().String())
+	f, err := client.Create("/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("hello"))
+	sessions, err := control.ListSessions(ctx, &controlpb.ListSessionsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions.Sessions) != 1 || sessions.Sessions[0].User != "scpuser" || len(sessions.Sessions[0].Transfers) != 1 ||
+		sessions.Sessions[0].Transfers[0].Bytes != 5 || sessions.Sessions[0].Transfers[0].Direction != "upload" {
+		t.Fatalf("Unexpected sessions %v", sessions.Sessions)
+	}
+	f.Close()
+
+	usage, err := control.GetQuota(ctx, &controlpb.GetQuotaRequest{User: "scpuser"})
+	if err != nil || usage.Used != 5 {
+		t.Errorf("Got quota usage %v, %v", usage, err)
+	}
+	if _, err := control.GetQuota(ctx, &controlpb.GetQuotaRequest{User: "nobody"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Got %v for the quota of an unknown user", err)
+	}
+
+	c.bans.failure("192.0.2.10", "mallory", slog.Default())
+	bans, err := control.ListBans(ctx, &controlpb.ListBansRequest{})
+	if err != nil || len(bans.Bans) != 2 {
+		t.Errorf("Got bans %v, %v", bans, err)
+	}
+	lifted, err := control.Unban(ctx, &controlpb.UnbanRequest{})
+	if err != nil || lifted.Lifted != 2 {
+		t.Errorf("Got %v, %v lifting bans", lifted, err)
+	}
+
+	if _, err := control.UpdateConfig(ctx, &controlpb.UpdateConfigRequest{Format: "toml", Config: []byte("max_rate = \"1M\"\nread_only = true\n")}); err != nil {
+		t.Fatal(err)
+	}
+	if updated := server.Config(); updated.MaxRate != 1024*1024 || !updated.ReadOnly || updated.Dir != c.Dir || updated.Admin.Token != "s3cret" {
+		t.Errorf("Unexpected config after update: %+v", updated)
+	}
+	if _, err := control.UpdateConfig(ctx, &controlpb.UpdateConfigRequest{Config: []byte("no_such_setting: 1\n")}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Got %v updating an unknown setting", err)
+	}
+	if _, err := control.UpdateConfig(ctx, &controlpb.UpdateConfigRequest{Config: []byte("upload_command: touch /tmp/owned\n")}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Got %v updating a command", err)
+	}
+	if updated := server.Config(); len(updated.UploadCommand) > 0 {
+		t.Errorf("Upload command changed to %q", updated.UploadCommand)
+	}
+
+	if _, err := control.CloseSession(ctx, &controlpb.CloseSessionRequest{Id: "nope"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Got %v closing an unknown session", err)
+	}
+
+	drained, err := control.Drain(ctx, &controlpb.DrainRequest{Grace: durationpb.New(50 * time.Millisecond)})
+	if err != nil || drained.ActiveConnections != 1 {
+		t.Fatalf("Got %v, %v draining", drained, err)
+	}
+	select {
+	case <-server.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Server not done draining")
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve returned %v", err)
+	}
+	if _, err := client.Stat("/file.txt"); err == nil {
+		t.Error("Session still works after the grace period")
+	}
+}
+
+func TestControlUpdateNeedsToken(t *testing.T) {
+	c := newTestConfig(t)
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	// Without a token the control service is only on localhost, where
+	// anyone could use it
+	control := controlService{server: NewServer(c)}
+	if _, err := control.UpdateConfig(context.Background(), &controlpb.UpdateConfigRequest{Config: []byte("read_only: true\n")}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Got %v updating the config without a token", err)
+	}
+	if control.server.Config().ReadOnly {
+		t.Error("Config updated without a token")
+	}
+}
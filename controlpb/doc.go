@@ -0,0 +1,6 @@
+// Package controlpb has the gRPC control service of simplescp and its
+// generated client, to manage a running server from other programs. It's
+// served on admin.grpc_listen.
+package controlpb
+
+//go:generate protoc -I.. --go_out=.. --go_opt=paths=source_relative --go-grpc_out=.. --go-grpc_opt=paths=source_relative controlpb/control.proto
@@ -0,0 +1,215 @@
+package simplescp
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DashboardConfig sets up the dashboard, a web page showing the sessions
+// logged in, the last transfers, how much of their quota users take up and
+// failed logins over the last hour. It has its own credentials, asked for by
+// the browser (HTTP basic authentication), so it can be handed out to people
+// who shouldn't get the admin token.
+type DashboardConfig struct {
+	Listen   string `yaml:"listen" toml:"listen"`     // Address to serve it on, e.g. 127.0.0.1:8225. Default: No dashboard
+	User     string `yaml:"user" toml:"user"`         // Username to log in to it with
+	Password string `yaml:"password" toml:"password"` // Password to log in to it with
+}
+
+func (d DashboardConfig) validate() error {
+	if len(d.Listen) == 0 {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(d.Listen); err != nil {
+		return fmt.Errorf("Invalid dashboard listen address %q: %v", d.Listen, err)
+	}
+	if len(d.User) == 0 || len(d.Password) == 0 {
+		return fmt.Errorf("The dashboard needs a user and password")
+	}
+	return nil
+}
+
+// How many minutes of failed logins the dashboard shows
+const trendMinutes = 60
+
+// failureTrend counts failed logins for each of the last trendMinutes
+// minutes. It's shared by all connections
+type failureTrend struct {
+	mu     sync.Mutex
+	counts [trendMinutes]int
+	minute int64 // The latest minute counted, since the epoch
+}
+
+func newFailureTrend() *failureTrend {
+	return &failureTrend{}
+}
+
+func (f *failureTrend) add(now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.advance(now)
+	f.counts[f.minute%trendMinutes]++
+}
+
+// Failed logins in each of the last minutes, oldest first
+func (f *failureTrend) list(now time.Time) []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.advance(now)
+	list := make([]int, trendMinutes)
+	for i := range list {
+		list[i] = f.counts[(f.minute+1+int64(i))%trendMinutes]
+	}
+	return list
+}
+
+// Move on to the minute of now, forgetting the counts of the minutes it
+// takes the place of
+func (f *failureTrend) advance(now time.Time) {
+	minute := now.Unix() / 60
+	if minute <= f.minute {
+		return
+	}
+	for m := max(f.minute+1, minute-trendMinutes+1); m <= minute; m++ {
+		f.counts[m%trendMinutes] = 0
+	}
+	f.minute = minute
+}
+
+//go:embed dashboard.html
+var dashboardHTML string
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"bytes": formatBytes,
+	"since": func(t time.Time) string { return time.Since(t).Round(time.Second).String() },
+	"took":  func(start, end time.Time) string { return end.Sub(start).Round(time.Millisecond).String() },
+	"percent": func(n, total int64) int64 {
+		if total <= 0 {
+			return 0
+		}
+		return min(100, n*100/total)
+	},
+	"height": func(n, highest int) int {
+		if highest == 0 {
+			return 0
+		}
+		return n * 100 / highest
+	},
+}).Parse(dashboardHTML))
+
+// What the dashboard shows
+type dashboardData struct {
+	Now       time.Time
+	Sessions  []Session
+	Transfers []FinishedTransfer
+	Quotas    []QuotaUsage
+	Failures  []int // Failed logins in each of the last minutes, oldest first
+	Total     int   // Failed logins over the last hour
+	Highest   int   // Most failed logins in a minute
+}
+
+// DashboardHandler returns the handler of the dashboard (see DashboardConfig),
+// for programs that want to serve it themselves. ListenAndServe serves it on
+// Dashboard.Listen
+func (s *Server) DashboardHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The credentials can change with a reload
+		config := s.Config()
+		user, password, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(config.Dashboard.User)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(config.Dashboard.Password)) != 1 {
+			if ok {
+				config.logger().Info("Rejected dashboard login", "remote_addr", r.RemoteAddr, "user", user)
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="simplescp", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+
+		now := time.Now()
+		data := dashboardData{
+			Now:       now,
+			Sessions:  s.Sessions(),
+			Transfers: s.RecentTransfers(),
+			Failures:  config.authFailures.list(now),
+		}
+		for _, n := range data.Failures {
+			data.Total += n
+			data.Highest = max(data.Highest, n)
+		}
+		// Quotas of the users that have been around lately
+		users := []string{config.User}
+		for _, session := range data.Sessions {
+			users = append(users, session.User)
+		}
+		for _, t := range data.Transfers {
+			users = append(users, t.User)
+		}
+		slices.Sort(users)
+		for _, user := range slices.Compact(users) {
+			if usage, err := s.Quota(user); err == nil {
+				data.Quotas = append(data.Quotas, usage)
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := dashboardTemplate.Execute(w, data); err != nil {
+			config.logger().Error("Can't show dashboard", "err", err)
+		}
+	})
+}
+
+// Sizes like 1.5 MiB
+func formatBytes(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	size := float64(n)
+	for _, unit := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		size /= 1024
+		if size < 1024 || unit == "TiB" {
+			return fmt.Sprintf("%.1f %s", size, unit)
+		}
+	}
+	return ""
+}
+
+// Start serving the dashboard on Dashboard.Listen, if it's set, until Shutdown
+func (s *Server) startDashboard() error {
+	addr := s.Config().Dashboard.Listen
+	if len(addr) == 0 {
+		return nil
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Can't start dashboard: %v", err)
+	}
+	server := &http.Server{
+		Handler:      s.DashboardHandler(),
+		ReadTimeout:  adminTimeout,
+		WriteTimeout: adminTimeout,
+	}
+	s.mu.Lock()
+	if s.inShutdown {
+		s.mu.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	s.dashboard = server
+	s.mu.Unlock()
+
+	s.Config().logger().Info("Serving dashboard", "addr", listener.Addr().String())
+	go server.Serve(listener)
+	return nil
+}
@@ -0,0 +1,121 @@
+package simplescp
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestDashboard(t *testing.T) {
+	c := newTestConfig(t)
+	c.Quota = 1024 * 1024
+	c.Dashboard = DashboardConfig{User: "ops", Password: "s3cret"}
+	addr := startTestServer(t, c)
+	server := NewServer(c)
+	dashboard := httptest.NewServer(server.DashboardHandler())
+	defer dashboard.Close()
+
+	get := func(user, password string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", dashboard.URL, nil)
+		if len(user) > 0 {
+			req.SetBasicAuth(user, password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	if status, _ := get("", ""); status != http.StatusUnauthorized {
+		t.Errorf("Got %d without credentials", status)
+	}
+	if status, _ := get("ops", "wrong"); status != http.StatusUnauthorized {
+		t.Errorf("Got %d with the wrong password", status)
+	}
+
+	client := dialSFTP(t, addr)
+	f, err := client.Create("/finished.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("hello"))
+	f.Close()
+	f, err = client.Create("/ongoing.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write([]byte("hi"))
+	if _, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "scpuser",
+		Auth:            []ssh.AuthMethod{ssh.Password("wrong")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}); err == nil {
+		t.Fatal("Logged in with the wrong password")
+	}
+
+	if transfers := server.RecentTransfers(); len(transfers) != 1 || transfers[0].User != "scpuser" ||
+		transfers[0].Bytes != 5 || !strings.HasSuffix(transfers[0].Path, "finished.txt") || transfers[0].End.IsZero() {
+		t.Errorf("Unexpected recent transfers %+v", transfers)
+	}
+	// The server notes the failed login once the client has given up
+	var status int
+	var page string
+	for i := 0; i < 50; i++ {
+		if status, page = get("ops", "s3cret"); status != http.StatusOK || strings.Contains(page, "1 in the last hour") {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if status != http.StatusOK {
+		t.Fatalf("Got %d with the right credentials", status)
+	}
+	for _, expected := range []string{"ongoing.txt", "finished.txt", "5 B", "1.0 MiB", "1 in the last hour"} {
+		if !strings.Contains(page, expected) {
+			t.Errorf("Dashboard doesn't show %q:\n%s", expected, page)
+		}
+	}
+}
+
+func TestFailureTrend(t *testing.T) {
+	f := newFailureTrend()
+	now := time.Unix(1800000000, 0)
+	f.add(now.Add(-time.Minute))
+	f.add(now)
+	f.add(now)
+	f.add(now.Add(time.Minute))
+	list := f.list(now.Add(time.Minute))
+	if len(list) != trendMinutes || !slices.Equal(list[trendMinutes-3:], []int{1, 2, 1}) {
+		t.Errorf("Unexpected trend %v", list)
+	}
+	// Only the last hour counts
+	list = f.list(now.Add(trendMinutes * time.Minute))
+	if !slices.Equal(list[:1], []int{1}) || slices.Max(list[1:]) != 0 {
+		t.Errorf("Unexpected trend an hour later %v", list)
+	}
+	if list := f.list(now.Add(3 * time.Hour)); slices.Max(list) != 0 {
+		t.Errorf("Unexpected trend hours later %v", list)
+	}
+}
+
+func TestDashboardConfigValidate(t *testing.T) {
+	for _, d := range []DashboardConfig{{}, {Listen: ":8225", User: "ops", Password: "s3cret"}} {
+		if err := d.validate(); err != nil {
+			t.Errorf("%+v not valid: %v", d, err)
+		}
+	}
+	for _, d := range []DashboardConfig{{Listen: "127.0.0.1:8225"}, {Listen: ":8225", User: "ops"}, {Listen: "8225", User: "ops", Password: "s3cret"}} {
+		if err := d.validate(); err == nil {
+			t.Errorf("%+v valid", d)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package simplescp
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Patterns in DenyFiles starting with this are regular expressions, the rest are globs
+const regexpPrefix = "regexp:"
+
+// fileFilter matches file names against a list of patterns
+type fileFilter struct {
+	globs   []string
+	regexps []*regexp.Regexp
+}
+
+func newFileFilter(patterns []string) (*fileFilter, error) {
+	f := &fileFilter{}
+	for _, pattern := range patterns {
+		if expr, ok := strings.CutPrefix(pattern, regexpPrefix); ok {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid file pattern %q: %v", pattern, err)
+			}
+			f.regexps = append(f.regexps, re)
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid file pattern %q: %v", pattern, err)
+		}
+		f.globs = append(f.globs, pattern)
+	}
+	return f, nil
+}
+
+// Whether any of the names in p match. Everything in a directory that
+// matches does too
+func (f *fileFilter) matches(p string) bool {
+	if f == nil {
+		return false
+	}
+	for _, name := range strings.Split(filepath.ToSlash(p), "/") {
+		if len(name) == 0 || name == "." || name == ".." {
+			continue
+		}
+		for _, glob := range f.globs {
+			if ok, _ := path.Match(glob, name); ok {
+				return true
+			}
+		}
+		for _, re := range f.regexps {
+			if re.MatchString(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Whether a file named name is left out of listings: our own bookkeeping
+// files, and the ones in HideFiles (and dotfiles with HideDotFiles). They can
+// still be reached by name
+func (c Config) hiddenFile(name string) bool {
+	if name == partialDir || name == quarantineDir || partialFile(name) {
+		return true
+	}
+	if c.HideDotFiles && strings.HasPrefix(name, ".") {
+		return true
+	}
+	return c.hideFiles.matches(name)
+}
+
+// Leave the denied and hidden files out of a directory listing
+func (c Config) listedFiles(files []os.FileInfo) []os.FileInfo {
+	listed := files[:0]
+	for _, fi := range files {
+		if !c.deniedFile(fi.Name()) && !c.hiddenFile(fi.Name()) {
+			listed = append(listed, fi)
+		}
+	}
+	return listed
+}
+
+// Whether the file at p, as clients see it, is one of the ones in
+// DenyFiles. They can't be uploaded and are hidden from downloads and listings
+func (c Config) deniedFile(p string) bool {
+	// Our own files are ours alone: infected ones could be taken out of the
+	// quarantine, and uploads could be read or changed before they're done
+	clean := path.Clean("/" + filepath.ToSlash(p))
+	for _, dir := range []string{quarantineDir, partialDir} {
+		if clean == "/"+dir || strings.HasPrefix(clean, "/"+dir+"/") {
+			return true
+		}
+	}
+	if partialFile(path.Base(clean)) {
+		return true
+	}
+	return c.denyFiles.matches(p)
+}
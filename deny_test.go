@@ -0,0 +1,169 @@
+package simplescp
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileFilter(t *testing.T) {
+	f, err := newFileFilter([]string{"*.exe", ".git", `regexp:(?i)\.bat$`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p, denied := range map[string]bool{
+		"file.txt":         false,
+		"dir/app.exe":      true,
+		"/.git/config":     true,
+		"RUN.BAT":          true,
+		"exe/file.txt":     false,
+		"dir/../file.exe2": false,
+	} {
+		if f.matches(p) != denied {
+			t.Errorf("%s denied: %v", p, !denied)
+		}
+	}
+	for _, pattern := range []string{"[", "regexp:("} {
+		if _, err := newFileFilter([]string{pattern}); err == nil {
+			t.Errorf("Invalid pattern %q accepted", pattern)
+		}
+	}
+}
+
+func TestDenyFiles(t *testing.T) {
+	c := newTestConfig(t)
+	c.DenyFiles = []string{"*.exe", "secret"}
+	os.MkdirAll(filepath.Join(c.Dir, "secret"), 0755)
+	for _, name := range []string{"a.txt", "b.exe", "secret/c.txt"} {
+		os.WriteFile(filepath.Join(c.Dir, name), []byte(name), 0644)
+	}
+	addr := startTestServer(t, c)
+
+	scp := startTestSCP(t, addr, "scp -t .")
+	scp.ack()
+	if err := scp.sendFile("upload.exe", "evil"); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("Denied file uploaded: %v", err)
+	}
+	if err := scp.sendFile("upload.txt", "fine"); err != nil {
+		t.Errorf("Allowed file not uploaded: %v", err)
+	}
+
+	for _, target := range []string{"b.exe", "secret/c.txt", "*.exe"} {
+		scp := startTestSCP(t, addr, "scp -f "+target)
+		if _, _, err := scp.receive(); err == nil || !strings.Contains(err.Error(), "No such file or directory") {
+			t.Errorf("Denied file %s downloaded: %v", target, err)
+		}
+	}
+	scp = startTestSCP(t, addr, "scp -r -f .")
+	var got []string
+	for {
+		msg, _, err := scp.receive()
+		if err != nil {
+			if err != io.EOF {
+				t.Error(err)
+			}
+			break
+		}
+		got = append(got, msg)
+	}
+	if strings.Contains(strings.Join(got, " "), "exe") || strings.Contains(strings.Join(got, " "), "secret") {
+		t.Errorf("Denied files sent with the directory: %q", got)
+	}
+
+	client := dialSFTP(t, addr)
+	files, err := client.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range files {
+		if fi.Name() != "a.txt" && fi.Name() != "upload.txt" {
+			t.Errorf("Denied file %s listed", fi.Name())
+		}
+	}
+	if _, err := client.Stat("/secret/c.txt"); !os.IsNotExist(err) {
+		t.Errorf("Denied file found: %v", err)
+	}
+	if _, err := client.Create("/other.exe"); !os.IsPermission(err) {
+		t.Errorf("Denied file created: %v", err)
+	}
+	if err := client.Rename("/a.txt", "/a.exe"); !os.IsPermission(err) {
+		t.Errorf("File renamed to a denied name: %v", err)
+	}
+}
+
+func TestHideFiles(t *testing.T) {
+	c := newTestConfig(t)
+	c.HideDotFiles = true
+	c.HideFiles = []string{"*.tmp"}
+	os.MkdirAll(filepath.Join(c.Dir, partialDir), 0755)
+	for _, name := range []string{"a.txt", ".hidden", "b.tmp"} {
+		os.WriteFile(filepath.Join(c.Dir, name), []byte(name), 0644)
+	}
+	addr := startTestServer(t, c)
+
+	client := dialSFTP(t, addr)
+	files, err := client.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "a.txt" {
+		t.Errorf("Listed %d files, expected just a.txt", len(files))
+	}
+	if _, err := client.Stat("/.hidden"); err != nil {
+		t.Errorf("Hidden file not found by name: %v", err)
+	}
+
+	scp := startTestSCP(t, addr, "scp -r -f .")
+	var got []string
+	for {
+		msg, _, err := scp.receive()
+		if err != nil {
+			break
+		}
+		got = append(got, msg)
+	}
+	if len(got) != 3 || got[1] != "C0644 5 a.txt" {
+		t.Errorf("Sent %q with the directory", got)
+	}
+	scp = startTestSCP(t, addr, "scp -f .hidden")
+	if _, contents, err := scp.receive(); err != nil || contents != ".hidden" {
+		t.Errorf("Hidden file not sent by name: %v", err)
+	}
+}
+
+// Uploads that aren't done yet, or were left behind, aren't anyone's to get at
+func TestDenyPartialUploads(t *testing.T) {
+	c := newTestConfig(t)
+	for p, denied := range map[string]bool{
+		"/.partial":                      true,
+		".partial/dir/a.txt":             true,
+		"dir/.partial":                   false,
+		"dir/.report.pdf.0123abcd.part":  true,
+		"/.a.txt.89abcdef.part":          true,
+		".notes.part":                    false,
+		".a.txt.0123abcz.part":           false,
+		"report.part":                    false,
+		"/.quarantine/infected/virus.sh": true,
+	} {
+		if c.deniedFile(p) != denied {
+			t.Errorf("%s denied: %v", p, !denied)
+		}
+	}
+
+	os.MkdirAll(filepath.Join(c.Dir, partialDir), 0755)
+	os.WriteFile(filepath.Join(c.Dir, partialDir, "a.txt"), []byte("half"), 0644)
+	os.WriteFile(filepath.Join(c.Dir, ".b.txt.0123abcd"+partialSuffix), []byte("half"), 0644)
+	addr := startTestServer(t, c)
+	client := dialSFTP(t, addr)
+	for _, name := range []string{"/.partial/a.txt", "/.b.txt.0123abcd.part"} {
+		if _, err := client.Open(name); err == nil {
+			t.Errorf("%s opened", name)
+		}
+		if f, err := client.Create(name); err == nil {
+			f.Close()
+			t.Errorf("%s written to", name)
+		}
+	}
+}
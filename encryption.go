@@ -0,0 +1,427 @@
+package simplescp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Encrypted files start with a header holding the file's own key, wrapped with
+// the master key, followed by its contents in chunks sealed with that key:
+//   magic (8 bytes) | nonce (12) | wrapped file key (32 + 16 byte tag)
+//   chunk 0 (up to encChunkSize + 16 byte tag) | chunk 1 | ...
+// Every file gets a new random key, so the chunk number can be the nonce. The
+// last chunk is sealed differently from the rest, so files can't be truncated
+// without it being noticed.
+const (
+	encMagic      = "SSCPENC1"
+	encChunkSize  = 64 << 10
+	encHeaderSize = len(encMagic) + 12 + 32 + 16
+	encTagSize    = 16
+)
+
+var errEncryptedCorrupt = errors.New("encrypted file is corrupt or was encrypted with another key")
+
+// LoadEncryptionKey reads a master key from a file holding its 32 bytes hex encoded
+func LoadEncryptionKey(path string) ([]byte, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read encryption key: %v", err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("Invalid encryption key in %s: it should be 32 bytes, hex encoded", path)
+	}
+	return key, nil
+}
+
+// NewEncryptedFS stores files in fsys encrypted with AES-256-GCM, so they're
+// useless without masterKey (32 bytes). File names and directory structure
+// aren't encrypted.
+func NewEncryptedFS(fsys FileSystem, masterKey []byte) (FileSystem, error) {
+	master, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedFS{fs: fsys, master: master, writing: make(map[string]*objectWriter)}, nil
+}
+
+type encryptedFS struct {
+	fs     FileSystem
+	master cipher.AEAD
+
+	mu      sync.Mutex
+	writing map[string]*objectWriter // Files being written, so their size can be seen before they're done
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, errors.New("Encryption keys need to be 32 bytes long")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Size of the contents of an encrypted file that takes up size bytes
+func plainSize(size int64) int64 {
+	size -= int64(encHeaderSize)
+	if size <= 0 {
+		return 0
+	}
+	full := size / (encChunkSize + encTagSize)
+	rest := size % (encChunkSize + encTagSize)
+	if rest > encTagSize {
+		rest -= encTagSize
+	} else {
+		rest = 0
+	}
+	return full*encChunkSize + rest
+}
+
+func chunkNonce(idx int64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], uint64(idx))
+	return nonce
+}
+
+// Additional data for each chunk, telling the last one apart
+func chunkAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encFileInfo reports the size of a file's contents rather than what it takes up on disk
+type encFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi encFileInfo) Size() int64 { return fi.size }
+
+func (e *encryptedFS) info(name string, fi os.FileInfo) os.FileInfo {
+	if !fi.Mode().IsRegular() {
+		return fi
+	}
+	e.mu.Lock()
+	w, ok := e.writing[name]
+	e.mu.Unlock()
+	if ok {
+		wfi, _ := w.Stat()
+		return encFileInfo{FileInfo: fi, size: wfi.Size()}
+	}
+	return encFileInfo{FileInfo: fi, size: plainSize(fi.Size())}
+}
+
+func (e *encryptedFS) Stat(name string) (os.FileInfo, error) {
+	fi, err := e.fs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return e.info(name, fi), nil
+}
+
+func (e *encryptedFS) Lstat(name string) (os.FileInfo, error) {
+	fi, err := e.fs.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	return e.info(name, fi), nil
+}
+
+func (e *encryptedFS) ReadDir(name string) ([]os.FileInfo, error) {
+	files, err := e.fs.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	for i, fi := range files {
+		files[i] = e.info(filepath.Join(name, fi.Name()), fi)
+	}
+	return files, nil
+}
+
+func (e *encryptedFS) Mkdir(name string, perm os.FileMode) error    { return e.fs.Mkdir(name, perm) }
+func (e *encryptedFS) MkdirAll(name string, perm os.FileMode) error { return e.fs.MkdirAll(name, perm) }
+func (e *encryptedFS) Rename(oldname, newname string) error         { return e.fs.Rename(oldname, newname) }
+func (e *encryptedFS) Remove(name string) error                     { return e.fs.Remove(name) }
+
+func (e *encryptedFS) Open(name string) (File, error) {
+	f, err := e.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return f, nil
+	}
+
+	// Even empty files have a last chunk
+	header := make([]byte, encHeaderSize)
+	if fi.Size() < int64(encHeaderSize+encTagSize) {
+		f.Close()
+		return nil, &os.PathError{Op: "open", Path: name, Err: errEncryptedCorrupt}
+	}
+	if _, err := f.ReadAt(header, 0); err != nil || string(header[:len(encMagic)]) != encMagic {
+		f.Close()
+		return nil, &os.PathError{Op: "open", Path: name, Err: errEncryptedCorrupt}
+	}
+	nonce := header[len(encMagic) : len(encMagic)+12]
+	key, err := e.master.Open(nil, nonce, header[len(encMagic)+12:], []byte(encMagic))
+	if err != nil {
+		f.Close()
+		return nil, &os.PathError{Op: "open", Path: name, Err: errEncryptedCorrupt}
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &encReader{f: f, name: name, aead: aead, info: encFileInfo{FileInfo: fi, size: plainSize(fi.Size())}, cached: -1}, nil
+}
+
+// Contents are encrypted as they're written, so files can't be updated in place
+func (e *encryptedFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return e.Open(name)
+	}
+	if flag&(os.O_RDWR|os.O_APPEND) != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errors.ErrUnsupported}
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(encMagic)+12, encHeaderSize)
+	copy(header, encMagic)
+	if _, err := rand.Read(header[len(encMagic):]); err != nil {
+		return nil, err
+	}
+	header = e.master.Seal(header, header[len(encMagic):], key, []byte(encMagic))
+
+	f, err := e.fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|(flag&os.O_EXCL), perm)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(header); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	w, pr := newObjectWriter(name)
+	e.mu.Lock()
+	e.writing[name] = w
+	e.mu.Unlock()
+
+	go func() {
+		err := encryptChunks(f, pr, aead)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		pr.CloseWithError(err)
+
+		e.mu.Lock()
+		if e.writing[name] == w {
+			delete(e.writing, name)
+		}
+		e.mu.Unlock()
+		w.done <- err
+	}()
+	return w, nil
+}
+
+// Seal everything read from r in chunks, writing them to w. There's always a
+// last chunk, even if it's empty
+func encryptChunks(w io.Writer, r io.Reader, aead cipher.AEAD) error {
+	// Read one byte more than a chunk to know whether it's the last one
+	buf := make([]byte, encChunkSize+1)
+	sealed := make([]byte, 0, encChunkSize+encTagSize)
+	n, err := io.ReadFull(r, buf)
+	for idx := int64(0); ; idx++ {
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+		sealed = aead.Seal(sealed[:0], chunkNonce(idx), buf[:min(n, encChunkSize)], chunkAD(last))
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+
+		// Carry over the extra byte
+		buf[0] = buf[encChunkSize]
+		var m int
+		m, err = io.ReadFull(r, buf[1:])
+		n = m + 1
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+}
+
+// encReader decrypts an encrypted file as it's read
+type encReader struct {
+	f    File
+	name string
+	aead cipher.AEAD
+	info os.FileInfo
+
+	mu     sync.Mutex
+	offset int64  // For Read
+	cached int64  // Chunk in chunk, -1 if none yet
+	chunk  []byte // Decrypted contents of the last chunk read
+}
+
+func (r *encReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n, err := r.readAt(p, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *encReader) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.readAt(p, off)
+}
+
+func (r *encReader) readAt(p []byte, off int64) (int, error) {
+	size := r.info.Size()
+	n := 0
+	for n < len(p) {
+		if off >= size {
+			return n, io.EOF
+		}
+		idx := off / encChunkSize
+		if err := r.load(idx, size); err != nil {
+			return n, err
+		}
+		m := copy(p[n:], r.chunk[off-idx*encChunkSize:])
+		n += m
+		off += int64(m)
+	}
+	return n, nil
+}
+
+// Decrypt the idx-th chunk, unless it's the one we've got already
+func (r *encReader) load(idx int64, size int64) error {
+	if r.cached == idx {
+		return nil
+	}
+	lastIdx := int64(0)
+	if size > 0 {
+		lastIdx = (size - 1) / encChunkSize
+	}
+	plain := int64(encChunkSize)
+	if idx == lastIdx {
+		plain = size - idx*encChunkSize
+	}
+
+	sealed := make([]byte, plain+encTagSize)
+	if _, err := r.f.ReadAt(sealed, int64(encHeaderSize)+idx*(encChunkSize+encTagSize)); err != nil && err != io.EOF {
+		return err
+	}
+	chunk, err := r.aead.Open(r.chunk[:0], chunkNonce(idx), sealed, chunkAD(idx == lastIdx))
+	if err != nil {
+		r.cached = -1
+		return &os.PathError{Op: "read", Path: r.name, Err: errEncryptedCorrupt}
+	}
+	r.chunk = chunk
+	r.cached = idx
+	return nil
+}
+
+func (r *encReader) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: r.name, Err: os.ErrPermission}
+}
+
+func (r *encReader) WriteAt(p []byte, off int64) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: r.name, Err: os.ErrPermission}
+}
+
+func (r *encReader) Stat() (os.FileInfo, error) { return r.info, nil }
+func (r *encReader) Close() error               { return r.f.Close() }
+
+// Attributes are left to the underlying file system, except for sizes which
+// can't be changed without rewriting the whole file
+func (e *encryptedFS) Chmod(name string, mode os.FileMode) error {
+	if a, ok := e.fs.(AttrFileSystem); ok {
+		return a.Chmod(name, mode)
+	}
+	return &os.PathError{Op: "chmod", Path: name, Err: errors.ErrUnsupported}
+}
+
+func (e *encryptedFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if a, ok := e.fs.(AttrFileSystem); ok {
+		return a.Chtimes(name, atime, mtime)
+	}
+	return &os.PathError{Op: "chtimes", Path: name, Err: errors.ErrUnsupported}
+}
+
+func (e *encryptedFS) Chown(name string, uid int, gid int) error {
+	if a, ok := e.fs.(AttrFileSystem); ok {
+		return a.Chown(name, uid, gid)
+	}
+	return &os.PathError{Op: "chown", Path: name, Err: errors.ErrUnsupported}
+}
+
+func (e *encryptedFS) Truncate(name string, size int64) error {
+	fi, err := e.Stat(name)
+	if err != nil {
+		return err
+	}
+	if fi.Size() != size {
+		return &os.PathError{Op: "truncate", Path: name, Err: errors.ErrUnsupported}
+	}
+	return nil
+}
+
+// Links don't care about what's in the files
+func (e *encryptedFS) Link(oldname, newname string) error {
+	if l, ok := e.fs.(LinkFileSystem); ok {
+		return l.Link(oldname, newname)
+	}
+	return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: errors.ErrUnsupported}
+}
+
+func (e *encryptedFS) Symlink(oldname, newname string) error {
+	if l, ok := e.fs.(LinkFileSystem); ok {
+		return l.Symlink(oldname, newname)
+	}
+	return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: errors.ErrUnsupported}
+}
+
+func (e *encryptedFS) Readlink(name string) (string, error) {
+	if l, ok := e.fs.(LinkFileSystem); ok {
+		return l.Readlink(name)
+	}
+	return "", &os.PathError{Op: "readlink", Path: name, Err: errors.ErrUnsupported}
+}
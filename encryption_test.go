@@ -0,0 +1,83 @@
+package simplescp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestEncryptedFS(t *testing.T) {
+	mem := afero.NewMemMapFs()
+	key := make([]byte, 32)
+	rand.Read(key)
+	fsys, err := NewEncryptedFS(NewAferoFS(mem), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sizes around the chunk boundaries
+	for _, size := range []int{0, 1, encChunkSize - 1, encChunkSize, encChunkSize + 1, 3*encChunkSize + 100} {
+		contents := make([]byte, size)
+		rand.Read(contents)
+
+		// sftp clients can send writes out of order
+		f, err := fsys.OpenFile("/file", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		half := size / 2
+		f.WriteAt(contents[half:], int64(half))
+		f.WriteAt(contents[:half], 0)
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if fi, err := fsys.Stat("/file"); err != nil || fi.Size() != int64(size) {
+			t.Fatalf("Unexpected stat result for %d bytes %+v, %v", size, fi, err)
+		}
+		stored, _ := afero.ReadFile(mem, "/file")
+		// Short enough contents could turn up in the ciphertext by chance
+		if size >= 16 && bytes.Contains(stored, contents) {
+			t.Errorf("Contents stored unencrypted for %d bytes", size)
+		}
+
+		r, err := fsys.Open("/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := io.ReadAll(r)
+		if err != nil || !bytes.Equal(read, contents) {
+			t.Errorf("Unexpected contents reading %d bytes back, %v", size, err)
+		}
+		if size > 10 {
+			buf := make([]byte, 10)
+			if n, err := r.ReadAt(buf, int64(size-10)); err != nil || !bytes.Equal(buf[:n], contents[size-10:]) {
+				t.Errorf("Unexpected ReadAt result for %d bytes, %v", size, err)
+			}
+		}
+		r.Close()
+	}
+
+	// Dropping the last chunk doesn't go unnoticed
+	stored, _ := afero.ReadFile(mem, "/file")
+	afero.WriteFile(mem, "/file", stored[:encHeaderSize+encChunkSize+encTagSize], 0644)
+	r, err := fsys.Open("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err == nil {
+		t.Error("Expected an error reading a truncated file")
+	}
+	r.Close()
+
+	// Nor does using another key
+	rand.Read(key)
+	other, _ := NewEncryptedFS(NewAferoFS(mem), key)
+	if _, err := other.Open("/file"); err == nil {
+		t.Error("Expected an error opening a file with the wrong key")
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux && !darwin
+
+package simplescp
+
+import (
+	"os"
+	"syscall"
+)
+
+// Elsewhere (like on Windows) only the modification time is used
+func fileTimes(fi os.FileInfo) (mtime, atime syscall.Timespec, ok bool) {
+	return mtime, atime, false
+}
+
+type fileID struct{}
+
+// Hard links aren't told apart from other files
+func fileLinks(fi os.FileInfo) (id fileID, links uint64, ok bool) {
+	return id, 0, false
+}
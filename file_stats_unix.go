@@ -0,0 +1,31 @@
+//go:build linux || darwin
+
+package simplescp
+
+import (
+	"os"
+	"syscall"
+)
+
+// Modification and access times of a file on the local filesystem
+func fileTimes(fi os.FileInfo) (mtime, atime syscall.Timespec, ok bool) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return mtime, atime, false
+	}
+	return getLastModification(stat), getLastAccess(stat), true
+}
+
+// fileID tells files on the local filesystem apart, whatever name they're found by
+type fileID struct {
+	dev, ino uint64
+}
+
+// Which file fi is and how many hard links it has
+func fileLinks(fi os.FileInfo) (id fileID, links uint64, ok bool) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return id, 0, false
+	}
+	return fileID{uint64(stat.Dev), uint64(stat.Ino)}, uint64(stat.Nlink), true
+}
@@ -0,0 +1,139 @@
+package simplescp
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// ErrInvalidFileName is returned for files that can't be created with the name asked for
+var ErrInvalidFileName = errors.New("Invalid file name")
+
+// ErrFileNameTooLong is returned for files with names over the maximum length
+var ErrFileNameTooLong = errors.New("File name too long")
+
+// FileNamesConfig has the rules for the names of the files and directories
+// clients create
+type FileNamesConfig struct {
+	Policy    string `yaml:"policy" toml:"policy"`         // What to do with names breaking the rules: reject them, or rename the files. Default: Names aren't checked
+	ASCII     bool   `yaml:"ascii" toml:"ascii"`           // Only allow ASCII names, everything else is transliterated when renaming (é becomes e)
+	MaxLength int    `yaml:"max_length" toml:"max_length"` // Longest name allowed, in bytes. Default: No limit other than the file system's
+}
+
+const (
+	fileNamesReject = "reject"
+	fileNamesRename = "rename"
+)
+
+func (f FileNamesConfig) validate() error {
+	switch f.Policy {
+	case "", fileNamesReject, fileNamesRename:
+	default:
+		return fmt.Errorf("Invalid file names policy %q, it should be %s or %s", f.Policy, fileNamesReject, fileNamesRename)
+	}
+	if f.MaxLength < 0 {
+		return fmt.Errorf("Invalid maximum file name length %d", f.MaxLength)
+	}
+	return nil
+}
+
+// Check a name for a new file against the rules, returning the name it
+// should be created with instead if they say to rename it
+func (f FileNamesConfig) sanitize(name string) (string, error) {
+	// Never allowed, they'd cut the name short anywhere it's passed to the system
+	if strings.ContainsRune(name, 0) {
+		return "", ErrInvalidFileName
+	}
+	if len(f.Policy) == 0 {
+		return name, nil
+	}
+
+	clean := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	if f.ASCII {
+		clean = toASCII(clean)
+	}
+	// Separators can't be part of a name, and transliterating can make them
+	// (a fullwidth ／ is written as /)
+	clean = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, clean)
+	if clean != name && f.Policy == fileNamesReject {
+		return "", ErrInvalidFileName
+	}
+	if f.MaxLength > 0 && len(clean) > f.MaxLength {
+		if f.Policy == fileNamesReject {
+			return "", ErrFileNameTooLong
+		}
+		clean = shortenName(clean, f.MaxLength)
+	}
+	if len(clean) == 0 || clean == "." || clean == ".." {
+		return "", ErrInvalidFileName
+	}
+	return clean, nil
+}
+
+// Sanitize the last element of p, a slash separated path
+func (c Config) sanitizePath(p string) (string, error) {
+	i := strings.LastIndex(p, "/") + 1
+	name, err := c.FileNames.sanitize(p[i:])
+	if err != nil {
+		return "", err
+	}
+	if name != p[i:] {
+		c.logger().Info("Renaming file to follow the file name rules", "name", p[i:], "renamed", name)
+	}
+	return p[:i] + name, nil
+}
+
+// Letters that aren't an ASCII one with accents, and what they're written as
+var transliterations = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'Æ': "AE", 'œ': "oe", 'Œ': "OE", 'ø': "o", 'Ø': "O",
+	'ł': "l", 'Ł': "L", 'đ': "d", 'Đ': "D", 'ð': "d", 'Ð': "D", 'þ': "th", 'Þ': "Th",
+}
+
+// Write s with ASCII characters only, leaving accents out and replacing what
+// has no ASCII equivalent with _
+func toASCII(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFKD.String(s) {
+		switch {
+		case r < utf8.RuneSelf:
+			b.WriteRune(r)
+		case unicode.Is(unicode.Mn, r):
+			// Accents, split from their letters by NFKD
+		case len(transliterations[r]) > 0:
+			b.WriteString(transliterations[r])
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// Cut name down to max bytes, keeping its extension if there's room for it
+func shortenName(name string, max int) string {
+	ext := filepath.Ext(name)
+	if len(ext) >= max/2 {
+		ext = ""
+	}
+	stem := name[:len(name)-len(ext)]
+	n := max - len(ext)
+	// Without splitting a character in two
+	for n > 0 && !utf8.RuneStart(stem[n]) {
+		n--
+	}
+	return stem[:n] + ext
+}
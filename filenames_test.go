@@ -0,0 +1,89 @@
+package simplescp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSanitizeFileName(t *testing.T) {
+	reject := FileNamesConfig{Policy: fileNamesReject, ASCII: true, MaxLength: 12}
+	rename := FileNamesConfig{Policy: fileNamesRename, ASCII: true, MaxLength: 12}
+	for name, expected := range map[string]string{
+		"report.pdf":           "report.pdf",
+		"bad\nname":            "badname",
+		"\x1b[31mred":          "[31mred",
+		"résumé.pdf":           "resume.pdf",
+		"Straße":               "Strasse",
+		"日本":                   "__",
+		"a-very-long-name.txt": "a-very-l.txt",
+		"\x01\x02":             "",
+		"．．／．．／x":              ".._.._x",
+		"．．":                   "",
+		`a\b`:                  "a_b",
+	} {
+		renamed, err := rename.sanitize(name)
+		if len(expected) == 0 {
+			if err == nil {
+				t.Errorf("%q renamed to %q", name, renamed)
+			}
+		} else if err != nil || renamed != expected {
+			t.Errorf("%q renamed to %q (%v), expected %q", name, renamed, err, expected)
+		}
+		if _, err := reject.sanitize(name); (err == nil) != (name == expected) {
+			t.Errorf("%q rejected: %v", name, err)
+		}
+	}
+
+	for _, c := range []FileNamesConfig{{}, rename} {
+		if _, err := c.sanitize("nul\x00"); err == nil {
+			t.Errorf("Name with a NUL byte allowed with policy %q", c.Policy)
+		}
+	}
+	if name, _ := (FileNamesConfig{}).sanitize("bad\nname"); name != "bad\nname" {
+		t.Errorf("Name changed to %q without a policy", name)
+	}
+
+	// Renamed files stay in the directory they were created in
+	c := Config{FileNames: rename}
+	if p, err := c.sanitizePath("dir/．．／x"); err != nil || p != "dir/.._x" {
+		t.Errorf("Path with fullwidth separators sanitized to %q (%v)", p, err)
+	}
+}
+
+func TestSinkFileNameRules(t *testing.T) {
+	c := newTestConfig(t)
+	c.FileNames = FileNamesConfig{Policy: fileNamesRename, ASCII: true}
+	addr := startTestServer(t, c)
+
+	scp := startTestSCP(t, addr, "scp -r -t .")
+	scp.ack()
+	for _, step := range []func() error{
+		func() error { return scp.send("D0755 0 café\n") },
+		func() error { return scp.sendFile("bad\x1bname.txt", "hello") },
+		func() error { return scp.send("E\n") },
+	} {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scp.stdin.Close()
+	scp.session.Wait()
+	if data, err := os.ReadFile(filepath.Join(c.Dir, "cafe", "badname.txt")); err != nil || string(data) != "hello" {
+		t.Errorf("File not renamed: %q, %v", data, err)
+	}
+
+	c.FileNames.Policy = fileNamesReject
+	client := dialSFTP(t, startTestServer(t, c))
+	if _, err := client.Create("/café.txt"); err == nil {
+		t.Error("File with a name breaking the rules created")
+	}
+	if err := client.Mkdir("/bad\ndir"); err == nil {
+		t.Error("Directory with a name breaking the rules created")
+	}
+	if f, err := client.Create("/cafe.txt"); err != nil {
+		t.Error(err)
+	} else {
+		f.Close()
+	}
+}
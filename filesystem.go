@@ -0,0 +1,248 @@
+package simplescp
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FileSystem is where the files we serve are stored. Programs embedding
+// simplescp can provide their own (see Config.FileSystem), or adapt an
+// existing one with NewIOFS or NewAferoFS.
+//
+// Paths handed to it are absolute and clean. Errors should be *os.PathError,
+// wrapping the usual os.ErrNotExist, os.ErrExist, etc where they apply, so
+// they can be reported to clients. File systems that support changing file
+// attributes or links can also implement AttrFileSystem and LinkFileSystem.
+type FileSystem interface {
+	Open(name string) (File, error)
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.FileInfo, error)
+	Mkdir(name string, perm os.FileMode) error
+	MkdirAll(name string, perm os.FileMode) error
+	Rename(oldname, newname string) error
+	Remove(name string) error
+}
+
+// File is a file open in a FileSystem
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+// AttrFileSystem is implemented by file systems that can change the attributes of files
+type AttrFileSystem interface {
+	Chmod(name string, mode os.FileMode) error
+	Chtimes(name string, atime time.Time, mtime time.Time) error
+	Chown(name string, uid int, gid int) error
+	Truncate(name string, size int64) error
+}
+
+// LinkFileSystem is implemented by file systems that support hard and symbolic links
+type LinkFileSystem interface {
+	Link(oldname, newname string) error
+	Symlink(oldname, newname string) error
+	Readlink(name string) (string, error)
+}
+
+// osFileSystem stores files in the local filesystem
+type osFileSystem struct{}
+
+func (osFileSystem) Open(name string) (File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFileSystem) Stat(name string) (os.FileInfo, error)  { return os.Stat(name) }
+func (osFileSystem) Lstat(name string) (os.FileInfo, error) { return os.Lstat(name) }
+
+func (osFileSystem) ReadDir(name string) ([]os.FileInfo, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdir(0)
+}
+
+func (osFileSystem) Mkdir(name string, perm os.FileMode) error    { return os.Mkdir(name, perm) }
+func (osFileSystem) MkdirAll(name string, perm os.FileMode) error { return os.MkdirAll(name, perm) }
+func (osFileSystem) Rename(oldname, newname string) error         { return os.Rename(oldname, newname) }
+func (osFileSystem) Remove(name string) error                     { return os.Remove(name) }
+
+func (osFileSystem) Chmod(name string, mode os.FileMode) error { return os.Chmod(name, mode) }
+func (osFileSystem) Chown(name string, uid int, gid int) error { return os.Chown(name, uid, gid) }
+func (osFileSystem) Truncate(name string, size int64) error    { return os.Truncate(name, size) }
+func (osFileSystem) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (osFileSystem) Link(oldname, newname string) error    { return os.Link(oldname, newname) }
+func (osFileSystem) Symlink(oldname, newname string) error { return os.Symlink(oldname, newname) }
+func (osFileSystem) Readlink(name string) (string, error)  { return os.Readlink(name) }
+
+// The file system files are served from. The local one unless configured otherwise
+func (c Config) fileSystem() FileSystem {
+	if c.FileSystem != nil {
+		return c.FileSystem
+	}
+	return osFileSystem{}
+}
+
+// Check if files are stored in the local filesystem, so their paths mean something to other programs
+func (c Config) isLocal() bool {
+	_, ok := c.fileSystem().(osFileSystem)
+	return ok
+}
+
+// jailedFS looks files up by the paths clients see (with the shared directory
+// as /), so nothing outside of it can be reached by following symlinks
+type jailedFS struct {
+	FileSystem
+	config Config
+}
+
+func (j jailedFS) Stat(name string) (os.FileInfo, error) {
+	if j.config.deniedFile(name) {
+		return nil, os.ErrNotExist
+	}
+	p, err := j.config.resolvePath(name)
+	if err != nil {
+		return nil, err
+	}
+	return j.FileSystem.Stat(p)
+}
+
+func (j jailedFS) Lstat(name string) (os.FileInfo, error) {
+	if j.config.deniedFile(name) {
+		return nil, os.ErrNotExist
+	}
+	p, err := j.config.resolveLinkPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return j.FileSystem.Lstat(p)
+}
+
+func (j jailedFS) ReadDir(name string) ([]os.FileInfo, error) {
+	if j.config.deniedFile(name) {
+		return nil, os.ErrNotExist
+	}
+	p, err := j.config.resolvePath(name)
+	if err != nil {
+		return nil, err
+	}
+	files, err := j.FileSystem.ReadDir(p)
+	return j.config.listedFiles(files), err
+}
+
+// Same as filepath.Glob, but for any file system
+func glob(fsys FileSystem, pattern string) ([]string, error) {
+	// Check the pattern is well formed
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	if !hasMeta(pattern) {
+		if _, err := fsys.Lstat(pattern); err != nil {
+			return nil, nil
+		}
+		return []string{pattern}, nil
+	}
+
+	dir, pat := filepath.Split(pattern)
+	dir = cleanGlobPath(dir)
+	if !hasMeta(dir) {
+		return globDir(fsys, dir, pat, nil), nil
+	}
+
+	dirs, err := glob(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	var matches []string
+	for _, d := range dirs {
+		matches = globDir(fsys, d, pat, matches)
+	}
+	return matches, nil
+}
+
+// Append the entries of dir matching pattern to matches
+func globDir(fsys FileSystem, dir string, pattern string, matches []string) []string {
+	fi, err := fsys.Stat(dir)
+	if err != nil || !fi.IsDir() {
+		return matches
+	}
+	entries, err := fsys.ReadDir(dir)
+	if err != nil {
+		return matches
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		if ok, _ := filepath.Match(pattern, n); ok {
+			matches = append(matches, filepath.Join(dir, n))
+		}
+	}
+	return matches
+}
+
+func cleanGlobPath(p string) string {
+	switch p {
+	case "":
+		return "."
+	case string(filepath.Separator):
+		return p
+	}
+	return p[:len(p)-1] // Remove the trailing separator
+}
+
+func hasMeta(p string) bool {
+	return strings.ContainsAny(p, `*?[\`)
+}
+
+// Same as filepath.Walk, but for any file system. Errors are skipped
+func walk(fsys FileSystem, root string, fn func(p string, info os.FileInfo)) {
+	info, err := fsys.Lstat(root)
+	if err != nil {
+		return
+	}
+	fn(root, info)
+	if !info.IsDir() {
+		return
+	}
+	entries, err := fsys.ReadDir(root)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		p := filepath.Join(root, e.Name())
+		if e.IsDir() {
+			walk(fsys, p, fn)
+		} else {
+			fn(p, e)
+		}
+	}
+}
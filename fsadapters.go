@@ -0,0 +1,194 @@
+package simplescp
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// NewAferoFS serves files out of an afero file system
+func NewAferoFS(fsys afero.Fs) FileSystem {
+	return aferoFS{fsys}
+}
+
+type aferoFS struct {
+	fs afero.Fs
+}
+
+func (a aferoFS) Open(name string) (File, error) {
+	f, err := a.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (a aferoFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := a.fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (a aferoFS) Stat(name string) (os.FileInfo, error) { return a.fs.Stat(name) }
+
+func (a aferoFS) Lstat(name string) (os.FileInfo, error) {
+	if l, ok := a.fs.(afero.Lstater); ok {
+		fi, _, err := l.LstatIfPossible(name)
+		return fi, err
+	}
+	return a.fs.Stat(name)
+}
+
+func (a aferoFS) ReadDir(name string) ([]os.FileInfo, error) { return afero.ReadDir(a.fs, name) }
+func (a aferoFS) Mkdir(name string, perm os.FileMode) error  { return a.fs.Mkdir(name, perm) }
+func (a aferoFS) MkdirAll(name string, perm os.FileMode) error {
+	return a.fs.MkdirAll(name, perm)
+}
+func (a aferoFS) Rename(oldname, newname string) error { return a.fs.Rename(oldname, newname) }
+func (a aferoFS) Remove(name string) error             { return a.fs.Remove(name) }
+
+func (a aferoFS) Chmod(name string, mode os.FileMode) error { return a.fs.Chmod(name, mode) }
+func (a aferoFS) Chown(name string, uid int, gid int) error { return a.fs.Chown(name, uid, gid) }
+func (a aferoFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return a.fs.Chtimes(name, atime, mtime)
+}
+
+func (a aferoFS) Truncate(name string, size int64) error {
+	f, err := a.fs.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Truncate(size)
+}
+
+func (a aferoFS) Link(oldname, newname string) error {
+	return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: errors.ErrUnsupported}
+}
+
+func (a aferoFS) Symlink(oldname, newname string) error {
+	if l, ok := a.fs.(afero.Linker); ok {
+		return l.SymlinkIfPossible(oldname, newname)
+	}
+	return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: afero.ErrNoSymlink}
+}
+
+func (a aferoFS) Readlink(name string) (string, error) {
+	if l, ok := a.fs.(afero.LinkReader); ok {
+		return l.ReadlinkIfPossible(name)
+	}
+	return "", &os.PathError{Op: "readlink", Path: name, Err: afero.ErrNoReadlink}
+}
+
+// NewIOFS serves files out of an io/fs file system (e.g. an embed.FS).
+// Those are read only, so nothing can be uploaded or changed.
+func NewIOFS(fsys fs.FS) FileSystem {
+	return ioFS{fsys}
+}
+
+type ioFS struct {
+	fs fs.FS
+}
+
+// io/fs paths are relative and unrooted
+func ioFSPath(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	if len(name) == 0 {
+		return "."
+	}
+	return name
+}
+
+func (i ioFS) Open(name string) (File, error) {
+	f, err := i.fs.Open(ioFSPath(name))
+	if err != nil {
+		return nil, err
+	}
+	return &ioFSFile{File: f, name: name}, nil
+}
+
+func (i ioFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+	}
+	return i.Open(name)
+}
+
+func (i ioFS) Stat(name string) (os.FileInfo, error)  { return fs.Stat(i.fs, ioFSPath(name)) }
+func (i ioFS) Lstat(name string) (os.FileInfo, error) { return i.Stat(name) }
+
+func (i ioFS) ReadDir(name string) ([]os.FileInfo, error) {
+	entries, err := fs.ReadDir(i.fs, ioFSPath(name))
+	if err != nil {
+		return nil, err
+	}
+	files := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			// Went away while we were looking
+			continue
+		}
+		files = append(files, fi)
+	}
+	return files, nil
+}
+
+func (i ioFS) Mkdir(name string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrPermission}
+}
+
+// Directories that already exist are fine, we just can't create new ones
+func (i ioFS) MkdirAll(name string, perm os.FileMode) error {
+	if fi, err := i.Stat(name); err == nil && fi.IsDir() {
+		return nil
+	}
+	return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrPermission}
+}
+
+func (i ioFS) Rename(oldname, newname string) error {
+	return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrPermission}
+}
+
+func (i ioFS) Remove(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+}
+
+// ioFSFile is a file open in an io/fs file system
+type ioFSFile struct {
+	fs.File
+	name string
+	mu   sync.Mutex // Serializes ReadAt for files that can only seek
+}
+
+func (f *ioFSFile) ReadAt(p []byte, off int64) (int, error) {
+	if r, ok := f.File.(io.ReaderAt); ok {
+		return r.ReadAt(p, off)
+	}
+	s, ok := f.File.(io.ReadSeeker)
+	if !ok {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: errors.ErrUnsupported}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := s.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(s, p)
+}
+
+func (f *ioFSFile) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+}
+
+func (f *ioFSFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+}
@@ -0,0 +1,162 @@
+package simplescp
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestIOFS(t *testing.T) {
+	fsys := NewIOFS(fstest.MapFS{
+		"scpuser/file.txt": &fstest.MapFile{Data: []byte("hello world\n"), Mode: 0644},
+	})
+
+	files, err := fsys.ReadDir("/scpuser")
+	if err != nil || len(files) != 1 || files[0].Name() != "file.txt" || files[0].Size() != 12 {
+		t.Fatalf("Unexpected directory contents %v, %v", files, err)
+	}
+	if fi, err := fsys.Stat("/"); err != nil || !fi.IsDir() {
+		t.Errorf("Expected the root to be a directory, got %+v, %v", fi, err)
+	}
+
+	f, err := fsys.Open("/scpuser/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, 5)
+	if n, err := f.ReadAt(buf, 6); err != nil || string(buf[:n]) != "world" {
+		t.Errorf("Unexpected ReadAt result %q, %v", buf[:n], err)
+	}
+
+	if _, err := fsys.OpenFile("/scpuser/new.txt", os.O_WRONLY|os.O_CREATE, 0644); !os.IsPermission(err) {
+		t.Errorf("Expected a permission error creating a file, got %v", err)
+	}
+	if err := fsys.MkdirAll("/scpuser", 0755); err != nil {
+		t.Errorf("Expected MkdirAll of an existing directory to succeed, got %v", err)
+	}
+	if err := fsys.Remove("/scpuser/file.txt"); !os.IsPermission(err) {
+		t.Errorf("Expected a permission error removing a file, got %v", err)
+	}
+}
+
+func TestAferoFS(t *testing.T) {
+	fsys := NewAferoFS(afero.NewMemMapFs())
+
+	if err := fsys.MkdirAll("/scpuser", 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fsys.OpenFile("/scpuser/file.txt", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("world\n"), 6)
+	f.WriteAt([]byte("hello "), 0)
+	f.Close()
+
+	if err := fsys.(AttrFileSystem).Truncate("/scpuser/file.txt", 5); err != nil {
+		t.Fatal(err)
+	}
+	r, err := fsys.Open("/scpuser/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || string(contents) != "hello" {
+		t.Errorf("Unexpected contents %q, %v", contents, err)
+	}
+
+	if err := fsys.Rename("/scpuser/file.txt", "/scpuser/other.txt"); err != nil {
+		t.Fatal(err)
+	}
+	files, err := fsys.ReadDir("/scpuser")
+	if err != nil || len(files) != 1 || files[0].Name() != "other.txt" {
+		t.Errorf("Unexpected directory contents %v, %v", files, err)
+	}
+}
+
+func TestMemBackend(t *testing.T) {
+	c := NewConfig()
+	c.User, c.Password, c.Backend = "scpuser", "hunter2", "mem"
+	c.PrivateKeyFile, c.AuthKeysFile = "", ""
+	// Nothing's ever there on disk
+	c.Dir = filepath.Join(t.TempDir(), "scpuser")
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := c.FileSystem.Stat(c.Dir); err != nil || !fi.IsDir() {
+		t.Fatalf("No shared directory in memory: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(c)
+	go server.Serve(listener)
+	defer server.Shutdown(context.Background())
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "scpuser",
+		Auth:            []ssh.AuthMethod{ssh.Password("hunter2")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// Starts an scp command, for the test to speak the protocol with. The
+	// request's only answered once scp's done, so it can't be waited for
+	scp := func(cmd string) (io.WriteCloser, *bufio.Reader) {
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { session.Close() })
+		stdin, _ := session.StdinPipe()
+		stdout, _ := session.StdoutPipe()
+		go session.Start(cmd)
+		return stdin, bufio.NewReader(stdout)
+	}
+
+	stdin, stdout := scp("scp -t file.txt")
+	for _, msg := range []string{"C0644 5 file.txt\n", "hello\x00"} {
+		if ack, err := stdout.ReadByte(); err != nil || ack != 0 {
+			t.Fatalf("Got %v (%v) instead of an ack", ack, err)
+		}
+		io.WriteString(stdin, msg)
+	}
+	stdout.ReadByte()
+	stdin.Close()
+	f, err := c.FileSystem.Open(filepath.Join(c.Dir, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, _ := io.ReadAll(f)
+	f.Close()
+	if string(contents) != "hello" {
+		t.Errorf("Uploaded %q", contents)
+	}
+	if _, err := os.Stat(c.Dir); !os.IsNotExist(err) {
+		t.Errorf("Upload written to disk: %v", err)
+	}
+
+	stdin, stdout = scp("scp -f file.txt")
+	stdin.Write([]byte{0})
+	msg, _ := stdout.ReadString('\n')
+	stdin.Write([]byte{0})
+	data := make([]byte, 6)
+	io.ReadFull(stdout, data)
+	stdin.Write([]byte{0})
+	if msg != "C0644 5 file.txt\n" || string(data) != "hello\x00" {
+		t.Errorf("Downloaded %q with %q", msg, data)
+	}
+}
@@ -0,0 +1,316 @@
+package simplescp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+// GCSConfig holds the settings for the Google Cloud Storage backend.
+// Credentials are found through Application Default Credentials, and
+// STORAGE_EMULATOR_HOST points it at an emulator instead
+type GCSConfig struct {
+	Bucket string `yaml:"bucket" toml:"bucket"`
+	Prefix string `yaml:"prefix" toml:"prefix"` // Everything is stored under this prefix
+}
+
+// Files are uploaded in chunks of this size
+const gcsChunkSize = 16 << 20
+
+// gcsFileSystem stores files as objects in a GCS bucket, the same way
+// s3FileSystem does
+type gcsFileSystem struct {
+	bucket *storage.BucketHandle
+	prefix string
+
+	mu      sync.Mutex
+	writing map[string]*objectWriter // Files being uploaded, so they can be seen before they're done
+}
+
+func newGCSFileSystem(conf GCSConfig) (*gcsFileSystem, error) {
+	if len(conf.Bucket) == 0 {
+		return nil, errors.New("GCS backend needs a bucket")
+	}
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Can't set up GCS client: %v", err)
+	}
+
+	bucket := client.Bucket(conf.Bucket)
+	if _, err := bucket.Attrs(ctx); err != nil {
+		client.Close()
+		if errors.Is(err, storage.ErrBucketNotExist) {
+			return nil, fmt.Errorf("GCS bucket %q doesn't exist", conf.Bucket)
+		}
+		return nil, fmt.Errorf("Can't access GCS bucket %q: %v", conf.Bucket, err)
+	}
+	return newGCSBucketFileSystem(bucket, conf.Prefix), nil
+}
+
+func newGCSBucketFileSystem(bucket *storage.BucketHandle, prefix string) *gcsFileSystem {
+	return &gcsFileSystem{bucket: bucket, prefix: strings.Trim(prefix, "/"), writing: make(map[string]*objectWriter)}
+}
+
+// Name of the object holding a file. The root directory is the empty name
+func (g *gcsFileSystem) key(name string) string {
+	return strings.TrimPrefix(path.Join(g.prefix, filepath.ToSlash(name)), "/")
+}
+
+// Turn GCS errors into the errors we'd get from a local filesystem
+func gcsError(op string, name string, err error) error {
+	var apiErr *googleapi.Error
+	switch {
+	case errors.Is(err, storage.ErrObjectNotExist):
+		err = os.ErrNotExist
+	case errors.As(err, &apiErr) && (apiErr.Code == http.StatusForbidden || apiErr.Code == http.StatusUnauthorized):
+		err = os.ErrPermission
+	}
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+func (g *gcsFileSystem) Stat(name string) (os.FileInfo, error) {
+	key := g.key(name)
+	base := filepath.Base(name)
+	if len(key) == 0 || key == g.prefix {
+		return objectInfo{name: base, dir: true}, nil
+	}
+
+	g.mu.Lock()
+	w, ok := g.writing[key]
+	g.mu.Unlock()
+	if ok {
+		return w.Stat()
+	}
+
+	ctx := context.Background()
+	attrs, err := g.bucket.Object(key).Attrs(ctx)
+	if err == nil {
+		return objectInfo{name: base, size: attrs.Size, modTime: attrs.Updated}, nil
+	}
+	if !errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, gcsError("stat", name, err)
+	}
+
+	// Maybe it's a directory
+	it := g.bucket.Objects(ctx, &storage.Query{Prefix: dirPrefix(key)})
+	attrs, err = it.Next()
+	if err == iterator.Done {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	if err != nil {
+		return nil, gcsError("stat", name, err)
+	}
+	return objectInfo{name: base, dir: true, modTime: attrs.Updated}, nil
+}
+
+// There are no symlinks in GCS
+func (g *gcsFileSystem) Lstat(name string) (os.FileInfo, error) {
+	return g.Stat(name)
+}
+
+func (g *gcsFileSystem) ReadDir(name string) ([]os.FileInfo, error) {
+	prefix := dirPrefix(g.key(name))
+	var files []os.FileInfo
+	it := g.bucket.Objects(context.Background(), &storage.Query{Prefix: prefix, Delimiter: "/"})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, gcsError("readdir", name, err)
+		}
+		if len(attrs.Prefix) > 0 {
+			files = append(files, objectInfo{name: strings.TrimSuffix(strings.TrimPrefix(attrs.Prefix, prefix), "/"), dir: true})
+			continue
+		}
+		if attrs.Name == prefix {
+			// The directory's own marker
+			continue
+		}
+		files = append(files, objectInfo{name: strings.TrimPrefix(attrs.Name, prefix), size: attrs.Size, modTime: attrs.Updated})
+	}
+
+	if len(files) == 0 {
+		// Make sure the directory exists at all
+		fi, err := g.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			return nil, &os.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+		}
+	}
+	return files, nil
+}
+
+func (g *gcsFileSystem) Open(name string) (File, error) {
+	fi, err := g.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	obj := g.bucket.Object(g.key(name))
+	return newObjectReader(name, fi, func(off int64, length int64) (io.ReadCloser, error) {
+		r, err := obj.NewRangeReader(context.Background(), off, length)
+		if err != nil {
+			return nil, gcsError("read", name, err)
+		}
+		return r, nil
+	}), nil
+}
+
+// Objects can only be written in one go, so files can be opened either for
+// reading or creating/replacing them, but not for updating them in place
+func (g *gcsFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return g.Open(name)
+	}
+	if flag&(os.O_RDWR|os.O_APPEND) != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errors.ErrUnsupported}
+	}
+
+	fi, err := g.Stat(name)
+	if err == nil {
+		if fi.IsDir() {
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		}
+		if flag&os.O_EXCL != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+		}
+	} else if flag&os.O_CREATE == 0 {
+		return nil, err
+	}
+
+	key := g.key(name)
+	w, pr := newObjectWriter(name)
+	g.mu.Lock()
+	g.writing[key] = w
+	g.mu.Unlock()
+
+	go func() {
+		// Closing the writer stores whatever it got so far, so a failed upload
+		// has to be cancelled instead
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ow := g.bucket.Object(key).NewWriter(ctx)
+		ow.ChunkSize = gcsChunkSize
+		_, err := io.Copy(ow, pr)
+		if err == nil {
+			err = ow.Close()
+		}
+		pr.CloseWithError(err)
+
+		g.mu.Lock()
+		if g.writing[key] == w {
+			delete(g.writing, key)
+		}
+		g.mu.Unlock()
+		if err != nil {
+			err = gcsError("close", name, err)
+		}
+		w.done <- err
+	}()
+	return w, nil
+}
+
+func (g *gcsFileSystem) Mkdir(name string, perm os.FileMode) error {
+	if _, err := g.Stat(name); err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	return g.putMarker("mkdir", name)
+}
+
+// Parent directories don't need creating, they're implied by the object names
+func (g *gcsFileSystem) MkdirAll(name string, perm os.FileMode) error {
+	if fi, err := g.Stat(name); err == nil {
+		if !fi.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	return g.putMarker("mkdir", name)
+}
+
+func (g *gcsFileSystem) putMarker(op string, name string) error {
+	w := g.bucket.Object(dirPrefix(g.key(name))).NewWriter(context.Background())
+	if err := w.Close(); err != nil {
+		return gcsError(op, name, err)
+	}
+	return nil
+}
+
+func (g *gcsFileSystem) Remove(name string) error {
+	fi, err := g.Stat(name)
+	if err != nil {
+		return err
+	}
+	key := g.key(name)
+	if fi.IsDir() {
+		files, err := g.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		if len(files) > 0 {
+			return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+		key = dirPrefix(key)
+	}
+	err = g.bucket.Object(key).Delete(context.Background())
+	if err != nil && !(fi.IsDir() && errors.Is(err, storage.ErrObjectNotExist)) {
+		return gcsError("remove", name, err)
+	}
+	return nil
+}
+
+// Objects can't be renamed, so they're copied and then removed. Renaming a
+// directory means doing that for everything inside of it.
+func (g *gcsFileSystem) Rename(oldname, newname string) error {
+	fi, err := g.Stat(oldname)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return g.move(oldname, g.key(oldname), g.key(newname))
+	}
+
+	oldPrefix := dirPrefix(g.key(oldname))
+	newPrefix := dirPrefix(g.key(newname))
+	it := g.bucket.Objects(context.Background(), &storage.Query{Prefix: oldPrefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return gcsError("rename", oldname, err)
+		}
+		if err := g.move(oldname, attrs.Name, newPrefix+strings.TrimPrefix(attrs.Name, oldPrefix)); err != nil {
+			return err
+		}
+	}
+}
+
+func (g *gcsFileSystem) move(name string, from string, to string) error {
+	ctx := context.Background()
+	src := g.bucket.Object(from)
+	if _, err := g.bucket.Object(to).CopierFrom(src).Run(ctx); err != nil {
+		return gcsError("rename", name, err)
+	}
+	if err := src.Delete(ctx); err != nil {
+		return gcsError("rename", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package simplescp
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+)
+
+func TestGCSFileSystem(t *testing.T) {
+	server, err := fakestorage.NewServerWithOptions(fakestorage.Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.CreateBucketWithOpts(fakestorage.CreateBucketOpts{Name: "files"})
+	fsys := newGCSBucketFileSystem(server.Client().Bucket("files"), "srv")
+
+	if err := fsys.MkdirAll("/scpuser", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Mkdir("/scpuser", 0755); !os.IsExist(err) {
+		t.Errorf("Expected Mkdir to fail with an exists error, got %v", err)
+	}
+
+	// sftp clients can send writes out of order
+	f, err := fsys.OpenFile("/scpuser/file.txt", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("world\n"), 6)
+	f.WriteAt([]byte("hello "), 0)
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := fsys.Stat("/scpuser/file.txt")
+	if err != nil || fi.Size() != 12 || fi.IsDir() {
+		t.Fatalf("Unexpected stat result %+v, %v", fi, err)
+	}
+	if fi, err := fsys.Stat("/scpuser"); err != nil || !fi.IsDir() {
+		t.Fatalf("Expected a directory, got %+v, %v", fi, err)
+	}
+	if _, err := fsys.Stat("/nothing"); !os.IsNotExist(err) {
+		t.Errorf("Expected a not exist error, got %v", err)
+	}
+
+	// And read them out of order too
+	r, err := fsys.Open("/scpuser/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 6)
+	if n, err := r.ReadAt(buf, 6); err != nil || string(buf[:n]) != "world\n" {
+		t.Errorf("Unexpected ReadAt result %q, %v", buf[:n], err)
+	}
+	if n, err := r.ReadAt(buf, 0); err != nil || string(buf[:n]) != "hello " {
+		t.Errorf("Unexpected ReadAt result %q, %v", buf[:n], err)
+	}
+	if _, err := r.ReadAt(buf, 12); err != io.EOF {
+		t.Errorf("Expected EOF reading past the end, got %v", err)
+	}
+	r.Close()
+
+	if err := fsys.Rename("/scpuser", "/other"); err != nil {
+		t.Fatal(err)
+	}
+	files, err := fsys.ReadDir("/other")
+	if err != nil || len(files) != 1 || files[0].Name() != "file.txt" {
+		t.Errorf("Unexpected directory contents %v, %v", files, err)
+	}
+	if err := fsys.Remove("/other"); err == nil {
+		t.Error("Expected an error removing a directory that isn't empty")
+	}
+	if err := fsys.Remove("/other/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Remove("/other"); err != nil {
+		t.Fatal(err)
+	}
+	if files, err := fsys.ReadDir("/"); err != nil || len(files) != 0 {
+		t.Errorf("Expected an empty bucket, got %v, %v", files, err)
+	}
+}
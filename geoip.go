@@ -0,0 +1,99 @@
+package simplescp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoIPConfig holds the settings for filtering connections by the country
+// they come from, looked up in a MaxMind database (GeoLite2 or GeoIP2
+// Country or City). Countries are ISO 3166 codes, like US or DE
+type GeoIPConfig struct {
+	Database       string   `yaml:"database" toml:"database"`
+	AllowCountries []string `yaml:"allow_countries" toml:"allow_countries"` // Only accept connections from these countries
+	DenyCountries  []string `yaml:"deny_countries" toml:"deny_countries"`   // Never accept connections from these countries
+}
+
+func (g GeoIPConfig) enabled() bool {
+	return len(g.Database) > 0
+}
+
+func (g GeoIPConfig) validate() error {
+	for _, country := range append(append([]string{}, g.AllowCountries...), g.DenyCountries...) {
+		if len(strings.TrimSpace(country)) != 2 {
+			return fmt.Errorf("Invalid country code %q, it should be like US or DE", country)
+		}
+	}
+	return nil
+}
+
+// Whether connections from country can go ahead. Addresses without a country
+// (private ones, or missing from the database) only can if there's no allowlist
+func (g GeoIPConfig) allowedCountry(country string) bool {
+	for _, c := range g.DenyCountries {
+		if strings.EqualFold(strings.TrimSpace(c), country) {
+			return false
+		}
+	}
+	if len(g.AllowCountries) == 0 {
+		return true
+	}
+	for _, c := range g.AllowCountries {
+		if strings.EqualFold(strings.TrimSpace(c), country) {
+			return true
+		}
+	}
+	return false
+}
+
+// geoIPDB is an open MaxMind database, shared by all connections
+type geoIPDB struct {
+	path   string
+	reader *maxminddb.Reader
+}
+
+func openGeoIPDB(path string) (*geoIPDB, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Can't open GeoIP database %s: %v", path, err)
+	}
+	if !strings.Contains(reader.Metadata.DatabaseType, "Country") && !strings.Contains(reader.Metadata.DatabaseType, "City") {
+		reader.Close()
+		return nil, fmt.Errorf("Can't use GeoIP database %s: it's a %s database, not a Country or City one", path, reader.Metadata.DatabaseType)
+	}
+	return &geoIPDB{path: path, reader: reader}, nil
+}
+
+// The fields we need from Country and City records
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// Country code for the address, or an empty string if it's not in the database
+func (db *geoIPDB) country(addr net.Addr) (string, error) {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return "", errors.New("not a TCP address")
+	}
+	var record geoIPRecord
+	if err := db.reader.Lookup(tcp.IP, &record); err != nil {
+		return "", err
+	}
+	if len(record.Country.ISOCode) > 0 {
+		return record.Country.ISOCode, nil
+	}
+	return record.RegisteredCountry.ISOCode, nil
+}
+
+func (db *geoIPDB) Close() error {
+	return db.reader.Close()
+}
@@ -0,0 +1,80 @@
+package simplescp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Writes the smallest MaxMind database that works: IPv4 only, with just
+// 192.0.2.0/24 in it, in country
+func writeTestGeoIPDB(t *testing.T, country string) string {
+	t.Helper()
+	str := func(s string) []byte { return append([]byte{0x40 | byte(len(s))}, s...) }
+	uint16Field := func(v uint16) []byte { return []byte{0xa2, byte(v >> 8), byte(v)} }
+	uint32Field := func(v uint32) []byte { return []byte{0xc4, byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)} }
+	mapOf := func(kv ...[]byte) []byte { return append([]byte{0xe0 | byte(len(kv)/2)}, bytes.Join(kv, nil)...) }
+
+	const nodes = 24
+	var db bytes.Buffer
+	prefix := binary.BigEndian.Uint32(net.ParseIP("192.0.2.0").To4())
+	for i := 0; i < nodes; i++ {
+		next := uint32(i + 1)
+		if i == nodes-1 {
+			next = nodes + 16 // First thing in the data section
+		}
+		records := [2]uint32{nodes, nodes} // Not in the database
+		records[prefix>>(31-i)&1] = next
+		for _, r := range records {
+			db.Write([]byte{byte(r >> 16), byte(r >> 8), byte(r)})
+		}
+	}
+	db.Write(make([]byte, 16))
+	db.Write(mapOf(str("country"), mapOf(str("iso_code"), str(country))))
+	db.WriteString("\xab\xcd\xefMaxMind.com")
+	db.Write(mapOf(
+		str("binary_format_major_version"), uint16Field(2),
+		str("binary_format_minor_version"), uint16Field(0),
+		str("database_type"), str("GeoLite2-Country"),
+		str("ip_version"), uint16Field(4),
+		str("node_count"), uint32Field(nodes),
+		str("record_size"), uint16Field(24)))
+
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	if err := os.WriteFile(path, db.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGeoIP(t *testing.T) {
+	db, err := openGeoIPDB(writeTestGeoIPDB(t, "DE"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for addr, expected := range map[string]string{"192.0.2.10": "DE", "198.51.100.1": ""} {
+		country, err := db.country(&net.TCPAddr{IP: net.ParseIP(addr), Port: 40000})
+		if err != nil || country != expected {
+			t.Errorf("Country for %s: %q (%v), expected %q", addr, country, err, expected)
+		}
+	}
+
+	allow := GeoIPConfig{AllowCountries: []string{"de", "US"}}
+	if !allow.allowedCountry("DE") || allow.allowedCountry("FR") || allow.allowedCountry("") {
+		t.Error("Allowed countries not applied")
+	}
+	deny := GeoIPConfig{DenyCountries: []string{"FR"}}
+	if !deny.allowedCountry("DE") || deny.allowedCountry("FR") || !deny.allowedCountry("") {
+		t.Error("Denied countries not applied")
+	}
+	if err := (GeoIPConfig{AllowCountries: []string{"Germany"}}).validate(); err == nil {
+		t.Error("Invalid country code accepted")
+	}
+	if _, err := openGeoIPDB(filepath.Join(t.TempDir(), "missing.mmdb")); err == nil {
+		t.Error("Missing database opened")
+	}
+}
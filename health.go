@@ -0,0 +1,100 @@
+package simplescp
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Health is the state the health endpoints report:
+//
+//	GET /healthz: 200 if the server is live (see Live), 503 otherwise
+//	GET /readyz: 200 if it's ready for connections (see Ready), 503 otherwise
+//
+// They're served by the admin API without needing its token, and on
+// Admin.HealthListen on their own, for Kubernetes probes and load balancer
+// health checks.
+type Health struct {
+	Listening    bool `json:"listening"`     // The SSH listeners are bound and being served
+	HostKeys     int  `json:"host_keys"`     // How many host keys are loaded
+	ShuttingDown bool `json:"shutting_down"` // Shutdown has been called, the active connections are being drained
+}
+
+// Live reports whether the server has what it needs to serve clients
+func (h Health) Live() bool {
+	return h.HostKeys > 0
+}
+
+// Ready reports whether the server should be sent new connections: it's live,
+// listening and not shutting down
+func (h Health) Ready() bool {
+	return h.Live() && h.Listening && !h.ShuttingDown
+}
+
+// Health returns the state of the server, as the health endpoints see it
+func (s *Server) Health() Health {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Health{
+		Listening:    len(s.listeners) > 0,
+		HostKeys:     len(s.Config().hostKeys),
+		ShuttingDown: s.inShutdown,
+	}
+}
+
+// HealthHandler returns the handler of the health endpoints (see Health), for
+// programs that want to serve them themselves
+func (s *Server) HealthHandler() http.Handler {
+	mux := http.NewServeMux()
+	check := func(ok func(Health) bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			health := s.Health()
+			status, code := "ok", http.StatusOK
+			if !ok(health) {
+				status, code = "unavailable", http.StatusServiceUnavailable
+			}
+			writeAdminJSON(w, code, struct {
+				Status string `json:"status"`
+				Health
+			}{status, health})
+		}
+	}
+	mux.HandleFunc("GET /healthz", check(Health.Live))
+	mux.HandleFunc("GET /readyz", check(Health.Ready))
+	return mux
+}
+
+// Whether path is one of the health endpoints
+func isHealthPath(path string) bool {
+	return path == "/healthz" || path == "/readyz"
+}
+
+// Start serving the health endpoints on Admin.HealthListen, if it's set, until
+// Shutdown
+func (s *Server) startHealth() error {
+	addr := s.Config().Admin.HealthListen
+	if len(addr) == 0 {
+		return nil
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Can't start health endpoints: %v", err)
+	}
+	server := &http.Server{
+		Handler:      s.HealthHandler(),
+		ReadTimeout:  adminTimeout,
+		WriteTimeout: adminTimeout,
+	}
+	s.mu.Lock()
+	if s.inShutdown {
+		s.mu.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	s.health = server
+	s.mu.Unlock()
+
+	s.Config().logger().Info("Serving health endpoints", "addr", listener.Addr().String())
+	go server.Serve(listener)
+	return nil
+}
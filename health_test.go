@@ -0,0 +1,99 @@
+package simplescp
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	c := newTestConfig(t)
+	c.Admin.Token = "s3cret"
+	c.Admin.HealthListen = "127.0.0.1:" + freePort(t)
+	c.Port = freePort(t)
+	c.Listen = []string{"127.0.0.1"}
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(c)
+	health := "http://" + c.Admin.HealthListen
+
+	check := func(path string, expected int) Health {
+		t.Helper()
+		var h Health
+		if status := adminRequest(t, "GET", health+path, "", &h); status != expected {
+			t.Errorf("Got %d from %s, expected %d", status, path, expected)
+		}
+		return h
+	}
+	done := make(chan error)
+	go func() { done <- server.ListenAndServe() }()
+	var client *ssh.Client
+	var err error
+	for i := 0; i < 50; i++ {
+		client, err = ssh.Dial("tcp", "127.0.0.1:"+c.Port, &ssh.ClientConfig{
+			User:            "scpuser",
+			Auth:            []ssh.AuthMethod{ssh.Password("hunter2")},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := check("/readyz", http.StatusOK); !h.Listening || h.HostKeys == 0 || h.ShuttingDown {
+		t.Errorf("Unexpected health %+v", h)
+	}
+	check("/healthz", http.StatusOK)
+	// The rest of the admin API isn't there
+	check("/sessions", http.StatusNotFound)
+
+	// Draining isn't ready for more connections, but it's still live
+	shutdown := make(chan error)
+	go func() { shutdown <- server.Shutdown(context.Background()) }()
+	for !server.shuttingDown() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if h := check("/readyz", http.StatusServiceUnavailable); !h.ShuttingDown {
+		t.Errorf("Unexpected health while shutting down %+v", h)
+	}
+	check("/healthz", http.StatusOK)
+	client.Close()
+	<-shutdown
+	if err := <-done; err != ErrServerClosed {
+		t.Errorf("ListenAndServe returned %v after shutting down", err)
+	}
+	if _, err := net.Dial("tcp", c.Admin.HealthListen); err == nil {
+		t.Error("Health endpoints still served after shutting down")
+	}
+}
+
+func TestAdminHealthEndpoints(t *testing.T) {
+	c := newTestConfig(t)
+	c.Admin.Token = "s3cret"
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	api := httptest.NewServer(NewServer(c).AdminHandler())
+	defer api.Close()
+
+	// Host keys are loaded, but nothing's listening yet. Probes don't need the token
+	var h Health
+	if status := adminRequest(t, "GET", api.URL+"/healthz", "", &h); status != http.StatusOK || h.HostKeys == 0 {
+		t.Errorf("Got %d and %+v from /healthz", status, h)
+	}
+	if status := adminRequest(t, "GET", api.URL+"/readyz", "", &h); status != http.StatusServiceUnavailable || h.Listening {
+		t.Errorf("Got %d and %+v from /readyz before listening", status, h)
+	}
+	if (Health{Listening: true}).Ready() {
+		t.Error("Ready without host keys")
+	}
+}
@@ -0,0 +1,293 @@
+package simplescp
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+func validateHostKeyType(keyType string) error {
+	switch keyType {
+	case "", "ed25519", "ecdsa", "rsa":
+		return nil
+	}
+	return fmt.Errorf("Invalid host key type %q, it should be ed25519, ecdsa or rsa", keyType)
+}
+
+// Size of generated RSA keys, unless told otherwise
+const defaultRSABits = 3072
+
+// Generate a new private key of keyType: ed25519 (the default), ecdsa or rsa
+func generateHostKey(keyType string) (crypto.Signer, error) {
+	return generateKey(keyType, 0)
+}
+
+// Same with bits for RSA keys (defaultRSABits if 0) and ECDSA ones (256, 384
+// or 521, 256 if 0)
+func generateKey(keyType string, bits int) (crypto.Signer, error) {
+	if err := validateHostKeyType(keyType); err != nil {
+		return nil, err
+	}
+	switch keyType {
+	case "ecdsa":
+		switch bits {
+		case 0, 256:
+			return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		case 384:
+			return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		case 521:
+			return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+		}
+		return nil, fmt.Errorf("Invalid ECDSA key size %d, it should be 256, 384 or 521", bits)
+	case "rsa":
+		if bits == 0 {
+			bits = defaultRSABits
+		}
+		if bits < 2048 {
+			return nil, fmt.Errorf("Invalid RSA key size %d, it should be at least 2048", bits)
+		}
+		return rsa.GenerateKey(rand.Reader, bits)
+	}
+	if bits != 0 {
+		return nil, fmt.Errorf("Ed25519 keys don't have a size to choose")
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	return key, err
+}
+
+// Generate a new host key and save it to file, so the server keeps the same
+// identity from then on
+func (c *Config) createHostKey(file string) ([]byte, error) {
+	key, err := generateHostKey(c.HostKeyType)
+	if err != nil {
+		return nil, err
+	}
+	privateBytes, err := writePrivateKey(file, key, "")
+	if err != nil {
+		return nil, fmt.Errorf("Can't create host key: %v", err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	c.logger().Warn("Generated a new host key", "file", file, "type", signer.PublicKey().Type(),
+		"fingerprint", ssh.FingerprintSHA256(signer.PublicKey()))
+	return privateBytes, nil
+}
+
+// KeyOptions describes a key for GenerateKeyFile to make
+type KeyOptions struct {
+	Type    string // ed25519, ecdsa or rsa. Default: ed25519
+	Bits    int    // Size of RSA keys (default 3072) and ECDSA ones (256, 384 or 521, default 256)
+	Comment string // Saved with the key and after the public key, like user@host for client keys
+}
+
+// GenerateKeyFile generates a private key and saves it to file in OpenSSH
+// format, along with its public key in authorized_keys format in file.pub.
+// Both work as a host key or as a client's key. Files that already exist
+// aren't overwritten
+func GenerateKeyFile(file string, opts KeyOptions) (ssh.Signer, error) {
+	key, err := generateKey(opts.Type, opts.Bits)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(file + ".pub"); err == nil {
+		return nil, fmt.Errorf("%s.pub already exists", file)
+	}
+	if _, err := writePrivateKey(file, key, opts.Comment); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(file+".pub", AuthorizedKey(signer.PublicKey(), opts.Comment), 0644); err != nil {
+		os.Remove(file)
+		return nil, err
+	}
+	return signer, nil
+}
+
+// AuthorizedKey returns key as a line of an authorized_keys file, with the
+// comment after it if there's one
+func AuthorizedKey(key ssh.PublicKey, comment string) []byte {
+	line := ssh.MarshalAuthorizedKey(key)
+	if len(comment) > 0 {
+		line = append(bytes.TrimSuffix(line, []byte("\n")), " "+comment+"\n"...)
+	}
+	return line
+}
+
+// Save key to file in OpenSSH format, returning what's been written
+func writePrivateKey(file string, key crypto.Signer, comment string) ([]byte, error) {
+	block, err := ssh.MarshalPrivateKey(key, comment)
+	if err != nil {
+		return nil, err
+	}
+	privateBytes := pem.EncodeToMemory(block)
+
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return nil, err
+	}
+	// Don't overwrite a key something else has just created
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(privateBytes); err != nil {
+		f.Close()
+		os.Remove(file)
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(file)
+		return nil, err
+	}
+	return privateBytes, nil
+}
+
+// Parse a host key, decrypting it if it's protected with a passphrase
+func (c *Config) parseHostKey(file string, privateBytes []byte) (ssh.Signer, error) {
+	key, err := ssh.ParsePrivateKey(privateBytes)
+	var missing *ssh.PassphraseMissingError
+	if err != nil && !errors.As(err, &missing) {
+		return nil, fmt.Errorf("Failed to parse private key %s: %v", file, err)
+	}
+	if err == nil {
+		return key, nil
+	}
+
+	passphrase, err := c.hostKeyPassphrase(file)
+	if err != nil {
+		return nil, err
+	}
+	key, err = ssh.ParsePrivateKeyWithPassphrase(privateBytes, passphrase)
+	if errors.Is(err, x509.IncorrectPasswordError) {
+		return nil, fmt.Errorf("Wrong passphrase for private key %s", file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse private key %s: %v", file, err)
+	}
+	return key, nil
+}
+
+// The passphrase for encrypted host keys: from the config, the passphrase file,
+// or asked for on the terminal if there's one. The same one is used for all keys
+func (c *Config) hostKeyPassphrase(file string) ([]byte, error) {
+	if len(c.HostKeyPassphrase) > 0 {
+		return []byte(c.HostKeyPassphrase), nil
+	}
+	if len(c.HostKeyPassphraseFile) > 0 {
+		passphrase, err := ioutil.ReadFile(c.HostKeyPassphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("Can't read host key passphrase: %v", err)
+		}
+		return bytes.TrimRight(passphrase, "\r\n"), nil
+	}
+	// Reloads reuse what was typed in on start, there's nobody to ask by then
+	if len(c.promptedPassphrase) > 0 {
+		return c.promptedPassphrase, nil
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("Private key %s is encrypted, set host_key_passphrase or host_key_passphrase_file", file)
+	}
+	fmt.Fprintf(os.Stderr, "Passphrase for %s: ", file)
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read host key passphrase: %v", err)
+	}
+	c.promptedPassphrase = passphrase
+	return passphrase, nil
+}
+
+// Load the host keys from PrivateKeyFile, HostKeyFiles and the ssh-agent, or
+// generate a random one if there aren't any. PrivateKeyFile is created if it
+// doesn't exist yet
+func (c *Config) initPrivateKey() error {
+	c.hostKeys = nil
+	c.extraHostKeys = nil
+	if err := validateHostKeyType(c.HostKeyType); err != nil {
+		return err
+	}
+	files := c.HostKeyFiles
+	if len(c.PrivateKeyFile) > 0 {
+		files = append([]string{c.PrivateKeyFile}, files...)
+	}
+	if len(files) == 0 && !c.HostKeyAgent {
+		if c.generatedKey == nil {
+			c.logger().Debug("Generating random private key...")
+			key, err := generateHostKey(c.HostKeyType)
+			if err != nil {
+				return err
+			}
+			c.generatedKey, _ = ssh.NewSignerFromKey(key)
+			c.logger().Debug("Done")
+		}
+		c.hostKeys = []ssh.Signer{c.generatedKey}
+		return nil
+	}
+
+	loaded := make(map[string]string)
+	add := func(key ssh.Signer, source string) {
+		keyType := key.PublicKey().Type()
+		fingerprint := ssh.FingerprintSHA256(key.PublicKey())
+		// Handshakes only ever use one key of each type, the first one. The
+		// rest are just advertised to clients, so they learn about them
+		// before they replace the current ones
+		if other, ok := loaded[keyType]; ok {
+			c.logger().Info("Loaded host key, only advertising it since there's already one of its type",
+				"file", source, "type", keyType, "fingerprint", fingerprint, "in_use", other)
+			c.extraHostKeys = append(c.extraHostKeys, key)
+			return
+		}
+		loaded[keyType] = source
+		c.hostKeys = append(c.hostKeys, key)
+		c.logger().Info("Loaded host key", "file", source, "type", keyType, "fingerprint", fingerprint)
+	}
+
+	for _, file := range files {
+		privateBytes, err := ioutil.ReadFile(file)
+		if errors.Is(err, fs.ErrNotExist) && file == c.PrivateKeyFile {
+			privateBytes, err = c.createHostKey(file)
+			if err != nil {
+				return err
+			}
+		} else if err != nil {
+			return fmt.Errorf("Can't load private key: %v", err)
+		}
+		key, err := c.parseHostKey(file, privateBytes)
+		if err != nil {
+			return err
+		}
+		add(key, file)
+	}
+
+	if c.HostKeyAgent {
+		keys, err := c.agentHostKeys()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			add(key, "ssh-agent")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package simplescp
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Writes key to a file in dir, in OpenSSH format
+func writeTestHostKey(t *testing.T, dir, name string, key interface{}) string {
+	t.Helper()
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestHostKeys(t *testing.T) {
+	dir := t.TempDir()
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, otherEdKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	c := Config{
+		PrivateKeyFile: writeTestHostKey(t, dir, "ed25519", edKey),
+		HostKeyFiles:   []string{writeTestHostKey(t, dir, "ecdsa", ecKey)},
+	}
+	if err := c.initPrivateKey(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.hostKeys) != 2 || c.hostKeys[0].PublicKey().Type() != ssh.KeyAlgoED25519 || c.hostKeys[1].PublicKey().Type() != ssh.KeyAlgoECDSA256 {
+		t.Errorf("Unexpected host keys %v", c.hostKeys)
+	}
+
+	// Keys of a type that's already there are only advertised
+	c.HostKeyFiles = append(c.HostKeyFiles, writeTestHostKey(t, dir, "ed25519_2", otherEdKey))
+	if err := c.initPrivateKey(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.hostKeys) != 2 || len(c.extraHostKeys) != 1 || len(c.advertisedHostKeys()) != 3 {
+		t.Errorf("Unexpected host keys %v, extra %v", c.hostKeys, c.extraHostKeys)
+	}
+
+	c = Config{}
+	if err := c.initPrivateKey(); err != nil || len(c.hostKeys) != 1 {
+		t.Errorf("Expected a random host key, got %v (%v)", c.hostKeys, err)
+	}
+}
+
+func TestGenerateHostKey(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys", "host_key")
+	c := Config{PrivateKeyFile: file, HostKeyType: "ecdsa"}
+	if err := c.initPrivateKey(); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("Generated host key has mode %v", fi.Mode().Perm())
+	}
+	if c.hostKeys[0].PublicKey().Type() != ssh.KeyAlgoECDSA256 {
+		t.Errorf("Generated a %s key", c.hostKeys[0].PublicKey().Type())
+	}
+
+	// Next time it's loaded rather than generated again
+	generated := c.hostKeys[0].PublicKey()
+	c = Config{PrivateKeyFile: file}
+	if err := c.initPrivateKey(); err != nil {
+		t.Fatal(err)
+	}
+	if !keysEqual(c.hostKeys[0].PublicKey(), generated) {
+		t.Error("Host key changed after being generated")
+	}
+
+	c = Config{PrivateKeyFile: filepath.Join(t.TempDir(), "host_key"), HostKeyType: "dsa"}
+	if err := c.initPrivateKey(); err == nil {
+		t.Error("Invalid host key type accepted")
+	}
+}
+
+func TestGenerateKeyFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "id_ecdsa")
+	signer, err := GenerateKeyFile(file, KeyOptions{Type: "ecdsa", Bits: 384, Comment: "alice@example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer.PublicKey().Type() != ssh.KeyAlgoECDSA384 {
+		t.Errorf("Generated a %s key", signer.PublicKey().Type())
+	}
+	if fi, err := os.Stat(file); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("Private key has mode %v, %v", fi.Mode().Perm(), err)
+	}
+	privateBytes, _ := os.ReadFile(file)
+	if key, err := ssh.ParsePrivateKey(privateBytes); err != nil || !keysEqual(key.PublicKey(), signer.PublicKey()) {
+		t.Errorf("Saved a different private key: %v", err)
+	}
+	pub, _ := os.ReadFile(file + ".pub")
+	key, comment, _, _, err := ssh.ParseAuthorizedKey(pub)
+	if err != nil || !keysEqual(key, signer.PublicKey()) || comment != "alice@example" {
+		t.Errorf("Unexpected public key file %q: %v", pub, err)
+	}
+
+	if _, err := GenerateKeyFile(file, KeyOptions{}); err == nil {
+		t.Error("Overwrote a key")
+	}
+	for _, opts := range []KeyOptions{{Type: "rsa", Bits: 1024}, {Type: "ecdsa", Bits: 300}, {Bits: 256}, {Type: "dsa"}} {
+		if _, err := GenerateKeyFile(filepath.Join(t.TempDir(), "key"), opts); err == nil {
+			t.Errorf("Generated a key with %+v", opts)
+		}
+	}
+}
+
+func TestEncryptedHostKey(t *testing.T) {
+	dir := t.TempDir()
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte("s3cret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "host_key")
+	if err := os.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	passphraseFile := filepath.Join(dir, "passphrase")
+	if err := os.WriteFile(passphraseFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []Config{
+		{PrivateKeyFile: file, HostKeyPassphrase: "s3cret"},
+		{PrivateKeyFile: file, HostKeyPassphraseFile: passphraseFile},
+	} {
+		if err := c.initPrivateKey(); err != nil {
+			t.Fatal(err)
+		}
+		if len(c.hostKeys) != 1 {
+			t.Errorf("Unexpected host keys %v", c.hostKeys)
+		}
+	}
+
+	c := Config{PrivateKeyFile: file, HostKeyPassphrase: "hunter2"}
+	if err := c.initPrivateKey(); err == nil || !strings.Contains(err.Error(), "Wrong passphrase") {
+		t.Errorf("Unexpected error for a wrong passphrase: %v", err)
+	}
+}
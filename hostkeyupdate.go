@@ -0,0 +1,104 @@
+package simplescp
+
+import (
+	"bytes"
+	"crypto/rand"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// OpenSSH's host key update extension (see PROTOCOL in the OpenSSH sources):
+// once a client has logged in we tell it about all our host keys, and it can
+// ask us to prove we have the private keys before adding them to known_hosts.
+// That way keys can be rotated without clients getting scary warnings
+const (
+	hostKeysRequest      = "hostkeys-00@openssh.com"
+	hostKeysProveRequest = "hostkeys-prove-00@openssh.com"
+)
+
+// Every key clients should know about, the ones in use and the ones coming up
+func (c Config) advertisedHostKeys() []ssh.Signer {
+	return append(append([]ssh.Signer{}, c.hostKeys...), c.extraHostKeys...)
+}
+
+// Tell the client about our host keys
+func (c Config) sendHostKeys(conn ssh.Conn) {
+	var payload []byte
+	for _, key := range c.advertisedHostKeys() {
+		payload = append(payload, ssh.Marshal(struct{ Key []byte }{key.PublicKey().Marshal()})...)
+	}
+	if _, _, err := conn.SendRequest(hostKeysRequest, false, payload); err != nil {
+		c.log.Debug("Can't send host keys", "err", err)
+	}
+}
+
+// Sign each of the keys the client asks about, along with the session ID, to
+// show we've got their private keys. Returns false if we don't know about any
+// of them
+func (c Config) proveHostKeys(sessionID, payload []byte) ([]byte, bool) {
+	var response []byte
+	for len(payload) > 0 {
+		var blob struct {
+			Key  []byte
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(payload, &blob); err != nil {
+			return nil, false
+		}
+		payload = blob.Rest
+
+		var signer ssh.Signer
+		for _, key := range c.advertisedHostKeys() {
+			if bytes.Equal(key.PublicKey().Marshal(), blob.Key) {
+				signer = key
+				break
+			}
+		}
+		if signer == nil {
+			return nil, false
+		}
+
+		data := ssh.Marshal(struct {
+			Request   string
+			SessionID []byte
+			Key       []byte
+		}{hostKeysProveRequest, sessionID, blob.Key})
+		var sig *ssh.Signature
+		var err error
+		if algSigner, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+			// Clients don't take SHA-1 signatures anymore
+			sig, err = algSigner.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSASHA512)
+		} else {
+			sig, err = signer.Sign(rand.Reader, data)
+		}
+		if err != nil {
+			c.log.Warn("Can't sign with host key", "fingerprint", ssh.FingerprintSHA256(signer.PublicKey()), "err", err)
+			return nil, false
+		}
+		response = append(response, ssh.Marshal(struct{ Sig []byte }{ssh.Marshal(sig)})...)
+	}
+	return response, true
+}
+
+// Handle the global requests of a connection: the host key proofs, and
+// declining everything else
+func (c Config) handleGlobalRequests(conn ssh.Conn, reqs <-chan *ssh.Request) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.logPanic("global request", r)
+			conn.Close()
+		}
+	}()
+	for req := range reqs {
+		switch req.Type {
+		case hostKeysProveRequest:
+			response, ok := c.proveHostKeys(conn.SessionID(), req.Payload)
+			req.Reply(ok, response)
+		default:
+			c.log.Debug("Ignoring global request", "type", req.Type)
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package simplescp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"log/slog"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestProveHostKeys(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	edSigner, _ := ssh.NewSignerFromKey(edKey)
+	rsaSigner, _ := ssh.NewSignerFromKey(rsaKey)
+	c := Config{hostKeys: []ssh.Signer{edSigner}, extraHostKeys: []ssh.Signer{rsaSigner}, log: slog.Default()}
+
+	sessionID := []byte("session")
+	var payload []byte
+	for _, signer := range []ssh.Signer{edSigner, rsaSigner} {
+		payload = append(payload, ssh.Marshal(struct{ Key []byte }{signer.PublicKey().Marshal()})...)
+	}
+	response, ok := c.proveHostKeys(sessionID, payload)
+	if !ok {
+		t.Fatal("Couldn't prove our own host keys")
+	}
+
+	for _, signer := range []ssh.Signer{edSigner, rsaSigner} {
+		var proof struct {
+			Sig  []byte
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(response, &proof); err != nil {
+			t.Fatal(err)
+		}
+		response = proof.Rest
+		var sig ssh.Signature
+		if err := ssh.Unmarshal(proof.Sig, &sig); err != nil {
+			t.Fatal(err)
+		}
+		data := ssh.Marshal(struct {
+			Request   string
+			SessionID []byte
+			Key       []byte
+		}{hostKeysProveRequest, sessionID, signer.PublicKey().Marshal()})
+		if err := signer.PublicKey().Verify(data, &sig); err != nil {
+			t.Errorf("Bad proof for %s key: %v", signer.PublicKey().Type(), err)
+		}
+		if signer == rsaSigner && sig.Format != ssh.KeyAlgoRSASHA512 {
+			t.Errorf("RSA key signed with %s", sig.Format)
+		}
+	}
+
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherSigner, _ := ssh.NewSignerFromKey(otherKey)
+	if _, ok := c.proveHostKeys(sessionID, ssh.Marshal(struct{ Key []byte }{otherSigner.PublicKey().Marshal()})); ok {
+		t.Error("Proved a key we don't have")
+	}
+}
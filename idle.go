@@ -0,0 +1,86 @@
+package simplescp
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// idleChannel closes a channel once nothing's been sent or received through
+// it for a while, so sessions that go silent don't hang around forever
+type idleChannel struct {
+	ssh.Channel
+	timeout    time.Duration
+	lastActive atomic.Int64 // Unix nanoseconds
+	log        *slog.Logger
+	cancel     context.CancelCauseFunc
+	done       chan struct{}
+	stopOnce   sync.Once
+}
+
+// Wrap channel so it gets closed after timeout without any activity, and
+// cancel called to stop what's being done in it. A zero timeout means sessions
+// can stay idle forever. The returned function stops watching the channel, it
+// should be called once it's done with
+func watchIdle(channel ssh.Channel, timeout time.Duration, log *slog.Logger, cancel context.CancelCauseFunc) (ssh.Channel, func()) {
+	if timeout <= 0 {
+		return channel, func() {}
+	}
+	ic := &idleChannel{Channel: channel, timeout: timeout, log: log, cancel: cancel, done: make(chan struct{})}
+	ic.touch()
+	go ic.watch()
+	return ic, ic.stop
+}
+
+func (ic *idleChannel) touch() {
+	ic.lastActive.Store(time.Now().UnixNano())
+}
+
+func (ic *idleChannel) stop() {
+	ic.stopOnce.Do(func() { close(ic.done) })
+}
+
+func (ic *idleChannel) watch() {
+	timer := time.NewTimer(ic.timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ic.done:
+			return
+		case <-timer.C:
+			idle := time.Since(time.Unix(0, ic.lastActive.Load()))
+			if idle >= ic.timeout {
+				ic.log.Info("Closing idle session", "idle_timeout", ic.timeout.String())
+				ic.cancel(errIdleTimeout)
+				ic.Channel.Close()
+				return
+			}
+			timer.Reset(ic.timeout - idle)
+		}
+	}
+}
+
+func (ic *idleChannel) Read(data []byte) (int, error) {
+	n, err := ic.Channel.Read(data)
+	if n > 0 {
+		ic.touch()
+	}
+	return n, err
+}
+
+func (ic *idleChannel) Write(data []byte) (int, error) {
+	// Writes can take a while with slow clients, they count as activity until they're done
+	ic.touch()
+	n, err := ic.Channel.Write(data)
+	ic.touch()
+	return n, err
+}
+
+func (ic *idleChannel) Close() error {
+	ic.stop()
+	return ic.Channel.Close()
+}
@@ -0,0 +1,52 @@
+package simplescp
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type testChannel struct {
+	ssh.Channel
+	closed atomic.Bool
+}
+
+func (c *testChannel) Write(data []byte) (int, error) { return len(data), nil }
+func (c *testChannel) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+func TestIdleTimeout(t *testing.T) {
+	underlying := &testChannel{}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	channel, stop := watchIdle(underlying, 200*time.Millisecond, slog.Default(), cancel)
+	defer stop()
+
+	// Keeping busy keeps it open
+	for i := 0; i < 5; i++ {
+		time.Sleep(100 * time.Millisecond)
+		channel.Write([]byte("x"))
+	}
+	if underlying.closed.Load() {
+		t.Fatal("Active channel closed")
+	}
+	time.Sleep(400 * time.Millisecond)
+	if !underlying.closed.Load() {
+		t.Error("Idle channel not closed")
+	}
+	if !errors.Is(context.Cause(ctx), errIdleTimeout) {
+		t.Errorf("Got cause %v for idle channel, expected %v", context.Cause(ctx), errIdleTimeout)
+	}
+
+	c := Config{IdleTimeout: time.Minute}
+	if c.userIdleTimeout(nil) != time.Minute || c.userIdleTimeout(&User{IdleTimeout: time.Hour}) != time.Hour {
+		t.Error("Per user idle timeout not applied")
+	}
+}
@@ -1,18 +1,18 @@
-package main
+package simplescp
 
 import (
 	"bufio"
 	"crypto/rand"
-	"crypto/rsa"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
 	"math/big"
 	"os"
+	"path/filepath"
+	"strings"
 	"unicode"
 
-	"github.com/FranGM/simplelog"
 	"github.com/kelseyhightower/envconfig"
+	"github.com/spf13/afero"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -34,21 +34,36 @@ func randString(n int) string {
 	return string(bs)
 }
 
-func (c *scpConfig) initPassword() error {
+func (c *Config) initPassword() error {
 	c.passwords = make(map[string]string)
 
-	scpPasswd := os.Getenv("SIMPLESCP_PASS")
+	scpPasswd := c.Password
 	// TODO: This doesn't allow for setting the password to ""
 	if len(scpPasswd) == 0 {
-		scpPasswd = randString(15)
-		simplelog.Info.Printf("Generating random password for user %v: %q", c.User, scpPasswd)
+		if len(c.generatedPassword) == 0 {
+			c.generatedPassword = randString(15)
+			c.logger().Info("Generated random password", "user", c.User, "password", c.generatedPassword)
+		}
+		scpPasswd = c.generatedPassword
 	}
 
+	if isPasswordHash(scpPasswd) {
+		if err := validatePasswordHash(scpPasswd); err != nil {
+			return fmt.Errorf("Can't use password hash for %s: %v", c.User, err)
+		}
+	}
 	c.passwords[c.User] = scpPasswd
+
+	if len(c.TOTPSecret) > 0 {
+		if _, err := decodeTOTPSecret(c.TOTPSecret); err != nil {
+			return fmt.Errorf("Can't use TOTP secret for %s: %v", c.User, err)
+		}
+		c.logger().Info("Asking for a verification code after the password", "user", c.User)
+	}
 	return nil
 }
 
-func (c *scpConfig) initAuthKeys() error {
+func (c *Config) initAuthKeys() error {
 	c.AuthKeys = make(map[string][]ssh.PublicKey)
 	c.AuthKeys[c.User] = make([]ssh.PublicKey, 0)
 
@@ -63,75 +78,535 @@ func (c *scpConfig) initAuthKeys() error {
 	}
 	defer f.Close()
 
-	scanner := bufio.NewScanner(f)
+	c.AuthKeys[c.User] = c.readKeys(f, c.AuthKeysFile)
+	c.logger().Info("Loaded authorized keys", "file", c.AuthKeysFile, "keys", len(c.AuthKeys[c.User]))
+	return nil
+}
+
+func (c *Config) initUserCAKeys() error {
+	c.userCAKeys = nil
+	if len(c.TrustedUserCAKeys) == 0 {
+		return nil
+	}
+
+	f, err := os.Open(c.TrustedUserCAKeys)
+	if err != nil {
+		return fmt.Errorf("Can't open trusted user CA keys: %v", err)
+	}
+	defer f.Close()
+
+	c.userCAKeys = c.readKeys(f, c.TrustedUserCAKeys)
+	c.logger().Info("Loaded trusted user CA keys", "file", c.TrustedUserCAKeys, "keys", len(c.userCAKeys))
+	return nil
+}
+
+func (c *Config) initRevokedKeys() error {
+	c.revokedKeys = nil
+	if len(c.RevokedKeysFile) == 0 {
+		return nil
+	}
+
+	revoked, err := loadRevokedKeys(c.RevokedKeysFile)
+	if err != nil {
+		return err
+	}
+	c.logger().Info("Loaded revoked keys", "file", c.RevokedKeysFile)
+	c.revokedKeys = revoked
+	return nil
+}
+
+// Read public keys in authorized_keys format, skipping the ones that can't be parsed
+func (c *Config) readKeys(r io.Reader, file string) []ssh.PublicKey {
+	keys := make([]ssh.PublicKey, 0)
+	scanner := bufio.NewScanner(r)
 
 	for scanner.Scan() {
-		pk, err := parsePubKey(scanner.Text())
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pk, err := parsePubKey(line)
 		if err != nil {
-			simplelog.Warning.Printf("Error when parsing public key, ignoring: %q", err)
+			c.logger().Warn("Error when parsing public key, ignoring", "file", file, "err", err)
 			continue
 		}
-		c.AuthKeys[c.User] = append(c.AuthKeys[c.User], pk)
+		keys = append(keys, pk)
 	}
-
-	simplelog.Info.Printf("loaded %d authorized keys", len(c.AuthKeys[c.User]))
-	return nil
+	return keys
 }
 
-func (c *scpConfig) initPrivateKey() error {
-	privateBytes, err := ioutil.ReadFile(c.PrivateKeyFile)
+// Init loads the password, host key and authorized keys referenced by the config.
+// It needs to be called before the config is handed over to a Server.
+func (c *Config) Init() error {
+	if c.Logger == nil {
+		logger, err := NewLogger(os.Stderr, c.LogFormat, c.LogLevel)
+		if err != nil {
+			return err
+		}
+		c.Logger = logger
+	}
+
+	c.logger().Info("Allowing logins", "user", c.User)
+	c.logger().Info("Sharing files", "dir", c.Dir)
+	if c.ReadOnly && c.WriteOnly {
+		c.logger().Warn("Both read_only and write_only are set, users won't be able to do anything")
+	}
+
+	err := c.initPassword()
 	if err != nil {
-		if len(c.PrivateKeyFile) > 0 {
-			return fmt.Errorf("Can't load private key: %v", err)
+		return err
+	}
+	if c.usage == nil {
+		c.usage = newUsageTracker()
+	}
+	if c.conns == nil {
+		c.conns = newConnCounter()
+	}
+	if c.sessions == nil {
+		c.sessions = newSessionList()
+	}
+	if c.authFailures == nil {
+		c.authFailures = newFailureTrend()
+	}
+
+	if len(c.PAMService) > 0 {
+		if !pamSupported {
+			return fmt.Errorf("Can't use PAM service %s: PAM support not built in, build with -tags pam", c.PAMService)
+		}
+		c.logger().Info("Checking passwords with PAM", "service", c.PAMService)
+	}
+
+	if c.LDAP.enabled() {
+		if err := c.LDAP.validate(); err != nil {
+			return err
+		}
+		c.logger().Info("Checking passwords with LDAP", "url", c.LDAP.URL)
+	}
+
+	if c.RADIUS.enabled() {
+		if err := c.RADIUS.validate(); err != nil {
+			return err
+		}
+		c.logger().Info("Checking passwords with RADIUS", "servers", c.RADIUS.Servers)
+	}
+
+	if c.Anonymous.Enabled {
+		if err := c.validateAnonymous(); err != nil {
+			return err
+		}
+		c.logger().Info("Allowing anonymous logins", "user", c.Anonymous.user(), "dir", c.Anonymous.Dir)
+	}
+
+	c.banner = ""
+	if len(c.BannerFile) > 0 {
+		banner, err := os.ReadFile(c.BannerFile)
+		if err != nil {
+			return fmt.Errorf("Can't read banner: %v", err)
+		}
+		c.banner = string(banner)
+		if !strings.HasSuffix(c.banner, "\n") {
+			c.banner += "\n"
+		}
+	}
+
+	if err := c.validateAlgorithms(); err != nil {
+		return err
+	}
+	if err := c.validateListen(); err != nil {
+		return err
+	}
+	if err := validateOutsideSymlinks(c.OutsideSymlinks); err != nil {
+		return err
+	}
+	if err := validateSymlinks(c.Symlinks); err != nil {
+		return err
+	}
+	if err := validatePartialUploads(c.PartialUploads); err != nil {
+		return err
+	}
+	if err := c.FileNames.validate(); err != nil {
+		return err
+	}
+	if err := c.SFTP.validate(); err != nil {
+		return err
+	}
+	if err := c.Admin.validate(); err != nil {
+		return err
+	}
+	if err := c.Dashboard.validate(); err != nil {
+		return err
+	}
+	if err := validateChecksum(c.Checksum); err != nil {
+		return err
+	}
+
+	c.denyFiles = nil
+	if len(c.DenyFiles) > 0 {
+		if c.denyFiles, err = newFileFilter(c.DenyFiles); err != nil {
+			return err
+		}
+	}
+	c.hideFiles = nil
+	if len(c.HideFiles) > 0 {
+		if c.hideFiles, err = newFileFilter(c.HideFiles); err != nil {
+			return err
+		}
+	}
+
+	c.ipFilter = nil
+	if len(c.AllowCIDRs) > 0 || len(c.DenyCIDRs) > 0 {
+		if c.ipFilter, err = newIPFilter(c.AllowCIDRs, c.DenyCIDRs); err != nil {
+			return err
+		}
+		c.logger().Info("Filtering connections by address", "allow", c.AllowCIDRs, "deny", c.DenyCIDRs)
+	}
+
+	c.proxyFrom = nil
+	if c.ProxyProtocol && len(c.ProxyProtocolFrom) == 0 {
+		return errProxyProtocolFrom
+	}
+	if len(c.ProxyProtocolFrom) > 0 {
+		if c.proxyFrom, err = newIPFilter(c.ProxyProtocolFrom, nil); err != nil {
+			return err
+		}
+	}
+	if c.ProxyProtocol {
+		c.logger().Info("Expecting PROXY protocol headers", "from", c.ProxyProtocolFrom)
+	}
+
+	if c.GeoIP.enabled() {
+		if err := c.GeoIP.validate(); err != nil {
+			return err
+		}
+		if c.geoIP == nil || c.geoIP.path != c.GeoIP.Database {
+			if c.geoIP, err = openGeoIPDB(c.GeoIP.Database); err != nil {
+				return err
+			}
+		}
+		c.logger().Info("Filtering connections by country", "database", c.GeoIP.Database,
+			"allow", c.GeoIP.AllowCountries, "deny", c.GeoIP.DenyCountries)
+	} else {
+		c.geoIP = nil
+	}
+
+	if c.AuthRateLimit > 0 {
+		// Keep counting attempts across reloads, unless the limits changed
+		if c.authLimiter == nil || !c.authLimiter.sameSettings(c.AuthRateLimit, c.AuthRateBurst) {
+			c.authLimiter = newAuthLimiter(c.AuthRateLimit, c.AuthRateBurst)
 		}
-		simplelog.Debug.Printf("Generating random private key...")
-		key, _ := rsa.GenerateKey(rand.Reader, 2048)
-		c.privateKey, _ = ssh.NewSignerFromKey(key)
-		simplelog.Debug.Printf("Done")
+		c.logger().Info("Limiting authentication attempts", "per_minute", c.AuthRateLimit, "burst", c.authLimiter.burst)
 	} else {
-		c.privateKey, err = ssh.ParsePrivateKey(privateBytes)
+		c.authLimiter = nil
+	}
+
+	if c.BanThreshold > 0 {
+		// Bans survive reloads
+		if c.bans == nil {
+			c.bans = newBanList()
+		}
+		c.bans.configure(c.BanThreshold, c.BanDuration, c.BanMaxDuration)
+		c.logger().Info("Banning clients after failed logins", "threshold", c.BanThreshold)
+	} else {
+		c.bans = nil
+	}
+
+	c.jwks = nil
+	if c.JWT.enabled() {
+		if err := c.JWT.validate(); err != nil {
+			return err
+		}
+		c.jwks = newJWKSCache(c.JWT.JWKSURL)
+		c.logger().Info("Accepting tokens as passwords", "jwks_url", c.JWT.JWKSURL, "issuer", c.JWT.Issuer)
+	}
+
+	if c.Scan.enabled() {
+		if err := c.Scan.validate(); err != nil {
+			return err
+		}
+		c.logger().Info("Scanning uploads for viruses", "clamd", c.Scan.Clamd, "command", c.Scan.Command)
+	}
+
+	if err := c.validateRsync(); err != nil {
+		return err
+	}
+
+	err = c.initPrivateKey()
+	if err != nil {
+		return err
+	}
+
+	err = c.initAuthKeys()
+	if err != nil {
+		c.logger().Error(err.Error())
+	}
+
+	if len(c.AuthKeysCommand) > 0 {
+		if _, err := parseAuthKeysCommand(c.AuthKeysCommand); err != nil {
+			return err
+		}
+		c.logger().Info("Looking up authorized keys with command", "command", c.AuthKeysCommand)
+	}
+
+	err = c.initUserCAKeys()
+	if err != nil {
+		return err
+	}
+
+	err = c.initRevokedKeys()
+	if err != nil {
+		return err
+	}
+
+	for _, w := range c.Webhooks {
+		if err := w.validate(); err != nil {
+			return err
+		}
+	}
+
+	if len(c.UploadCommand) > 0 {
+		if _, err := parseUploadCommand(c.UploadCommand); err != nil {
+			return err
+		}
+		c.logger().Info("Running command after uploads", "command", c.UploadCommand)
+	}
+
+	err = c.initFileSystem()
+	if err != nil {
+		return err
+	}
+
+	err = c.initTransferLog()
+	if err != nil {
+		return err
+	}
+
+	if len(c.RecordDir) > 0 {
+		if err := os.MkdirAll(c.RecordDir, 0700); err != nil {
+			return fmt.Errorf("Can't create record_dir: %v", err)
+		}
+		c.logger().Info("Recording sessions", "dir", c.RecordDir, "contents", c.RecordContents)
+	}
+
+	return c.initUserStore()
+}
+
+func (c *Config) initFileSystem() error {
+	if c.FileSystem != nil {
+		return nil
+	}
+
+	switch strings.ToLower(c.Backend) {
+	case "", "os":
+		c.FileSystem = osFileSystem{}
+	case "s3":
+		fs, err := newS3FileSystem(c.S3)
+		if err != nil {
+			return err
+		}
+		c.logger().Info("Storing files in S3", "bucket", c.S3.Bucket, "prefix", c.S3.Prefix)
+		c.FileSystem = fs
+	case "gcs":
+		fs, err := newGCSFileSystem(c.GCS)
 		if err != nil {
-			return fmt.Errorf("Failed to parse private key: %v", err)
+			return err
 		}
-		simplelog.Debug.Printf("Get private key from " + c.PrivateKeyFile)
-		// TODO: At this point we've generated a new private key so store it in ~/.simplescp/keys for the next time
+		c.logger().Info("Storing files in GCS", "bucket", c.GCS.Bucket, "prefix", c.GCS.Prefix)
+		c.FileSystem = fs
+	case "azure":
+		fs, err := newAzureFileSystem(c.Azure)
+		if err != nil {
+			return err
+		}
+		c.logger().Info("Storing files in Azure", "container", c.Azure.Container, "prefix", c.Azure.Prefix)
+		c.FileSystem = fs
+	case "mem":
+		c.logger().Warn("Storing files in memory, they'll be gone when the server stops")
+		fs := NewAferoFS(afero.NewMemMapFs())
+		// It starts out empty, without the directory we share (per user
+		// directories are made when the users log in)
+		if !strings.Contains(c.Dir, userPlaceholder) {
+			if err := fs.MkdirAll(filepath.Clean(c.Dir), 0755); err != nil {
+				return err
+			}
+		}
+		c.FileSystem = fs
+	default:
+		return fmt.Errorf("Unknown storage backend %q, expected os, s3, gcs, azure or mem", c.Backend)
+	}
+
+	if len(c.EncryptionKeyFile) > 0 {
+		key, err := LoadEncryptionKey(c.EncryptionKeyFile)
+		if err != nil {
+			return err
+		}
+		fs, err := NewEncryptedFS(c.FileSystem, key)
+		if err != nil {
+			return err
+		}
+		c.logger().Info("Encrypting stored files", "key_file", c.EncryptionKeyFile)
+		c.FileSystem = fs
 	}
 	return nil
 }
 
-// Initialize global config based in environment variables (or their defaults)
+func (c *Config) initTransferLog() error {
+	if c.transferLog != nil || len(c.TransferLog) == 0 {
+		return nil
+	}
+
+	l, err := openTransferLog(c.TransferLog, c.TransferLogFormat)
+	if err != nil {
+		return err
+	}
+	c.logger().Info("Logging transfers", "file", c.TransferLog, "format", l.format, "checksum", c.checksumAlgorithm())
+	c.transferLog = l
+	return nil
+}
+
+func (c *Config) initUserStore() error {
+	if c.UserStore != nil || len(c.UserDB) == 0 {
+		return nil
+	}
+
+	store, err := OpenSQLiteUserStore(c.UserDB)
+	if err != nil {
+		return err
+	}
+	c.logger().Info("Using user database", "file", c.UserDB)
+	c.UserStore = store
+	return nil
+}
+
+// ReadConfig builds a config out of the defaults, the given config file (if any)
+// and environment variables, in increasing order of precedence.
 // Environment variables:
-//   SIMPLESCP_DIR: Directory to share. Nothing outside of it will be accessible. Default: Working directory
-//   SIMPLESCP_PORT: Port we'll be listening in. Default: 2222
+//   SIMPLESCP_DIR: Directory to share. Nothing outside of it will be accessible. %u is replaced by the username. Default: Working directory
+//   SIMPLESCP_PORT: Port we'll be listening in, 0 for any free one (it's logged). Default: 2222
+//   SIMPLESCP_LISTEN: Addresses to listen on, comma separated (e.g. "127.0.0.1:22,[::1]:2222,10.0.0.5"). The ones without a port use SIMPLESCP_PORT. Default: 0.0.0.0
+//   SIMPLESCP_REUSEPORT: Listen with this many sockets with SO_REUSEPORT on each address, accepting connections in parallel. Other simplescp processes can also listen on the same port then, e.g. while replacing this one. Default: 0 (one socket, without SO_REUSEPORT)
 //   SIMPLESCP_USER: Username for connecting to this server. Default: scpuser
-//   SIMPLESCP_PASS: Password used for connecting to this server. Default: One will be generated randomly
-//   SIMPLESCP_PRIVATEKEYFILE: Location for the private key that will identify this server. Default: One will be generated randomly
+//   SIMPLESCP_PASS: Password used for connecting to this server, or a bcrypt or argon2id hash of it. Default: One will be generated randomly
+//   SIMPLESCP_TOTPSECRET: Base32 TOTP secret asked for as a second factor after the password. Default: Just the password
+//   SIMPLESCP_PAMSERVICE: PAM service to also check passwords against, letting system accounts log in (needs -tags pam). Default: None
+//   SIMPLESCP_LDAP_URL: LDAP directory to also check passwords against (ldap:// or ldaps://). Default: None
+//   SIMPLESCP_LDAP_USERDN: DN to bind as to check a password, e.g. "uid=%u,ou=people,dc=example,dc=com". Default: Search for the user
+//   SIMPLESCP_LDAP_BINDDN, SIMPLESCP_LDAP_BINDPASSWORD, SIMPLESCP_LDAP_BASEDN, SIMPLESCP_LDAP_USERFILTER: Where and how to search for users. Default filter: (uid=%u)
+//   SIMPLESCP_LDAP_STARTTLS, SIMPLESCP_LDAP_CACERTFILE, SIMPLESCP_LDAP_INSECURESKIPVERIFY: TLS settings for the directory
+//   SIMPLESCP_LDAP_GROUPS, SIMPLESCP_LDAP_GROUPATTRIBUTE: Groups (comma separated DNs) allowed to log in, and the attribute listing them. Default: Anyone, memberOf
+//   SIMPLESCP_LDAP_HOMEDIRATTRIBUTE: Attribute with the user's directory, absolute or relative to SIMPLESCP_DIR. Default: SIMPLESCP_DIR
+//   SIMPLESCP_RADIUS_SERVERS: RADIUS servers (comma separated host:port) to also check passwords against, tried in order. Default: None
+//   SIMPLESCP_RADIUS_SECRET, SIMPLESCP_RADIUS_TIMEOUT, SIMPLESCP_RADIUS_NASIDENTIFIER: Shared secret, how long to wait for each server and NAS-Identifier. Default timeout: 5s
+//   SIMPLESCP_ANONYMOUS_ENABLED: Let clients logging in as SIMPLESCP_ANONYMOUS_USER in without credentials. Default: false
+//   SIMPLESCP_ANONYMOUS_USER, SIMPLESCP_ANONYMOUS_DIR: Username for anonymous clients, and the directory they all share. Default user: anonymous
+//   SIMPLESCP_ANONYMOUS_PERMISSIONS, SIMPLESCP_ANONYMOUS_QUOTA, SIMPLESCP_ANONYMOUS_MAXFILESIZE: What anonymous clients can do, read or write (drop box), and how much they can upload (0 for no limit). Default: read, 100M quota
+//   SIMPLESCP_JWT_JWKSURL, SIMPLESCP_JWT_ISSUER, SIMPLESCP_JWT_AUDIENCE: Accept JWTs signed with these keys, for this issuer and audience, as passwords. Default: None
+//   SIMPLESCP_JWT_USERNAMECLAIM, SIMPLESCP_JWT_PERMISSIONSCLAIM: Claims with the username and (optionally) permissions. Default: sub, all permissions
+//   SIMPLESCP_PRIVATEKEYFILE: Location for the private key that will identify this server, generated if it doesn't exist. Empty for a random key on every start. Default: ~/.simplescp/host_key (or ~/.ssh/id_rsa if it's there)
+//   SIMPLESCP_HOSTKEYTYPE: Type of the private key generated: ed25519, ecdsa or rsa. Default: ed25519
+//   SIMPLESCP_HOSTKEYPASSPHRASE, SIMPLESCP_HOSTKEYPASSPHRASEFILE: Passphrase for encrypted private keys, or a file with it. Default: Asked for on the terminal
+//   SIMPLESCP_HOSTKEYFILES: More private keys identifying this server (comma separated). Keys of a type there's already one of are only advertised to clients, for rotating keys. Default: None
+//   SIMPLESCP_HOSTKEYAGENT: Also use the keys in the ssh-agent at SSH_AUTH_SOCK to identify this server (set SIMPLESCP_PRIVATEKEYFILE to "" to only use those). Default: false
+//   SIMPLESCP_HOSTKEYAGENTKEYS: SHA256 fingerprints (comma separated) of the agent keys to use. Default: All of them
+//   SIMPLESCP_BANNERFILE: File with a message shown to clients before they log in (e.g. a legal notice). Default: None
 //   SIMPLESCP_AUTHKEYSFILE: Location of the authorized keys file for this server. Default: No pubkey authentication
-func initSettings() *scpConfig {
+//   SIMPLESCP_AUTHKEYSCOMMAND: Command printing more authorized keys for the user logging in (e.g. "/usr/local/bin/keys %u"). Default: None
+//   SIMPLESCP_TRUSTEDUSERCAKEYS: File with the CA keys whose user certificates are accepted, in authorized_keys format. Default: No certificate authentication
+//   SIMPLESCP_REVOKEDKEYSFILE: Public keys (one per line) or OpenSSH key revocation list of keys and certificates that are never accepted. Default: None
+//   SIMPLESCP_KEYEXCHANGES, SIMPLESCP_CIPHERS, SIMPLESCP_MACS: Algorithms to allow, comma separated in order of preference (e.g. "chacha20-poly1305@openssh.com,aes256-gcm@openssh.com"). Default: golang.org/x/crypto/ssh's
+//   SIMPLESCP_ALLOWCIDRS: Address ranges (comma separated, e.g. "10.8.0.0/16,fd00::/8") connections are accepted from. Default: Anywhere
+//   SIMPLESCP_DENYCIDRS: Address ranges connections are never accepted from, even if they're in SIMPLESCP_ALLOWCIDRS. Default: None
+//   SIMPLESCP_PROXYPROTOCOL: Take client addresses from the PROXY protocol (v1 or v2) header load balancers like HAProxy send. Default: false
+//   SIMPLESCP_PROXYPROTOCOLFROM: Load balancer addresses (comma separated CIDRs) that send the header, connections from anywhere else are taken as they are. Required with SIMPLESCP_PROXYPROTOCOL
+//   SIMPLESCP_GEOIP_DATABASE: MaxMind Country or City database (.mmdb) to look up the country of clients in. Default: None
+//   SIMPLESCP_GEOIP_ALLOWCOUNTRIES, SIMPLESCP_GEOIP_DENYCOUNTRIES: Countries (comma separated ISO codes, e.g. "US,DE") connections are, or aren't, accepted from. Default: Anywhere
+//   SIMPLESCP_AUTHRATELIMIT: Authentication attempts (passwords and keys) each client IP can make per minute. Default: No limit
+//   SIMPLESCP_AUTHRATEBURST: How many attempts a client IP can make at once before being limited. Default: 10
+//   SIMPLESCP_BANTHRESHOLD: Consecutive failed logins before the client IP or username is banned for a while. Default: No bans
+//   SIMPLESCP_BANDURATION, SIMPLESCP_BANMAXDURATION: How long the first ban lasts (each one after that lasts twice as long), and the longest one. Default: 10m, 24h
+//   SIMPLESCP_MAXCONNECTIONS, SIMPLESCP_MAXCONNECTIONSPERIP: Connections served at once, overall and for each client IP. Default: No limit
+//   SIMPLESCP_MAXSESSIONSPERUSER: scp and sftp sessions each user can have open at once. Default: No limit
+//   SIMPLESCP_IDLETIMEOUT: Close sessions without any scp or sftp activity for this long (e.g. 15m). Users in SIMPLESCP_USERDB can have their own. Default: Never
+//   SIMPLESCP_OUTSIDESYMLINKS: What to do with symlinks pointing outside of SIMPLESCP_DIR: deny, or resolve-within-root to take them as if SIMPLESCP_DIR was /. Default: deny
+//   SIMPLESCP_SYMLINKS: What to do with symlinks in directories being copied: follow them, skip them, or preserve them as links (sftp only, scp skips them). Default: follow with scp, preserve with sftp
+//   SIMPLESCP_NOHARDLINKS: Don't let sftp clients create hard links (hardlink@openssh.com, ln in OpenSSH's sftp), and don't let rsync preserve them. Default: false
+//   SIMPLESCP_ATOMICUPLOADS: Write uploads to a hidden file next to them (.name.random.part), renamed into place once they're complete, so half written files are never seen. Default: false
+//   SIMPLESCP_PARTIALUPLOADS: What's done with uploads that didn't finish, e.g. because the client disconnected: keep them, delete them or move them to .partial in the user's directory. Default: delete with SIMPLESCP_ATOMICUPLOADS, keep otherwise
+//   SIMPLESCP_NOTRUNCATE: Don't let sftp clients truncate existing files, so interrupted uploads can be resumed (e.g. with reput) but not started over by accident. Default: false
+//   SIMPLESCP_FILENAMES_POLICY: What's done with the names of new files that have control characters in them, or break the rules below: reject the files, or rename them. Default: Names aren't checked
+//   SIMPLESCP_FILENAMES_ASCII, SIMPLESCP_FILENAMES_MAXLENGTH: Only allow ASCII in names (transliterating the rest when renaming), and the longest name allowed in bytes. Default: false, no limit
+//   SIMPLESCP_DENYFILES: Names of files (comma separated globs like "*.exe", or regular expressions after "regexp:") that can't be uploaded, and are hidden from downloads and listings. Everything in directories with those names too. Default: None
+//   SIMPLESCP_HIDEDOTFILES: Leave files starting with a dot out of directory listings (scp -r, wildcards and sftp), they can still be copied by name. Default: false
+//   SIMPLESCP_HIDEFILES: More files to leave out of listings, with the same patterns as SIMPLESCP_DENYFILES. simplescp's own files (.partial and partial uploads) always are. Default: None
+//   SIMPLESCP_ADMIN_LISTEN: Address to serve the admin API on, e.g. 127.0.0.1:8223. Default: No admin API
+//   SIMPLESCP_ADMIN_GRPCLISTEN: Address to serve the gRPC control service on, e.g. 127.0.0.1:8224. Default: No control service
+//   SIMPLESCP_ADMIN_TOKEN: Bearer token admin requests and control calls need to come with, required unless they only listen on localhost. Default: None
+//   SIMPLESCP_ADMIN_HEALTHLISTEN: Address to serve just the /healthz and /readyz endpoints on, which don't need the token, e.g. :8226. Default: Only in the admin API
+//   SIMPLESCP_ADMIN_PPROF: Serve CPU, heap and goroutine profiles for go tool pprof under /debug/pprof/ in the admin API. Default: false
+//   SIMPLESCP_DASHBOARD_LISTEN: Address to serve the web dashboard on, e.g. 127.0.0.1:8225. Default: No dashboard
+//   SIMPLESCP_DASHBOARD_USER: Username to log in to the dashboard with, required along with its password. Default: None
+//   SIMPLESCP_DASHBOARD_PASSWORD: Password to log in to the dashboard with. Default: None
+//   SIMPLESCP_SFTP_MAXPACKET: Biggest request sftp clients can send, which OpenSSH's sftp sizes its writes by. Default: 256K, which is also the most
+//   SIMPLESCP_SFTP_ALLOCATOR: Reuse sftp packet buffers between requests, trading memory held by each session for less garbage collection. Default: false
+//   SIMPLESCP_SFTP_MAXCONCURRENTREQUESTS: sftp requests from a session worked on at once, before the server stops reading more from it. Default: No limit
+//   SIMPLESCP_SCAN_CLAMD: clamd socket (a path or host:port) to scan uploads with, they're kept in .quarantine until they pass. Default: No scanning
+//   SIMPLESCP_SCAN_COMMAND: Or a command scanning the upload it gets on stdin (e.g. "clamscan --no-summary -"), exiting with 1 if it's infected. Default: None
+//   SIMPLESCP_SCAN_TIMEOUT, SIMPLESCP_SCAN_INFECTED: How long a scan can take, and whether to delete infected uploads or keep them in .quarantine/infected. Default: 5m, delete
+//   SIMPLESCP_READONLY: Don't allow uploads or changes to any files. Default: false
+//   SIMPLESCP_WRITEONLY: Only allow uploads, files can't be downloaded or listed. Default: false
+//   SIMPLESCP_MAXRATE: Bandwidth limit for each session in bytes per second (e.g. 10M). Default: No limit
+//   SIMPLESCP_MAXFILESIZE: Biggest file that can be uploaded (e.g. 100M). Default: No limit
+//   SIMPLESCP_QUOTA: How much disk space each user can use (e.g. 1G). Default: No quota
+//   SIMPLESCP_USERDB: SQLite database holding additional users. Default: Only SIMPLESCP_USER can log in
+//   SIMPLESCP_LOGLEVEL: One of debug, info, warn or error. Default: info
+//   SIMPLESCP_LOGFORMAT: text or json. Default: text
+//   SIMPLESCP_WINSCPSHELL: Answer the few shell commands WinSCP's SCP mode needs (pwd, cd, ls, echo and scp) in shell sessions. Default: false
+//   SIMPLESCP_RSYNC: rsync binary to serve `rsync --server` requests with, e.g. /usr/bin/rsync. Default: rsync isn't allowed
+//   SIMPLESCP_TRANSFERLOG: File recording every upload and download. Default: No transfer log
+//   SIMPLESCP_TRANSFERLOGFORMAT: xferlog or csv. Default: xferlog
+//   SIMPLESCP_RECORDDIR: Directory each scp and sftp session is recorded to, to be replayed with -replay. Default: Sessions aren't recorded
+//   SIMPLESCP_RECORDCONTENTS: Record what's read from and written to files too, not just the requests. Default: false
+//   SIMPLESCP_CHECKSUM: Algorithm transfers are checksummed with for the transfer log and webhooks: md5, sha1, sha256, sha512 or none. Default: sha256
+//   SIMPLESCP_BACKEND: Where files are stored: os, s3, gcs, azure or mem (in memory, lost on exit). Default: os
+//   SIMPLESCP_S3_BUCKET, SIMPLESCP_S3_PREFIX, SIMPLESCP_S3_ENDPOINT, SIMPLESCP_S3_REGION: S3 bucket to store files in, when using the s3 backend
+//   SIMPLESCP_S3_ACCESSKEY, SIMPLESCP_S3_SECRETKEY: S3 credentials. Default: Taken from the AWS environment variables, config files or instance profile
+//   SIMPLESCP_GCS_BUCKET, SIMPLESCP_GCS_PREFIX: GCS bucket to store files in, when using the gcs backend. Credentials come from Application Default Credentials
+//   SIMPLESCP_AZURE_ACCOUNT, SIMPLESCP_AZURE_CONTAINER, SIMPLESCP_AZURE_PREFIX, SIMPLESCP_AZURE_ENDPOINT: Azure container to store files in, when using the azure backend
+//   SIMPLESCP_AZURE_KEY, SIMPLESCP_AZURE_CONNECTIONSTRING: Azure credentials. Default: Taken from the Azure environment variables, managed identity or az login
+//   SIMPLESCP_ENCRYPTIONKEYFILE: File with a hex encoded 32 byte key to encrypt stored files with. Default: Files aren't encrypted
+//   SIMPLESCP_UPLOADCOMMAND: Command run after every successful upload (e.g. "/usr/local/bin/process %f %u"). Default: None
+//   SIMPLESCP_UPLOADCOMMANDTIMEOUT: How long the upload command can run for before it's killed. Default: 1m
+//   SIMPLESCP_LOGINGRACETIME: How long clients have to log in after connecting before they're dropped (0 for no limit). Default: 2m
+//   SIMPLESCP_MAXCONNECTIONTIME: Close connections that have been open for this long, even if they're busy (e.g. 12h). Default: No limit
+//   SIMPLESCP_TCPKEEPALIVE: How often to probe the client of an idle connection, so dead ones get dropped (negative to not probe). Default: 15s
+//   SIMPLESCP_SHUTDOWNGRACE: How long to wait for active sessions to finish when shutting down. Default: 30s
+func ReadConfig(configFile string) (*Config, error) {
 
 	// TODO: workingDir should be configurable
-	simplelog.SetThreshold(simplelog.LevelDebug)
+	config := NewConfig()
+	if len(configFile) > 0 {
+		err := LoadConfigFile(configFile, config)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	config := newScpConfig()
 	err := envconfig.Process("simplescp", config)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	return config, nil
+}
 
-	simplelog.Info.Printf("Allowing logins from user %q", config.User)
-	simplelog.Info.Printf("Sharing files out of %q", config.Dir)
-
-	config.initPassword()
-
-	err = config.initPrivateKey()
+// LoadConfig reads the config (see ReadConfig) and initializes it so it's ready to be served
+func LoadConfig(configFile string) (*Config, error) {
+	config, err := ReadConfig(configFile)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	err = config.initAuthKeys()
+	err = config.Init()
 	if err != nil {
-		simplelog.Error.Printf("%v", err)
+		return nil, err
 	}
-	return config
-
+	return config, nil
 }
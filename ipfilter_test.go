@@ -0,0 +1,40 @@
+package simplescp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIPFilter(t *testing.T) {
+	f, err := newIPFilter([]string{"10.8.0.0/16", "fd00::/8", "192.0.2.10"}, []string{"10.8.99.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, allowed := range map[string]bool{
+		"10.8.1.2":        true,
+		"10.8.99.1":       false,
+		"10.9.0.1":        false,
+		"192.0.2.10":      true,
+		"192.0.2.11":      false,
+		"::ffff:10.8.1.2": true,
+		"fd12::1":         true,
+		"2001:db8::1":     false,
+	} {
+		tcpAddr := &net.TCPAddr{IP: net.ParseIP(addr), Port: 40000}
+		if f.allowed(tcpAddr) != allowed {
+			t.Errorf("%s allowed: %v, expected %v", addr, !allowed, allowed)
+		}
+	}
+
+	denyOnly, err := newIPFilter(nil, []string{"192.0.2.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !denyOnly.allowed(&net.TCPAddr{IP: net.ParseIP("198.51.100.1")}) || denyOnly.allowed(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}) {
+		t.Error("Deny list without an allow list not applied")
+	}
+
+	if _, err := newIPFilter([]string{"10.8.0.0/33"}, nil); err == nil {
+		t.Error("Invalid CIDR accepted")
+	}
+}
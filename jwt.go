@@ -0,0 +1,272 @@
+package simplescp
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWTConfig holds the settings for logging in with a signed JWT as the
+// password, verified with the keys published at JWKSURL
+type JWTConfig struct {
+	JWKSURL          string `yaml:"jwks_url" toml:"jwks_url"`
+	Issuer           string `yaml:"issuer" toml:"issuer"`                       // Required iss claim
+	Audience         string `yaml:"audience" toml:"audience"`                   // Required aud claim
+	UsernameClaim    string `yaml:"username_claim" toml:"username_claim"`       // Has to match the username. Default: sub
+	PermissionsClaim string `yaml:"permissions_claim" toml:"permissions_claim"` // Limits what the user can do, e.g. "read" or ["read", "write"]
+}
+
+const (
+	// How often the keys are fetched again, and how often at most when a
+	// token comes signed with a key we don't know about (it might be new)
+	jwksRefreshInterval = time.Hour
+	jwksMissRefresh     = time.Minute
+	jwksFetchTimeout    = 10 * time.Second
+)
+
+func (j JWTConfig) enabled() bool {
+	return len(j.JWKSURL) > 0
+}
+
+func (j JWTConfig) validate() error {
+	if len(j.Issuer) == 0 || len(j.Audience) == 0 {
+		return errors.New("Invalid JWT settings: both issuer and audience have to be set")
+	}
+	u, err := url.Parse(j.JWKSURL)
+	if err != nil || len(u.Host) == 0 || (u.Scheme != "https" && u.Scheme != "http") {
+		return fmt.Errorf("Invalid JWKS URL %q", j.JWKSURL)
+	}
+	// Anyone in between could hand out keys of their own otherwise
+	if u.Scheme != "https" && !loopbackHost(u.Hostname()) {
+		return fmt.Errorf("Invalid JWKS URL %q: has to be https", j.JWKSURL)
+	}
+	return nil
+}
+
+func loopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (j JWTConfig) usernameClaim() string {
+	if len(j.UsernameClaim) > 0 {
+		return j.UsernameClaim
+	}
+	return "sub"
+}
+
+// Whether a password looks like a JWT rather than an actual password
+func looksLikeJWT(pass []byte) bool {
+	// The header's always a JSON object, so the token starts with {" encoded
+	return strings.HasPrefix(string(pass), "eyJ") && strings.Count(string(pass), ".") == 2
+}
+
+// Verify a token for the user, returning the permissions it grants (all of
+// them if it doesn't have a permissions claim)
+func (j JWTConfig) authenticate(keys *jwksCache, username string, token string) (Permission, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, keys.keyFunc,
+		jwt.WithIssuer(j.Issuer),
+		jwt.WithAudience(j.Audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30*time.Second),
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}))
+	if err != nil {
+		return 0, err
+	}
+
+	if name, _ := claims[j.usernameClaim()].(string); name != username {
+		return 0, fmt.Errorf("token is for %q", name)
+	}
+	if len(j.PermissionsClaim) == 0 || claims[j.PermissionsClaim] == nil {
+		return PermAll, nil
+	}
+	switch perms := claims[j.PermissionsClaim].(type) {
+	case string:
+		return ParsePermissions(perms)
+	case []interface{}:
+		var names []string
+		for _, p := range perms {
+			name, ok := p.(string)
+			if !ok {
+				return 0, fmt.Errorf("invalid %s claim", j.PermissionsClaim)
+			}
+			names = append(names, name)
+		}
+		return ParsePermissions(strings.Join(names, ","))
+	}
+	return 0, fmt.Errorf("invalid %s claim", j.PermissionsClaim)
+}
+
+// jwksCache holds the keys from a JWKS URL, fetching them again every now and
+// then. It's shared by all sessions
+type jwksCache struct {
+	url    string
+	client *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetched   time.Time
+	lastFetch time.Time     // Including failed attempts
+	fetching  chan struct{} // Closed once the fetch in progress is done
+}
+
+func newJWKSCache(url string) *jwksCache {
+	return &jwksCache{url: url, client: &http.Client{Timeout: jwksFetchTimeout}}
+}
+
+func (c *jwksCache) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	c.mu.Lock()
+
+	key, ok := c.keys[kid]
+	stale := time.Since(c.fetched) > jwksRefreshInterval
+	var err error
+	switch {
+	case (!ok || stale) && time.Since(c.lastFetch) > jwksMissRefresh:
+		err = c.refresh()
+		key, ok = c.keys[kid]
+	case !ok && c.fetching != nil:
+		// The key might be in what's being fetched
+		done := c.fetching
+		c.mu.Unlock()
+		<-done
+		c.mu.Lock()
+		key, ok = c.keys[kid]
+	}
+	c.mu.Unlock()
+
+	if !ok && err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+// Fetch the keys again. It's called with c.mu held, which is let go of for
+// the fetch so that logins with keys we have don't wait for it. The keys we
+// have are kept if it fails
+func (c *jwksCache) refresh() error {
+	c.lastFetch = time.Now()
+	done := make(chan struct{})
+	c.fetching = done
+	c.mu.Unlock()
+
+	keys, err := c.fetch()
+
+	c.mu.Lock()
+	if err == nil {
+		c.keys = keys
+		c.fetched = time.Now()
+	}
+	c.fetching = nil
+	close(done)
+	return err
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (c *jwksCache) fetch() (map[string]crypto.PublicKey, error) {
+	resp, err := c.client.Get(c.url)
+	if err != nil {
+		return nil, fmt.Errorf("can't fetch JWKS: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("can't fetch JWKS: %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %v", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		// Keys we can't make sense of are skipped, they might be for somebody else
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, errors.New("invalid key")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("invalid key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curve := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}[k.Crv]
+		if curve == nil {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
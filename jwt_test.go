@@ -0,0 +1,148 @@
+package simplescp
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestJWTAuth(t *testing.T) {
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "OKP", "crv": "Ed25519", "kid": "ed", "x": b64(edPub)},
+		{"kty": "RSA", "kid": "rsa", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+	}})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jwks)
+	}))
+	defer server.Close()
+
+	c := Config{User: "scpuser", JWT: JWTConfig{
+		JWKSURL:          server.URL,
+		Issuer:           "https://auth.example.com/",
+		Audience:         "simplescp",
+		PermissionsClaim: "scp_permissions",
+	}}
+	c.jwks = newJWKSCache(c.JWT.JWKSURL)
+
+	token := func(method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+		base := jwt.MapClaims{
+			"iss": "https://auth.example.com/",
+			"aud": "simplescp",
+			"sub": "robot",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+		for k, v := range claims {
+			base[k] = v
+		}
+		tok := jwt.NewWithClaims(method, base)
+		tok.Header["kid"] = kid
+		s, err := tok.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		accepted bool
+		perms    Permission
+	}{
+		{"ed25519", token(jwt.SigningMethodEdDSA, "ed", edKey, nil), true, PermAll},
+		{"rsa", token(jwt.SigningMethodRS256, "rsa", rsaKey, nil), true, PermAll},
+		{"read only", token(jwt.SigningMethodEdDSA, "ed", edKey, jwt.MapClaims{"scp_permissions": []string{"read"}}), true, permReadAll},
+		{"other user", token(jwt.SigningMethodEdDSA, "ed", edKey, jwt.MapClaims{"sub": "alice"}), false, 0},
+		{"expired", token(jwt.SigningMethodEdDSA, "ed", edKey, jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}), false, 0},
+		{"wrong audience", token(jwt.SigningMethodEdDSA, "ed", edKey, jwt.MapClaims{"aud": "other"}), false, 0},
+		{"wrong issuer", token(jwt.SigningMethodEdDSA, "ed", edKey, jwt.MapClaims{"iss": "https://evil.example.com/"}), false, 0},
+		{"unknown key", token(jwt.SigningMethodEdDSA, "ed", otherKey, nil), false, 0},
+		{"hmac", token(jwt.SigningMethodHS256, "ed", []byte(edPub), nil), false, 0},
+	}
+	for _, test := range tests {
+		perms, err := c.passwordAuth(testConnMetadata{"robot"}, []byte(test.token))
+		if (err == nil) != test.accepted {
+			t.Errorf("%s: expected accepted %v, got error %v", test.name, test.accepted, err)
+			continue
+		}
+		if !test.accepted {
+			continue
+		}
+		session := c
+		session.Dir = t.TempDir()
+		if err := session.setupSession("robot", perms); err != nil {
+			t.Fatal(err)
+		}
+		if session.perms != test.perms {
+			t.Errorf("%s: expected permissions %v, got %v", test.name, test.perms, session.perms)
+		}
+	}
+}
+
+func TestJWKSFetchUnlocked(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	fetching := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(fetching)
+		<-release
+		w.Write([]byte(`{"keys": []}`))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	// The keys we have are due for a refresh, which hangs
+	c := newJWKSCache(server.URL)
+	c.keys = map[string]crypto.PublicKey{"ed": pub}
+	go c.keyFunc(&jwt.Token{Header: map[string]interface{}{"kid": "ed"}})
+	<-fetching
+
+	got := make(chan error)
+	go func() {
+		_, err := c.keyFunc(&jwt.Token{Header: map[string]interface{}{"kid": "ed"}})
+		got <- err
+	}()
+	select {
+	case err := <-got:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Known key waited for the JWKS to be fetched")
+	}
+}
+
+func TestJWKSURL(t *testing.T) {
+	for url, ok := range map[string]bool{
+		"https://auth.example.com/.well-known/jwks.json": true,
+		"http://127.0.0.1:8080/jwks.json":                true,
+		"http://localhost/jwks.json":                     true,
+		"http://[::1]/jwks.json":                         true,
+		"http://auth.example.com/.well-known/jwks.json":  false,
+		"ftp://auth.example.com/jwks.json":               false,
+		"auth.example.com/jwks.json":                     false,
+	} {
+		j := JWTConfig{JWKSURL: url, Issuer: "https://auth.example.com/", Audience: "simplescp"}
+		if err := j.validate(); (err == nil) != ok {
+			t.Errorf("%s: expected valid %v, got %v", url, ok, err)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package simplescp
+
+import (
+	"net"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// The TCP connection under nConn, if it is one
+func tcpConn(nConn net.Conn) (*net.TCPConn, bool) {
+	if pConn, ok := nConn.(*proxyproto.Conn); ok {
+		return pConn.TCPConn()
+	}
+	tc, ok := nConn.(*net.TCPConn)
+	return tc, ok
+}
+
+// Set up TCP keepalives on nConn, probing every interval once it's idle so dead
+// peers get noticed. 0 leaves Go's default (15s), negative turns them off
+func setTCPKeepAlive(nConn net.Conn, interval time.Duration) error {
+	tc, ok := tcpConn(nConn)
+	if !ok || interval == 0 {
+		return nil
+	}
+	if interval < 0 {
+		return tc.SetKeepAlive(false)
+	}
+	return tc.SetKeepAliveConfig(net.KeepAliveConfig{Enable: true, Idle: interval, Interval: interval})
+}
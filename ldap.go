@@ -0,0 +1,208 @@
+package simplescp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPConfig holds the settings for checking passwords against an LDAP
+// directory (or Active Directory). Users are either bound to directly with
+// UserDN, or searched for under BaseDN and then bound to.
+type LDAPConfig struct {
+	URL                string   `yaml:"url" toml:"url"`                   // ldap://host:389 or ldaps://host:636
+	StartTLS           bool     `yaml:"start_tls" toml:"start_tls"`       // Upgrade ldap:// connections to TLS
+	CACertFile         string   `yaml:"ca_cert_file" toml:"ca_cert_file"` // Instead of the system CAs
+	InsecureSkipVerify bool     `yaml:"insecure_skip_verify" toml:"insecure_skip_verify"`
+	UserDN             string   `yaml:"user_dn" toml:"user_dn"` // e.g. uid=%u,ou=people,dc=example,dc=com
+	BindDN             string   `yaml:"bind_dn" toml:"bind_dn"` // Used to search for users. Anonymous if not set
+	BindPassword       string   `yaml:"bind_password" toml:"bind_password"`
+	BaseDN             string   `yaml:"base_dn" toml:"base_dn"`
+	UserFilter         string   `yaml:"user_filter" toml:"user_filter"`               // Default: (uid=%u). (sAMAccountName=%u) for Active Directory
+	GroupAttribute     string   `yaml:"group_attribute" toml:"group_attribute"`       // Default: memberOf
+	Groups             []string `yaml:"groups" toml:"groups"`                         // DNs of the groups allowed to log in. Anyone if empty
+	HomeDirAttribute   string   `yaml:"home_dir_attribute" toml:"home_dir_attribute"` // e.g. homeDirectory
+}
+
+var errLDAPGroup = errors.New("not a member of any of the allowed groups")
+
+// How long we wait for the directory to answer
+const ldapTimeout = 10 * time.Second
+
+func (l LDAPConfig) enabled() bool {
+	return len(l.URL) > 0
+}
+
+func (l LDAPConfig) validate() error {
+	if len(l.UserDN) == 0 && len(l.BaseDN) == 0 {
+		return errors.New("Invalid LDAP settings: either user_dn or base_dn have to be set")
+	}
+	if len(l.UserDN) > 0 && !strings.Contains(l.UserDN, userPlaceholder) {
+		return fmt.Errorf("Invalid LDAP settings: user_dn needs a %s for the username", userPlaceholder)
+	}
+	for _, group := range l.Groups {
+		if _, err := ldap.ParseDN(group); err != nil {
+			return fmt.Errorf("Invalid LDAP group %q: %v", group, err)
+		}
+	}
+	if _, err := l.tlsConfig(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (l LDAPConfig) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: l.InsecureSkipVerify}
+	if len(l.CACertFile) > 0 {
+		pem, err := os.ReadFile(l.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("Can't read LDAP CA certificates: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", l.CACertFile)
+		}
+	}
+	return config, nil
+}
+
+func (l LDAPConfig) dial() (*ldap.Conn, error) {
+	tlsConfig, err := l.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := ldap.DialURL(l.URL, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}), ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(ldapTimeout)
+	if l.StartTLS {
+		if u, err := url.Parse(l.URL); err == nil {
+			tlsConfig.ServerName = u.Hostname()
+		}
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// The filter used to search for a user, with the username escaped
+func (l LDAPConfig) userFilter(username string) string {
+	filter := l.UserFilter
+	if len(filter) == 0 {
+		filter = "(uid=%u)"
+	}
+	return strings.ReplaceAll(filter, userPlaceholder, ldap.EscapeFilter(username))
+}
+
+func (l LDAPConfig) groupAttribute() string {
+	if len(l.GroupAttribute) > 0 {
+		return l.GroupAttribute
+	}
+	return "memberOf"
+}
+
+// The attributes we need to look at for the user
+func (l LDAPConfig) attributes() []string {
+	var attrs []string
+	if len(l.Groups) > 0 {
+		attrs = append(attrs, l.groupAttribute())
+	}
+	if len(l.HomeDirAttribute) > 0 {
+		attrs = append(attrs, l.HomeDirAttribute)
+	}
+	return attrs
+}
+
+// Whether any of the groups the user belongs to is one of the allowed ones
+func (l LDAPConfig) inGroups(memberOf []string) bool {
+	for _, member := range memberOf {
+		memberDN, err := ldap.ParseDN(member)
+		if err != nil {
+			continue
+		}
+		for _, group := range l.Groups {
+			groupDN, _ := ldap.ParseDN(group)
+			if groupDN != nil && memberDN.EqualFold(groupDN) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func searchOne(conn *ldap.Conn, baseDN string, scope int, filter string, attrs []string) (*ldap.Entry, error) {
+	if len(attrs) == 0 {
+		attrs = []string{"1.1"} // No attributes, just the DN
+	}
+	req := ldap.NewSearchRequest(baseDN, scope, ldap.NeverDerefAliases, 2, int(ldapTimeout/time.Second), false, filter, attrs, nil)
+	res, err := conn.Search(req)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, err
+	}
+	if res == nil || len(res.Entries) != 1 {
+		return nil, ErrNoSuchUser
+	}
+	return res.Entries[0], nil
+}
+
+// Check a user's password against the directory, returning the user with
+// their home directory (if HomeDirAttribute is set) when it's right
+func (l LDAPConfig) authenticate(username string, pass string) (*User, error) {
+	if len(pass) == 0 {
+		// It'd be an unauthenticated bind, which most servers let through
+		return nil, errors.New("empty password")
+	}
+	conn, err := l.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	attrs := l.attributes()
+	var entry *ldap.Entry
+	if len(l.UserDN) > 0 {
+		dn := strings.ReplaceAll(l.UserDN, userPlaceholder, ldap.EscapeDN(username))
+		if err := conn.Bind(dn, pass); err != nil {
+			return nil, err
+		}
+		if len(attrs) > 0 {
+			entry, err = searchOne(conn, dn, ldap.ScopeBaseObject, "(objectClass=*)", attrs)
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		if len(l.BindDN) > 0 {
+			if err := conn.Bind(l.BindDN, l.BindPassword); err != nil {
+				return nil, fmt.Errorf("can't bind as %s: %v", l.BindDN, err)
+			}
+		}
+		entry, err = searchOne(conn, l.BaseDN, ldap.ScopeWholeSubtree, l.userFilter(username), attrs)
+		if err != nil {
+			return nil, err
+		}
+		if err := conn.Bind(entry.DN, pass); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(l.Groups) > 0 && (entry == nil || !l.inGroups(entry.GetEqualFoldAttributeValues(l.groupAttribute()))) {
+		return nil, errLDAPGroup
+	}
+	u := &User{Name: username, Permissions: PermAll}
+	if entry != nil && len(l.HomeDirAttribute) > 0 {
+		u.HomeDir = entry.GetEqualFoldAttributeValue(l.HomeDirAttribute)
+	}
+	return u, nil
+}
@@ -0,0 +1,46 @@
+package simplescp
+
+import "testing"
+
+func TestLDAPConfig(t *testing.T) {
+	l := LDAPConfig{URL: "ldap://localhost", BaseDN: "dc=example,dc=com"}
+	if err := l.validate(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if filter := l.userFilter("al*ce)(uid=*"); filter != `(uid=al\2ace\29\28uid=\2a)` {
+		t.Errorf("Username not escaped in filter %s", filter)
+	}
+	l.UserFilter = "(&(objectClass=user)(sAMAccountName=%u))"
+	if filter := l.userFilter("alice"); filter != "(&(objectClass=user)(sAMAccountName=alice))" {
+		t.Errorf("Unexpected filter %s", filter)
+	}
+
+	l.Groups = []string{"cn=scp-users,ou=groups,dc=example,dc=com"}
+	if !l.inGroups([]string{"cn=admins,dc=example,dc=com", "CN=SCP-Users, OU=Groups,DC=example,DC=com"}) {
+		t.Error("Member of an allowed group rejected")
+	}
+	if l.inGroups([]string{"cn=admins,dc=example,dc=com"}) || l.inGroups(nil) {
+		t.Error("Member of other groups accepted")
+	}
+
+	for _, bad := range []LDAPConfig{
+		{URL: "ldap://localhost"},
+		{URL: "ldap://localhost", UserDN: "uid=alice,dc=example,dc=com"},
+		{URL: "ldap://localhost", BaseDN: "dc=example,dc=com", Groups: []string{"not a dn"}},
+	} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("Expected an error for %+v", bad)
+		}
+	}
+}
+
+func TestSessionHomeDir(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{User: "scpuser", Dir: dir + "/%u"}
+	if err := c.setupSession("alice", homeDirPermissions("shared/alice")); err != nil {
+		t.Fatal(err)
+	}
+	if c.Dir != dir+"/alice/shared/alice" || !c.perms.Has(PermAll) {
+		t.Errorf("Unexpected session dir %s, permissions %v", c.Dir, c.perms)
+	}
+}
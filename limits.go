@@ -0,0 +1,57 @@
+package simplescp
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrFileTooLarge is returned when a file would go over the maximum file size
+var ErrFileTooLarge = errors.New("File too large")
+
+// Check if a file is allowed to be size bytes long
+func (c Config) checkFileSize(size int64) error {
+	if c.MaxFileSize > 0 && size > int64(c.MaxFileSize) {
+		return ErrFileTooLarge
+	}
+	return nil
+}
+
+// limitedFile is a file open for writing through sftp that can't grow past the
+// maximum file size or the user's quota
+type limitedFile struct {
+	File
+	config Config
+	mu     sync.Mutex
+	size   int64
+}
+
+// Wrap a file that's been opened for writing so it respects the file size and quota limits (if any)
+func (c Config) limitFile(f File) sftpFile {
+	if c.MaxFileSize <= 0 && (c.quotaLimit <= 0 || c.usage == nil) {
+		return f
+	}
+	fi, err := f.Stat()
+	var size int64
+	if err == nil {
+		size = fi.Size()
+	}
+	return &limitedFile{File: f, config: c, size: size}
+}
+
+func (f *limitedFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	end := off + int64(len(p))
+	if end > f.size {
+		if err := f.config.checkFileSize(end); err != nil {
+			f.mu.Unlock()
+			return 0, err
+		}
+		if err := f.config.reserveSpace(end - f.size); err != nil {
+			f.mu.Unlock()
+			return 0, err
+		}
+		f.size = end
+	}
+	f.mu.Unlock()
+	return f.File.WriteAt(p, off)
+}
@@ -0,0 +1,270 @@
+package simplescp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How much data from out of order sftp writes object storage backends are
+// willing to hold on to
+const maxPendingWrites = 32 << 20
+
+// Prefix shared by all the objects inside of a directory
+func dirPrefix(key string) string {
+	if len(key) == 0 {
+		return ""
+	}
+	return key + "/"
+}
+
+// objectWriter streams whatever's written to it into a new object, which gets
+// stored once it's closed. Data needs to be written sequentially, although
+// writes arriving a bit out of order (as sftp clients do) are put back in order.
+type objectWriter struct {
+	name string
+	pw   *io.PipeWriter
+	done chan error
+
+	mu          sync.Mutex
+	offset      int64            // Where the next sequential write goes
+	pending     map[int64][]byte // Writes waiting for the ones before them
+	pendingSize int
+	closed      bool
+	err         error
+}
+
+// Start writing a new object. Whatever's written can be read from the returned
+// pipe, and the result of uploading it needs to be sent to done
+func newObjectWriter(name string) (*objectWriter, *io.PipeReader) {
+	pr, pw := io.Pipe()
+	return &objectWriter{name: name, pw: pw, done: make(chan error, 1), pending: make(map[int64][]byte)}, pr
+}
+
+func (w *objectWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.writeAt(p, w.offset)
+}
+
+func (w *objectWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.writeAt(p, off)
+}
+
+func (w *objectWriter) writeAt(p []byte, off int64) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.closed {
+		return 0, &os.PathError{Op: "write", Path: w.name, Err: os.ErrClosed}
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if off < w.offset {
+		return 0, w.fail(errors.New("can't rewrite data already uploaded"))
+	}
+
+	if off > w.offset {
+		if w.pendingSize+len(p) > maxPendingWrites {
+			return 0, w.fail(errors.New("writes are too far out of order"))
+		}
+		w.pending[off] = append([]byte(nil), p...)
+		w.pendingSize += len(p)
+		return len(p), nil
+	}
+
+	if _, err := w.pw.Write(p); err != nil {
+		return 0, w.fail(err)
+	}
+	w.offset += int64(len(p))
+
+	// Some of the writes we're holding on to might be next
+	for {
+		next, ok := w.pending[w.offset]
+		if !ok {
+			break
+		}
+		delete(w.pending, w.offset)
+		w.pendingSize -= len(next)
+		if _, err := w.pw.Write(next); err != nil {
+			return 0, w.fail(err)
+		}
+		w.offset += int64(len(next))
+	}
+	return len(p), nil
+}
+
+// Abort the upload
+func (w *objectWriter) fail(err error) error {
+	w.err = &os.PathError{Op: "write", Path: w.name, Err: err}
+	w.pw.CloseWithError(w.err)
+	return w.err
+}
+
+func (w *objectWriter) Read(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "read", Path: w.name, Err: syscall.EBADF}
+}
+
+func (w *objectWriter) ReadAt(p []byte, off int64) (int, error) {
+	return 0, &os.PathError{Op: "read", Path: w.name, Err: syscall.EBADF}
+}
+
+func (w *objectWriter) Stat() (os.FileInfo, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return objectInfo{name: filepath.Base(w.name), size: w.offset, modTime: time.Now()}, nil
+}
+
+// Finish the upload, returning whether the object could be stored
+func (w *objectWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return &os.PathError{Op: "close", Path: w.name, Err: os.ErrClosed}
+	}
+	w.closed = true
+
+	if w.err == nil && len(w.pending) > 0 {
+		w.fail(errors.New("file has holes in it"))
+	}
+	if w.err != nil {
+		<-w.done
+		return w.err
+	}
+
+	w.pw.Close()
+	if err := <-w.done; err != nil {
+		w.err = err
+		return w.err
+	}
+	return nil
+}
+
+// Open an object (or directory) for reading, getting its contents from open
+func newObjectReader(name string, info os.FileInfo, open func(off int64, length int64) (io.ReadCloser, error)) *objectReader {
+	return &objectReader{name: name, info: info, open: open}
+}
+
+// objectReader is an object (or directory) open for reading. Reads are streamed
+// from wherever the last one left off, and anything else gets its own request
+type objectReader struct {
+	name string
+	info os.FileInfo
+	open func(off int64, length int64) (io.ReadCloser, error) // A length of -1 reads to the end
+
+	mu     sync.Mutex
+	r      io.ReadCloser
+	offset int64 // Where r is at
+}
+
+func (r *objectReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.readAt(p, r.offset)
+}
+
+func (r *objectReader) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// ReadAt has to fill the buffer, unless the file's over
+	var n int
+	var err error
+	for n < len(p) && err == nil {
+		var m int
+		m, err = r.readAt(p[n:], off+int64(n))
+		n += m
+	}
+	return n, err
+}
+
+func (r *objectReader) readAt(p []byte, off int64) (int, error) {
+	if r.info.IsDir() {
+		return 0, &os.PathError{Op: "read", Path: r.name, Err: syscall.EISDIR}
+	}
+	if off >= r.info.Size() {
+		return 0, io.EOF
+	}
+
+	if off < r.offset && r.r != nil {
+		// Going back, most likely an sftp read that arrived late. Don't lose
+		// our place for it
+		rr, err := r.open(off, int64(len(p)))
+		if err != nil {
+			return 0, err
+		}
+		defer rr.Close()
+		n, err := io.ReadFull(rr, p)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return n, err
+	}
+
+	if r.r == nil || off != r.offset {
+		if r.r != nil {
+			r.r.Close()
+		}
+		rr, err := r.open(off, -1)
+		if err != nil {
+			r.r = nil
+			return 0, err
+		}
+		r.r = rr
+		r.offset = off
+	}
+	n, err := r.r.Read(p)
+	r.offset += int64(n)
+	if err == io.EOF && r.offset < r.info.Size() {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *objectReader) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: r.name, Err: syscall.EBADF}
+}
+
+func (r *objectReader) WriteAt(p []byte, off int64) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: r.name, Err: syscall.EBADF}
+}
+
+func (r *objectReader) Stat() (os.FileInfo, error) { return r.info, nil }
+
+func (r *objectReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.r == nil {
+		return nil
+	}
+	err := r.r.Close()
+	r.r = nil
+	return err
+}
+
+// objectInfo describes an object or directory
+type objectInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi objectInfo) Name() string       { return fi.name }
+func (fi objectInfo) Size() int64        { return fi.size }
+func (fi objectInfo) ModTime() time.Time { return fi.modTime }
+func (fi objectInfo) IsDir() bool        { return fi.dir }
+func (fi objectInfo) Sys() interface{}   { return nil }
+
+func (fi objectInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
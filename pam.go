@@ -0,0 +1,43 @@
+//go:build pam
+
+package simplescp
+
+import (
+	"errors"
+
+	"github.com/msteinert/pam/v2"
+)
+
+// Built with -tags pam, which needs cgo and the PAM headers (libpam0g-dev or pam-devel)
+const pamSupported = true
+
+// Authenticate a user with the given PAM service, answering its password
+// prompts with pass. Accounts that PAM says are expired or locked are
+// rejected as well
+func pamAuthenticate(service, user, pass, remoteHost string) error {
+	t, err := pam.StartFunc(service, user, func(s pam.Style, msg string) (string, error) {
+		switch s {
+		case pam.PromptEchoOff:
+			return pass, nil
+		case pam.PromptEchoOn:
+			return user, nil
+		case pam.ErrorMsg, pam.TextInfo:
+			return "", nil
+		}
+		return "", errors.New("unsupported PAM conversation style")
+	})
+	if err != nil {
+		return err
+	}
+	defer t.End()
+
+	if len(remoteHost) > 0 {
+		if err := t.SetItem(pam.Rhost, remoteHost); err != nil {
+			return err
+		}
+	}
+	if err := t.Authenticate(pam.Silent | pam.DisallowNullAuthtok); err != nil {
+		return err
+	}
+	return t.AcctMgmt(pam.Silent)
+}
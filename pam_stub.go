@@ -0,0 +1,12 @@
+//go:build !pam
+
+package simplescp
+
+import "errors"
+
+// PAM support needs cgo, so it's only there when built with -tags pam
+const pamSupported = false
+
+func pamAuthenticate(service, user, pass, remoteHost string) error {
+	return errors.New("PAM support not built in")
+}
@@ -0,0 +1,39 @@
+package simplescp
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordHashes(t *testing.T) {
+	argonHash, err := HashPassword("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcryptHash, _ := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	ourBcryptHash, err := HashPasswordBcrypt("hunter2", bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stored := range []string{"hunter2", argonHash, string(bcryptHash), ourBcryptHash} {
+		if isPasswordHash(stored) {
+			if err := validatePasswordHash(stored); err != nil {
+				t.Errorf("Invalid hash %s: %v", stored, err)
+			}
+		}
+		if !checkConfigPassword(stored, []byte("hunter2")) {
+			t.Errorf("Right password rejected for %s", stored)
+		}
+		if checkConfigPassword(stored, []byte("hunter3")) || checkConfigPassword(stored, nil) {
+			t.Errorf("Wrong password accepted for %s", stored)
+		}
+	}
+
+	for _, bad := range []string{"$argon2id$v=19$m=65536$abc$def", "$argon2id$v=18$m=65536,t=3,p=4$c2FsdA$aGFzaA", "$2a$10$tooshort"} {
+		if err := validatePasswordHash(bad); err == nil {
+			t.Errorf("Expected an error for %s", bad)
+		}
+	}
+}
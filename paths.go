@@ -0,0 +1,164 @@
+package simplescp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Placeholder in Dir that gets replaced by the name of the user logging in
+const userPlaceholder = "%u"
+
+// Work out the directory a user will be sharing files out of.
+// Users coming from the user store (u) can have their own home directory
+// (relative ones are taken from the shared directory), otherwise Dir is used
+// with any %u replaced by the username.
+func (c Config) userDir(username string, u *User) (string, error) {
+	if len(username) == 0 || username == "." || username == ".." || strings.ContainsAny(username, `/\`) {
+		return "", fmt.Errorf("invalid username %q", username)
+	}
+
+	dir := strings.ReplaceAll(c.Dir, userPlaceholder, username)
+	if u != nil && len(u.HomeDir) > 0 {
+		if filepath.IsAbs(u.HomeDir) {
+			dir = u.HomeDir
+		} else {
+			dir = filepath.Join(dir, u.HomeDir)
+		}
+	}
+	dir = filepath.Clean(dir)
+
+	if dir != filepath.Clean(c.Dir) {
+		// Per user directories are created the first time the user logs in
+		err := c.fileSystem().MkdirAll(dir, 0755)
+		if err != nil {
+			return "", err
+		}
+	}
+	c.logger().Debug("Sharing files", "dir", dir, "user", username)
+	return dir, nil
+}
+
+// Check if path is dir or is inside of it. Both need to be clean.
+func isWithinDir(path string, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// What to do with symlinks pointing outside of the shared directory (OutsideSymlinks)
+const (
+	symlinksDeny    = "deny"
+	symlinksResolve = "resolve-within-root"
+)
+
+func validateOutsideSymlinks(policy string) error {
+	switch policy {
+	case "", symlinksDeny, symlinksResolve:
+		return nil
+	}
+	return fmt.Errorf("Invalid outside_symlinks %q, it should be %s or %s", policy, symlinksDeny, symlinksResolve)
+}
+
+// How symlinks found copying directories are handled (Symlinks)
+const (
+	symlinksFollow   = "follow"
+	symlinksSkip     = "skip"
+	symlinksPreserve = "preserve"
+)
+
+func validateSymlinks(policy string) error {
+	switch policy {
+	case "", symlinksFollow, symlinksSkip, symlinksPreserve:
+		return nil
+	}
+	return fmt.Errorf("Invalid symlinks %q, it should be %s, %s or %s", policy, symlinksFollow, symlinksSkip, symlinksPreserve)
+}
+
+// Most symlinks followed when resolving a path, the same as Linux
+const maxSymlinks = 40
+
+// Translate a path as the client sees it (with the shared directory as /) into
+// a path in our file system, following the symlinks along the way so they
+// can't take it outside of the shared directory. Ones that would are refused,
+// or with resolve-within-root taken as if the shared directory was /, like in
+// a chroot. The path doesn't need to exist, the parts that don't are just
+// appended.
+func (c Config) resolvePath(p string) (string, error) {
+	root := filepath.Clean(c.Dir)
+	sep := string(filepath.Separator)
+	fsys := c.fileSystem()
+	lfs, ok := fsys.(LinkFileSystem)
+	if !ok {
+		// There can't be any symlinks to follow
+		return filepath.Join(root, filepath.Clean(sep+p)), nil
+	}
+
+	resolved := root
+	rest := filepath.Clean(sep + p)
+	links := 0
+	for len(rest) > 0 {
+		var name string
+		name, rest, _ = strings.Cut(strings.TrimLeft(rest, sep), sep)
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			// The client's path is clean, this comes from a symlink
+			if resolved == root {
+				if c.OutsideSymlinks != symlinksResolve {
+					return "", c.symlinkEscape(p)
+				}
+				continue
+			}
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, name)
+		fi, err := fsys.Lstat(next)
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		links++
+		if links > maxSymlinks {
+			return "", &os.PathError{Op: "open", Path: p, Err: syscall.ELOOP}
+		}
+		target, err := lfs.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			target = filepath.Clean(target)
+			if isWithinDir(target, root) {
+				target, _ = filepath.Rel(root, target)
+			} else if c.OutsideSymlinks != symlinksResolve {
+				return "", c.symlinkEscape(p)
+			}
+			resolved = root
+		}
+		rest = target + sep + rest
+	}
+	return resolved, nil
+}
+
+// Same as resolvePath, but if the path itself is a symlink it's not followed,
+// for operations on the link like removing or renaming it
+func (c Config) resolveLinkPath(p string) (string, error) {
+	p = filepath.Clean(string(filepath.Separator) + p)
+	dir, err := c.resolvePath(filepath.Dir(p))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(p)), nil
+}
+
+func (c Config) symlinkEscape(p string) error {
+	c.logger().Warn("Refusing to follow symlink out of the shared directory", "path", p)
+	return &os.PathError{Op: "open", Path: p, Err: syscall.EACCES}
+}
@@ -0,0 +1,83 @@
+package simplescp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolvePath(t *testing.T) {
+	outside := t.TempDir()
+	root := t.TempDir()
+	os.Mkdir(filepath.Join(root, "dir"), 0755)
+	for link, target := range map[string]string{
+		"up":       "..",
+		"etc":      outside,
+		"sneaky":   "dir/../../" + filepath.Base(outside),
+		"inside":   filepath.Join(root, "dir"),
+		"relative": "dir",
+		"loop":     "loop",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Skipf("Can't create symlinks: %v", err)
+		}
+	}
+
+	c := Config{Dir: root}
+	for p, expected := range map[string]string{
+		"/":                 root,
+		"dir/file":          filepath.Join(root, "dir", "file"),
+		"/relative/file":    filepath.Join(root, "dir", "file"),
+		"inside/file":       filepath.Join(root, "dir", "file"),
+		"../../dir":         filepath.Join(root, "dir"),
+		"missing/../../etc": "",
+		"up/file":           "",
+		"etc/passwd":        "",
+		"sneaky":            "",
+		"loop":              "",
+	} {
+		resolved, err := c.resolvePath(p)
+		if len(expected) == 0 {
+			if err == nil {
+				t.Errorf("%s resolved to %s", p, resolved)
+			}
+		} else if err != nil || resolved != expected {
+			t.Errorf("%s resolved to %s (%v), expected %s", p, resolved, err, expected)
+		}
+	}
+	// Links themselves can still be removed and such
+	if p, err := c.resolveLinkPath("etc"); err != nil || p != filepath.Join(root, "etc") {
+		t.Errorf("Link resolved to %s (%v)", p, err)
+	}
+
+	// Or taken like in a chroot
+	c.OutsideSymlinks = symlinksResolve
+	for p, expected := range map[string]string{
+		"up/dir":     filepath.Join(root, "dir"),
+		"etc/passwd": filepath.Join(root, outside, "passwd"),
+		"sneaky":     filepath.Join(root, filepath.Base(outside)),
+	} {
+		if resolved, err := c.resolvePath(p); err != nil || resolved != expected {
+			t.Errorf("%s resolved to %s (%v), expected %s", p, resolved, err, expected)
+		}
+	}
+}
+
+func TestSinkOutsideSymlink(t *testing.T) {
+	c := newTestConfig(t)
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(c.Dir, "out")); err != nil {
+		t.Skipf("Can't create symlinks: %v", err)
+	}
+	addr := startTestServer(t, c)
+
+	scp := startTestSCP(t, addr, "scp -t out")
+	if err := scp.ack(); err == nil {
+		t.Error("Copying through a symlink out of the shared directory accepted")
+	}
+	scp = startTestSCP(t, addr, "scp -t out/evil")
+	scp.ack()
+	if _, err := os.Stat(filepath.Join(outside, "evil")); err == nil {
+		t.Error("File written outside of the shared directory")
+	}
+}
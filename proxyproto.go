@@ -0,0 +1,43 @@
+package simplescp
+
+import (
+	"errors"
+	"net"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// Anyone could send a PROXY protocol header claiming to be anyone else, so
+// they're only taken from the load balancers
+var errProxyProtocolFrom = errors.New("Invalid proxy_protocol settings: proxy_protocol_from has to list the load balancers that send the header")
+
+// proxyListener wraps listener so that, while ProxyProtocol is on, connections
+// from the load balancers in ProxyProtocolFrom have to start with a PROXY
+// protocol header, v1 or v2. Their RemoteAddr is
+// then the client's real address. The config is checked on every connection,
+// so turning it on or off doesn't need a restart
+func (s *Server) proxyListener(listener net.Listener) net.Listener {
+	return &proxyproto.Listener{
+		Listener: listener,
+		ConnPolicy: func(opts proxyproto.ConnPolicyOptions) (proxyproto.Policy, error) {
+			c := s.Config()
+			if !c.ProxyProtocol || c.proxyFrom == nil || !c.proxyFrom.allowed(opts.Upstream) {
+				return proxyproto.SKIP, nil
+			}
+			return proxyproto.REQUIRE, nil
+		},
+	}
+}
+
+// Reads the PROXY protocol header of nConn, if it should have one. Connections
+// that need one but don't send a valid one get an error
+func readProxyHeader(nConn net.Conn) error {
+	pConn, ok := nConn.(*proxyproto.Conn)
+	if !ok {
+		return nil
+	}
+	if pConn.ProxyHeader() == nil {
+		return errors.New("Missing or invalid PROXY protocol header")
+	}
+	return nil
+}
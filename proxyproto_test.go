@@ -0,0 +1,68 @@
+package simplescp
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Logs into addr as scpuser, after sending header if there's one
+func dialWithProxyHeader(addr, header string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if len(header) > 0 {
+		if _, err := conn.Write([]byte(header)); err != nil {
+			return err
+		}
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
+		User:            "scpuser",
+		Auth:            []ssh.AuthMethod{ssh.Password("hunter2")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		return err
+	}
+	ssh.NewClient(sshConn, chans, reqs).Close()
+	return nil
+}
+
+func TestProxyProtocol(t *testing.T) {
+	c := newTestConfig(t)
+	c.ProxyProtocol = true
+	if err := c.Init(); err == nil {
+		t.Error("PROXY protocol headers taken from anyone")
+	}
+	c.ProxyProtocolFrom = []string{"127.0.0.0/8"}
+	c.DenyCIDRs = []string{"192.0.2.0/24"}
+	addr := startTestServer(t, c)
+
+	if err := dialWithProxyHeader(addr, "PROXY TCP4 198.51.100.7 127.0.0.1 40000 22\r\n"); err != nil {
+		t.Errorf("Connection with a PROXY v1 header failed: %v", err)
+	}
+	if err := dialWithProxyHeader(addr, "PROXY TCP4 192.0.2.10 127.0.0.1 40000 22\r\n"); err == nil {
+		t.Error("Client address from the PROXY header not filtered")
+	}
+	if err := dialWithProxyHeader(addr, ""); err == nil {
+		t.Error("Connection without a PROXY header accepted")
+	}
+
+	// Only the load balancers it's expected from have to send it
+	c = newTestConfig(t)
+	c.ProxyProtocol = true
+	c.ProxyProtocolFrom = []string{"10.0.0.0/8"}
+	c.DenyCIDRs = []string{"192.0.2.0/24"}
+	addr = startTestServer(t, c)
+	if err := dialWithProxyHeader(addr, ""); err != nil {
+		t.Errorf("Connection from elsewhere than a load balancer failed: %v", err)
+	}
+	// Or get to say where they're from: the header's just a line before ssh
+	// starts, which it skips
+	if err := dialWithProxyHeader(addr, "PROXY TCP4 192.0.2.10 127.0.0.1 40000 22\r\n"); err != nil {
+		t.Errorf("PROXY header taken from elsewhere than a load balancer: %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package simplescp
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// ErrQuotaExceeded is returned when a write would take a user over their quota
+var ErrQuotaExceeded = errors.New("Disk quota exceeded")
+
+// usageTracker keeps track of the disk space used under each user's directory.
+// Usage is worked out by walking the directory the first time it's needed, and
+// then updated as files are written and removed. Whenever a user looks like
+// they're going over quota usage is recalculated, in case files were removed
+// behind our back.
+type usageTracker struct {
+	mu   sync.Mutex
+	used map[string]int64
+}
+
+func newUsageTracker() *usageTracker {
+	return &usageTracker{used: make(map[string]int64)}
+}
+
+// Reserve n more bytes under root. Fails if that would take it over limit
+func (t *usageTracker) reserve(fsys FileSystem, root string, limit int64, n int64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	used, ok := t.used[root]
+	if !ok || used+n > limit {
+		used = diskUsage(fsys, root)
+		t.used[root] = used
+	}
+	if used+n > limit {
+		slog.Info("Quota exceeded", "dir", root, "used", used, "requested", n, "limit", limit)
+		return ErrQuotaExceeded
+	}
+	t.used[root] = used + n
+	return nil
+}
+
+// How much space is used under root, working it out if it isn't known yet
+func (t *usageTracker) current(fsys FileSystem, root string) int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	used, ok := t.used[root]
+	if !ok {
+		used = diskUsage(fsys, root)
+		t.used[root] = used
+	}
+	return used
+}
+
+// Give back n bytes under root (after a file has been removed, truncated, etc)
+func (t *usageTracker) release(root string, n int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if used, ok := t.used[root]; ok {
+		used -= n
+		if used < 0 {
+			used = 0
+		}
+		t.used[root] = used
+	}
+}
+
+// Add up the size of all the files under root, hard linked ones only once
+func diskUsage(fsys FileSystem, root string) int64 {
+	var total int64
+	seen := map[fileID]bool{}
+	walk(fsys, root, func(p string, info os.FileInfo) {
+		if !info.Mode().IsRegular() {
+			return
+		}
+		if id, links, ok := fileLinks(info); ok && links > 1 {
+			if seen[id] {
+				return
+			}
+			seen[id] = true
+		}
+		total += info.Size()
+	})
+	return total
+}
+
+// Reserve space for a file about to grow by n bytes (can be negative)
+func (c Config) reserveSpace(n int64) error {
+	if c.quotaLimit <= 0 || c.usage == nil {
+		return nil
+	}
+	if n <= 0 {
+		c.usage.release(c.Dir, -n)
+		return nil
+	}
+	return c.usage.reserve(c.fileSystem(), c.Dir, int64(c.quotaLimit), n)
+}
+
+// Size of a file if it already exists, 0 otherwise
+func (c Config) existingSize(path string) int64 {
+	fi, err := c.fileSystem().Lstat(path)
+	if err != nil || !fi.Mode().IsRegular() {
+		return 0
+	}
+	return fi.Size()
+}
+
+// Space that removing path frees up, nothing if there are other hard links to it
+func (c Config) removedSize(path string) int64 {
+	fi, err := c.fileSystem().Lstat(path)
+	if err != nil || !fi.Mode().IsRegular() {
+		return 0
+	}
+	if _, links, ok := fileLinks(fi); ok && links > 1 {
+		return 0
+	}
+	return fi.Size()
+}
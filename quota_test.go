@@ -0,0 +1,42 @@
+package simplescp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUsageTracker(t *testing.T) {
+	root := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(root, "existing"), make([]byte, 600), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracker := newUsageTracker()
+	if err := tracker.reserve(osFileSystem{}, root, 1000, 300); err != nil {
+		t.Errorf("Expected 300 bytes to fit, got %v", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(root, "new"), make([]byte, 300), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.reserve(osFileSystem{}, root, 1000, 200); err != ErrQuotaExceeded {
+		t.Errorf("Expected quota to be exceeded, got %v", err)
+	}
+
+	// Files removed behind our back are noticed once the quota looks exceeded
+	err = os.Remove(filepath.Join(root, "existing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.reserve(osFileSystem{}, root, 1000, 400); err != nil {
+		t.Errorf("Expected 400 bytes to fit after removing a file, got %v", err)
+	}
+
+	tracker.release(root, 400)
+	if err := tracker.reserve(osFileSystem{}, root, 1000, 700); err != nil {
+		t.Errorf("Expected 700 bytes to fit after releasing space, got %v", err)
+	}
+}
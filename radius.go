@@ -0,0 +1,229 @@
+package simplescp
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// RADIUSConfig holds the settings for checking passwords against RADIUS
+// servers with PAP. Servers are tried in order, moving on to the next one
+// when a server doesn't answer.
+type RADIUSConfig struct {
+	Servers       []string      `yaml:"servers" toml:"servers"` // host:port, the port defaults to 1812
+	Secret        string        `yaml:"secret" toml:"secret"`
+	Timeout       time.Duration `yaml:"timeout" toml:"timeout"`               // How long to wait for each server. Default: 5s
+	NASIdentifier string        `yaml:"nas_identifier" toml:"nas_identifier"` // Default: simplescp
+}
+
+// Packet codes and attribute types from RFC 2865 and RFC 3579
+const (
+	radiusAccessRequest   = 1
+	radiusAccessAccept    = 2
+	radiusAccessReject    = 3
+	radiusAccessChallenge = 11
+
+	radiusUserName             = 1
+	radiusUserPassword         = 2
+	radiusCallingStationID     = 31
+	radiusNASIdentifier        = 32
+	radiusMessageAuthenticator = 80
+)
+
+// Requests are sent this many times to each server before giving up on it
+const radiusAttempts = 2
+
+var errRADIUSReject = errors.New("access rejected")
+
+func (r RADIUSConfig) enabled() bool {
+	return len(r.Servers) > 0
+}
+
+func (r RADIUSConfig) validate() error {
+	if len(r.Secret) == 0 {
+		return errors.New("Invalid RADIUS settings: the secret has to be set")
+	}
+	for _, server := range r.Servers {
+		if _, err := net.ResolveUDPAddr("udp", r.serverAddr(server)); err != nil {
+			return fmt.Errorf("Invalid RADIUS server %q: %v", server, err)
+		}
+	}
+	return nil
+}
+
+func (r RADIUSConfig) serverAddr(server string) string {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		return net.JoinHostPort(server, "1812")
+	}
+	return server
+}
+
+func (r RADIUSConfig) timeout() time.Duration {
+	if r.Timeout > 0 {
+		return r.Timeout
+	}
+	return 5 * time.Second
+}
+
+// Check a user's password, trying each server in turn until one of them answers
+func (r RADIUSConfig) authenticate(username, pass, remoteHost string) error {
+	if len(pass) == 0 || len(pass) > 128 || len(username) > 253 || len(remoteHost) > 253 {
+		return errors.New("username or password length not supported by RADIUS")
+	}
+	err := errors.New("no RADIUS servers")
+	for _, server := range r.Servers {
+		err = r.exchange(r.serverAddr(server), username, pass, remoteHost)
+		if err == nil || err == errRADIUSReject {
+			return err
+		}
+	}
+	return err
+}
+
+func (r RADIUSConfig) exchange(addr, username, pass, remoteHost string) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	packet, authenticator, err := r.accessRequest(username, pass, remoteHost)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4096)
+	for attempt := 0; attempt < radiusAttempts; attempt++ {
+		if _, err := conn.Write(packet); err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(r.timeout()))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return err
+			}
+			// Anything that isn't an answer to this request is ignored
+			code, ok := r.checkResponse(buf[:n], packet[1], authenticator)
+			if !ok {
+				continue
+			}
+			if code == radiusAccessAccept {
+				return nil
+			}
+			return errRADIUSReject
+		}
+	}
+	return fmt.Errorf("no answer from RADIUS server %s", addr)
+}
+
+// Build an Access-Request, returning it along with its authenticator
+func (r RADIUSConfig) accessRequest(username, pass, remoteHost string) ([]byte, []byte, error) {
+	header := make([]byte, 20)
+	if _, err := rand.Read(header[1:]); err != nil {
+		return nil, nil, err
+	}
+	header[0] = radiusAccessRequest
+	authenticator := header[4:20]
+
+	nasID := r.NASIdentifier
+	if len(nasID) == 0 {
+		nasID = "simplescp"
+	}
+	var attrs []byte
+	attrs = appendRADIUSAttr(attrs, radiusUserName, []byte(username))
+	attrs = appendRADIUSAttr(attrs, radiusUserPassword, hideRADIUSPassword([]byte(pass), []byte(r.Secret), authenticator))
+	attrs = appendRADIUSAttr(attrs, radiusNASIdentifier, []byte(nasID))
+	if len(remoteHost) > 0 {
+		attrs = appendRADIUSAttr(attrs, radiusCallingStationID, []byte(remoteHost))
+	}
+	// Signed with a Message-Authenticator, which goes last (RFC 3579)
+	attrs = appendRADIUSAttr(attrs, radiusMessageAuthenticator, make([]byte, md5.Size))
+
+	packet := append(header, attrs...)
+	if len(packet) > 4096 {
+		return nil, nil, errors.New("RADIUS request too big")
+	}
+	packet[2], packet[3] = byte(len(packet)>>8), byte(len(packet))
+	mac := hmac.New(md5.New, []byte(r.Secret))
+	mac.Write(packet)
+	copy(packet[len(packet)-md5.Size:], mac.Sum(nil))
+	return packet, append([]byte(nil), authenticator...), nil
+}
+
+// Check that a response is for the request with the given id and
+// authenticator, and was signed with our secret. Returns its code
+func (r RADIUSConfig) checkResponse(resp []byte, id byte, requestAuth []byte) (byte, bool) {
+	if len(resp) < 20 || resp[1] != id {
+		return 0, false
+	}
+	length := int(resp[2])<<8 | int(resp[3])
+	if length < 20 || length > len(resp) {
+		return 0, false
+	}
+	resp = resp[:length]
+
+	h := md5.New()
+	h.Write(resp[:4])
+	h.Write(requestAuth)
+	h.Write(resp[20:])
+	h.Write([]byte(r.Secret))
+	if !hmac.Equal(h.Sum(nil), resp[4:20]) {
+		return 0, false
+	}
+
+	// If there's a Message-Authenticator it has to be right too
+	for attrs := resp[20:]; len(attrs) >= 2; attrs = attrs[attrs[1]:] {
+		if attrs[1] < 2 || int(attrs[1]) > len(attrs) {
+			return 0, false
+		}
+		if attrs[0] != radiusMessageAuthenticator {
+			continue
+		}
+		if attrs[1] != 2+md5.Size {
+			return 0, false
+		}
+		signed := append([]byte(nil), resp...)
+		copy(signed[4:20], requestAuth)
+		offset := len(resp) - len(attrs) + 2
+		copy(signed[offset:offset+md5.Size], make([]byte, md5.Size))
+		mac := hmac.New(md5.New, []byte(r.Secret))
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), attrs[2:2+md5.Size]) {
+			return 0, false
+		}
+	}
+
+	switch resp[0] {
+	case radiusAccessAccept, radiusAccessReject, radiusAccessChallenge:
+		return resp[0], true
+	}
+	return 0, false
+}
+
+func appendRADIUSAttr(attrs []byte, typ byte, value []byte) []byte {
+	attrs = append(attrs, typ, byte(2+len(value)))
+	return append(attrs, value...)
+}
+
+// Hide the password as described in RFC 2865 section 5.2
+func hideRADIUSPassword(pass, secret, authenticator []byte) []byte {
+	padded := make([]byte, (len(pass)+15)/16*16)
+	copy(padded, pass)
+	prev := authenticator
+	for i := 0; i < len(padded); i += 16 {
+		b := md5.Sum(append(append([]byte(nil), secret...), prev...))
+		for j := range b {
+			padded[i+j] ^= b[j]
+		}
+		prev = padded[i : i+16]
+	}
+	return padded
+}
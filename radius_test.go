@@ -0,0 +1,97 @@
+package simplescp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"net"
+	"testing"
+	"time"
+)
+
+// Answers Access-Requests for alice with password hunter2, the way a RADIUS server would
+func serveTestRADIUS(conn net.PacketConn, secret string) {
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req := buf[:n]
+		var user, pass []byte
+		for attrs := req[20:]; len(attrs) >= 2 && int(attrs[1]) <= len(attrs); attrs = attrs[attrs[1]:] {
+			switch attrs[0] {
+			case radiusUserName:
+				user = attrs[2:attrs[1]]
+			case radiusUserPassword:
+				hidden := attrs[2:attrs[1]]
+				pass = make([]byte, len(hidden))
+				prev := req[4:20]
+				for i := 0; i < len(hidden); i += 16 {
+					b := md5.Sum(append([]byte(secret), prev...))
+					for j := range b {
+						pass[i+j] = hidden[i+j] ^ b[j]
+					}
+					prev = hidden[i : i+16]
+				}
+				pass = bytes.TrimRight(pass, "\x00")
+			}
+		}
+
+		code := byte(radiusAccessReject)
+		if string(user) == "alice" && string(pass) == "hunter2" {
+			code = radiusAccessAccept
+		}
+		// Accept with a Message-Authenticator, reject without one
+		resp := []byte{code, req[1], 0, 20}
+		resp = append(resp, req[4:20]...)
+		if code == radiusAccessAccept {
+			resp = appendRADIUSAttr(resp, radiusMessageAuthenticator, make([]byte, md5.Size))
+			resp[3] = byte(len(resp))
+			mac := hmac.New(md5.New, []byte(secret))
+			mac.Write(resp)
+			copy(resp[22:], mac.Sum(nil))
+		}
+		h := md5.New()
+		h.Write(resp)
+		h.Write([]byte(secret))
+		copy(resp[4:20], h.Sum(nil))
+		conn.WriteTo(resp, addr)
+	}
+}
+
+func TestRADIUS(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go serveTestRADIUS(conn, "s3cret")
+
+	// A server that never answers, so we have to fail over to the next one
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	r := RADIUSConfig{
+		Servers: []string{silent.LocalAddr().String(), conn.LocalAddr().String()},
+		Secret:  "s3cret",
+		Timeout: 50 * time.Millisecond,
+	}
+	if err := r.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.authenticate("alice", "hunter2", "192.0.2.10"); err != nil {
+		t.Errorf("Right password rejected: %v", err)
+	}
+	if err := r.authenticate("alice", "hunter3", "192.0.2.10"); err != errRADIUSReject {
+		t.Errorf("Expected a reject for the wrong password, got %v", err)
+	}
+
+	r.Secret = "wrong"
+	if err := r.authenticate("alice", "hunter2", "192.0.2.10"); err == nil || err == errRADIUSReject {
+		t.Errorf("Expected responses signed with another secret to be ignored, got %v", err)
+	}
+}
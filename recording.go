@@ -0,0 +1,301 @@
+package simplescp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Session recordings are JSON lines: a recordingHeader, then a recordedEvent
+// for each message in the scp or sftp dialogue, in the order they went
+// through the channel. ReplayRecording turns them back into something to read
+const recordingVersion = 1
+
+// recordingHeader is the first line of a recording, describing the session
+type recordingHeader struct {
+	Version    int       `json:"version"`
+	Session    string    `json:"session"`
+	User       string    `json:"user"`
+	RemoteHost string    `json:"remote_host"`
+	Protocol   string    `json:"protocol"` // scp or sftp
+	Command    string    `json:"command,omitempty"`
+	Start      time.Time `json:"start"`
+	Contents   bool      `json:"contents"` // Whether file contents were recorded
+}
+
+// recordedEvent is a message sent through the channel: an scp control message
+// or status, a run of file contents, or an sftp packet
+type recordedEvent struct {
+	Time     float64 `json:"t"`    // Seconds since the session started
+	From     string  `json:"from"` // client or server
+	Message  []byte  `json:"msg,omitempty"`
+	Contents int64   `json:"contents,omitempty"` // Bytes of file contents in (or left out of) the message
+}
+
+// Longest scp control message recorded in one piece, anything longer isn't
+// really one
+const maxRecordedLine = 64 * 1024
+
+// sessionRecorder writes the recording of a session to its file
+type sessionRecorder struct {
+	mu       sync.Mutex
+	f        *os.File
+	enc      *json.Encoder
+	start    time.Time
+	contents bool
+	config   Config
+	client   recordSplitter // What the client sends
+	server   recordSplitter // What we send
+}
+
+// recordSplitter breaks what goes one way through the channel into messages
+// for the recording
+type recordSplitter interface {
+	feed(r *sessionRecorder, data []byte)
+	flush(r *sessionRecorder)
+}
+
+// recordedChannel records what's read from and written to the channel
+type recordedChannel struct {
+	ssh.Channel
+	rec *sessionRecorder
+}
+
+func (c recordedChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	c.rec.feed(c.rec.client, p[:n])
+	return n, err
+}
+
+func (c recordedChannel) Write(p []byte) (int, error) {
+	n, err := c.Channel.Write(p)
+	c.rec.feed(c.rec.server, p[:n])
+	return n, err
+}
+
+// Start recording the session on channel to a new file in RecordDir, if
+// there's one. The channel returned has to be used instead, and stop called
+// once the session's over
+func (c Config) recordSession(channel ssh.Channel, protocol, command string) (ssh.Channel, func()) {
+	if len(c.RecordDir) == 0 {
+		return channel, func() {}
+	}
+
+	start := time.Now()
+	pattern := fmt.Sprintf("%s-%s-%s-*.rec", start.UTC().Format("20060102T150405"), c.sessionID, protocol)
+	f, err := os.CreateTemp(c.RecordDir, pattern)
+	if err != nil {
+		c.logger().Error("Can't record session", "dir", c.RecordDir, "err", err)
+		return channel, func() {}
+	}
+	r := &sessionRecorder{f: f, enc: json.NewEncoder(f), start: start, contents: c.RecordContents, config: c}
+	if protocol == "sftp" {
+		r.client, r.server = &sftpSplitter{from: "client"}, &sftpSplitter{from: "server"}
+	} else {
+		r.client, r.server = &scpSplitter{from: "client"}, &scpSplitter{from: "server"}
+	}
+	err = r.enc.Encode(recordingHeader{
+		Version:    recordingVersion,
+		Session:    c.sessionID,
+		User:       c.username,
+		RemoteHost: c.remoteHost,
+		Protocol:   protocol,
+		Command:    command,
+		Start:      start.UTC(),
+		Contents:   c.RecordContents,
+	})
+	if err != nil {
+		c.logger().Error("Can't record session", "file", f.Name(), "err", err)
+	}
+	c.logger().Debug("Recording session", "file", f.Name())
+	return recordedChannel{channel, r}, r.close
+}
+
+func (r *sessionRecorder) feed(s recordSplitter, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s.feed(r, data)
+}
+
+// Note down a message. r.mu has to be held
+func (r *sessionRecorder) record(from string, msg []byte, contents int64) {
+	err := r.enc.Encode(recordedEvent{
+		Time:     time.Since(r.start).Seconds(),
+		From:     from,
+		Message:  msg,
+		Contents: contents,
+	})
+	if err != nil {
+		r.config.logger().Error("Can't write to session recording", "file", r.f.Name(), "err", err)
+	}
+}
+
+func (r *sessionRecorder) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.client.flush(r)
+	r.server.flush(r)
+	if err := r.f.Close(); err != nil {
+		r.config.logger().Error("Can't write to session recording", "file", r.f.Name(), "err", err)
+	}
+}
+
+// scpSplitter splits one side of the scp dialogue into status codes, control
+// messages (and errors) and the contents of the files that follow C messages
+type scpSplitter struct {
+	from     string
+	line     []byte // Control message read so far
+	left     int64  // Bytes of file contents still to come
+	contents int64  // Bytes of file contents not recorded yet
+}
+
+func (s *scpSplitter) feed(r *sessionRecorder, data []byte) {
+	for len(data) > 0 {
+		if s.left > 0 {
+			n := int(min(s.left, int64(len(data))))
+			if r.contents {
+				r.record(s.from, data[:n], int64(n))
+			} else {
+				s.contents += int64(n)
+			}
+			s.left -= int64(n)
+			data = data[n:]
+			if s.left == 0 {
+				s.flush(r)
+			}
+			continue
+		}
+		if len(s.line) == 0 && data[0] == 0 {
+			// Everything's fine, it doesn't come with a message
+			r.record(s.from, data[:1], 0)
+			data = data[1:]
+			continue
+		}
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			s.line = append(s.line, data...)
+			if len(s.line) > maxRecordedLine {
+				r.record(s.from, s.line, 0)
+				s.line = nil
+			}
+			return
+		}
+		msg := append(s.line, data[:i+1]...)
+		s.line = nil
+		data = data[i+1:]
+		r.record(s.from, msg, 0)
+		if msg[0] == 'C' {
+			if fields := strings.Fields(string(msg)); len(fields) == 3 {
+				s.left, _ = strconv.ParseInt(fields[1], 10, 64)
+			}
+		}
+	}
+}
+
+func (s *scpSplitter) flush(r *sessionRecorder) {
+	if s.contents > 0 {
+		r.record(s.from, nil, s.contents)
+		s.contents = 0
+	}
+	if len(s.line) > 0 {
+		r.record(s.from, s.line, 0)
+		s.line = nil
+	}
+}
+
+// sftpSplitter splits one side of an sftp session into its packets, leaving
+// out what's read from or written to files unless it's recorded too
+type sftpSplitter struct {
+	from   string
+	packet []byte // Read so far
+	broken bool   // Not made of packets after all, what's left is recorded as it comes
+}
+
+func (s *sftpSplitter) feed(r *sessionRecorder, data []byte) {
+	if s.broken {
+		r.record(s.from, data, 0)
+		return
+	}
+	s.packet = append(s.packet, data...)
+	for len(s.packet) >= 4 {
+		length := int(binary.BigEndian.Uint32(s.packet))
+		if length == 0 || length > maxSFTPPacket+sftpWriteOverhead {
+			s.broken = true
+			s.flush(r)
+			return
+		}
+		if len(s.packet) < 4+length {
+			return
+		}
+		packet := s.packet[:4+length]
+		msg, contents := packet, int64(0)
+		if start, n, ok := sftpContents(packet); ok {
+			contents = n
+			if !r.contents {
+				msg = packet[:start]
+			}
+		}
+		r.record(s.from, msg, contents)
+		s.packet = s.packet[4+length:]
+	}
+	if len(s.packet) == 0 {
+		s.packet = nil
+	}
+}
+
+func (s *sftpSplitter) flush(r *sessionRecorder) {
+	if len(s.packet) > 0 {
+		r.record(s.from, s.packet, 0)
+		s.packet = nil
+	}
+}
+
+// Where the file contents in an sftp write request or data response start,
+// and how many bytes of them there are
+func sftpContents(packet []byte) (int, int64, bool) {
+	var rest []byte
+	var ok bool
+	switch packet[4] {
+	case sshFxpWrite:
+		_, rest, ok = sftpUint32(packet[5:])
+		if ok {
+			_, rest, ok = sftpString(rest)
+		}
+		if ok {
+			_, rest, ok = sftpUint64(rest)
+		}
+	case sshFxpData:
+		_, rest, ok = sftpUint32(packet[5:])
+	}
+	if !ok || len(rest) < 4 {
+		return 0, 0, false
+	}
+	start := len(packet) - len(rest) + 4
+	return start, int64(len(packet) - start), true
+}
+
+// The scp command line opts were parsed from, more or less
+func scpCommandLine(opts scpOptions) string {
+	args := []string{"scp"}
+	for _, f := range []struct {
+		set  bool
+		flag string
+	}{{opts.From, "-f"}, {opts.To, "-t"}, {opts.TargetIsDir, "-d"}, {opts.Recursive, "-r"}, {opts.PreserveMode, "-p"}} {
+		if f.set {
+			args = append(args, f.flag)
+		}
+	}
+	args = append(args, "--")
+	return strings.Join(append(args, opts.fileNames...), " ")
+}
@@ -0,0 +1,109 @@
+package simplescp
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Replays the only session recorded in dir, returns it along with whether
+// secret was recorded in it
+func replayTestRecording(t *testing.T, dir, secret string) (string, bool) {
+	t.Helper()
+	files, _ := filepath.Glob(filepath.Join(dir, "*.rec"))
+	if len(files) != 1 {
+		t.Fatalf("Got recordings %q, expected one", files)
+	}
+	recording, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replay strings.Builder
+	if err := ReplayRecording(bytes.NewReader(recording), &replay, 0); err != nil {
+		t.Fatal(err)
+	}
+	var recorded bool
+	dec := json.NewDecoder(bytes.NewReader(recording))
+	for dec.More() {
+		var e recordedEvent
+		dec.Decode(&e)
+		recorded = recorded || bytes.Contains(e.Message, []byte(secret))
+	}
+	return replay.String(), recorded
+}
+
+func TestRecordSCP(t *testing.T) {
+	for _, contents := range []bool{false, true} {
+		c := newTestConfig(t)
+		c.RecordDir = filepath.Join(t.TempDir(), "sessions")
+		c.RecordContents = contents
+		addr := startTestServer(t, c)
+
+		scp := startTestSCP(t, addr, "scp -t .")
+		scp.ack()
+		if err := scp.sendFile("file.txt", "top secret"); err != nil {
+			t.Fatal(err)
+		}
+		scp.stdin.Close()
+		if err := scp.session.Wait(); err != nil {
+			t.Fatal(err)
+		}
+
+		replay, recorded := replayTestRecording(t, c.RecordDir, "top secret")
+		for _, expected := range []string{
+			"session", "of scpuser from 127.0.0.1 (scp): scp -t -- .",
+			`client "C0644 10 file.txt"`,
+			"client 10 bytes of file contents",
+			"server ok",
+		} {
+			if !strings.Contains(replay, expected) {
+				t.Errorf("Replay doesn't have %q:\n%s", expected, replay)
+			}
+		}
+		if recorded != contents {
+			t.Errorf("File contents recorded: %v, expected %v", recorded, contents)
+		}
+	}
+}
+
+func TestRecordSFTP(t *testing.T) {
+	for _, contents := range []bool{false, true} {
+		c := newTestConfig(t)
+		c.RecordDir = filepath.Join(t.TempDir(), "sessions")
+		c.RecordContents = contents
+		addr := startTestServer(t, c)
+
+		client := dialSFTP(t, addr)
+		f, err := client.Create("/file.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte("top secret"))
+		f.Close()
+		if err := client.Rename("/file.txt", "/renamed.txt"); err != nil {
+			t.Fatal(err)
+		}
+
+		replay, recorded := replayTestRecording(t, c.RecordDir, "top secret")
+		for _, expected := range []string{
+			"(sftp)",
+			"client init",
+			"client #1 open /file.txt",
+			"server #1 handle /file.txt",
+			"client #2 write /file.txt at 0, 10 bytes",
+			"client #3 close /file.txt",
+			"client #4 rename /file.txt -> /renamed.txt",
+			"server #4 ok",
+		} {
+			if !strings.Contains(replay, expected) {
+				t.Errorf("Replay doesn't have %q:\n%s", expected, replay)
+			}
+		}
+		if recorded != contents {
+			t.Errorf("File contents recorded: %v, expected %v", recorded, contents)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+package simplescp
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// Log a panic recovered from while serving a client, r being what recover
+// returned, along with where it happened. The goroutine it happened in cleans
+// up and carries on, so one bad session can't take the whole server down
+func (c Config) logPanic(what string, r any) {
+	c.logger().Error("Recovered from panic", "in", what, "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+}
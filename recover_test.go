@@ -0,0 +1,77 @@
+package simplescp
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A file system that panics when it's asked about boom
+type panicFS struct {
+	FileSystem
+}
+
+func (fsys panicFS) Stat(name string) (os.FileInfo, error) {
+	if filepath.Base(name) == "boom" {
+		panic("boom")
+	}
+	return fsys.FileSystem.Stat(name)
+}
+
+func (fsys panicFS) Lstat(name string) (os.FileInfo, error) {
+	if filepath.Base(name) == "boom" {
+		panic("boom")
+	}
+	return fsys.FileSystem.Lstat(name)
+}
+
+func TestRecoverPanics(t *testing.T) {
+	c := newTestConfig(t)
+	c.FileSystem = panicFS{osFileSystem{}}
+	c.Logger = slog.New(slog.DiscardHandler)
+	addr := startTestServer(t, c)
+
+	// The sftp request fails, the session goes on
+	client := dialSFTP(t, addr)
+	if _, err := client.Stat("/boom"); err == nil {
+		t.Error("Request that panicked didn't fail")
+	}
+	if _, err := client.Stat("/"); err != nil {
+		t.Errorf("Session not usable after a panic: %v", err)
+	}
+
+	// So does the scp command, with an error
+	scp := startTestSCP(t, addr, "scp -f boom")
+	scp.stdin.Write([]byte{0})
+	var exitErr *ssh.ExitError
+	if err := scp.session.Wait(); !errors.As(err, &exitErr) || exitErr.ExitStatus() != 1 {
+		t.Errorf("Got %v from scp command that panicked, expected exit status 1", err)
+	}
+
+	// Commands that can't be run are refused, without bringing anything down
+	sshClient, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "scpuser",
+		Auth:            []ssh.AuthMethod{ssh.Password("hunter2")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sshClient.Close()
+	for _, cmd := range []string{"", `"unterminated`} {
+		session, err := sshClient.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := session.Run(cmd); err == nil {
+			t.Errorf("Command %q ran", cmd)
+		}
+	}
+	if _, err := dialSFTP(t, addr).Stat("/"); err != nil {
+		t.Errorf("Server not usable after panics: %v", err)
+	}
+}
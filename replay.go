@@ -0,0 +1,154 @@
+package simplescp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// ReplayRecording writes out a session recorded in RecordDir, one message per
+// line with when it was sent and who by. With speed above 0 it takes as long
+// as the session did (divided by speed), as if it was being watched live
+func ReplayRecording(r io.Reader, w io.Writer, speed float64) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	var header recordingHeader
+	if err := dec.Decode(&header); err != nil {
+		return fmt.Errorf("Invalid recording: %v", err)
+	}
+	if header.Version != recordingVersion {
+		return fmt.Errorf("Unknown recording version %d", header.Version)
+	}
+	fmt.Fprintf(w, "%s session %s of %s from %s (%s)", header.Start.Format(time.RFC3339), header.Session, header.User, header.RemoteHost, header.Protocol)
+	if len(header.Command) > 0 {
+		fmt.Fprintf(w, ": %s", header.Command)
+	}
+	fmt.Fprintln(w)
+
+	replay := sftpReplay{pending: map[uint32]string{}, handles: map[string]string{}}
+	start := time.Now()
+	for {
+		var e recordedEvent
+		err := dec.Decode(&e)
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Invalid recording: %v", err)
+		}
+		if speed > 0 {
+			time.Sleep(time.Until(start.Add(time.Duration(e.Time / speed * float64(time.Second)))))
+		}
+
+		var msg string
+		if header.Protocol == "sftp" {
+			msg = replay.describe(e)
+		} else {
+			msg = describeSCPMessage(e)
+		}
+		if _, err := fmt.Fprintf(w, "%9.3fs %-6s %s\n", e.Time, e.From, msg); err != nil {
+			return err
+		}
+	}
+}
+
+// How an scp message reads in a replay
+func describeSCPMessage(e recordedEvent) string {
+	switch {
+	case e.Contents > 0:
+		return fmt.Sprintf("%d bytes of file contents", e.Contents)
+	case len(e.Message) == 1 && e.Message[0] == 0:
+		return "ok"
+	case len(e.Message) > 0 && (e.Message[0] == 1 || e.Message[0] == 2):
+		return fmt.Sprintf("error: %s", strings.TrimSpace(string(e.Message[1:])))
+	}
+	return fmt.Sprintf("%q", strings.TrimSuffix(string(e.Message), "\n"))
+}
+
+// sftpReplay follows the sftp requests of a recording, so requests on handles
+// can be shown with the file they're about
+type sftpReplay struct {
+	pending map[uint32]string // Paths of the files being opened, by request id
+	handles map[string]string // Paths of the open files
+}
+
+// How an sftp packet reads in a replay
+func (s sftpReplay) describe(e recordedEvent) string {
+	packet := e.Message
+	if len(packet) < 5 {
+		return fmt.Sprintf("%q", packet)
+	}
+	kind := packet[4]
+	id, rest, ok := sftpUint32(packet[5:])
+	switch kind {
+	case 1:
+		return "init"
+	case sshFxpVersion:
+		return "version"
+	case sshFxpStatus:
+		code, _, _ := sftpUint32(rest)
+		status, known := sftpStatuses[code]
+		if !known {
+			status = "error"
+		}
+		return fmt.Sprintf("#%d %s", id, status)
+	case sshFxpHandle:
+		handle, _, _ := sftpString(rest)
+		if p, ok := s.pending[id]; ok {
+			s.handles[handle] = p
+			delete(s.pending, id)
+		}
+		return fmt.Sprintf("#%d handle %s", id, s.handles[handle])
+	case sshFxpData:
+		return fmt.Sprintf("#%d %d bytes of file contents", id, e.Contents)
+	case sshFxpExtendedReply:
+		return fmt.Sprintf("#%d extended reply", id)
+	case 104:
+		return fmt.Sprintf("#%d names", id)
+	case 105:
+		return fmt.Sprintf("#%d attributes", id)
+	}
+
+	op := sftpOps[kind]
+	if kind == sshFxpExtended && ok {
+		op, rest, ok = sftpString(rest)
+	}
+	if !ok || op == "" {
+		return fmt.Sprintf("#%d unknown request %d", id, kind)
+	}
+	desc := fmt.Sprintf("#%d %s", id, op)
+	arg, more, ok := sftpString(rest)
+	if !ok || op == limitsExtension {
+		return desc
+	}
+	if sftpHandleOps[op] {
+		desc += " " + s.handles[arg]
+		if op == "close" {
+			delete(s.handles, arg)
+		}
+	} else {
+		desc += " " + arg
+	}
+	if kind == sshFxpOpen || kind == sshFxpOpendir {
+		s.pending[id] = arg
+	}
+	if sftpTargetOps[op] {
+		if target, _, ok := sftpString(more); ok {
+			desc += " -> " + target
+		}
+	}
+	switch kind {
+	case sshFxpRead:
+		if off, more, ok := sftpUint64(more); ok {
+			n, _, _ := sftpUint32(more)
+			desc += fmt.Sprintf(" at %d, %d bytes", off, n)
+		}
+	case sshFxpWrite:
+		if off, _, ok := sftpUint64(more); ok {
+			desc += fmt.Sprintf(" at %d, %d bytes", off, e.Contents)
+		}
+	}
+	return desc
+}
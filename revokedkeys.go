@@ -0,0 +1,267 @@
+package simplescp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// revokedKeys are the keys and certificates that can't be used to log in no
+// matter what, read from either a list of public keys or an OpenSSH key
+// revocation list (see ssh-keygen -k and PROTOCOL.krl in OpenSSH)
+type revokedKeys struct {
+	keys   map[string]bool // Marshalled public keys
+	sha1   map[string]bool // Hashes of marshalled public keys
+	sha256 map[string]bool
+	certs  []revokedCerts
+}
+
+// Certificates revoked for one CA
+type revokedCerts struct {
+	ca      []byte // Marshalled CA key, empty for any CA
+	serials []serialRange
+	bitmaps []serialBitmap
+	keyIDs  map[string]bool
+}
+
+type serialRange struct{ min, max uint64 }
+
+type serialBitmap struct {
+	offset uint64
+	bits   *big.Int
+}
+
+const krlMagic = "SSHKRL\n\x00"
+
+// KRL section and certificate subsection types
+const (
+	krlSectionCertificates      = 1
+	krlSectionExplicitKey       = 2
+	krlSectionFingerprintSHA1   = 3
+	krlSectionSignature         = 4
+	krlSectionFingerprintSHA256 = 5
+
+	krlCertSerialList   = 0x20
+	krlCertSerialRange  = 0x21
+	krlCertSerialBitmap = 0x22
+	krlCertKeyID        = 0x23
+)
+
+func newRevokedKeys() *revokedKeys {
+	return &revokedKeys{keys: make(map[string]bool), sha1: make(map[string]bool), sha256: make(map[string]bool)}
+}
+
+func loadRevokedKeys(path string) (*revokedKeys, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read revoked keys: %v", err)
+	}
+	if bytes.HasPrefix(data, []byte(krlMagic)) {
+		r, err := parseKRL(data)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key revocation list %s: %v", path, err)
+		}
+		return r, nil
+	}
+
+	r := newRevokedKeys()
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pk, err := parsePubKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid revoked key in %s line %d: %v", path, n, err)
+		}
+		r.keys[string(pk.Marshal())] = true
+	}
+	return r, nil
+}
+
+// krlReader reads the SSH wire encoding used by KRLs
+type krlReader struct {
+	data []byte
+	err  error
+}
+
+func (r *krlReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.data) < n {
+		r.err = errors.New("truncated")
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *krlReader) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *krlReader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *krlReader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *krlReader) string() []byte {
+	return r.next(int(r.uint32()))
+}
+
+func (r *krlReader) done() bool {
+	return r.err != nil || len(r.data) == 0
+}
+
+func parseKRL(data []byte) (*revokedKeys, error) {
+	r := &krlReader{data: data[len(krlMagic):]}
+	if version := r.uint32(); r.err == nil && version != 1 {
+		return nil, fmt.Errorf("unsupported format version %d", version)
+	}
+	r.uint64() // KRL version
+	r.uint64() // Generation date
+	r.uint64() // Flags
+	r.string() // Reserved
+	r.string() // Comment
+
+	revoked := newRevokedKeys()
+	for !r.done() {
+		sectionType := r.byte()
+		section := &krlReader{data: r.string()}
+		if r.err != nil {
+			break
+		}
+		switch sectionType {
+		case krlSectionCertificates:
+			certs, err := parseKRLCerts(section)
+			if err != nil {
+				return nil, err
+			}
+			revoked.certs = append(revoked.certs, certs)
+		case krlSectionExplicitKey, krlSectionFingerprintSHA1, krlSectionFingerprintSHA256:
+			set := map[byte]map[string]bool{
+				krlSectionExplicitKey:       revoked.keys,
+				krlSectionFingerprintSHA1:   revoked.sha1,
+				krlSectionFingerprintSHA256: revoked.sha256,
+			}[sectionType]
+			for !section.done() {
+				set[string(section.string())] = true
+			}
+			r.err = section.err
+		case krlSectionSignature:
+			// Only signatures from here on. We trust the file we were given
+			return revoked, nil
+		default:
+			return nil, fmt.Errorf("unknown section type %d", sectionType)
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return revoked, nil
+}
+
+func parseKRLCerts(r *krlReader) (revokedCerts, error) {
+	certs := revokedCerts{ca: r.string(), keyIDs: make(map[string]bool)}
+	r.string() // Reserved
+	for !r.done() {
+		subsectionType := r.byte()
+		sub := &krlReader{data: r.string()}
+		if r.err != nil {
+			break
+		}
+		switch subsectionType {
+		case krlCertSerialList:
+			for !sub.done() {
+				serial := sub.uint64()
+				certs.serials = append(certs.serials, serialRange{serial, serial})
+			}
+		case krlCertSerialRange:
+			certs.serials = append(certs.serials, serialRange{sub.uint64(), sub.uint64()})
+		case krlCertSerialBitmap:
+			offset := sub.uint64()
+			certs.bitmaps = append(certs.bitmaps, serialBitmap{offset, new(big.Int).SetBytes(sub.string())})
+		case krlCertKeyID:
+			for !sub.done() {
+				certs.keyIDs[string(sub.string())] = true
+			}
+		default:
+			return certs, fmt.Errorf("unknown certificate subsection type %d", subsectionType)
+		}
+		if sub.err != nil {
+			return certs, sub.err
+		}
+	}
+	return certs, r.err
+}
+
+// Whether a key has been revoked. For certificates that includes the key
+// they certify and the CA that signed them, but not their serial or key id
+// (see certRevoked)
+func (r *revokedKeys) keyRevoked(key ssh.PublicKey) bool {
+	if r == nil {
+		return false
+	}
+	if cert, ok := key.(*ssh.Certificate); ok {
+		return r.keyRevoked(cert.Key) || r.keyRevoked(cert.SignatureKey)
+	}
+	blob := key.Marshal()
+	sha1Sum := sha1.Sum(blob)
+	sha256Sum := sha256.Sum256(blob)
+	return r.keys[string(blob)] || r.sha1[string(sha1Sum[:])] || r.sha256[string(sha256Sum[:])]
+}
+
+// Whether a certificate has been revoked by serial number or key id
+func (r *revokedKeys) certRevoked(cert *ssh.Certificate) bool {
+	if r == nil {
+		return false
+	}
+	ca := cert.SignatureKey.Marshal()
+	for _, certs := range r.certs {
+		if len(certs.ca) > 0 && !bytes.Equal(certs.ca, ca) {
+			continue
+		}
+		if certs.keyIDs[cert.KeyId] {
+			return true
+		}
+		// Serials only mean anything for a given CA
+		if len(certs.ca) == 0 {
+			continue
+		}
+		for _, s := range certs.serials {
+			if cert.Serial >= s.min && cert.Serial <= s.max {
+				return true
+			}
+		}
+		for _, b := range certs.bitmaps {
+			if cert.Serial >= b.offset && cert.Serial-b.offset < uint64(b.bits.BitLen()) && b.bits.Bit(int(cert.Serial-b.offset)) == 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package simplescp
+
+import (
+	"crypto/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRevokedKeys(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen is needed to make key revocation lists")
+	}
+	dir := t.TempDir()
+	ca := newTestSigner(t)
+	revokedKey := newTestSigner(t)
+	hashedKey := newTestSigner(t)
+	goodKey := newTestSigner(t)
+
+	writeKey := func(name string, key ssh.PublicKey) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, ssh.MarshalAuthorizedKey(key), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	caFile := writeKey("ca.pub", ca.PublicKey())
+	spec := filepath.Join(dir, "spec")
+	os.WriteFile(spec, []byte("serial: 5\nserial: 10-20\nid: bob\n"), 0644)
+	hashSpec := filepath.Join(dir, "hashspec")
+	os.WriteFile(hashSpec, []byte("hash: "+ssh.FingerprintSHA256(hashedKey.PublicKey())+"\n"), 0644)
+	krl := filepath.Join(dir, "krl")
+	for _, args := range [][]string{
+		{"-k", "-f", krl, "-s", caFile, spec},
+		{"-k", "-u", "-f", krl, writeKey("revoked.pub", revokedKey.PublicKey())},
+		{"-k", "-u", "-f", krl, hashSpec},
+	} {
+		if output, err := exec.Command("ssh-keygen", args...).CombinedOutput(); err != nil {
+			t.Fatalf("ssh-keygen %v failed: %v\n%s", args, err, output)
+		}
+	}
+
+	revoked, err := loadRevokedKeys(krl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := func(key ssh.PublicKey, serial uint64, keyID string) *ssh.Certificate {
+		cert := &ssh.Certificate{
+			Key:             key,
+			Serial:          serial,
+			CertType:        ssh.UserCert,
+			KeyId:           keyID,
+			ValidPrincipals: []string{"scpuser"},
+			ValidBefore:     ssh.CertTimeInfinity,
+		}
+		if err := cert.SignCert(rand.Reader, ca); err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+
+	tests := []struct {
+		name    string
+		key     ssh.PublicKey
+		revoked bool
+	}{
+		{"good key", goodKey.PublicKey(), false},
+		{"revoked key", revokedKey.PublicKey(), true},
+		{"revoked by hash", hashedKey.PublicKey(), true},
+		{"good cert", cert(goodKey.PublicKey(), 6, "alice"), false},
+		{"revoked serial", cert(goodKey.PublicKey(), 5, "alice"), true},
+		{"revoked serial range", cert(goodKey.PublicKey(), 15, "alice"), true},
+		{"revoked key id", cert(goodKey.PublicKey(), 6, "bob"), true},
+		{"cert for a revoked key", cert(revokedKey.PublicKey(), 6, "alice"), true},
+	}
+	for _, test := range tests {
+		isRevoked := revoked.keyRevoked(test.key)
+		if cert, ok := test.key.(*ssh.Certificate); ok {
+			isRevoked = isRevoked || revoked.certRevoked(cert)
+		}
+		if isRevoked != test.revoked {
+			t.Errorf("%s: expected revoked %v, got %v", test.name, test.revoked, isRevoked)
+		}
+	}
+
+	// Plain lists of keys work too
+	list := writeKey("list", revokedKey.PublicKey())
+	revoked, err = loadRevokedKeys(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !revoked.keyRevoked(revokedKey.PublicKey()) || revoked.keyRevoked(goodKey.PublicKey()) {
+		t.Error("Unexpected result checking keys against a list of revoked keys")
+	}
+}
@@ -0,0 +1,224 @@
+package simplescp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Options rsync isn't run with, because they'd have it read or write files
+// outside of what it was asked to transfer, follow symlinks out of the
+// shared directory or change who owns files
+var deniedRsyncOptions = map[string]bool{
+	"--backup-dir":        true,
+	"--compare-dest":      true,
+	"--config":            true,
+	"--copy-dest":         true,
+	"--copy-dirlinks":     true,
+	"--copy-links":        true,
+	"--copy-unsafe-links": true,
+	"--daemon":            true,
+	"--dparam":            true,
+	"--exclude-from":      true,
+	"--files-from":        true,
+	"--filter":            true,
+	"--include-from":      true,
+	"--keep-dirlinks":     true,
+	"--link-dest":         true,
+	"--log-file":          true,
+	"--only-write-batch":  true,
+	"--partial-dir":       true,
+	"--password-file":     true,
+	"--read-batch":        true,
+	"--super":             true,
+	"--temp-dir":          true,
+	"--write-batch":       true,
+}
+
+// The same as some of deniedRsyncOptions, as short options
+const deniedRsyncFlags = "LkKTf"
+
+// Preserving hard links, which isn't allowed with no_hardlinks
+const (
+	rsyncHardlinksOption = "--hard-links"
+	rsyncHardlinksFlag   = "H"
+)
+
+// rsync handles the files itself, so it can't be used with the settings
+// that need to see each of them. Excluding files wouldn't do either: clients
+// send rsync filter rules of their own, which can clear the ones it's run with
+func (c Config) validateRsync() error {
+	if len(c.Rsync) == 0 {
+		return nil
+	}
+	if c.Scan.enabled() {
+		return errors.New("Invalid rsync settings: uploads by rsync can't be scanned")
+	}
+	for _, setting := range []struct {
+		name string
+		set  bool
+	}{
+		{"deny_files", len(c.DenyFiles) > 0},
+		{"hide_files", len(c.HideFiles) > 0},
+		{"hide_dot_files", c.HideDotFiles},
+		{"atomic_uploads", c.AtomicUploads},
+		{"partial_uploads: move", c.PartialUploads == partialMove},
+	} {
+		if setting.set {
+			return fmt.Errorf("Invalid rsync settings: rsync can't be kept from sending the files left out with %s", setting.name)
+		}
+	}
+	return nil
+}
+
+// The options rsync is always run with: symlinks it receives are munged, so
+// they can't be followed out of the shared directory, and it doesn't try to
+// set the owners of the files it receives
+var rsyncServerArgs = []string{"--server", "--munge-links", "--no-super"}
+
+// rsyncCommand is an `rsync --server` command line a client asked for, made
+// safe to run in the shared directory
+type rsyncCommand struct {
+	args         []string // To run rsync with, paths relative to the shared directory
+	sender       bool     // The client's downloading
+	removesFiles bool     // --remove-source-files, so downloads delete what they've sent
+}
+
+// What the user needs to be allowed to do for rsync to run: list and read
+// what it sends, and make any changes at all to what it receives, since
+// there's no telling which ones it's going to make
+func (cmd rsyncCommand) permissions() Permission {
+	if !cmd.sender {
+		return permWriteAll
+	}
+	if cmd.removesFiles {
+		return permReadAll | PermDelete
+	}
+	return permReadAll
+}
+
+// Check the arguments a client wants rsync run with, translating the paths
+// in them (as the client sees them) into ones in the shared directory
+func (c Config) parseRsyncArgs(args []string) (rsyncCommand, error) {
+	var cmd rsyncCommand
+	if len(args) < 2 || args[0] != "rsync" || args[1] != "--server" {
+		return cmd, errors.New("Only rsync --server can be run")
+	}
+	cmd.args = slices.Clone(rsyncServerArgs)
+	parseOpts := true
+	for _, arg := range args[2:] {
+		switch {
+		case parseOpts && arg == "--":
+			parseOpts = false
+		case parseOpts && strings.HasPrefix(arg, "--"):
+			name, _, _ := strings.Cut(arg, "=")
+			if deniedRsyncOptions[name] || (c.NoHardlinks && name == rsyncHardlinksOption) {
+				return cmd, fmt.Errorf("Option %s isn't allowed", name)
+			}
+			cmd.sender = cmd.sender || name == "--sender"
+			cmd.removesFiles = cmd.removesFiles || name == "--remove-source-files"
+		case parseOpts && strings.HasPrefix(arg, "-") && len(arg) > 1:
+			// What comes after e are the protocol's flags, not more options
+			flags, _, _ := strings.Cut(arg[1:], "e")
+			if strings.ContainsAny(flags, deniedRsyncFlags) || (c.NoHardlinks && strings.Contains(flags, rsyncHardlinksFlag)) {
+				return cmd, fmt.Errorf("Option %s isn't allowed", arg)
+			}
+		default:
+			p, err := c.rsyncPath(arg)
+			if err != nil {
+				return cmd, err
+			}
+			arg = p
+		}
+		cmd.args = append(cmd.args, arg)
+	}
+	// Nothing would keep what rsync writes within them
+	if !cmd.sender && (c.quotaLimit > 0 || c.MaxFileSize > 0) {
+		return cmd, errors.New("Uploads with rsync aren't allowed with a quota or max_file_size")
+	}
+	return cmd, nil
+}
+
+// The path rsync is given for p, as the client sees it: where it really is,
+// relative to the shared directory (where rsync runs)
+func (c Config) rsyncPath(p string) (string, error) {
+	if c.deniedFile(p) {
+		return "", fmt.Errorf("%s: %v", p, os.ErrNotExist)
+	}
+	resolved, err := c.resolvePath(p)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(filepath.Clean(c.Dir), resolved)
+	if err != nil {
+		return "", err
+	}
+	// A trailing slash means a directory's contents to rsync
+	if strings.HasSuffix(p, "/") && rel != "." {
+		rel += "/"
+	}
+	return rel, nil
+}
+
+// Serve an `rsync --server` exec request by running rsync in the shared
+// directory, with the client on its stdin and stdout
+func (c Config) runRsync(channel ssh.Channel, req *ssh.Request, args []string) {
+	log := c.logger().With("command", "rsync")
+	req.Reply(true, nil)
+
+	cmd, err := c.parseRsyncArgs(args)
+	if err == nil && !c.isLocal() {
+		err = errors.New("rsync only works with files on the local file system")
+	}
+	if err == nil && !c.perms.Has(cmd.permissions()) {
+		err = errors.New("Permission denied")
+	}
+	if err != nil {
+		log.Warn("Refusing to run rsync", "args", args, "err", err)
+		fmt.Fprintf(channel.Stderr(), "rsync: %v\n", err)
+		closeChannel(channel, 1)
+		return
+	}
+
+	log.Info("Running rsync", "args", cmd.args)
+	child := exec.Command(c.Rsync, cmd.args...)
+	child.Dir = c.Dir
+	// Nothing of ours to pass on, just where to find what it runs
+	child.Env = []string{"PATH=" + os.Getenv("PATH")}
+	child.Stdout = channel
+	child.Stderr = channel.Stderr()
+	stdin, err := child.StdinPipe()
+	if err == nil {
+		err = child.Start()
+	}
+	if err != nil {
+		log.Error("Can't run rsync", "err", err)
+		fmt.Fprintln(channel.Stderr(), "rsync: can't be run on this server")
+		closeChannel(channel, 1)
+		return
+	}
+	go func() {
+		io.Copy(stdin, channel)
+		stdin.Close()
+	}()
+
+	var status uint8
+	if err := child.Wait(); err != nil {
+		log.Info("rsync failed", "err", err)
+		status = 1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+			status = uint8(exitErr.ExitCode())
+		}
+	} else {
+		log.Info("rsync finished")
+	}
+	closeChannel(channel, status)
+}
@@ -0,0 +1,139 @@
+package simplescp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseRsyncArgs(t *testing.T) {
+	c := newTestConfig(t)
+	server := []string{"--server", "--munge-links", "--no-super"}
+	for args, expected := range map[string][]string{
+		"rsync --server -vlogDtpre.iLsfxC --delete . dir/":        append(slices.Clone(server), "-vlogDtpre.iLsfxC", "--delete", ".", "dir/"),
+		"rsync --server --sender -vlogDtpre.iLsfxC . /a/../b.txt": append(slices.Clone(server), "--sender", "-vlogDtpre.iLsfxC", ".", "b.txt"),
+		"rsync --server -vlogDtpre.iLsfxC . ../../etc":            append(slices.Clone(server), "-vlogDtpre.iLsfxC", ".", "etc"),
+		"rsync --server -vLogDtpre.iLsfxC . dir":                  nil,
+		"rsync --server --temp-dir=/tmp -vlogDtpre.iLsfxC . dir":  nil,
+		"rsync --server --super -vlogDtpre.iLsfxC . dir":          nil,
+		"rsync --daemon": nil,
+	} {
+		cmd, err := c.parseRsyncArgs(strings.Fields(args))
+		if expected == nil {
+			if err == nil {
+				t.Errorf("%s allowed", args)
+			}
+		} else if err != nil || !slices.Equal(cmd.args, expected) {
+			t.Errorf("%s parsed to %q (%v), expected %q", args, cmd.args, err, expected)
+		}
+	}
+
+	// Nothing would keep uploads within a quota or max_file_size, downloads
+	// are fine
+	for _, limit := range []*ByteSize{&c.quotaLimit, &c.MaxFileSize} {
+		*limit = 1000
+		if _, err := c.parseRsyncArgs(strings.Fields("rsync --server -vlogDtpre.iLsfxC . dir/")); err == nil {
+			t.Error("Upload allowed with a limit")
+		}
+		if _, err := c.parseRsyncArgs(strings.Fields("rsync --server --sender -vlogDtpre.iLsfxC . dir/")); err != nil {
+			t.Errorf("Download refused with a limit: %v", err)
+		}
+		*limit = 0
+	}
+
+	c.NoHardlinks = true
+	for _, args := range []string{"rsync --server -vlHogDtpre.iLsfxC . dir", "rsync --server --hard-links -vlogDtpre.iLsfxC . dir"} {
+		if _, err := c.parseRsyncArgs(strings.Fields(args)); err == nil {
+			t.Errorf("%s allowed with no_hardlinks", args)
+		}
+	}
+}
+
+func TestRsync(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("No sh to run a fake rsync with")
+	}
+	// Stands in for rsync, saying where it's run and with what
+	fake := filepath.Join(t.TempDir(), "rsync")
+	os.WriteFile(fake, []byte("#!/bin/sh\npwd\necho \"$@\"\ncat\nexit 3\n"), 0755)
+	c := newTestConfig(t)
+	c.Rsync = fake
+	addr := startTestServer(t, c)
+
+	cmd := startTestSCP(t, addr, "rsync --server -vlogDtpre.iLsfxC . /dir/")
+	io.WriteString(cmd.stdin, "from the client\n")
+	cmd.stdin.Close()
+	output, _ := io.ReadAll(cmd.stdout)
+	dir, _ := filepath.EvalSymlinks(c.Dir)
+	if expected := dir + "\n--server --munge-links --no-super -vlogDtpre.iLsfxC . dir/\nfrom the client\n"; string(output) != expected {
+		t.Errorf("rsync said %q, expected %q", output, expected)
+	}
+	var exitErr *ssh.ExitError
+	if err := cmd.session.Wait(); !errors.As(err, &exitErr) || exitErr.ExitStatus() != 3 {
+		t.Errorf("Unexpected exit: %v", err)
+	}
+
+	cmd = startTestSCP(t, addr, "rsync --server --copy-links . dir")
+	cmd.stdin.Close()
+	if output, _ := io.ReadAll(cmd.stdout); len(output) > 0 {
+		t.Errorf("rsync run with a denied option: %q", output)
+	}
+	if err := cmd.session.Wait(); err == nil {
+		t.Error("rsync with a denied option didn't fail")
+	}
+}
+
+func TestRsyncConfined(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("No sh to run a fake rsync with")
+	}
+	fake := filepath.Join(t.TempDir(), "rsync")
+	os.WriteFile(fake, []byte("#!/bin/sh\necho \"$@\"\n"), 0755)
+	c := newTestConfig(t)
+	c.Rsync = fake
+	os.Symlink(t.TempDir(), filepath.Join(c.Dir, "outside"))
+	addr := startTestServer(t, c)
+
+	run := func(command string) string {
+		t.Helper()
+		cmd := startTestSCP(t, addr, command)
+		cmd.stdin.Close()
+		output, _ := io.ReadAll(cmd.stdout)
+		cmd.session.Wait()
+		return string(output)
+	}
+	// rsync -a dir/ host: with a symlink out of the directory in dir/,
+	// which -a sends as a symlink. It can't be followed once it's received
+	if output := run("rsync --server -logDtpre.iLsfxC . ."); !strings.Contains(output, "--munge-links ") {
+		t.Errorf("rsync run to receive symlinks with %q", output)
+	}
+	// Receiving into the symlink itself isn't allowed either
+	if output := run("rsync --server -logDtpre.iLsfxC . outside/"); len(output) > 0 {
+		t.Errorf("rsync run to receive into a symlink out of the directory with %q", output)
+	}
+
+	// rsync uploads couldn't be scanned, and the files it sends can't be
+	// filtered: the client could clear any --exclude rules
+	for name, set := range map[string]func(*Config){
+		"scan":                  func(c *Config) { c.Scan.Command = "true" },
+		"deny_files":            func(c *Config) { c.DenyFiles = []string{"*.key"} },
+		"hide_files":            func(c *Config) { c.HideFiles = []string{"*.bak"} },
+		"hide_dot_files":        func(c *Config) { c.HideDotFiles = true },
+		"atomic_uploads":        func(c *Config) { c.AtomicUploads = true },
+		"partial_uploads: move": func(c *Config) { c.PartialUploads = partialMove },
+	} {
+		c := newTestConfig(t)
+		c.Rsync = fake
+		set(c)
+		if err := c.Init(); err == nil {
+			t.Errorf("rsync allowed along with %s", name)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package simplescp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Config holds the settings for the S3 storage backend
+type S3Config struct {
+	Endpoint  string `yaml:"endpoint" toml:"endpoint"` // Default: s3.amazonaws.com
+	Region    string `yaml:"region" toml:"region"`
+	Bucket    string `yaml:"bucket" toml:"bucket"`
+	Prefix    string `yaml:"prefix" toml:"prefix"` // Everything is stored under this prefix
+	AccessKey string `yaml:"access_key" toml:"access_key"`
+	// Credentials are taken from the usual AWS environment variables, config
+	// files or instance profile if the access key isn't set
+	SecretKey string `yaml:"secret_key" toml:"secret_key"`
+	Insecure  bool   `yaml:"insecure" toml:"insecure"` // Talk to the endpoint over plain http
+}
+
+// Files are uploaded in parts of this size, which caps them at 160GiB
+const s3PartSize = 16 << 20
+
+// s3FileSystem stores files as objects in an S3 bucket, with their paths as
+// keys. Directories are implied by the keys, and empty ones are kept around
+// with "dir/" marker objects.
+type s3FileSystem struct {
+	client *minio.Client
+	bucket string
+	prefix string
+
+	mu      sync.Mutex
+	writing map[string]*objectWriter // Files being uploaded, so they can be seen before they're done
+}
+
+func newS3FileSystem(conf S3Config) (*s3FileSystem, error) {
+	if len(conf.Bucket) == 0 {
+		return nil, errors.New("S3 backend needs a bucket")
+	}
+	endpoint := conf.Endpoint
+	if len(endpoint) == 0 {
+		endpoint = "s3.amazonaws.com"
+	}
+
+	var creds *credentials.Credentials
+	if len(conf.AccessKey) > 0 {
+		creds = credentials.NewStaticV4(conf.AccessKey, conf.SecretKey, "")
+	} else {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{},
+		})
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: !conf.Insecure,
+		Region: conf.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Can't set up S3 client: %v", err)
+	}
+
+	ok, err := client.BucketExists(context.Background(), conf.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("Can't access S3 bucket %q: %v", conf.Bucket, err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("S3 bucket %q doesn't exist", conf.Bucket)
+	}
+
+	return &s3FileSystem{client: client, bucket: conf.Bucket, prefix: strings.Trim(conf.Prefix, "/"), writing: make(map[string]*objectWriter)}, nil
+}
+
+// Key for the object holding a file. The root directory is the empty key
+func (s *s3FileSystem) key(name string) string {
+	return strings.TrimPrefix(path.Join(s.prefix, filepath.ToSlash(name)), "/")
+}
+
+// Turn S3 errors into the errors we'd get from a local filesystem
+func s3Error(op string, name string, err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case minio.NoSuchKey:
+		err = os.ErrNotExist
+	case "AccessDenied":
+		err = os.ErrPermission
+	}
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+func (s *s3FileSystem) Stat(name string) (os.FileInfo, error) {
+	key := s.key(name)
+	base := filepath.Base(name)
+	if len(key) == 0 || key == s.prefix {
+		return objectInfo{name: base, dir: true}, nil
+	}
+
+	s.mu.Lock()
+	w, ok := s.writing[key]
+	s.mu.Unlock()
+	if ok {
+		return w.Stat()
+	}
+
+	ctx := context.Background()
+	info, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+	if err == nil {
+		return objectInfo{name: base, size: info.Size, modTime: info.LastModified}, nil
+	}
+	if minio.ToErrorResponse(err).Code != minio.NoSuchKey {
+		return nil, s3Error("stat", name, err)
+	}
+
+	// Maybe it's a directory
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: dirPrefix(key), MaxKeys: 1}) {
+		if obj.Err != nil {
+			return nil, s3Error("stat", name, obj.Err)
+		}
+		return objectInfo{name: base, dir: true, modTime: obj.LastModified}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+// There are no symlinks in S3
+func (s *s3FileSystem) Lstat(name string) (os.FileInfo, error) {
+	return s.Stat(name)
+}
+
+func (s *s3FileSystem) ReadDir(name string) ([]os.FileInfo, error) {
+	prefix := dirPrefix(s.key(name))
+	var files []os.FileInfo
+	// Subdirectories can show up twice, as a common prefix and as their marker
+	seen := make(map[string]bool)
+	for obj := range s.client.ListObjects(context.Background(), s.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if obj.Err != nil {
+			return nil, s3Error("readdir", name, obj.Err)
+		}
+		if obj.Key == prefix {
+			// The directory's own marker
+			continue
+		}
+		entry := strings.TrimPrefix(obj.Key, prefix)
+		if seen[entry] {
+			continue
+		}
+		seen[entry] = true
+		if strings.HasSuffix(entry, "/") {
+			files = append(files, objectInfo{name: strings.TrimSuffix(entry, "/"), dir: true, modTime: obj.LastModified})
+		} else {
+			files = append(files, objectInfo{name: entry, size: obj.Size, modTime: obj.LastModified})
+		}
+	}
+
+	if len(files) == 0 {
+		// Make sure the directory exists at all
+		fi, err := s.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			return nil, &os.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+		}
+	}
+	return files, nil
+}
+
+func (s *s3FileSystem) Open(name string) (File, error) {
+	fi, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return &s3Reader{name: name, info: fi}, nil
+	}
+
+	obj, err := s.client.GetObject(context.Background(), s.bucket, s.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s3Error("open", name, err)
+	}
+	return &s3Reader{name: name, info: fi, obj: obj}, nil
+}
+
+// Objects can only be written in one go, so files can be opened either for
+// reading or creating/replacing them, but not for updating them in place
+func (s *s3FileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return s.Open(name)
+	}
+	if flag&(os.O_RDWR|os.O_APPEND) != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errors.ErrUnsupported}
+	}
+
+	fi, err := s.Stat(name)
+	if err == nil {
+		if fi.IsDir() {
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		}
+		if flag&os.O_EXCL != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+		}
+	} else if flag&os.O_CREATE == 0 {
+		return nil, err
+	}
+
+	key := s.key(name)
+	w, pr := newObjectWriter(name)
+	s.mu.Lock()
+	s.writing[key] = w
+	s.mu.Unlock()
+
+	go func() {
+		_, err := s.client.PutObject(context.Background(), s.bucket, key, pr, -1, minio.PutObjectOptions{PartSize: s3PartSize})
+		pr.CloseWithError(err)
+
+		s.mu.Lock()
+		if s.writing[key] == w {
+			delete(s.writing, key)
+		}
+		s.mu.Unlock()
+		if err != nil {
+			err = s3Error("close", name, err)
+		}
+		w.done <- err
+	}()
+	return w, nil
+}
+
+func (s *s3FileSystem) Mkdir(name string, perm os.FileMode) error {
+	if _, err := s.Stat(name); err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	return s.putMarker("mkdir", name)
+}
+
+// Parent directories don't need creating, they're implied by the keys
+func (s *s3FileSystem) MkdirAll(name string, perm os.FileMode) error {
+	if fi, err := s.Stat(name); err == nil {
+		if !fi.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	return s.putMarker("mkdir", name)
+}
+
+func (s *s3FileSystem) putMarker(op string, name string) error {
+	_, err := s.client.PutObject(context.Background(), s.bucket, dirPrefix(s.key(name)), bytes.NewReader(nil), 0, minio.PutObjectOptions{})
+	if err != nil {
+		return s3Error(op, name, err)
+	}
+	return nil
+}
+
+func (s *s3FileSystem) Remove(name string) error {
+	fi, err := s.Stat(name)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	key := s.key(name)
+	if fi.IsDir() {
+		files, err := s.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		if len(files) > 0 {
+			return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+		key = dirPrefix(key)
+	}
+	if err := s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{}); err != nil {
+		return s3Error("remove", name, err)
+	}
+	return nil
+}
+
+// Objects can't be renamed, so they're copied and then removed. Renaming a
+// directory means doing that for everything inside of it.
+func (s *s3FileSystem) Rename(oldname, newname string) error {
+	fi, err := s.Stat(oldname)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return s.move(oldname, s.key(oldname), s.key(newname))
+	}
+
+	oldPrefix := dirPrefix(s.key(oldname))
+	newPrefix := dirPrefix(s.key(newname))
+	for obj := range s.client.ListObjects(context.Background(), s.bucket, minio.ListObjectsOptions{Prefix: oldPrefix, Recursive: true}) {
+		if obj.Err != nil {
+			return s3Error("rename", oldname, obj.Err)
+		}
+		if err := s.move(oldname, obj.Key, newPrefix+strings.TrimPrefix(obj.Key, oldPrefix)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *s3FileSystem) move(name string, from string, to string) error {
+	ctx := context.Background()
+	_, err := s.client.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: s.bucket, Object: to},
+		minio.CopySrcOptions{Bucket: s.bucket, Object: from})
+	if err != nil {
+		return s3Error("rename", name, err)
+	}
+	if err := s.client.RemoveObject(ctx, s.bucket, from, minio.RemoveObjectOptions{}); err != nil {
+		return s3Error("rename", name, err)
+	}
+	return nil
+}
+
+// s3Reader is an object (or directory) open for reading
+type s3Reader struct {
+	name string
+	info os.FileInfo
+	obj  *minio.Object // nil for directories
+}
+
+func (r *s3Reader) Read(p []byte) (int, error) {
+	if r.obj == nil {
+		return 0, &os.PathError{Op: "read", Path: r.name, Err: syscall.EISDIR}
+	}
+	return r.obj.Read(p)
+}
+
+func (r *s3Reader) ReadAt(p []byte, off int64) (int, error) {
+	if r.obj == nil {
+		return 0, &os.PathError{Op: "read", Path: r.name, Err: syscall.EISDIR}
+	}
+	if off >= r.info.Size() {
+		// S3 complains about the range instead
+		return 0, io.EOF
+	}
+	return r.obj.ReadAt(p, off)
+}
+
+func (r *s3Reader) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: r.name, Err: syscall.EBADF}
+}
+
+func (r *s3Reader) WriteAt(p []byte, off int64) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: r.name, Err: syscall.EBADF}
+}
+
+func (r *s3Reader) Stat() (os.FileInfo, error) { return r.info, nil }
+
+func (r *s3Reader) Close() error {
+	if r.obj == nil {
+		return nil
+	}
+	return r.obj.Close()
+}
@@ -0,0 +1,91 @@
+package simplescp
+
+import (
+	"io"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+func TestS3FileSystem(t *testing.T) {
+	backend := s3mem.New()
+	backend.CreateBucket("files")
+	ts := httptest.NewTLSServer(gofakes3.New(backend).Server())
+	defer ts.Close()
+
+	client, err := minio.New(strings.TrimPrefix(ts.URL, "https://"), &minio.Options{
+		Creds:     credentials.NewStaticV4("key", "secret", ""),
+		Secure:    true,
+		Region:    "us-east-1",
+		Transport: ts.Client().Transport,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := &s3FileSystem{client: client, bucket: "files", prefix: "srv", writing: make(map[string]*objectWriter)}
+
+	if err := fsys.MkdirAll("/scpuser", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Mkdir("/scpuser", 0755); !os.IsExist(err) {
+		t.Errorf("Expected Mkdir to fail with an exists error, got %v", err)
+	}
+
+	// sftp clients can send writes out of order
+	f, err := fsys.OpenFile("/scpuser/file.txt", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("world\n"), 6)
+	f.WriteAt([]byte("hello "), 0)
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := fsys.Stat("/scpuser/file.txt")
+	if err != nil || fi.Size() != 12 || fi.IsDir() {
+		t.Fatalf("Unexpected stat result %+v, %v", fi, err)
+	}
+	if fi, err := fsys.Stat("/scpuser"); err != nil || !fi.IsDir() {
+		t.Fatalf("Expected a directory, got %+v, %v", fi, err)
+	}
+	if _, err := fsys.Stat("/nothing"); !os.IsNotExist(err) {
+		t.Errorf("Expected a not exist error, got %v", err)
+	}
+
+	r, err := fsys.Open("/scpuser/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || string(contents) != "hello world\n" {
+		t.Errorf("Unexpected contents %q, %v", contents, err)
+	}
+
+	if err := fsys.Rename("/scpuser", "/other"); err != nil {
+		t.Fatal(err)
+	}
+	files, err := fsys.ReadDir("/other")
+	if err != nil || len(files) != 1 || files[0].Name() != "file.txt" {
+		t.Errorf("Unexpected directory contents %v, %v", files, err)
+	}
+	if err := fsys.Remove("/other"); err == nil {
+		t.Error("Expected an error removing a directory that isn't empty")
+	}
+	if err := fsys.Remove("/other/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Remove("/other"); err != nil {
+		t.Fatal(err)
+	}
+	if files, err := fsys.ReadDir("/"); err != nil || len(files) != 0 {
+		t.Errorf("Expected an empty bucket, got %v, %v", files, err)
+	}
+}
@@ -0,0 +1,211 @@
+package simplescp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrInfected is returned for uploads the virus scan found something in
+var ErrInfected = errors.New("File rejected by virus scan")
+
+// ErrScanFailed is returned for uploads that couldn't be scanned, which aren't let in either
+var ErrScanFailed = errors.New("Virus scan failed")
+
+// ScanConfig is for scanning uploads for viruses before anyone gets to see them
+type ScanConfig struct {
+	Clamd    string        `yaml:"clamd" toml:"clamd"`       // clamd's socket, a path or host:port (e.g. /run/clamav/clamd.ctl or 127.0.0.1:3310)
+	Command  string        `yaml:"command" toml:"command"`   // Or a command scanning the file it gets on stdin, e.g. "clamscan --no-summary -". Exit status 1 means it's infected
+	Timeout  time.Duration `yaml:"timeout" toml:"timeout"`   // How long a scan can take. Default: 5m
+	Infected string        `yaml:"infected" toml:"infected"` // What's done with infected files: delete them (the default), or keep them in .quarantine/infected for review
+}
+
+const (
+	infectedDelete = "delete"
+	infectedKeep   = "keep"
+)
+
+// Where uploads are kept in the user's directory until they've been scanned,
+// out of the reach of clients
+const quarantineDir = ".quarantine"
+
+// Size of the chunks uploads are streamed to clamd in
+const clamdChunkSize = 64 * 1024
+
+func (s ScanConfig) enabled() bool {
+	return len(s.Clamd) > 0 || len(s.Command) > 0
+}
+
+func (s ScanConfig) validate() error {
+	if len(s.Clamd) > 0 && len(s.Command) > 0 {
+		return errors.New("Invalid scan settings: either clamd or command can be set, not both")
+	}
+	if len(s.Command) > 0 {
+		if _, err := parseUploadCommand(s.Command); err != nil {
+			return fmt.Errorf("Invalid scan command: %v", err)
+		}
+	}
+	switch s.Infected {
+	case "", infectedDelete, infectedKeep:
+		return nil
+	}
+	return fmt.Errorf("Invalid infected files policy %q, it should be %s or %s", s.Infected, infectedDelete, infectedKeep)
+}
+
+func (s ScanConfig) timeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return 5 * time.Minute
+}
+
+// Move an upload that's been written to part to name, where clients can see
+// it, once it's passed the virus scan
+func (c Config) completeUpload(part, name string) error {
+	if c.Scan.enabled() {
+		log := c.logger().With("file", name)
+		virus, err := c.scanUpload(part)
+		if err != nil {
+			log.Error("Can't scan upload", "err", err)
+			return ErrScanFailed
+		}
+		if len(virus) > 0 {
+			log.Warn("Infected upload", "virus", virus)
+			c.quarantineInfected(part, name)
+			return ErrInfected
+		}
+		log.Debug("Upload scanned, it's clean")
+	}
+	return c.fileSystem().Rename(part, name)
+}
+
+// Scan the file at p, returning the name of what was found in it if it's infected
+func (c Config) scanUpload(p string) (string, error) {
+	f, err := c.fileSystem().Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if len(c.Scan.Clamd) > 0 {
+		return c.Scan.clamdScan(f)
+	}
+	return c.scanCommand(f, p)
+}
+
+// Send r to clamd with INSTREAM (see clamd(8)) and read the verdict
+func (s ScanConfig) clamdScan(r io.Reader) (string, error) {
+	network := "tcp"
+	if strings.Contains(s.Clamd, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, s.Clamd, 10*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(s.timeout()))
+
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	buf := make([]byte, clamdChunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			binary.Write(w, binary.BigEndian, uint32(n))
+			w.Write(buf[:n])
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+	}
+	// A chunk of length 0 ends the stream
+	binary.Write(w, binary.BigEndian, uint32(0))
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	// e.g. "stream: OK" or "stream: Eicar-Signature FOUND"
+	reply = strings.TrimPrefix(strings.TrimRight(reply, "\x00\n"), "stream: ")
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	}
+	return "", fmt.Errorf("clamd: %s", reply)
+}
+
+// Run the scan command with f on its stdin, and p (where it's stored) for %f
+func (c Config) scanCommand(f File, p string) (string, error) {
+	args, err := parseUploadCommand(c.Scan.Command)
+	if err != nil {
+		return "", err
+	}
+	var size int64
+	if fi, err := f.Stat(); err == nil {
+		size = fi.Size()
+	}
+	for i := range args {
+		args[i] = expandUploadArg(args[i], p, c.username, size, c.remoteHost)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.Scan.timeout())
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = f
+	output, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 && ctx.Err() == nil {
+		// Like clamscan, which says what it found
+		virus := string(bytes.TrimSpace(output))
+		if len(virus) == 0 {
+			virus = "unknown"
+		}
+		return virus, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, bytes.TrimSpace(output))
+	}
+	return "", nil
+}
+
+// Get rid of an infected upload, or keep it where only admins can reach it
+func (c Config) quarantineInfected(part, name string) {
+	fsys := c.fileSystem()
+	log := c.logger().With("file", name)
+	if c.Scan.Infected == infectedKeep {
+		rel, err := filepath.Rel(c.Dir, name)
+		if err == nil {
+			dest := filepath.Join(c.Dir, quarantineDir, "infected", rel)
+			err = fsys.MkdirAll(filepath.Dir(dest), 0755)
+			if err == nil {
+				err = fsys.Rename(part, dest)
+			}
+			if err == nil {
+				log.Info("Kept infected upload", "to", dest)
+				return
+			}
+		}
+		log.Warn("Can't keep infected upload, removing it", "err", err)
+	}
+	size := c.existingSize(part)
+	if err := fsys.Remove(part); err != nil {
+		log.Error("Can't remove infected upload", "err", err)
+		return
+	}
+	c.reserveSpace(-size)
+}
@@ -0,0 +1,120 @@
+package simplescp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A clamd that finds a virus in anything with EICAR in it
+func startTestClamd(t *testing.T) string {
+	t.Helper()
+	sock := filepath.Join(t.TempDir(), "clamd.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skipf("Can't listen on a unix socket: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			if cmd, _ := r.ReadString(0); cmd != "zINSTREAM\x00" {
+				conn.Write([]byte("UNKNOWN COMMAND\x00"))
+				conn.Close()
+				continue
+			}
+			var data []byte
+			for {
+				var size uint32
+				if binary.Read(r, binary.BigEndian, &size) != nil || size == 0 {
+					break
+				}
+				chunk := make([]byte, size)
+				io.ReadFull(r, chunk)
+				data = append(data, chunk...)
+			}
+			if bytes.Contains(data, []byte("EICAR")) {
+				conn.Write([]byte("stream: Eicar-Signature FOUND\x00"))
+			} else {
+				conn.Write([]byte("stream: OK\x00"))
+			}
+			conn.Close()
+		}
+	}()
+	return sock
+}
+
+func TestScanUploads(t *testing.T) {
+	c := newTestConfig(t)
+	c.Scan = ScanConfig{Clamd: startTestClamd(t), Infected: infectedKeep}
+	addr := startTestServer(t, c)
+
+	scp := startTestSCP(t, addr, "scp -t .")
+	scp.ack()
+	if err := scp.sendFile("clean.txt", "hello"); err != nil {
+		t.Errorf("Clean file refused: %v", err)
+	}
+	if err := scp.sendFile("virus.txt", "EICAR"); err == nil || !strings.Contains(err.Error(), ErrInfected.Error()) {
+		t.Errorf("Infected file accepted: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(c.Dir, "clean.txt")); string(data) != "hello" {
+		t.Errorf("Clean file has %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(c.Dir, "virus.txt")); err == nil {
+		t.Error("Infected file let in")
+	}
+	if _, err := os.Stat(filepath.Join(c.Dir, quarantineDir, "infected", "virus.txt")); err != nil {
+		t.Errorf("Infected file not kept: %v", err)
+	}
+
+	client := dialSFTP(t, addr)
+	f, err := client.Create("/virus2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("EICAR"))
+	if err := f.Close(); err == nil {
+		t.Error("Infected file accepted over sftp")
+	}
+	if _, err := client.Stat("/" + quarantineDir + "/infected/virus.txt"); err == nil {
+		t.Error("Quarantine reachable over sftp")
+	}
+	if _, err := client.OpenFile("/clean.txt", os.O_WRONLY|os.O_APPEND); err == nil {
+		t.Error("Scanned file opened for appending")
+	}
+}
+
+func TestScanCommand(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("No sh to run the scan command with")
+	}
+	c := newTestConfig(t)
+	c.Scan = ScanConfig{Command: `sh -c "if grep -q EICAR; then echo Eicar-Signature; exit 1; fi"`}
+	addr := startTestServer(t, c)
+
+	scp := startTestSCP(t, addr, "scp -t .")
+	scp.ack()
+	if err := scp.sendFile("clean.txt", "hello"); err != nil {
+		t.Errorf("Clean file refused: %v", err)
+	}
+	if err := scp.sendFile("virus.txt", "EICAR"); err == nil {
+		t.Error("Infected file accepted")
+	}
+	if _, err := os.Stat(filepath.Join(c.Dir, "virus.txt")); err == nil {
+		t.Error("Infected file let in")
+	}
+	if files, _ := os.ReadDir(filepath.Join(c.Dir, quarantineDir)); len(files) > 0 {
+		t.Errorf("Infected file left in the quarantine")
+	}
+}
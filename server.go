@@ -0,0 +1,590 @@
+package simplescp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/grpc"
+	"gopkg.in/yaml.v3"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after a call to Shutdown
+var ErrServerClosed = errors.New("simplescp: Server closed")
+
+// Server serves scp and sftp requests for the files described by its Config.
+// It can be embedded in other programs and stopped with Shutdown.
+type Server struct {
+	state atomic.Value // *serverState
+
+	mu         sync.Mutex
+	listeners  []net.Listener // In the order they started being served
+	conns      map[net.Conn]struct{}
+	admin      *http.Server // Serving the admin API, if it's on
+	control    *grpc.Server // Serving the control service, if it's on
+	dashboard  *http.Server // Serving the dashboard, if it's on
+	health     *http.Server // Serving the health endpoints on their own, if they are
+	inShutdown bool
+	done       chan struct{} // Closed once Shutdown is over
+	doneOnce   sync.Once
+
+	// Connections are served with contexts derived from this one, it's
+	// cancelled when Shutdown gives up waiting for them
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+}
+
+// The config in use, along with the ssh config built out of it.
+// They get swapped together when reloading
+type serverState struct {
+	config       *Config
+	serverConfig *ssh.ServerConfig
+}
+
+// NewServer returns a Server for the given config. The config should already
+// have been initialized (see Config.Init and LoadConfig).
+func NewServer(config *Config) *Server {
+	s := &Server{
+		conns: make(map[net.Conn]struct{}),
+		done:  make(chan struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancelCause(context.Background())
+	s.state.Store(&serverState{config: config, serverConfig: config.initSSHConfig()})
+	return s
+}
+
+// Config returns the config currently in use by the server
+func (s *Server) Config() *Config {
+	return s.currentState().config
+}
+
+func (s *Server) currentState() *serverState {
+	return s.state.Load().(*serverState)
+}
+
+// Reload initializes config and atomically swaps it in place of the current one.
+// New connections (and authentication attempts) will use the new settings, while
+// sessions already in progress keep using the config they started with.
+// Randomly generated passwords and host keys are carried over from the current
+// config so clients don't notice the reload.
+func (s *Server) Reload(config *Config) error {
+	prev := s.Config()
+	config.generatedPassword = prev.generatedPassword
+	config.generatedKey = prev.generatedKey
+	config.promptedPassphrase = prev.promptedPassphrase
+	config.usage = prev.usage
+	config.authLimiter = prev.authLimiter
+	config.bans = prev.bans
+	config.conns = prev.conns
+	config.sessions = prev.sessions
+	config.authFailures = prev.authFailures
+	// Keep using the same user database connection if it hasn't changed
+	reuseStore := config.UserStore == nil && config.UserDB == prev.UserDB
+	if reuseStore {
+		config.UserStore = prev.UserStore
+	}
+	// Same for the storage backend
+	if config.FileSystem == nil && config.Backend == prev.Backend && config.S3 == prev.S3 && config.GCS == prev.GCS &&
+		config.Azure == prev.Azure && config.EncryptionKeyFile == prev.EncryptionKeyFile {
+		config.FileSystem = prev.FileSystem
+	}
+	// Same for the GeoIP database
+	reuseGeoIP := prev.geoIP != nil && config.GeoIP.Database == prev.geoIP.path
+	if reuseGeoIP {
+		config.geoIP = prev.geoIP
+	}
+	// Same for the transfer log, unless it's been moved (e.g. by logrotate)
+	reuseLog := prev.transferLog != nil && config.TransferLog == prev.TransferLog &&
+		config.TransferLogFormat == prev.TransferLogFormat && !prev.transferLog.moved()
+	if reuseLog {
+		config.transferLog = prev.transferLog
+	}
+
+	err := config.Init()
+	if err != nil {
+		return err
+	}
+
+	if old, addrs := prev.listenAddresses(), config.listenAddresses(); !slices.Equal(old, addrs) {
+		config.logger().Warn("Listen addresses changed, a restart is needed for them to take effect", "old_addrs", old, "addrs", addrs)
+	}
+	if config.Admin.Listen != prev.Admin.Listen {
+		config.logger().Warn("Admin API address changed, a restart is needed for it to take effect", "old_addr", prev.Admin.Listen, "addr", config.Admin.Listen)
+	}
+	if config.Admin.GRPCListen != prev.Admin.GRPCListen {
+		config.logger().Warn("Control service address changed, a restart is needed for it to take effect", "old_addr", prev.Admin.GRPCListen, "addr", config.Admin.GRPCListen)
+	}
+	if config.Dashboard.Listen != prev.Dashboard.Listen {
+		config.logger().Warn("Dashboard address changed, a restart is needed for it to take effect", "old_addr", prev.Dashboard.Listen, "addr", config.Dashboard.Listen)
+	}
+	if config.Admin.HealthListen != prev.Admin.HealthListen {
+		config.logger().Warn("Health endpoints address changed, a restart is needed for it to take effect", "old_addr", prev.Admin.HealthListen, "addr", config.Admin.HealthListen)
+	}
+
+	s.state.Store(&serverState{config: config, serverConfig: config.initSSHConfig()})
+	if !reuseStore && prev.UserStore != nil && len(prev.UserDB) > 0 {
+		// Only close stores we opened ourselves
+		prev.UserStore.Close()
+	}
+	if !reuseLog && prev.transferLog != nil {
+		prev.transferLog.Close()
+	}
+	if !reuseGeoIP && prev.geoIP != nil {
+		prev.geoIP.Close()
+	}
+	config.logger().Info("Config reloaded")
+	return nil
+}
+
+// UpdateConfig reloads the config with the settings in doc changed, doc being
+// in the same format as a config file ("yaml" or "toml"). Settings it doesn't
+// mention keep their current value. The ones naming commands to run can only
+// be changed in the config file.
+func (s *Server) UpdateConfig(doc []byte, format string) error {
+	prev := s.Config()
+	current, err := yaml.Marshal(prev)
+	if err != nil {
+		return err
+	}
+	config := NewConfig()
+	if err := decodeConfig(current, "yaml", config); err != nil {
+		return err
+	}
+	if err := decodeConfig(doc, strings.ToLower(format), config); err != nil {
+		return fmt.Errorf("Invalid config: %v", err)
+	}
+	// Settings that can't be in a config file. Reload takes care of the
+	// user store and storage backend opened out of the config
+	config.OnListen = prev.OnListen
+	if len(prev.UserDB) == 0 {
+		config.UserStore = prev.UserStore
+	}
+	if config.LogLevel == prev.LogLevel && config.LogFormat == prev.LogFormat {
+		config.Logger = prev.Logger
+	}
+	// Whoever can reach the control service would get to run anything as us
+	for _, setting := range []struct {
+		name    string
+		changed bool
+	}{
+		{"authorized_keys_command", config.AuthKeysCommand != prev.AuthKeysCommand},
+		{"rsync", config.Rsync != prev.Rsync},
+		{"scan.command", config.Scan.Command != prev.Scan.Command},
+		{"upload_command", config.UploadCommand != prev.UploadCommand},
+	} {
+		if setting.changed {
+			return fmt.Errorf("Invalid config: %s can only be changed in the config file", setting.name)
+		}
+	}
+	return s.Reload(config)
+}
+
+// The addresses in Listen, with Port added to the ones without one, or all
+// IPv4 addresses on Port if there aren't any
+func (c *Config) listenAddresses() []string {
+	if len(c.Listen) == 0 {
+		return []string{net.JoinHostPort("0.0.0.0", c.Port)}
+	}
+	var addrs []string
+	for _, addr := range c.Listen {
+		addr = strings.TrimSpace(addr)
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(strings.Trim(addr, "[]"), c.Port)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+func (c *Config) validateListen() error {
+	if c.ReusePort < 0 {
+		return fmt.Errorf("Invalid reuse_port %d", c.ReusePort)
+	}
+	for _, addr := range c.listenAddresses() {
+		if _, port, err := net.SplitHostPort(addr); err != nil || len(port) == 0 {
+			return fmt.Errorf("Invalid listen address %q", addr)
+		}
+	}
+	return nil
+}
+
+// ListenAndServe listens on the TCP addresses set in the config (see
+// Config.Listen) and serves all of them until one of them fails or Shutdown is
+// called. The first error is returned. If any of them can't be listened on
+// nothing is served.
+// When started through systemd socket activation the sockets it passes in are
+// served instead, same for the ones handed over by Upgrade.
+func (s *Server) ListenAndServe() error {
+	if err := s.startAdmin(); err != nil {
+		return err
+	}
+	if err := s.startControl(); err != nil {
+		s.stopAdmin()
+		return err
+	}
+	if err := s.startDashboard(); err != nil {
+		s.stopAdmin()
+		return err
+	}
+	if err := s.startHealth(); err != nil {
+		s.stopAdmin()
+		return err
+	}
+	defer func() {
+		// Shutdown stops them once it's done, so draining can be watched
+		if !s.shuttingDown() {
+			s.stopAdmin()
+		}
+	}()
+	listeners, err := systemdListeners()
+	if err != nil {
+		return err
+	}
+	if len(listeners) > 0 {
+		s.Config().logger().Info("Using sockets from systemd", "sockets", len(listeners))
+		return s.serveAll(listeners)
+	}
+	listeners, ready, err := upgradeListeners()
+	if err != nil {
+		return err
+	}
+	if len(listeners) > 0 {
+		s.Config().logger().Info("Taking over sockets from the previous process", "sockets", len(listeners))
+		// They're already listening, connections just wait for us to accept them
+		ready.Write([]byte{1})
+		ready.Close()
+		return s.serveAll(listeners)
+	}
+	for _, addr := range s.Config().listenAddresses() {
+		addrListeners, err := s.Config().listen(addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, addrListeners...)
+	}
+	return s.serveAll(listeners)
+}
+
+// Listen on addr. With ReusePort that's ReusePort sockets, all with
+// SO_REUSEPORT so the kernel spreads connections between them (and any other
+// simplescp on the same port, like a newer one that's taking over)
+func (c *Config) listen(addr string) ([]net.Listener, error) {
+	if c.ReusePort <= 0 {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{listener}, nil
+	}
+
+	lc := net.ListenConfig{Control: reusePortControl}
+	var listeners []net.Listener
+	for i := 0; i < c.ReusePort; i++ {
+		listener, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		if i == 0 {
+			// The rest go on the same port, even if the kernel picked it
+			addr = listener.Addr().String()
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// Serve all of listeners at once, until one of them fails or Shutdown is called
+func (s *Server) serveAll(listeners []net.Listener) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.notifySystemd(stop)
+	if len(listeners) == 1 {
+		return s.Serve(listeners[0])
+	}
+
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func() { errs <- s.Serve(listener) }()
+	}
+	err := <-errs
+	// Stop the rest too, one-shot servers are done after their connection
+	if err != ErrServerClosed {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}
+	for range len(listeners) - 1 {
+		<-errs
+	}
+	return err
+}
+
+// Serve accepts incoming connections on the listener, handling each of them in
+// a new goroutine. It always returns a non-nil error, ErrServerClosed after Shutdown.
+func (s *Server) Serve(listener net.Listener) error {
+	if !s.trackListener(listener, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(listener, false)
+
+	s.Config().logger().Info("Listening. Accepting connections", "addr", listener.Addr().String())
+	if onListen := s.Config().OnListen; onListen != nil {
+		onListen(listener.Addr())
+	}
+	listener = s.proxyListener(listener)
+	for {
+		nConn, err := listener.Accept()
+		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if !s.trackConn(nConn, true) {
+			nConn.Close()
+			return ErrServerClosed
+		}
+
+		if s.Config().OneShot {
+			if s.serveConn(s.ctx, nConn) {
+				return nil
+			}
+			continue
+		}
+
+		go s.serveConn(s.ctx, nConn)
+	}
+}
+
+// Addr returns the address the server is listening on, the first one if it's
+// listening on several, or nil if it isn't serving yet. With port 0 that's the
+// port the system picked
+func (s *Server) Addr() net.Addr {
+	addrs := s.Addrs()
+	if len(addrs) == 0 {
+		return nil
+	}
+	return addrs[0]
+}
+
+// Addrs returns all the addresses the server is listening on
+func (s *Server) Addrs() []net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var addrs []net.Addr
+	for _, l := range s.listeners {
+		addrs = append(addrs, l.Addr())
+	}
+	return addrs
+}
+
+// Bans returns the client IPs and usernames currently banned after too many
+// failed logins (see Config.BanThreshold)
+func (s *Server) Bans() []Ban {
+	if bans := s.Config().bans; bans != nil {
+		return bans.list()
+	}
+	return nil
+}
+
+// Unban lifts the ban on a client IP or username, or all of them if target
+// is empty, and forgets about their failed logins. It returns how many bans
+// were lifted
+func (s *Server) Unban(target string) int {
+	bans := s.Config().bans
+	if bans == nil {
+		return 0
+	}
+	n := bans.clear(target)
+	s.Config().logger().Info("Lifted bans", "target", target, "bans", n)
+	return n
+}
+
+// Checks a new connection against the address filters and bans, once it's
+// read the PROXY protocol header if there's one
+func (s *Server) admitConn(nConn net.Conn) bool {
+	if err := readProxyHeader(nConn); err != nil {
+		s.Config().logger().Info("Rejected connection", "remote_addr", nConn.RemoteAddr().String(), "err", err)
+		return false
+	}
+	if filter := s.Config().ipFilter; filter != nil && !filter.allowed(nConn.RemoteAddr()) {
+		s.Config().logger().Debug("Rejected connection from filtered address", "remote_addr", nConn.RemoteAddr().String())
+		return false
+	}
+	var country string
+	if geoIP := s.Config().geoIP; geoIP != nil {
+		var err error
+		country, err = geoIP.country(nConn.RemoteAddr())
+		if err != nil {
+			s.Config().logger().Debug("Can't look up country", "remote_addr", nConn.RemoteAddr().String(), "err", err)
+		}
+		if !s.Config().GeoIP.allowedCountry(country) {
+			s.Config().logger().Info("Rejected connection from filtered country", "remote_addr", nConn.RemoteAddr().String(), "country", country)
+			return false
+		}
+	}
+	if bans := s.Config().bans; bans != nil {
+		ip, _, _ := net.SplitHostPort(nConn.RemoteAddr().String())
+		if bans.bannedIP(ip) {
+			s.Config().logger().Info("Rejected connection from banned address", "remote_addr", nConn.RemoteAddr().String())
+			return false
+		}
+	}
+	if len(country) > 0 {
+		s.Config().logger().Info("Accepted connection", "remote_addr", nConn.RemoteAddr().String(), "local_addr", nConn.LocalAddr().String(), "country", country)
+	} else {
+		s.Config().logger().Info("Accepted connection", "remote_addr", nConn.RemoteAddr().String(), "local_addr", nConn.LocalAddr().String())
+	}
+	return true
+}
+
+// Serves nConn if it's admitted, until it's done or ctx is cancelled.
+// Returns whether it was admitted
+func (s *Server) serveConn(ctx context.Context, nConn net.Conn) bool {
+	defer s.trackConn(nConn, false)
+	defer nConn.Close()
+	defer func() {
+		// The connection's closed, the rest keep being served
+		if r := recover(); r != nil {
+			s.Config().logPanic("connection", r)
+		}
+	}()
+	if !s.admitConn(nConn) {
+		return false
+	}
+	if err := setTCPKeepAlive(nConn, s.Config().TCPKeepAlive); err != nil {
+		s.Config().logger().Debug("Can't set TCP keepalive", "remote_addr", nConn.RemoteAddr().String(), "err", err)
+	}
+	state := s.currentState()
+	state.config.handleConn(ctx, nConn, state.serverConfig)
+	return true
+}
+
+// Shutdown stops the server from accepting new connections and waits for the
+// active ones to finish. If ctx expires first the transfers still going are
+// cancelled, the remaining connections closed and the context's error is
+// returned. The admin API, control service, dashboard and health endpoints
+// keep being served until then, /readyz failing from the start.
+func (s *Server) Shutdown(ctx context.Context) error {
+	defer s.doneOnce.Do(func() { close(s.done) })
+	defer s.stopAdmin()
+	s.mu.Lock()
+	s.inShutdown = true
+	var err error
+	for _, l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	s.Config().logger().Info("Shutting down", "active_connections", len(s.conns))
+	s.mu.Unlock()
+	sdNotify("STOPPING=1")
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if s.activeConns() == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.cancel(errServerShutdown)
+			s.closeConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Done returns a channel that's closed once Shutdown is over, however it was
+// called (e.g. through the control service's Drain)
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
+
+// Stop serving the admin API, control service, dashboard and health endpoints
+func (s *Server) stopAdmin() {
+	s.mu.Lock()
+	admin, control, dashboard, health := s.admin, s.control, s.dashboard, s.health
+	s.admin, s.control, s.dashboard, s.health = nil, nil, nil, nil
+	s.mu.Unlock()
+	if admin != nil {
+		admin.Close()
+	}
+	if dashboard != nil {
+		dashboard.Close()
+	}
+	if health != nil {
+		health.Close()
+	}
+	if control != nil {
+		// Lets the reply to Drain go out
+		control.GracefulStop()
+	}
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inShutdown
+}
+
+// Adds or removes a listener from the set we'll close on shutdown.
+// Returns false if we're already shutting down
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.inShutdown {
+			return false
+		}
+		s.listeners = append(s.listeners, l)
+	} else {
+		s.listeners = slices.DeleteFunc(s.listeners, func(other net.Listener) bool { return other == l })
+	}
+	return true
+}
+
+// Adds or removes a connection from the set of active connections.
+// Returns false if we're already shutting down
+func (s *Server) trackConn(c net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.inShutdown {
+			return false
+		}
+		s.conns[c] = struct{}{}
+	} else {
+		delete(s.conns, c)
+	}
+	return true
+}
+
+func (s *Server) activeConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.Close()
+	}
+}
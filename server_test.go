@@ -0,0 +1,146 @@
+package simplescp
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestListenAddresses(t *testing.T) {
+	c := Config{Port: "2222"}
+	if addrs := c.listenAddresses(); !slices.Equal(addrs, []string{"0.0.0.0:2222"}) {
+		t.Errorf("Unexpected default listen addresses %v", addrs)
+	}
+	c.Listen = []string{"127.0.0.1:22", " [::1]:8222", "10.0.0.5", "::1", "[fd00::1]"}
+	expected := []string{"127.0.0.1:22", "[::1]:8222", "10.0.0.5:2222", "[::1]:2222", "[fd00::1]:2222"}
+	if addrs := c.listenAddresses(); !slices.Equal(addrs, expected) {
+		t.Errorf("Listen addresses %v, expected %v", addrs, expected)
+	}
+	if err := c.validateListen(); err != nil {
+		t.Error(err)
+	}
+	c.Listen = []string{"127.0.0.1:"}
+	if err := c.validateListen(); err == nil {
+		t.Error("Listen address without a port accepted")
+	}
+}
+
+// A port nothing's listening on right now
+func freePort(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+}
+
+func TestListenAndServeMultipleAddresses(t *testing.T) {
+	c := newTestConfig(t)
+	c.Port = freePort(t)
+	otherAddr := "127.0.0.1:" + freePort(t)
+	c.Listen = []string{"127.0.0.1", otherAddr}
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(c)
+	done := make(chan error)
+	go func() { done <- server.ListenAndServe() }()
+
+	for _, addr := range []string{"127.0.0.1:" + c.Port, otherAddr} {
+		var client *ssh.Client
+		var err error
+		// Give the listeners a moment to start
+		for i := 0; i < 50; i++ {
+			client, err = ssh.Dial("tcp", addr, &ssh.ClientConfig{
+				User:            "scpuser",
+				Auth:            []ssh.AuthMethod{ssh.Password("hunter2")},
+				HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			})
+			if err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatalf("Can't connect to %s: %v", addr, err)
+		}
+		client.Close()
+	}
+
+	server.Shutdown(context.Background())
+	if err := <-done; err != ErrServerClosed {
+		t.Errorf("ListenAndServe returned %v after shutting down", err)
+	}
+}
+
+func TestReusePort(t *testing.T) {
+	c := newTestConfig(t)
+	c.ReusePort = 3
+	listeners, err := c.listen("127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Can't use SO_REUSEPORT: %v", err)
+	}
+	if len(listeners) != 3 {
+		t.Fatalf("Got %d listeners", len(listeners))
+	}
+	addr := listeners[0].Addr().String()
+	for _, listener := range listeners {
+		defer listener.Close()
+		if listener.Addr().String() != addr {
+			t.Errorf("Listening on %s and %s", addr, listener.Addr())
+		}
+	}
+
+	// Another process could start listening on it too
+	other, err := c.listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, listener := range other {
+		listener.Close()
+	}
+	c.ReusePort = 0
+	if _, err := c.listen(addr); err == nil {
+		t.Error("Listened on a port in use without SO_REUSEPORT")
+	}
+}
+
+func TestEphemeralPort(t *testing.T) {
+	c := newTestConfig(t)
+	c.Port = "0"
+	c.Listen = []string{"127.0.0.1"}
+	listening := make(chan net.Addr, 1)
+	c.OnListen = func(addr net.Addr) { listening <- addr }
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(c)
+	if server.Addr() != nil {
+		t.Errorf("Got address %v before listening", server.Addr())
+	}
+	go server.ListenAndServe()
+	defer server.Shutdown(context.Background())
+
+	addr := <-listening
+	if addr.(*net.TCPAddr).Port == 0 {
+		t.Fatal("Listening on port 0")
+	}
+	if server.Addr().String() != addr.String() {
+		t.Errorf("Server.Addr is %v, listening on %v", server.Addr(), addr)
+	}
+	client, err := ssh.Dial("tcp", addr.String(), &ssh.ClientConfig{
+		User:            "scpuser",
+		Auth:            []ssh.AuthMethod{ssh.Password("hunter2")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+}
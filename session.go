@@ -0,0 +1,43 @@
+package simplescp
+
+import (
+	"strconv"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Set up the config of a connection for the user that's just logged in:
+// the directory they'll be served files from, what they can do there, etc.
+func (c *Config) setupSession(username string, perms *ssh.Permissions) error {
+	if perms != nil && len(perms.Extensions[permAnonymous]) > 0 {
+		return c.setupAnonymousSession(username)
+	}
+
+	var u *User
+	if username != c.User {
+		u = c.lookupStoreUser(username)
+	}
+	// Users from outside the user store (e.g. LDAP) can bring their home directory along
+	if u == nil && perms != nil && len(perms.Extensions[permHomeDir]) > 0 {
+		u = &User{Name: username, HomeDir: perms.Extensions[permHomeDir], Permissions: PermAll}
+	}
+
+	dir, err := c.userDir(username, u)
+	if err != nil {
+		return err
+	}
+	c.Dir = dir
+	c.username = username
+	c.perms = c.userPermissions(u)
+	// Tokens can narrow down what the user is allowed to do
+	if perms != nil && len(perms.Extensions[permLimit]) > 0 {
+		limit, err := strconv.ParseUint(perms.Extensions[permLimit], 10, 32)
+		if err != nil {
+			return err
+		}
+		c.perms &= Permission(limit)
+	}
+	c.quotaLimit = c.userQuota(u)
+	c.idleTimeout = c.userIdleTimeout(u)
+	return nil
+}
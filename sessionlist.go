@@ -0,0 +1,238 @@
+package simplescp
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Session is a connection a user has logged in with
+type Session struct {
+	ID         string     `json:"id"`
+	User       string     `json:"user"`
+	RemoteAddr string     `json:"remote_addr"`
+	Start      time.Time  `json:"start"`
+	BytesIn    int64      `json:"bytes_in"`  // Received from the client, over all its channels
+	BytesOut   int64      `json:"bytes_out"` // Sent to the client
+	Transfers  []Transfer `json:"transfers"` // Files being uploaded or downloaded right now
+}
+
+// Transfer is an upload or download in progress
+type Transfer struct {
+	Protocol  string    `json:"protocol"`  // scp or sftp
+	Direction string    `json:"direction"` // upload or download
+	Path      string    `json:"path"`
+	Start     time.Time `json:"start"`
+	Bytes     int64     `json:"bytes"` // Transferred so far
+}
+
+// FinishedTransfer is an upload or download that's over
+type FinishedTransfer struct {
+	Transfer
+	User string    `json:"user"`
+	End  time.Time `json:"end"`
+}
+
+// How many finished transfers sessionList remembers
+const recentTransfers = 50
+
+// sessionList keeps track of the sessions logged in, so they can be looked
+// at and closed through the admin API, along with the last transfers they
+// did. It's shared by all connections
+type sessionList struct {
+	mu       sync.Mutex
+	sessions map[string]*liveSession
+	recent   []FinishedTransfer // Newest first
+}
+
+// liveSession is a session in the sessionList
+type liveSession struct {
+	id         string
+	user       string
+	remoteAddr string
+	start      time.Time
+	cancel     context.CancelCauseFunc // Ends the connection
+	list       *sessionList
+	bytesIn    atomic.Int64
+	bytesOut   atomic.Int64
+
+	mu        sync.Mutex
+	transfers []*liveTransfer
+}
+
+// liveTransfer is a transfer in progress in a liveSession. Writing to it
+// counts the bytes transferred
+type liveTransfer struct {
+	protocol string
+	upload   bool
+	path     string
+	start    time.Time
+	bytes    atomic.Int64
+}
+
+func newSessionList() *sessionList {
+	return &sessionList{sessions: make(map[string]*liveSession)}
+}
+
+// Add a session to the list, until it's removed once it's over. It's closed
+// through cancel, which should end its connection
+func (l *sessionList) add(id, user, remoteAddr string, cancel context.CancelCauseFunc) *liveSession {
+	s := &liveSession{id: id, user: user, remoteAddr: remoteAddr, start: time.Now(), cancel: cancel, list: l}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sessions[id] = s
+	return s
+}
+
+func (l *sessionList) remove(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.sessions, id)
+}
+
+// The sessions logged in, oldest first
+func (l *sessionList) list() []Session {
+	l.mu.Lock()
+	sessions := make([]*liveSession, 0, len(l.sessions))
+	for _, s := range l.sessions {
+		sessions = append(sessions, s)
+	}
+	l.mu.Unlock()
+
+	list := make([]Session, len(sessions))
+	for i, s := range sessions {
+		list[i] = s.info()
+	}
+	slices.SortFunc(list, func(a, b Session) int {
+		if c := a.Start.Compare(b.Start); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return list
+}
+
+// The last transfers that finished, newest first
+func (l *sessionList) finished() []FinishedTransfer {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.recent)
+}
+
+func (l *sessionList) addFinished(t FinishedTransfer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.recent = slices.Insert(l.recent, 0, t)
+	if len(l.recent) > recentTransfers {
+		l.recent = l.recent[:recentTransfers]
+	}
+}
+
+// Close the session with the id given, returns whether there was one
+func (l *sessionList) close(id string) bool {
+	l.mu.Lock()
+	s, ok := l.sessions[id]
+	l.mu.Unlock()
+	if ok {
+		s.cancel(errSessionClosed)
+	}
+	return ok
+}
+
+func (s *liveSession) info() Session {
+	info := Session{
+		ID:         s.id,
+		User:       s.user,
+		RemoteAddr: s.remoteAddr,
+		Start:      s.start,
+		BytesIn:    s.bytesIn.Load(),
+		BytesOut:   s.bytesOut.Load(),
+		Transfers:  []Transfer{},
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.transfers {
+		info.Transfers = append(info.Transfers, t.info())
+	}
+	return info
+}
+
+func (t *liveTransfer) info() Transfer {
+	direction := "download"
+	if t.upload {
+		direction = "upload"
+	}
+	return Transfer{
+		Protocol:  t.protocol,
+		Direction: direction,
+		Path:      t.path,
+		Start:     t.start,
+		Bytes:     t.bytes.Load(),
+	}
+}
+
+// Note down a transfer starting in the session, until endTransfer is called
+// with what's returned. Sessions that aren't being tracked get a nil one,
+// which can still be used
+func (s *liveSession) startTransfer(protocol string, upload bool, path string) *liveTransfer {
+	if s == nil {
+		return nil
+	}
+	t := &liveTransfer{protocol: protocol, upload: upload, path: path, start: time.Now()}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.transfers = append(s.transfers, t)
+	return t
+}
+
+func (s *liveSession) endTransfer(t *liveTransfer) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.transfers = slices.DeleteFunc(s.transfers, func(other *liveTransfer) bool { return other == t })
+	s.mu.Unlock()
+	s.list.addFinished(FinishedTransfer{Transfer: t.info(), User: s.user, End: time.Now()})
+}
+
+func (t *liveTransfer) add(n int64) {
+	if t != nil {
+		t.bytes.Add(n)
+	}
+}
+
+func (t *liveTransfer) Write(p []byte) (int, error) {
+	t.add(int64(len(p)))
+	return len(p), nil
+}
+
+// countedChannel adds up the bytes going through a channel of a session
+type countedChannel struct {
+	ssh.Channel
+	session *liveSession
+}
+
+// Wrap channel so what goes through it counts towards the session's bytes
+func countChannel(channel ssh.Channel, s *liveSession) ssh.Channel {
+	if s == nil {
+		return channel
+	}
+	return countedChannel{channel, s}
+}
+
+func (c countedChannel) Read(data []byte) (int, error) {
+	n, err := c.Channel.Read(data)
+	c.session.bytesIn.Add(int64(n))
+	return n, err
+}
+
+func (c countedChannel) Write(data []byte) (int, error) {
+	n, err := c.Channel.Write(data)
+	c.session.bytesOut.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,44 @@
+package simplescp
+
+import (
+	"fmt"
+
+	"github.com/pkg/sftp"
+)
+
+// SFTPConfig tunes the sftp server, for links where the defaults leave
+// bandwidth unused or sessions take up too much memory
+type SFTPConfig struct {
+	MaxPacket             ByteSize `yaml:"max_packet" toml:"max_packet"`                           // Biggest request clients can send, and what they're told they can (limits@openssh.com). Default: 256K, which is also the most
+	Allocator             bool     `yaml:"allocator" toml:"allocator"`                             // Reuse packet buffers between requests, for less garbage collection at the cost of memory held by each session
+	MaxConcurrentRequests int      `yaml:"max_concurrent_requests" toml:"max_concurrent_requests"` // Requests from a session being worked on at once, before it stops reading more. Default: No limit
+}
+
+// Smallest max_packet, enough for any request but writes with much in them
+const minSFTPPacket = 4 * 1024
+
+func (s SFTPConfig) validate() error {
+	if s.MaxPacket != 0 && (s.MaxPacket < minSFTPPacket || s.MaxPacket > maxSFTPPacket) {
+		return fmt.Errorf("Invalid sftp max_packet %v, it should be between %v and %v", s.MaxPacket, ByteSize(minSFTPPacket), ByteSize(maxSFTPPacket))
+	}
+	if s.MaxConcurrentRequests < 0 {
+		return fmt.Errorf("Invalid sftp max_concurrent_requests %d", s.MaxConcurrentRequests)
+	}
+	return nil
+}
+
+func (s SFTPConfig) maxPacket() int {
+	if s.MaxPacket == 0 {
+		return maxSFTPPacket
+	}
+	return int(s.MaxPacket)
+}
+
+// Options the request server is started with
+func (s SFTPConfig) serverOptions() []sftp.RequestServerOption {
+	var options []sftp.RequestServerOption
+	if s.Allocator {
+		options = append(options, sftp.WithRSAllocator())
+	}
+	return options
+}
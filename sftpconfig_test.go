@@ -0,0 +1,55 @@
+package simplescp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestSFTPConfigValidate(t *testing.T) {
+	for config, valid := range map[SFTPConfig]bool{
+		{}:                          true,
+		{MaxPacket: 64 * 1024}:      true,
+		{MaxPacket: 1024}:           false,
+		{MaxPacket: 1024 * 1024}:    false,
+		{MaxConcurrentRequests: 4}:  true,
+		{MaxConcurrentRequests: -1}: false,
+		{Allocator: true}:           true,
+	} {
+		if err := config.validate(); (err == nil) != valid {
+			t.Errorf("%+v validated to %v", config, err)
+		}
+	}
+}
+
+func TestSFTPTuning(t *testing.T) {
+	c := newTestConfig(t)
+	c.SFTP = SFTPConfig{MaxPacket: 64 * 1024, Allocator: true, MaxConcurrentRequests: 1}
+	addr := startTestServer(t, c)
+
+	s, _ := startRawSFTP(t, addr)
+	reply := s.request(sshFxpExtended, 1, sftpStringBytes("limits@openssh.com"))
+	if packet := binary.BigEndian.Uint64(reply[9:]); packet != 64*1024 {
+		t.Errorf("Client told packets can be %d bytes", packet)
+	}
+
+	// One request at a time is still enough for the client's pipelined ones
+	client := dialSFTP(t, addr)
+	data := bytes.Repeat([]byte("0123456789"), 100000)
+	f, err := client.Create("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.ReadFrom(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if f, err = client.Open("/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if got, err := io.ReadAll(f); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Downloaded %d bytes back, %v", len(got), err)
+	}
+}
@@ -0,0 +1,398 @@
+package simplescp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+)
+
+// sftpConn sits between the request server and the client. It logs each
+// request with what came of it (at the debug level), and since the request
+// server doesn't know about some of OpenSSH's extensions, announces them and
+// answers them itself:
+//
+//   - fsync@openssh.com: sftpConn keeps track of which file each handle
+//     the request server hands out is for, and syncs that file once everything
+//     the client asked for before has been answered, so all of its writes are in.
+//   - limits@openssh.com: how big the requests the request server takes can be,
+//     so clients (OpenSSH's since 8.9) can send big writes and fewer of them.
+//   - check-file (check-file-name and check-file-handle requests): hashes of
+//     a file, or of blocks of it, so clients can check a transfer or where to
+//     resume one from without reading the file back.
+
+// sftp packet types sftpConn looks at
+const (
+	sshFxpVersion       = 2
+	sshFxpOpen          = 3
+	sshFxpClose         = 4
+	sshFxpRead          = 5
+	sshFxpWrite         = 6
+	sshFxpOpendir       = 11
+	sshFxpStatus        = 101
+	sshFxpHandle        = 102
+	sshFxpData          = 103
+	sshFxpExtended      = 200
+	sshFxpExtendedReply = 201
+)
+
+// sftp status codes
+const (
+	sshFxOK               = 0
+	sshFxNoSuchFile       = 2
+	sshFxPermissionDenied = 3
+	sshFxFailure          = 4
+	sshFxOpUnsupported    = 8
+)
+
+const (
+	fsyncExtension     = "fsync@openssh.com"
+	limitsExtension    = "limits@openssh.com"
+	checkFileExtension = "check-file"
+	checkFileName      = "check-file-name"
+	checkFileHandle    = "check-file-handle"
+)
+
+// Extensions we announce on top of the request server's
+var extraSFTPExtensions = []string{fsyncExtension, limitsExtension, checkFileExtension}
+
+// Extended requests we answer instead of passing them on
+var extensionRequests = map[string]bool{
+	fsyncExtension:  true,
+	limitsExtension: true,
+	checkFileName:   true,
+	checkFileHandle: true,
+}
+
+// Biggest packet that can be let through, the same as the request server's
+const maxSFTPPacket = 256 * 1024
+
+// Most the request server reads at once, however much is asked for
+const maxSFTPRead = 32 * 1024
+
+// Room left in a packet for everything in a write request but the data
+const sftpWriteOverhead = 1024
+
+var errInvalidHandle = errors.New("Invalid handle")
+
+type sftpConn struct {
+	conn    io.ReadWriteCloser
+	handler *sftpHandler
+	in      []byte // Packet from the client the request server hasn't read all of yet
+
+	mu        sync.Mutex
+	answered  *sync.Cond
+	out       []byte            // What the request server has written of its next packet
+	requests  int               // Passed on to the request server
+	responses int               // Sent back by it
+	opens     map[uint32]string // Files and directories being opened, by request ID
+	handles   map[string]string // Open files and directories, by handle
+
+	maxPacket   int // Biggest request let through
+	maxRequests int // Passed on to the request server and not answered yet, at most
+
+	logRequests bool                     // Debug logging is on
+	pending     map[uint32]loggedRequest // Requests waiting for a response, by ID
+}
+
+func newSFTPConn(conn io.ReadWriteCloser, handler *sftpHandler) *sftpConn {
+	c := &sftpConn{conn: conn, handler: handler, opens: map[uint32]string{}, handles: map[string]string{}, pending: map[uint32]loggedRequest{}}
+	c.answered = sync.NewCond(&c.mu)
+	c.maxPacket, c.maxRequests = handler.config.SFTP.maxPacket(), handler.config.SFTP.MaxConcurrentRequests
+	c.logRequests = handler.config.logger().Enabled(context.Background(), slog.LevelDebug)
+	return c
+}
+
+func (c *sftpConn) Read(p []byte) (int, error) {
+	for len(c.in) == 0 {
+		packet, err := readSFTPPacket(c.conn, c.maxPacket)
+		if err != nil {
+			return 0, err
+		}
+		name, rest, ok := extendedRequest(packet)
+		ours := ok && extensionRequests[name]
+		c.request(packet, ours)
+		if ours {
+			if err := c.extension(binary.BigEndian.Uint32(packet[5:]), name, rest); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		c.in = packet
+	}
+	n := copy(p, c.in)
+	c.in = c.in[n:]
+	return n, nil
+}
+
+func (c *sftpConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.out = append(c.out, p...)
+	for len(c.out) >= 5 {
+		length := 4 + int(binary.BigEndian.Uint32(c.out))
+		if len(c.out) < length {
+			break
+		}
+		if _, err := c.reply(c.response(c.out[:length])); err != nil {
+			return 0, err
+		}
+		c.out = c.out[:copy(c.out, c.out[length:])]
+		c.responses++
+		c.answered.Broadcast()
+	}
+	return len(p), nil
+}
+
+func (c *sftpConn) Close() error {
+	return c.conn.Close()
+}
+
+// Send a response on to the client. c.mu has to be held
+func (c *sftpConn) reply(packet []byte) (int, error) {
+	if c.logRequests {
+		c.logResponse(packet)
+	}
+	return c.conn.Write(packet)
+}
+
+// Note down a request, and what it does to handles if it's going to the
+// request server rather than being one of ours
+func (c *sftpConn) request(packet []byte, ours bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.logRequests {
+		c.logRequest(packet)
+	}
+	if ours {
+		return
+	}
+	for c.maxRequests > 0 && c.requests-c.responses >= c.maxRequests {
+		c.answered.Wait()
+	}
+	c.requests++
+	id, rest, ok := sftpUint32(packet[5:])
+	if !ok {
+		return
+	}
+	switch packet[4] {
+	case sshFxpOpen, sshFxpOpendir:
+		if name, _, ok := sftpString(rest); ok {
+			c.opens[id] = name
+		}
+	case sshFxpClose:
+		if handle, _, ok := sftpString(rest); ok {
+			delete(c.handles, handle)
+		}
+	}
+}
+
+// Take note of the handles in a response on its way to the client, and add
+// ours to the extensions the request server announces
+func (c *sftpConn) response(packet []byte) []byte {
+	switch packet[4] {
+	case sshFxpVersion:
+		// A copy, what comes after it is the start of the next packet
+		packet = packet[:len(packet):len(packet)]
+		for _, name := range extraSFTPExtensions {
+			packet = append(packet, sftpStringBytes(name)...)
+			packet = append(packet, sftpStringBytes("1")...)
+		}
+		binary.BigEndian.PutUint32(packet, uint32(len(packet)-4))
+	case sshFxpHandle, sshFxpStatus:
+		id, rest, ok := sftpUint32(packet[5:])
+		name, opening := c.opens[id]
+		if !ok || !opening {
+			break
+		}
+		delete(c.opens, id)
+		if handle, _, ok := sftpString(rest); ok && packet[4] == sshFxpHandle {
+			c.handles[handle] = name
+		}
+	}
+	return packet
+}
+
+// Answer a request for one of our extensions once the request server is done
+// with everything before it
+func (c *sftpConn) extension(id uint32, name string, args []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.responses < c.requests {
+		c.answered.Wait()
+	}
+	switch name {
+	case limitsExtension:
+		return c.limits(id)
+	case checkFileName, checkFileHandle:
+		return c.checkFile(id, name == checkFileHandle, args)
+	}
+	err := errInvalidHandle
+	if handle, _, ok := sftpString(args); !ok {
+		err = errors.New("Invalid fsync request")
+	} else if file, ok := c.handles[handle]; ok {
+		err = c.handler.fsync(file)
+	}
+	return c.status(id, err)
+}
+
+// Hash what a check-file request asks for, of the file with the given name
+// or (byHandle) that's open with the given handle
+func (c *sftpConn) checkFile(id uint32, byHandle bool, args []byte) error {
+	file, rest, ok := sftpString(args)
+	algorithms, rest, ok2 := sftpString(rest)
+	offset, rest, ok3 := sftpUint64(rest)
+	length, rest, ok4 := sftpUint64(rest)
+	blockSize, _, ok5 := sftpUint32(rest)
+	if !ok || !ok2 || !ok3 || !ok4 || !ok5 {
+		return c.status(id, errors.New("Invalid check-file request"))
+	}
+	if byHandle {
+		if file, ok = c.handles[file]; !ok {
+			return c.status(id, errInvalidHandle)
+		}
+	}
+	algorithm, hashes, err := c.handler.checkFile(file, strings.Split(algorithms, ","), offset, length, blockSize)
+	if err != nil {
+		return c.status(id, err)
+	}
+
+	packet := make([]byte, 9, 9+len(checkFileExtension)+len(algorithm)+8+len(hashes))
+	packet[4] = sshFxpExtendedReply
+	binary.BigEndian.PutUint32(packet[5:], id)
+	packet = append(packet, sftpStringBytes(checkFileExtension)...)
+	packet = append(packet, sftpStringBytes(algorithm)...)
+	packet = append(packet, hashes...)
+	binary.BigEndian.PutUint32(packet, uint32(len(packet)-4))
+	_, err = c.reply(packet)
+	return err
+}
+
+// Tell the client how big its requests can be. There's no limit on how many
+// files it can have open
+func (c *sftpConn) limits(id uint32) error {
+	packet := make([]byte, 9, 9+4*8)
+	packet[4] = sshFxpExtendedReply
+	binary.BigEndian.PutUint32(packet[5:], id)
+	for _, limit := range []uint64{uint64(c.maxPacket), maxSFTPRead, uint64(c.maxPacket - sftpWriteOverhead), 0} {
+		packet = binary.BigEndian.AppendUint64(packet, limit)
+	}
+	binary.BigEndian.PutUint32(packet, uint32(len(packet)-4))
+	_, err := c.reply(packet)
+	return err
+}
+
+// Send a status response, for err
+func (c *sftpConn) status(id uint32, err error) error {
+	code, msg := uint32(sshFxOK), ""
+	switch {
+	case errors.Is(err, sftp.ErrSSHFxOpUnsupported):
+		code, msg = sshFxOpUnsupported, "Not supported for these files"
+	case errors.Is(err, os.ErrNotExist):
+		code, msg = sshFxNoSuchFile, "No such file"
+	case errors.Is(err, os.ErrPermission), errors.Is(err, sftp.ErrSSHFxPermissionDenied):
+		code, msg = sshFxPermissionDenied, "Permission denied"
+	case err != nil:
+		code, msg = sshFxFailure, err.Error()
+	}
+	packet := make([]byte, 13, 13+len(msg)+8)
+	packet[4] = sshFxpStatus
+	binary.BigEndian.PutUint32(packet[5:], id)
+	binary.BigEndian.PutUint32(packet[9:], code)
+	packet = append(packet, sftpStringBytes(msg)...)
+	packet = append(packet, sftpStringBytes("")...)
+	binary.BigEndian.PutUint32(packet, uint32(len(packet)-4))
+	_, err = c.reply(packet)
+	return err
+}
+
+// Make sure what's been written to the file at p, as the client sees it, is
+// on disk
+func (h *sftpHandler) fsync(p string) error {
+	if !h.config.isLocal() {
+		return sftp.ErrSSHFxOpUnsupported
+	}
+	p, err := h.realPath(p)
+	if err != nil {
+		return err
+	}
+	// Any descriptor will do, syncing is for the file and not just what was
+	// written through it
+	p = h.uploadPath(p)
+	f, err := os.Open(p)
+	if errors.Is(err, os.ErrPermission) {
+		f, err = os.OpenFile(p, os.O_WRONLY, 0)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	h.config.logger().Debug("Synced file", "file", p)
+	return nil
+}
+
+// Read a whole sftp packet, length and all, of up to limit bytes
+func readSFTPPacket(r io.Reader, limit int) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	// Every request has its type and ID
+	if length < 5 || length > uint32(limit) {
+		return nil, fmt.Errorf("Invalid sftp packet length %d", length)
+	}
+	packet := make([]byte, 4+length)
+	copy(packet, header[:])
+	if _, err := io.ReadFull(r, packet[4:]); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// Which extension an extended request is for, and its arguments
+func extendedRequest(packet []byte) (string, []byte, bool) {
+	if len(packet) < 9 || packet[4] != sshFxpExtended {
+		return "", nil, false
+	}
+	return sftpString(packet[9:])
+}
+
+func sftpUint32(b []byte) (uint32, []byte, bool) {
+	if len(b) < 4 {
+		return 0, b, false
+	}
+	return binary.BigEndian.Uint32(b), b[4:], true
+}
+
+func sftpUint64(b []byte) (uint64, []byte, bool) {
+	if len(b) < 8 {
+		return 0, b, false
+	}
+	return binary.BigEndian.Uint64(b), b[8:], true
+}
+
+func sftpString(b []byte) (string, []byte, bool) {
+	n, rest, ok := sftpUint32(b)
+	if !ok || uint64(len(rest)) < uint64(n) {
+		return "", b, false
+	}
+	return string(rest[:n]), rest[n:], true
+}
+
+func sftpStringBytes(s string) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(s))), s...)
+}
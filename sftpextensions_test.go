@@ -0,0 +1,153 @@
+package simplescp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// rawSFTP talks to the sftp subsystem packet by packet, for the extensions
+// the sftp client doesn't know about
+type rawSFTP struct {
+	t      *testing.T
+	stdin  io.Writer
+	stdout io.Reader
+}
+
+// Starts an sftp session on the server at addr, returning the extensions it
+// announces
+func startRawSFTP(t *testing.T, addr string) (*rawSFTP, map[string]string) {
+	t.Helper()
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "scpuser",
+		Auth:            []ssh.AuthMethod{ssh.Password("hunter2")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, _ := session.StdinPipe()
+	stdout, _ := session.StdoutPipe()
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		t.Fatal(err)
+	}
+	s := &rawSFTP{t: t, stdin: stdin, stdout: stdout}
+
+	version := s.request(1, 3)
+	extensions := map[string]string{}
+	for rest := version[9:]; len(rest) > 0; {
+		name, more, ok := sftpString(rest)
+		value, more, ok2 := sftpString(more)
+		if !ok || !ok2 {
+			t.Fatalf("Invalid version packet %x", version)
+		}
+		extensions[name] = value
+		rest = more
+	}
+	return s, extensions
+}
+
+// Sends a packet of the given type and ID (followed by args) and returns
+// the response
+func (s *rawSFTP) request(kind byte, id uint32, args ...[]byte) []byte {
+	s.t.Helper()
+	packet := binary.BigEndian.AppendUint32([]byte{0, 0, 0, 0, kind}, id)
+	for _, arg := range args {
+		packet = append(packet, arg...)
+	}
+	binary.BigEndian.PutUint32(packet, uint32(len(packet)-4))
+	s.stdin.Write(packet)
+	response, err := readSFTPPacket(s.stdout, maxSFTPPacket)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return response
+}
+
+func TestSFTPLimits(t *testing.T) {
+	s, extensions := startRawSFTP(t, startTestServer(t, newTestConfig(t)))
+	if extensions["limits@openssh.com"] != "1" || extensions["fsync@openssh.com"] != "1" || extensions["statvfs@openssh.com"] == "" {
+		t.Errorf("Unexpected extensions %v", extensions)
+	}
+
+	reply := s.request(sshFxpExtended, 7, sftpStringBytes("limits@openssh.com"))
+	if reply[4] != sshFxpExtendedReply || binary.BigEndian.Uint32(reply[5:]) != 7 || len(reply) != 9+4*8 {
+		t.Fatalf("Unexpected limits reply %x", reply)
+	}
+	if packet, read, write := binary.BigEndian.Uint64(reply[9:]), binary.BigEndian.Uint64(reply[17:]), binary.BigEndian.Uint64(reply[25:]); packet != 256*1024 || read != 32*1024 || write >= packet {
+		t.Errorf("Unexpected limits %d, %d, %d", packet, read, write)
+	}
+
+	// Requests to the request server keep being answered in order
+	if realpath := s.request(16, 8, sftpStringBytes(".")); realpath[4] != 104 || binary.BigEndian.Uint32(realpath[5:]) != 8 {
+		t.Errorf("Unexpected realpath reply %x", realpath)
+	}
+}
+
+func TestSFTPCheckFile(t *testing.T) {
+	c := newTestConfig(t)
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	os.WriteFile(filepath.Join(c.Dir, "a.txt"), data, 0644)
+	s, extensions := startRawSFTP(t, startTestServer(t, c))
+	if _, ok := extensions["check-file"]; !ok {
+		t.Errorf("check-file not announced: %v", extensions)
+	}
+
+	checkFile := func(id uint32, algorithms string, offset, length uint64, blockSize uint32) (string, []byte) {
+		t.Helper()
+		reply := s.request(sshFxpExtended, id, sftpStringBytes("check-file-name"), sftpStringBytes("/a.txt"), sftpStringBytes(algorithms),
+			binary.BigEndian.AppendUint64(nil, offset), binary.BigEndian.AppendUint64(nil, length), binary.BigEndian.AppendUint32(nil, blockSize))
+		if reply[4] != sshFxpExtendedReply {
+			return "", reply
+		}
+		name, rest, _ := sftpString(reply[9:])
+		algorithm, hashes, _ := sftpString(rest)
+		if name != "check-file" {
+			t.Errorf("Unexpected reply %q", name)
+		}
+		return algorithm, hashes
+	}
+
+	whole := sha256.Sum256(data)
+	if algorithm, hashes := checkFile(1, "crc32,sha256,md5", 0, 0, 0); algorithm != "sha256" || !bytes.Equal(hashes, whole[:]) {
+		t.Errorf("Whole file hashed with %s to %x", algorithm, hashes)
+	}
+	var blocks []byte
+	for _, block := range [][]byte{data[100:356], data[356:612], data[612:700]} {
+		sum := md5.Sum(block)
+		blocks = append(blocks, sum[:]...)
+	}
+	if algorithm, hashes := checkFile(2, "md5", 100, 600, 256); algorithm != "md5" || !bytes.Equal(hashes, blocks) {
+		t.Errorf("Blocks hashed with %s to %x, expected %x", algorithm, hashes, blocks)
+	}
+	if _, reply := checkFile(3, "crc32", 0, 0, 0); reply[4] != sshFxpStatus || binary.BigEndian.Uint32(reply[9:]) != sshFxOpUnsupported {
+		t.Errorf("Unknown algorithm answered with %x", reply)
+	}
+	if _, reply := checkFile(4, "md5", 0, 0, 16); reply[4] != sshFxpStatus {
+		t.Errorf("Blocks too small answered with %x", reply)
+	}
+
+	// The same through a handle
+	open := s.request(3, 5, sftpStringBytes("/a.txt"), binary.BigEndian.AppendUint32(nil, 1), binary.BigEndian.AppendUint32(nil, 0))
+	handle, _, ok := sftpString(open[9:])
+	if open[4] != sshFxpHandle || !ok {
+		t.Fatalf("Can't open file: %x", open)
+	}
+	reply := s.request(sshFxpExtended, 6, sftpStringBytes("check-file-handle"), sftpStringBytes(handle), sftpStringBytes("sha256"),
+		make([]byte, 8), make([]byte, 8), make([]byte, 4))
+	if reply[4] != sshFxpExtendedReply || !bytes.HasSuffix(reply, whole[:]) {
+		t.Errorf("Unexpected reply by handle %x", reply)
+	}
+}
@@ -0,0 +1,139 @@
+package simplescp
+
+import (
+	"time"
+)
+
+// What each sftp request is logged as, by packet type
+var sftpOps = map[byte]string{
+	3:  "open",
+	4:  "close",
+	5:  "read",
+	6:  "write",
+	7:  "lstat",
+	8:  "fstat",
+	9:  "setstat",
+	10: "fsetstat",
+	11: "opendir",
+	12: "readdir",
+	13: "remove",
+	14: "mkdir",
+	15: "rmdir",
+	16: "realpath",
+	17: "stat",
+	18: "rename",
+	19: "readlink",
+	20: "symlink",
+}
+
+// Requests that are about an open handle rather than a path
+var sftpHandleOps = map[string]bool{
+	"close":                true,
+	"read":                 true,
+	"write":                true,
+	"fstat":                true,
+	"fsetstat":             true,
+	"readdir":              true,
+	"fstatvfs@openssh.com": true,
+	fsyncExtension:         true,
+	checkFileHandle:        true,
+}
+
+// Requests that have a second path, after the first one
+var sftpTargetOps = map[string]bool{
+	"rename":                   true,
+	"symlink":                  true,
+	"posix-rename@openssh.com": true,
+	"hardlink@openssh.com":     true,
+}
+
+// How each status is logged
+var sftpStatuses = map[uint32]string{
+	0: "ok",
+	1: "eof",
+	2: "no such file",
+	3: "permission denied",
+	4: "failure",
+	5: "bad message",
+	8: "unsupported",
+}
+
+// loggedRequest is a request waiting for its response to be logged
+type loggedRequest struct {
+	op     string
+	path   string
+	target string
+	size   int64
+	start  time.Time
+}
+
+// Note down a request from the client, to be logged along with its response.
+// c.mu has to be held
+func (c *sftpConn) logRequest(packet []byte) {
+	op := sftpOps[packet[4]]
+	id, rest, ok := sftpUint32(packet[5:])
+	if packet[4] == sshFxpExtended && ok {
+		op, rest, ok = sftpString(rest)
+	}
+	if !ok || op == "" {
+		return
+	}
+
+	req := loggedRequest{op: op, start: time.Now()}
+	if arg, more, ok := sftpString(rest); ok && op != limitsExtension {
+		req.path = arg
+		if sftpHandleOps[op] {
+			req.path = c.handles[arg]
+		}
+		if sftpTargetOps[op] {
+			req.target, _, _ = sftpString(more)
+		}
+		if op == "write" {
+			if _, more, ok := sftpUint64(more); ok {
+				data, _, _ := sftpString(more)
+				req.size = int64(len(data))
+			}
+		}
+	}
+	c.pending[id] = req
+}
+
+// Log a request along with the response on its way to the client. c.mu has
+// to be held
+func (c *sftpConn) logResponse(packet []byte) {
+	id, rest, ok := sftpUint32(packet[5:])
+	if !ok || packet[4] == sshFxpVersion {
+		return
+	}
+	req, ok := c.pending[id]
+	if !ok {
+		return
+	}
+	delete(c.pending, id)
+
+	status := "ok"
+	switch packet[4] {
+	case sshFxpStatus:
+		if code, _, ok := sftpUint32(rest); ok {
+			if status, ok = sftpStatuses[code]; !ok {
+				status = "error"
+			}
+		}
+	case sshFxpData:
+		data, _, _ := sftpString(rest)
+		req.size = int64(len(data))
+	}
+
+	args := []any{"op", req.op}
+	if req.path != "" {
+		args = append(args, "path", req.path)
+	}
+	if req.target != "" {
+		args = append(args, "target", req.target)
+	}
+	if req.op == "read" || req.op == "write" {
+		args = append(args, "size", req.size)
+	}
+	args = append(args, "status", status, "latency", time.Since(req.start))
+	c.handler.config.logger().Debug("SFTP request", args...)
+}
@@ -0,0 +1,52 @@
+package simplescp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSFTPRequestLogging(t *testing.T) {
+	c := newTestConfig(t)
+	var logs bytes.Buffer
+	c.Logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	packet := func(kind byte, id uint32, args ...[]byte) []byte {
+		p := binary.BigEndian.AppendUint32([]byte{0, 0, 0, 0, kind}, id)
+		for _, arg := range args {
+			p = append(p, arg...)
+		}
+		binary.BigEndian.PutUint32(p, uint32(len(p)-4))
+		return p
+	}
+
+	var requests bytes.Buffer
+	open := packet(sshFxpOpen, 1, sftpStringBytes("/a.txt"), make([]byte, 8))
+	requests.Write(open)
+	requests.Write(packet(sshFxpWrite, 2, sftpStringBytes("0"), make([]byte, 8), sftpStringBytes("hello")))
+	requests.Write(packet(sshFxpOpen, 3, sftpStringBytes("/missing"), make([]byte, 8)))
+	conn := newSFTPConn(struct {
+		io.Reader
+		io.Writer
+		io.Closer
+	}{&requests, io.Discard, io.NopCloser(nil)}, &sftpHandler{config: *c})
+
+	io.ReadFull(conn, make([]byte, len(open)))
+	conn.Write(packet(sshFxpHandle, 1, sftpStringBytes("0")))
+	io.Copy(io.Discard, conn)
+	conn.Write(packet(sshFxpStatus, 2, make([]byte, 4)))
+	conn.Write(packet(sshFxpStatus, 3, binary.BigEndian.AppendUint32(nil, sshFxNoSuchFile)))
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	for i, expected := range []string{
+		`msg="SFTP request" op=open path=/a.txt status=ok latency=`,
+		`msg="SFTP request" op=write path=/a.txt size=5 status=ok latency=`,
+		`msg="SFTP request" op=open path=/missing status="no such file" latency=`,
+	} {
+		if i >= len(lines) || !strings.Contains(lines[i], expected) {
+			t.Errorf("Expected a log line with %s, got %q", expected, lines)
+		}
+	}
+}
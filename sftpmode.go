@@ -0,0 +1,551 @@
+package simplescp
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+func (config Config) handleSFTP(channel ssh.Channel) {
+	channel, stopRecording := config.recordSession(channel, "sftp", "")
+	defer stopRecording()
+	handler := &sftpHandler{root: filepath.Clean(config.Dir), config: config, fs: config.fileSystem(), uploads: map[string]string{}}
+	server := sftp.NewRequestServer(newSFTPConn(channel, handler), sftp.Handlers{
+		FileGet:  handler,
+		FilePut:  handler,
+		FileCmd:  handler,
+		FileList: handler,
+	}, config.SFTP.serverOptions()...)
+	defer server.Close()
+
+	if err := server.Serve(); err == nil || err == io.EOF {
+		config.logger().Debug("SFTP server exited cleanly")
+		sendExitStatusCode(channel, 0)
+	} else {
+		config.logger().Debug("SFTP server exited with error", "err", err)
+		sendExitStatusCode(channel, 1)
+	}
+
+	channel.Close()
+}
+
+// sftpHandler serves sftp requests out of root. Clients see root as "/" and
+// can't reach anything outside of it.
+type sftpHandler struct {
+	root   string
+	config Config
+	fs     FileSystem
+
+	mu      sync.Mutex
+	uploads map[string]string // Partial files of atomic uploads in progress, by where they're going
+}
+
+// sftpFile is what we hand over to the request server to read from and write to
+type sftpFile interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+}
+
+// Fails the request with a generic error if handling it panics, instead of
+// taking the whole server down. Deferred by the request handlers, with their
+// error result
+func (h *sftpHandler) recoverRequest(r *sftp.Request, err *error) {
+	if p := recover(); p != nil {
+		h.config.logPanic("sftp "+r.Method, p)
+		*err = sftp.ErrSSHFxFailure
+	}
+}
+
+// Translate a path as seen by the client into a path in our filesystem,
+// following symlinks as long as they don't take it outside of root. Denied
+// files aren't there as far as clients know
+func (h *sftpHandler) realPath(p string) (string, error) {
+	if h.config.deniedFile(p) {
+		return "", os.ErrNotExist
+	}
+	// The request server has already cleaned the path, but better safe than sorry
+	return h.config.resolvePath(filepath.FromSlash(path.Clean("/" + p)))
+}
+
+// Same as realPath, for requests about the path itself even if it's a symlink
+func (h *sftpHandler) linkPath(p string) (string, error) {
+	if h.config.deniedFile(p) {
+		return "", os.ErrNotExist
+	}
+	return h.config.resolveLinkPath(filepath.FromSlash(path.Clean("/" + p)))
+}
+
+// Same as linkPath, for files about to be created, whose names have to follow the rules
+func (h *sftpHandler) newPath(p string) (string, error) {
+	p, err := h.config.sanitizePath(path.Clean("/" + p))
+	if err != nil {
+		return "", err
+	}
+	if h.config.deniedFile(p) {
+		return "", sftp.ErrSSHFxPermissionDenied
+	}
+	return h.linkPath(p)
+}
+
+func (h *sftpHandler) Fileread(r *sftp.Request) (_ io.ReaderAt, err error) {
+	defer h.recoverRequest(r, &err)
+	if !h.config.perms.Has(PermRead) {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	p, err := h.realPath(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := h.fs.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return h.config.logFile(f, p, false), nil
+}
+
+func (h *sftpHandler) Filewrite(r *sftp.Request) (_ io.WriterAt, err error) {
+	defer h.recoverRequest(r, &err)
+	if !h.config.perms.Has(PermWrite) {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	return h.openFile(r)
+}
+
+func (h *sftpHandler) OpenFile(r *sftp.Request) (_ sftp.WriterAtReaderAt, err error) {
+	defer h.recoverRequest(r, &err)
+	// Handles opened this way can be read from too
+	if !h.config.perms.Has(PermRead | PermWrite) {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	return h.openFile(r)
+}
+
+func (h *sftpHandler) openFile(r *sftp.Request) (sftpFile, error) {
+	pflags := r.Pflags()
+	var flags int
+	switch {
+	case pflags.Read && pflags.Write:
+		flags = os.O_RDWR
+	case pflags.Write:
+		flags = os.O_WRONLY
+	default:
+		flags = os.O_RDONLY
+	}
+	// Appending clients, like the ones resuming uploads, still say where each
+	// write goes (the end of the file), and O_APPEND would make WriteAt fail
+	if pflags.Creat {
+		flags |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flags |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flags |= os.O_EXCL
+	}
+
+	mode := os.FileMode(0644)
+	if r.AttrFlags().Permissions {
+		mode = r.Attributes().FileMode().Perm()
+	}
+	name := r.Filepath
+	if pflags.Creat {
+		var err error
+		if name, err = h.config.sanitizePath(path.Clean("/" + name)); err != nil {
+			return nil, err
+		}
+		if h.config.deniedFile(name) {
+			return nil, sftp.ErrSSHFxPermissionDenied
+		}
+	}
+	p, err := h.realPath(name)
+	if err != nil {
+		return nil, err
+	}
+	oldSize := h.config.existingSize(p)
+	if pflags.Trunc && oldSize > 0 && h.config.NoTruncate {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	_, err = h.fs.Lstat(p)
+	// Files being written from scratch, as opposed to resumed or modified
+	newUpload := pflags.Write && pflags.Creat && !pflags.Append && (err != nil || pflags.Trunc)
+	if newUpload && h.config.stagedUploads() {
+		return h.openAtomic(p, flags, pflags.Excl && err == nil, mode, oldSize)
+	}
+	if pflags.Write && h.config.Scan.enabled() {
+		// Only whole files can be scanned, they can't be added to or changed afterwards
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	f, err := h.fs.OpenFile(p, flags, mode)
+	if err != nil {
+		return nil, err
+	}
+	if pflags.Trunc {
+		h.config.reserveSpace(-oldSize)
+	}
+	if !newUpload {
+		return h.config.logFile(h.config.limitFile(f), p, pflags.Write), nil
+	}
+	uf := &uploadFile{sftpFile: h.config.limitFile(f), config: h.config, part: p, name: p}
+	return h.config.logFile(uf, p, true), nil
+}
+
+// Open a new upload to p that's only moved into place once the client closes it
+func (h *sftpHandler) openAtomic(p string, flags int, exists bool, mode os.FileMode, oldSize int64) (sftpFile, error) {
+	if exists {
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrExist}
+	}
+	f, part, err := h.config.createUpload(p, flags, mode)
+	if err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	h.uploads[p] = part
+	h.mu.Unlock()
+	done := func() {
+		h.mu.Lock()
+		delete(h.uploads, p)
+		h.mu.Unlock()
+	}
+	uf := &uploadFile{sftpFile: h.config.limitFile(f), config: h.config, part: part, name: p, oldSize: oldSize, done: done}
+	return h.config.logFile(uf, p, true), nil
+}
+
+// Where the file at p really is for now, the partial file if it's being uploaded
+func (h *sftpHandler) uploadPath(p string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if part, ok := h.uploads[p]; ok {
+		return part
+	}
+	return p
+}
+
+// What each sftp command needs permission for
+var sftpCmdPermissions = map[string]Permission{
+	"Setstat": PermChmod,
+	"Rename":  PermRename,
+	"Rmdir":   PermDelete,
+	"Remove":  PermDelete,
+	"Mkdir":   PermMkdir,
+	"Link":    PermSymlink,
+	"Symlink": PermSymlink,
+}
+
+func (h *sftpHandler) Filecmd(r *sftp.Request) (err error) {
+	defer h.recoverRequest(r, &err)
+	// All commands modify the filesystem in some way
+	needed, ok := sftpCmdPermissions[r.Method]
+	if r.Method == "Setstat" {
+		// Changing the size is changing what's in the file, not its mode
+		needed = setstatPermissions(r.AttrFlags())
+	}
+	if !ok || !h.config.perms.Has(needed) {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+
+	if r.Method == "Symlink" {
+		// For symlinks Filepath is the link's target and Target is the link itself
+		link, err := h.newPath(r.Target)
+		if err != nil {
+			return err
+		}
+		return h.symlink(r.Filepath, link)
+	}
+
+	// Everything else works on links themselves, except for setstat
+	resolve := h.linkPath
+	switch r.Method {
+	case "Setstat":
+		resolve = h.realPath
+	case "Mkdir":
+		resolve = h.newPath
+	}
+	p, err := resolve(r.Filepath)
+	if err != nil {
+		return err
+	}
+	switch r.Method {
+	case "Setstat":
+		// Clients set the times and permissions of uploads before they're done with them
+		return h.setstat(h.uploadPath(p), r)
+	case "Rename":
+		target, err := h.newPath(r.Target)
+		if err != nil {
+			return err
+		}
+		// SFTP renames are not supposed to overwrite existing files
+		if _, err := h.fs.Lstat(target); err == nil {
+			return os.ErrExist
+		}
+		return h.fs.Rename(p, target)
+	case "Rmdir", "Remove":
+		size := h.config.removedSize(p)
+		err := h.fs.Remove(p)
+		if err == nil {
+			h.config.reserveSpace(-size)
+		}
+		return err
+	case "Mkdir":
+		return h.fs.Mkdir(p, 0755)
+	case "Link":
+		lfs, ok := h.fs.(LinkFileSystem)
+		if !ok || h.config.NoHardlinks {
+			return sftp.ErrSSHFxOpUnsupported
+		}
+		link, err := h.newPath(r.Target)
+		if err != nil {
+			return err
+		}
+		return lfs.Link(p, link)
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+// Create a symlink, making sure it doesn't point outside of our root.
+// Absolute targets are taken as relative to root, the same way the client sees them.
+func (h *sftpHandler) symlink(target string, link string) error {
+	lfs, ok := h.fs.(LinkFileSystem)
+	if !ok {
+		return sftp.ErrSSHFxOpUnsupported
+	}
+	if path.IsAbs(target) {
+		rel, err := filepath.Rel(filepath.Dir(link), filepath.Join(h.root, filepath.FromSlash(path.Clean(target))))
+		if err != nil {
+			return err
+		}
+		target = rel
+	} else {
+		target = filepath.FromSlash(target)
+	}
+
+	if !isWithinDir(filepath.Join(filepath.Dir(link), target), h.root) {
+		return os.ErrPermission
+	}
+	return lfs.Symlink(target, link)
+}
+
+// posix-rename@openssh.com, which is what clients writing to a temporary file
+// and then moving it over the real one (rsync, editors) count on
+func (h *sftpHandler) PosixRename(r *sftp.Request) (err error) {
+	defer h.recoverRequest(r, &err)
+	if !h.config.perms.Has(PermRename) {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	p, err := h.linkPath(r.Filepath)
+	if err != nil {
+		return err
+	}
+	target, err := h.newPath(r.Target)
+	if err != nil {
+		return err
+	}
+	// Unlike with plain renames whatever's at target is replaced, which takes
+	// it away as much as removing it would
+	overwritten := h.config.removedSize(target)
+	if _, err := h.fs.Lstat(target); err == nil && !h.config.perms.Has(PermDelete) {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	if h.config.existingSize(target) > 0 && h.config.NoTruncate {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	err = h.fs.Rename(p, target)
+	if err == nil {
+		h.config.reserveSpace(-overwritten)
+	}
+	return err
+}
+
+func setstatPermissions(flags sftp.FileAttrFlags) Permission {
+	var needed Permission
+	if flags.Size {
+		needed |= PermWrite
+	}
+	if flags.Permissions || flags.Acmodtime || flags.UidGid {
+		needed |= PermChmod
+	}
+	return needed
+}
+
+func (h *sftpHandler) setstat(p string, r *sftp.Request) error {
+	attrFlags := r.AttrFlags()
+	attrs := r.Attributes()
+
+	afs, ok := h.fs.(AttrFileSystem)
+	if !ok {
+		// Clients set the size of files they've just uploaded, which is fine as long as it doesn't change it
+		if attrFlags.Size {
+			fi, err := h.fs.Stat(p)
+			if err != nil {
+				return err
+			}
+			if fi.Size() != int64(attrs.Size) {
+				return sftp.ErrSSHFxOpUnsupported
+			}
+		}
+		// Clients like to set permissions and times after uploading files,
+		// don't make them fail when we have nowhere to keep them
+		h.config.logger().Debug("Ignoring setstat, not supported by storage backend", "file", p)
+		return nil
+	}
+
+	if attrFlags.Size {
+		if err := h.config.checkFileSize(int64(attrs.Size)); err != nil {
+			return err
+		}
+		growth := int64(attrs.Size) - h.config.existingSize(p)
+		if growth < 0 && h.config.NoTruncate {
+			return sftp.ErrSSHFxPermissionDenied
+		}
+		if err := h.config.reserveSpace(growth); err != nil {
+			return err
+		}
+		if err := afs.Truncate(p, int64(attrs.Size)); err != nil {
+			h.config.reserveSpace(-growth)
+			return err
+		}
+	}
+	if attrFlags.Permissions {
+		if err := afs.Chmod(p, attrs.FileMode().Perm()); err != nil {
+			return err
+		}
+	}
+	if attrFlags.Acmodtime {
+		atime := time.Unix(int64(attrs.Atime), 0)
+		mtime := time.Unix(int64(attrs.Mtime), 0)
+		if err := afs.Chtimes(p, atime, mtime); err != nil {
+			return err
+		}
+	}
+	if attrFlags.UidGid {
+		if err := afs.Chown(p, int(attrs.UID), int(attrs.GID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *sftpHandler) Filelist(r *sftp.Request) (_ sftp.ListerAt, err error) {
+	defer h.recoverRequest(r, &err)
+	resolve := h.realPath
+	if r.Method == "Readlink" {
+		resolve = h.linkPath
+	}
+	p, err := resolve(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	switch r.Method {
+	case "List":
+		// Stat is still allowed for write only users, clients need it to upload files
+		if !h.config.perms.Has(PermList) {
+			return nil, sftp.ErrSSHFxPermissionDenied
+		}
+		files, err := h.fs.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt(h.listSymlinks(r.Filepath, h.config.listedFiles(files))), nil
+	case "Stat":
+		// Handles being uploaded are stat'ed by their path as well
+		fi, err := h.fs.Stat(h.uploadPath(p))
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{fi}, nil
+	case "Readlink":
+		if !h.config.perms.Has(PermList) {
+			return nil, sftp.ErrSSHFxPermissionDenied
+		}
+		lfs, ok := h.fs.(LinkFileSystem)
+		if !ok {
+			return nil, sftp.ErrSSHFxOpUnsupported
+		}
+		target, err := lfs.Readlink(p)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{fileName{target}}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// Show the symlinks in a directory listing the way Config.Symlinks says, which
+// is what clients go by when copying whole directories. They're shown as links
+// unless they should be followed (then it's what they point to, if that's in
+// root) or skipped
+func (h *sftpHandler) listSymlinks(dir string, files []os.FileInfo) []os.FileInfo {
+	if h.config.Symlinks == "" || h.config.Symlinks == symlinksPreserve {
+		return files
+	}
+	var listed []os.FileInfo
+	for _, fi := range files {
+		if fi.Mode()&os.ModeSymlink == 0 {
+			listed = append(listed, fi)
+			continue
+		}
+		if h.config.Symlinks == symlinksSkip {
+			continue
+		}
+		if p, err := h.realPath(path.Join(dir, fi.Name())); err == nil {
+			if target, err := h.fs.Stat(p); err == nil {
+				fi = namedFileInfo{target, fi.Name()}
+			}
+		}
+		listed = append(listed, fi)
+	}
+	return listed
+}
+
+// namedFileInfo is the os.FileInfo of what a symlink points to, with the link's name
+type namedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (f namedFileInfo) Name() string { return f.name }
+
+func (h *sftpHandler) Lstat(r *sftp.Request) (_ sftp.ListerAt, err error) {
+	defer h.recoverRequest(r, &err)
+	p, err := h.linkPath(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := h.fs.Lstat(p)
+	if err != nil {
+		return nil, err
+	}
+	return listerAt{fi}, nil
+}
+
+// listerAt serves a list of files to the request server
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// fileName is a os.FileInfo that only carries a name, used to reply to readlink requests
+type fileName struct {
+	name string
+}
+
+func (f fileName) Name() string       { return f.name }
+func (f fileName) Size() int64        { return 0 }
+func (f fileName) Mode() os.FileMode  { return 0 }
+func (f fileName) ModTime() time.Time { return time.Time{} }
+func (f fileName) IsDir() bool        { return false }
+func (f fileName) Sys() interface{}   { return nil }
@@ -0,0 +1,339 @@
+package simplescp
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+// Logs into the server at addr with an sftp client
+func dialSFTP(t *testing.T, addr string) *sftp.Client {
+	t.Helper()
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "scpuser",
+		Auth:            []ssh.AuthMethod{ssh.Password("hunter2")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sftpClient.Close() })
+	return sftpClient
+}
+
+func TestSFTPSymlinks(t *testing.T) {
+	for policy, expected := range map[string]map[string]os.FileMode{
+		"":               {"dir": os.ModeDir, "link": os.ModeSymlink, "out": os.ModeSymlink},
+		symlinksPreserve: {"dir": os.ModeDir, "link": os.ModeSymlink, "out": os.ModeSymlink},
+		symlinksFollow:   {"dir": os.ModeDir, "link": os.ModeDir, "out": os.ModeSymlink},
+		symlinksSkip:     {"dir": os.ModeDir},
+	} {
+		c := newTestConfig(t)
+		c.Symlinks = policy
+		os.Mkdir(filepath.Join(c.Dir, "dir"), 0755)
+		os.Symlink("dir", filepath.Join(c.Dir, "link"))
+		// Never followed, it's outside of the shared directory
+		os.Symlink(t.TempDir(), filepath.Join(c.Dir, "out"))
+		client := dialSFTP(t, startTestServer(t, c))
+
+		files, err := client.ReadDir("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]os.FileMode)
+		for _, fi := range files {
+			got[fi.Name()] = fi.Mode().Type()
+		}
+		if len(got) != len(expected) {
+			t.Errorf("Listed %v with symlinks %q, expected %v", got, policy, expected)
+		}
+		for name, mode := range expected {
+			if got[name] != mode {
+				t.Errorf("%s listed as %v with symlinks %q, expected %v", name, got[name], policy, mode)
+			}
+		}
+	}
+}
+
+func TestSFTPResume(t *testing.T) {
+	c := newTestConfig(t)
+	c.NoTruncate = true
+	file := filepath.Join(c.Dir, "file.txt")
+	os.WriteFile(file, []byte("hello"), 0644)
+	client := dialSFTP(t, startTestServer(t, c))
+
+	// The way reput goes on with an upload
+	f, err := client.OpenFile("/file.txt", os.O_WRONLY|os.O_APPEND|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte(" world"), 5); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if data, _ := os.ReadFile(file); string(data) != "hello world" {
+		t.Errorf("Resumed upload has %q", data)
+	}
+
+	// And reget with a download
+	f, err = client.Open("/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if n, _ := f.ReadAt(buf, 6); string(buf[:n]) != "world" {
+		t.Errorf("Resumed download got %q", buf[:n])
+	}
+	f.Close()
+
+	if _, err := client.Create("/file.txt"); err == nil {
+		t.Error("File truncated when opening it")
+	}
+	if err := client.Truncate("/file.txt", 2); err == nil {
+		t.Error("File truncated with setstat")
+	}
+	if data, _ := os.ReadFile(file); string(data) != "hello world" {
+		t.Errorf("File has %q after trying to truncate it", data)
+	}
+}
+
+// A user store holding users in memory
+type testUserStore map[string]*User
+
+func (s testUserStore) LookupUser(username string) (*User, error) {
+	if u, ok := s[username]; ok {
+		return u, nil
+	}
+	return nil, ErrNoSuchUser
+}
+
+func (s testUserStore) Close() error { return nil }
+
+func TestSFTPReadOnly(t *testing.T) {
+	readOnly := newTestConfig(t)
+	readOnly.ReadOnly = true
+
+	// Just the one user can only read
+	readUser := newTestConfig(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	readUser.User = "admin"
+	readUser.UserStore = testUserStore{"scpuser": {Name: "scpuser", PasswordHash: string(hash), HomeDir: readUser.Dir, Permissions: PermRead | PermList}}
+
+	for name, c := range map[string]*Config{"read_only": readOnly, "read permission": readUser} {
+		os.WriteFile(filepath.Join(c.Dir, "a.txt"), []byte("hello"), 0644)
+		client := dialSFTP(t, startTestServer(t, c))
+
+		if f, err := client.Open("/a.txt"); err != nil {
+			t.Errorf("%s: Can't read: %v", name, err)
+		} else {
+			f.Close()
+		}
+		if _, err := client.ReadDir("/"); err != nil {
+			t.Errorf("%s: Can't list: %v", name, err)
+		}
+		for op, err := range map[string]error{
+			"create":  func() error { _, err := client.Create("/b.txt"); return err }(),
+			"append":  func() error { _, err := client.OpenFile("/a.txt", os.O_WRONLY|os.O_APPEND); return err }(),
+			"mkdir":   client.Mkdir("/dir"),
+			"remove":  client.Remove("/a.txt"),
+			"rename":  client.Rename("/a.txt", "/c.txt"),
+			"chmod":   client.Chmod("/a.txt", 0600),
+			"symlink": client.Symlink("/a.txt", "/link"),
+		} {
+			if !os.IsPermission(err) {
+				t.Errorf("%s: %s allowed: %v", name, op, err)
+			}
+		}
+		if data, _ := os.ReadFile(filepath.Join(c.Dir, "a.txt")); string(data) != "hello" {
+			t.Errorf("%s: File changed to %q", name, data)
+		}
+	}
+}
+
+func TestSFTPPermissions(t *testing.T) {
+	c := newTestConfig(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	c.User = "admin"
+	// Uploads and listing, but nothing can be taken away
+	c.UserStore = testUserStore{"scpuser": {Name: "scpuser", PasswordHash: string(hash), HomeDir: c.Dir, Permissions: PermWrite | PermList}}
+	os.WriteFile(filepath.Join(c.Dir, "a.txt"), []byte("hello"), 0644)
+	addr := startTestServer(t, c)
+	client := dialSFTP(t, addr)
+
+	if f, err := client.OpenFile("/b.txt", os.O_WRONLY|os.O_CREATE|os.O_TRUNC); err != nil {
+		t.Errorf("Can't upload: %v", err)
+	} else {
+		f.Close()
+	}
+	if files, err := client.ReadDir("/"); err != nil || len(files) != 2 {
+		t.Errorf("Can't list: %v", err)
+	}
+	for op, err := range map[string]error{
+		"download": func() error { _, err := client.Open("/a.txt"); return err }(),
+		"remove":   client.Remove("/a.txt"),
+		"rename":   client.Rename("/a.txt", "/c.txt"),
+		"mkdir":    client.Mkdir("/dir"),
+		"chmod":    client.Chmod("/a.txt", 0600),
+		"symlink":  client.Symlink("/a.txt", "/link"),
+	} {
+		if !os.IsPermission(err) {
+			t.Errorf("%s allowed: %v", op, err)
+		}
+	}
+
+	scp := startTestSCP(t, addr, "scp -r -t .")
+	scp.ack()
+	if err := scp.send("D0755 0 dir\n"); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("Directory created over scp: %v", err)
+	}
+}
+
+func TestSFTPStatVFS(t *testing.T) {
+	c := newTestConfig(t)
+	client := dialSFTP(t, startTestServer(t, c))
+	stat, err := client.StatVFS("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Blocks == 0 || stat.Bavail > stat.Blocks || stat.Flag&statvfsReadOnly != 0 {
+		t.Errorf("Unexpected file system space %+v", stat)
+	}
+
+	c = newTestConfig(t)
+	c.Quota = 1 << 20
+	c.ReadOnly = true
+	os.WriteFile(filepath.Join(c.Dir, "a.txt"), make([]byte, 256<<10), 0644)
+	client = dialSFTP(t, startTestServer(t, c))
+	stat, err = client.StatVFS("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.TotalSpace() != 1<<20 || stat.FreeSpace() != 768<<10 || stat.Flag&statvfsReadOnly == 0 {
+		t.Errorf("Space not relative to the quota: %+v", stat)
+	}
+}
+
+func TestSFTPPosixRename(t *testing.T) {
+	c := newTestConfig(t)
+	os.WriteFile(filepath.Join(c.Dir, "a.txt"), []byte("old"), 0644)
+	os.WriteFile(filepath.Join(c.Dir, "a.txt.tmp"), []byte("new"), 0644)
+	client := dialSFTP(t, startTestServer(t, c))
+
+	if err := client.Rename("/a.txt.tmp", "/a.txt"); err == nil {
+		t.Error("Plain rename overwrote a file")
+	}
+	if err := client.PosixRename("/a.txt.tmp", "/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(c.Dir, "a.txt")); err != nil || string(data) != "new" {
+		t.Errorf("File not replaced: %q, %v", data, err)
+	}
+
+	c = newTestConfig(t)
+	c.NoTruncate = true
+	os.WriteFile(filepath.Join(c.Dir, "a.txt"), []byte("old"), 0644)
+	os.WriteFile(filepath.Join(c.Dir, "b.txt"), []byte("new"), 0644)
+	client = dialSFTP(t, startTestServer(t, c))
+	if err := client.PosixRename("/b.txt", "/a.txt"); !os.IsPermission(err) {
+		t.Errorf("File replaced with no_truncate: %v", err)
+	}
+	if err := client.PosixRename("/b.txt", "/c.txt"); err != nil {
+		t.Errorf("Can't rename with no_truncate: %v", err)
+	}
+}
+
+func TestSFTPFsync(t *testing.T) {
+	c := newTestConfig(t)
+	client := dialSFTP(t, startTestServer(t, c))
+	if _, ok := client.HasExtension("fsync@openssh.com"); !ok {
+		t.Error("fsync not announced")
+	}
+
+	f, err := client.OpenFile("/a.txt", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(strings.Repeat("hello", 100000))); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Errorf("Can't sync: %v", err)
+	}
+	// Synced after everything else, and the session goes on as usual
+	if fi, err := os.Stat(filepath.Join(c.Dir, "a.txt")); err != nil || fi.Size() != 500000 {
+		t.Errorf("Not all written before syncing: %v", err)
+	}
+	f.Close()
+	if err := f.Sync(); err == nil {
+		t.Error("Synced a closed file")
+	}
+	if fi, err := client.Stat("/a.txt"); err != nil || fi.Size() != 500000 {
+		t.Errorf("Unexpected file %v, %v", fi, err)
+	}
+
+	c = newTestConfig(t)
+	c.FileSystem = NewAferoFS(afero.NewMemMapFs())
+	c.FileSystem.MkdirAll(c.Dir, 0755)
+	client = dialSFTP(t, startTestServer(t, c))
+	f, err = client.Create("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Sync(); err == nil {
+		t.Error("Synced a file that isn't on the local file system")
+	}
+}
+
+func TestSFTPHardlinks(t *testing.T) {
+	c := newTestConfig(t)
+	c.Quota = 1 << 20
+	os.WriteFile(filepath.Join(c.Dir, "a.txt"), make([]byte, 512<<10), 0644)
+	client := dialSFTP(t, startTestServer(t, c))
+
+	if err := client.Link("/a.txt", "/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	a, _ := os.Stat(filepath.Join(c.Dir, "a.txt"))
+	if b, err := os.Stat(filepath.Join(c.Dir, "b.txt")); err != nil || !os.SameFile(a, b) {
+		t.Errorf("Not linked: %v", err)
+	}
+	// Counted once, and still there after one of the links is removed
+	upload := func(name string, size int) error {
+		f, err := client.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = f.Write(make([]byte, size))
+		return err
+	}
+	if err := upload("/c.txt", 400<<10); err != nil {
+		t.Errorf("Linked file counted twice: %v", err)
+	}
+	if err := client.Remove("/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := upload("/d.txt", 200<<10); err == nil {
+		t.Error("Space given back for a file that's still linked")
+	}
+
+	c = newTestConfig(t)
+	c.NoHardlinks = true
+	os.WriteFile(filepath.Join(c.Dir, "a.txt"), []byte("hello"), 0644)
+	client = dialSFTP(t, startTestServer(t, c))
+	if err := client.Link("/a.txt", "/b.txt"); err == nil {
+		t.Error("Hard link made with no_hardlinks")
+	}
+}
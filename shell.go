@@ -0,0 +1,302 @@
+package simplescp
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flynn/go-shlex"
+	"golang.org/x/crypto/ssh"
+)
+
+// WinSCP's SCP mode doesn't exec scp, it opens a shell and types in a few
+// commands: pwd, cd, ls, echo (to mark the end of each command's output, e.g.
+// `ls -la ; echo "WinSCP: this is end-of-file:$?"`) and scp itself. This is just
+// enough of a shell to answer those, with the shared directory as /
+
+// shellChannel is the channel a shell's commands run on. The exit status scp
+// sends and its closing the channel are the shell's to deal with, and what the
+// shell already read ahead is still there for scp
+type shellChannel struct {
+	ssh.Channel
+	r      *bufio.Reader
+	status uint8
+}
+
+func (s *shellChannel) Read(p []byte) (int, error) {
+	return s.r.Read(p)
+}
+
+func (s *shellChannel) Close() error {
+	return nil
+}
+
+func (s *shellChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	if name == "exit-status" && len(payload) == 4 {
+		s.status = uint8(binary.BigEndian.Uint32(payload))
+		return true, nil
+	}
+	return s.Channel.SendRequest(name, wantReply, payload)
+}
+
+type shell struct {
+	ctx     context.Context // Of the channel, for the scp commands run
+	config  Config
+	channel *shellChannel
+	cwd     string // As the client sees it
+	status  uint8  // Of the last command, for $?
+}
+
+// Read commands from the client until it's done with the shell (or types exit)
+func (c Config) runShell(ctx context.Context, channel ssh.Channel) {
+	sh := &shell{ctx: ctx, config: c, channel: &shellChannel{Channel: channel, r: bufio.NewReader(channel)}, cwd: "/"}
+	defer func() {
+		if r := recover(); r != nil {
+			c.logPanic("shell", r)
+			closeChannel(channel, 1)
+		}
+	}()
+	c.logger().Debug("Started shell")
+	for {
+		line, err := sh.channel.r.ReadString('\n')
+		for _, cmd := range splitCommands(strings.TrimRight(line, "\r\n")) {
+			if !sh.run(cmd) {
+				closeChannel(channel, sh.status)
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				c.logger().Error("Error reading shell commands", "err", err)
+			}
+			break
+		}
+	}
+	closeChannel(channel, sh.status)
+}
+
+// Split a command line at the semicolons that aren't quoted
+func splitCommands(line string) []string {
+	var cmds []string
+	var quote rune
+	escaped := false
+	start := 0
+	for i, r := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == ';':
+			cmds = append(cmds, line[start:i])
+			start = i + 1
+		}
+	}
+	return append(cmds, line[start:])
+}
+
+// Run a single command, returns false if it was exit
+func (sh *shell) run(cmd string) bool {
+	// $? is the only variable there is, the rest are empty
+	cmd = os.Expand(cmd, func(name string) string {
+		if name == "?" {
+			return strconv.Itoa(int(sh.status))
+		}
+		return ""
+	})
+	args, err := shlex.Split(cmd)
+	if err != nil {
+		fmt.Fprintf(sh.channel.Stderr(), "sh: %v\n", err)
+		sh.status = 2
+		return true
+	}
+	if len(args) == 0 {
+		return true
+	}
+	sh.config.logger().Debug("Shell command", "args", args)
+
+	switch args[0] {
+	case "exit":
+		if len(args) > 1 {
+			status, _ := strconv.Atoi(args[1])
+			sh.status = uint8(status)
+		}
+		return false
+	case "echo":
+		fmt.Fprintln(sh.channel, strings.Join(args[1:], " "))
+		sh.status = 0
+	case "pwd":
+		fmt.Fprintln(sh.channel, sh.cwd)
+		sh.status = 0
+	case "cd":
+		sh.status = sh.cd(args[1:])
+	case "ls":
+		sh.status = sh.ls(args[1:])
+	case "groups":
+		fmt.Fprintln(sh.channel, sh.config.username)
+		sh.status = 0
+	case "unset", "unalias", "alias", "export", "true", ":":
+		// There's nothing to set up
+		sh.status = 0
+	case "scp":
+		opts := parseSCPArgs(args[1:])
+		for i, name := range opts.fileNames {
+			// scp's paths are relative to the shared directory
+			opts.fileNames[i] = strings.TrimPrefix(sh.path(name), "/")
+			if len(opts.fileNames[i]) == 0 {
+				opts.fileNames[i] = "."
+			}
+		}
+		sh.channel.status = 0
+		sh.config.runSCP(sh.ctx, sh.channel, opts)
+		sh.status = sh.channel.status
+	default:
+		fmt.Fprintf(sh.channel.Stderr(), "sh: %s: command not supported\n", args[0])
+		sh.status = 127
+	}
+	return true
+}
+
+// p as the client sees it, relative to the current directory
+func (sh *shell) path(p string) string {
+	if path.IsAbs(p) {
+		return path.Clean(p)
+	}
+	return path.Join(sh.cwd, p)
+}
+
+func (sh *shell) cd(args []string) uint8 {
+	name := "/"
+	if len(args) > 0 {
+		name = args[0]
+	}
+	dir := sh.path(name)
+	fi, err := (jailedFS{sh.config.fileSystem(), sh.config}).Stat(dir)
+	if err != nil {
+		fmt.Fprintf(sh.channel.Stderr(), "cd: %s: No such file or directory\n", name)
+		return 1
+	}
+	if !fi.IsDir() {
+		fmt.Fprintf(sh.channel.Stderr(), "cd: %s: Not a directory\n", name)
+		return 1
+	}
+	sh.cwd = dir
+	return 0
+}
+
+// ls -l, which is the only way WinSCP asks, with -a, -d and --full-time
+func (sh *shell) ls(args []string) uint8 {
+	var all, dirOnly, fullTime bool
+	var targets []string
+	for _, arg := range args {
+		switch {
+		case arg == "--full-time":
+			fullTime = true
+		case strings.HasPrefix(arg, "--"):
+			// Nothing else changes what we list
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			all = all || strings.ContainsAny(arg, "aA")
+			dirOnly = dirOnly || strings.Contains(arg, "d")
+		default:
+			targets = append(targets, arg)
+		}
+	}
+	if len(targets) == 0 {
+		targets = []string{"."}
+	}
+
+	fsys := jailedFS{sh.config.fileSystem(), sh.config}
+	var status uint8
+	for _, target := range targets {
+		// Like with sftp, write only users can't see what's there, not even
+		// whether a file exists
+		if !sh.config.perms.Has(PermList) {
+			fmt.Fprintf(sh.channel.Stderr(), "ls: cannot access '%s': Permission denied\n", target)
+			status = 2
+			continue
+		}
+		p := sh.path(target)
+		fi, err := fsys.Lstat(p)
+		if err == nil && fi.IsDir() && !dirOnly {
+			err = sh.listDir(fsys, p, all, fullTime)
+		} else if err == nil {
+			sh.listFile(p, target, fi, fullTime)
+		}
+		if err != nil {
+			fmt.Fprintf(sh.channel.Stderr(), "ls: cannot access '%s': No such file or directory\n", target)
+			status = 2
+		}
+	}
+	return status
+}
+
+func (sh *shell) listDir(fsys jailedFS, dir string, all, fullTime bool) error {
+	files, err := fsys.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(sh.channel, "total %d\n", len(files))
+	if all {
+		for _, name := range []string{".", ".."} {
+			if fi, err := fsys.Stat(path.Join(dir, name)); err == nil {
+				sh.listFile(path.Join(dir, name), name, fi, fullTime)
+			}
+		}
+	}
+	for _, fi := range files {
+		if !all && strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		sh.listFile(path.Join(dir, fi.Name()), fi.Name(), fi, fullTime)
+	}
+	return nil
+}
+
+// Print a line like ls -l does for the file at p, shown as name
+func (sh *shell) listFile(p, name string, fi os.FileInfo, fullTime bool) {
+	mode := fi.Mode()
+	kind := "-"
+	switch {
+	case mode.IsDir():
+		kind = "d"
+	case mode&os.ModeSymlink != 0:
+		kind = "l"
+		if lfs, ok := sh.config.fileSystem().(LinkFileSystem); ok {
+			if real, err := sh.config.resolveLinkPath(p); err == nil {
+				if target, err := lfs.Readlink(real); err == nil {
+					name += " -> " + target
+				}
+			}
+		}
+	case mode&os.ModeNamedPipe != 0:
+		kind = "p"
+	case mode&os.ModeSocket != 0:
+		kind = "s"
+	}
+
+	mtime := fi.ModTime()
+	var when string
+	switch {
+	case fullTime:
+		when = mtime.Format("2006-01-02 15:04:05.000000000 -0700")
+	case time.Since(mtime) < 180*24*time.Hour && time.Until(mtime) < time.Hour:
+		when = mtime.Format("Jan _2 15:04")
+	default:
+		when = mtime.Format("Jan _2  2006")
+	}
+	user := sh.config.username
+	fmt.Fprintf(sh.channel, "%s%s 1 %s %s %d %s %s\n", kind, mode.Perm().String()[1:], user, user, fi.Size(), when, name)
+}
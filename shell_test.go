@@ -0,0 +1,141 @@
+package simplescp
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Opens a shell on the server at addr, the way WinSCP does
+func startTestShell(t *testing.T, addr string) *testSCP {
+	t.Helper()
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "scpuser",
+		Auth:            []ssh.AuthMethod{ssh.Password("hunter2")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, _ := session.StdinPipe()
+	stdout, _ := session.StdoutPipe()
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	return &testSCP{stdin: stdin, stdout: bufio.NewReader(stdout), session: session}
+}
+
+// Runs cmd like WinSCP does and returns its output, up to the end marker
+func (s *testSCP) command(t *testing.T, cmd string) string {
+	t.Helper()
+	io.WriteString(s.stdin, cmd+` ; echo "END:$?"`+"\n")
+	var output strings.Builder
+	for {
+		line, err := s.stdout.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Running %s: %v", cmd, err)
+		}
+		if strings.HasPrefix(line, "END:") {
+			return output.String() + strings.TrimSpace(line)
+		}
+		output.WriteString(line)
+	}
+}
+
+func TestWinSCPShell(t *testing.T) {
+	c := newTestConfig(t)
+	c.WinSCPShell = true
+	os.Mkdir(filepath.Join(c.Dir, "dir"), 0755)
+	os.WriteFile(filepath.Join(c.Dir, "dir", "a.txt"), []byte("hello"), 0644)
+	addr := startTestServer(t, c)
+
+	sh := startTestShell(t, addr)
+	if out := sh.command(t, "pwd"); out != "/\nEND:0" {
+		t.Errorf("pwd said %q", out)
+	}
+	if out := sh.command(t, "cd missing"); out != "END:1" {
+		t.Errorf("cd to a missing directory said %q", out)
+	}
+	if out := sh.command(t, `cd "dir" ; pwd`); out != "/dir\nEND:0" {
+		t.Errorf("cd said %q", out)
+	}
+	out := sh.command(t, "ls -la --full-time")
+	lines := strings.Split(out, "\n")
+	if len(lines) != 5 || lines[0] != "total 1" || !strings.HasPrefix(lines[1], "drwxr-xr-x 1 scpuser scpuser") ||
+		!strings.HasPrefix(lines[3], "-rw-r--r-- 1 scpuser scpuser 5 ") || !strings.HasSuffix(lines[3], " a.txt") {
+		t.Errorf("ls said %q", out)
+	}
+	if out := sh.command(t, "rm a.txt"); out != "END:127" {
+		t.Errorf("Unsupported command said %q", out)
+	}
+
+	// scp runs in the shell, and it's still there afterwards
+	io.WriteString(sh.stdin, `scp -r -d -t "/dir/sub/" ; echo "END:$?"`+"\n")
+	for _, step := range []func() error{
+		sh.ack,
+		func() error { return sh.sendFile("b.txt", "world") },
+		func() error { return sh.send("E\n") },
+	} {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if line, _ := sh.stdout.ReadString('\n'); line != "END:0\n" {
+		t.Errorf("scp ended with %q", line)
+	}
+	if data, err := os.ReadFile(filepath.Join(c.Dir, "dir", "sub", "b.txt")); err != nil || string(data) != "world" {
+		t.Errorf("File not uploaded: %q, %v", data, err)
+	}
+	io.WriteString(sh.stdin, `scp -f sub/b.txt`+"\n")
+	sh.stdin.Write([]byte{0})
+	if msg, _ := sh.stdout.ReadString('\n'); msg != "C0644 5 b.txt\n" {
+		t.Errorf("Unexpected C message %q for a path relative to the current directory", msg)
+	}
+}
+
+func TestShellDisabled(t *testing.T) {
+	addr := startTestServer(t, newTestConfig(t))
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "scpuser",
+		Auth:            []ssh.AuthMethod{ssh.Password("hunter2")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Shell(); err == nil {
+		t.Error("Shell opened without winscp_shell")
+	}
+}
+
+func TestShellListPermission(t *testing.T) {
+	c := newTestConfig(t)
+	c.WinSCPShell = true
+	c.WriteOnly = true
+	os.WriteFile(filepath.Join(c.Dir, "a.txt"), []byte("hello"), 0644)
+	os.Mkdir(filepath.Join(c.Dir, "dir"), 0755)
+	addr := startTestServer(t, c)
+
+	// Not even whether a file's there, or what a directory is like
+	sh := startTestShell(t, addr)
+	for _, cmd := range []string{"ls -la a.txt", "ls -la missing.txt", "ls -ld dir", "ls -la"} {
+		if out := sh.command(t, cmd); out != "END:2" {
+			t.Errorf("%s said %q without the list permission", cmd, out)
+		}
+	}
+}
@@ -1,14 +1,19 @@
-package main
+package simplescp
 
 import (
-	"io"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net"
 	"os"
 	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/FranGM/simplelog"
 	"github.com/flynn/go-shlex"
-	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -21,30 +26,162 @@ type scpOptions struct {
 	fileNames    []string
 }
 
-type scpConfig struct {
-	User           string
-	passwords      map[string]string
-	Dir            string
-	privateKey     ssh.Signer
-	PrivateKeyFile string
-	Port           string
-	AuthKeys       map[string][]ssh.PublicKey
-	AuthKeysFile   string
-	OneShot        bool // Serve just one connection, then quit (useful for tests)
+// Config holds the settings for a simplescp server. Exported fields can be
+// populated from a config file and SIMPLESCP_* environment variables (see LoadConfig).
+type Config struct {
+	User                  string                     `yaml:"user" toml:"user"`
+	Password              string                     `yaml:"password" toml:"password" envconfig:"PASS"`
+	TOTPSecret            string                     `yaml:"totp_secret" toml:"totp_secret"` // Base32 secret for a second factor, from an authenticator app
+	Dir                   string                     `yaml:"dir" toml:"dir"`
+	PrivateKeyFile        string                     `yaml:"private_key_file" toml:"private_key_file"`
+	HostKeyType           string                     `yaml:"host_key_type" toml:"host_key_type"`             // Type of the key generated when PrivateKeyFile doesn't exist: ed25519 (the default), ecdsa or rsa
+	HostKeyPassphrase     string                     `yaml:"host_key_passphrase" toml:"host_key_passphrase"` // For encrypted host keys. Asked for on the terminal if neither this nor the file are set
+	HostKeyPassphraseFile string                     `yaml:"host_key_passphrase_file" toml:"host_key_passphrase_file"`
+	HostKeyAgent          bool                       `yaml:"host_key_agent" toml:"host_key_agent"`           // Also use the keys in the ssh-agent at SSH_AUTH_SOCK as host keys
+	HostKeyAgentKeys      []string                   `yaml:"host_key_agent_keys" toml:"host_key_agent_keys"` // SHA256 fingerprints of the agent keys to use. Default: All of them
+	HostKeyFiles          []string                   `yaml:"host_key_files" toml:"host_key_files"`           // More host keys. Only the first one of each type is used, the rest are just advertised to clients
+	Port                  string                     `yaml:"port" toml:"port"`
+	Listen                []string                   `yaml:"listen" toml:"listen"`           // Addresses to listen on, e.g. 127.0.0.1:22 or [::1]. The ones without a port use Port. Default: 0.0.0.0
+	ReusePort             int                        `yaml:"reuse_port" toml:"reuse_port"`   // Open this many sockets with SO_REUSEPORT on each address, each with its own accept loop
+	PAMService            string                     `yaml:"pam_service" toml:"pam_service"` // Also check passwords against this PAM service (needs -tags pam)
+	LDAP                  LDAPConfig                 `yaml:"ldap" toml:"ldap"`               // Also check passwords against an LDAP directory, if its URL is set
+	RADIUS                RADIUSConfig               `yaml:"radius" toml:"radius"`           // Also check passwords against RADIUS servers, if there are any
+	Anonymous             AnonymousConfig            `yaml:"anonymous" toml:"anonymous"`     // Let clients in without credentials, into a sandbox
+	JWT                   JWTConfig                  `yaml:"jwt" toml:"jwt"`                 // Accept signed JWTs as passwords, if there's a JWKS URL
+	BannerFile            string                     `yaml:"banner_file" toml:"banner_file"` // Shown to clients before they log in, e.g. a legal notice
+	AuthKeys              map[string][]ssh.PublicKey `yaml:"-" toml:"-" ignored:"true"`
+	AuthKeysFile          string                     `yaml:"authorized_keys_file" toml:"authorized_keys_file"`
+	AuthKeysCommand       string                     `yaml:"authorized_keys_command" toml:"authorized_keys_command"` // Prints more authorized keys for the user, e.g. "/usr/local/bin/keys %u"
+	TrustedUserCAKeys     string                     `yaml:"trusted_user_ca_keys" toml:"trusted_user_ca_keys"`       // CAs whose user certificates are accepted
+	RevokedKeysFile       string                     `yaml:"revoked_keys_file" toml:"revoked_keys_file"`             // Keys and certificates that are never accepted
+	KeyExchanges          []string                   `yaml:"key_exchanges" toml:"key_exchanges"`                     // Key exchange algorithms to allow, in order of preference. Default: golang.org/x/crypto/ssh's
+	Ciphers               []string                   `yaml:"ciphers" toml:"ciphers"`                                 // Same for ciphers
+	MACs                  []string                   `yaml:"macs" toml:"macs"`                                       // Same for MACs
+	AllowCIDRs            []string                   `yaml:"allow_cidrs" toml:"allow_cidrs"`                         // Only accept connections from these ranges, e.g. 10.8.0.0/16
+	DenyCIDRs             []string                   `yaml:"deny_cidrs" toml:"deny_cidrs"`                           // Never accept connections from these ranges
+	GeoIP                 GeoIPConfig                `yaml:"geoip" toml:"geoip"`                                     // Filter connections by country, if there's a database
+	ProxyProtocol         bool                       `yaml:"proxy_protocol" toml:"proxy_protocol"`                   // Take client addresses from the PROXY protocol header load balancers send
+	ProxyProtocolFrom     []string                   `yaml:"proxy_protocol_from" toml:"proxy_protocol_from"`         // Load balancers that send it, other connections are taken as they are. Required with proxy_protocol
+	AuthRateLimit         float64                    `yaml:"auth_rate_limit" toml:"auth_rate_limit"`                 // Authentication attempts each client IP can make per minute
+	AuthRateBurst         int                        `yaml:"auth_rate_burst" toml:"auth_rate_burst"`                 // How many of them can be made at once. Default: 10
+	BanThreshold          int                        `yaml:"ban_threshold" toml:"ban_threshold"`                     // Consecutive failed logins before a client IP or username gets banned
+	BanDuration           time.Duration              `yaml:"ban_duration" toml:"ban_duration"`                       // How long the first ban lasts, each one after that lasts twice as long. Default: 10m
+	BanMaxDuration        time.Duration              `yaml:"ban_max_duration" toml:"ban_max_duration"`               // Longest a ban can last. Default: 24h
+	MaxConnections        int                        `yaml:"max_connections" toml:"max_connections"`                 // Connections served at once
+	MaxConnectionsPerIP   int                        `yaml:"max_connections_per_ip" toml:"max_connections_per_ip"`   // Connections served at once for each client IP
+	MaxSessionsPerUser    int                        `yaml:"max_sessions_per_user" toml:"max_sessions_per_user"`     // scp and sftp sessions open at once for each user
+	IdleTimeout           time.Duration              `yaml:"idle_timeout" toml:"idle_timeout"`                       // Close sessions without any scp or sftp activity for this long
+	MaxRate               ByteSize                   `yaml:"max_rate" toml:"max_rate"`                               // Bandwidth limit for each session, in bytes per second
+	MaxFileSize           ByteSize                   `yaml:"max_file_size" toml:"max_file_size"`                     // Biggest file that can be uploaded
+	Quota                 ByteSize                   `yaml:"quota" toml:"quota"`                                     // How much disk space each user can use
+	Backend               string                     `yaml:"backend" toml:"backend"`                                 // Where files are stored: os (the default), s3, gcs, azure or mem
+	S3                    S3Config                   `yaml:"s3" toml:"s3"`
+	GCS                   GCSConfig                  `yaml:"gcs" toml:"gcs"`
+	Azure                 AzureConfig                `yaml:"azure" toml:"azure"`
+	EncryptionKeyFile     string                     `yaml:"encryption_key_file" toml:"encryption_key_file"` // Encrypt files with the key in here before storing them
+	FileSystem            FileSystem                 `yaml:"-" toml:"-" ignored:"true"`                      // Where files are stored. Built out of Backend if not set
+	OutsideSymlinks       string                     `yaml:"outside_symlinks" toml:"outside_symlinks"`       // Symlinks pointing outside of Dir: deny (the default) refuses them, resolve-within-root takes them as if Dir was /
+	Symlinks              string                     `yaml:"symlinks" toml:"symlinks"`                       // Symlinks in directories being copied: follow, skip or preserve (for sftp, scp can't send them). Default: follow with scp, preserve with sftp
+	NoHardlinks           bool                       `yaml:"no_hardlinks" toml:"no_hardlinks"`               // Don't let sftp clients (or rsync) create hard links
+	AtomicUploads         bool                       `yaml:"atomic_uploads" toml:"atomic_uploads"`           // Write uploads to a hidden file next to them, renamed into place once they're complete
+	PartialUploads        string                     `yaml:"partial_uploads" toml:"partial_uploads"`         // What's done with uploads that didn't finish: keep, delete or move (to .partial). Default: delete with atomic uploads, keep otherwise
+	NoTruncate            bool                       `yaml:"no_truncate" toml:"no_truncate"`                 // Don't let sftp clients truncate existing files, so interrupted uploads can only be resumed
+	FileNames             FileNamesConfig            `yaml:"file_names" toml:"file_names"`                   // Rules for the names of new files, like leaving control characters out
+	DenyFiles             []string                   `yaml:"deny_files" toml:"deny_files"`                   // Files that can't be uploaded and are hidden from clients, globs like "*.exe" or regular expressions after "regexp:"
+	HideDotFiles          bool                       `yaml:"hide_dot_files" toml:"hide_dot_files"`           // Leave files starting with a dot out of listings
+	HideFiles             []string                   `yaml:"hide_files" toml:"hide_files"`                   // More files to leave out of listings, with the same patterns as DenyFiles
+	Admin                 AdminConfig                `yaml:"admin" toml:"admin"`                             // HTTP API to manage sessions and bans through
+	Dashboard             DashboardConfig            `yaml:"dashboard" toml:"dashboard"`                     // Web page showing sessions, transfers, quotas and failed logins
+	SFTP                  SFTPConfig                 `yaml:"sftp" toml:"sftp"`                               // Tuning for the sftp server
+	Scan                  ScanConfig                 `yaml:"scan" toml:"scan"`                               // Scan uploads for viruses before they're let in
+	UserDB                string                     `yaml:"user_db" toml:"user_db"`
+	ReadOnly              bool                       `yaml:"read_only" toml:"read_only"`   // Don't allow any user to upload or modify files
+	WriteOnly             bool                       `yaml:"write_only" toml:"write_only"` // Don't allow any user to download or list files
+	UserStore             UserStore                  `yaml:"-" toml:"-" ignored:"true"`    // Looked up for users other than User. Opened from UserDB if not set
+	LogLevel              string                     `yaml:"log_level" toml:"log_level"`
+	LogFormat             string                     `yaml:"log_format" toml:"log_format"`
+	Logger                *slog.Logger               `yaml:"-" toml:"-" ignored:"true"`                      // Built out of LogLevel and LogFormat if not set
+	OnListen              func(addr net.Addr)        `yaml:"-" toml:"-" ignored:"true"`                      // Called with each address the server starts listening on, e.g. to find out the port with port 0
+	WinSCPShell           bool                       `yaml:"winscp_shell" toml:"winscp_shell"`               // Answer the few shell commands WinSCP's SCP mode needs (pwd, cd, ls, echo and scp) in shell sessions
+	Rsync                 string                     `yaml:"rsync" toml:"rsync"`                             // rsync binary to serve `rsync --server` requests with, e.g. /usr/bin/rsync. Default: rsync isn't allowed
+	TransferLog           string                     `yaml:"transfer_log" toml:"transfer_log"`               // File recording every upload and download
+	TransferLogFormat     string                     `yaml:"transfer_log_format" toml:"transfer_log_format"` // xferlog or csv
+	RecordDir             string                     `yaml:"record_dir" toml:"record_dir"`                   // Directory each scp and sftp session is recorded to, to be replayed with -replay
+	RecordContents        bool                       `yaml:"record_contents" toml:"record_contents"`         // Record what's read from and written to files too, not just the requests
+	Checksum              string                     `yaml:"checksum" toml:"checksum"`                       // Algorithm transfers are checksummed with for the transfer log and webhooks: md5, sha1, sha256 (the default), sha512 or none
+	Webhooks              []Webhook                  `yaml:"webhooks" toml:"webhooks" ignored:"true"`        // Notified of transfers, failed logins and finished sessions
+	UploadCommand         string                     `yaml:"upload_command" toml:"upload_command"`           // Run after every successful upload, e.g. "/usr/local/bin/process %f %u"
+	UploadCommandTimeout  time.Duration              `yaml:"upload_command_timeout" toml:"upload_command_timeout"`
+	UploadCommandEnv      []string                   `yaml:"upload_command_env" toml:"upload_command_env"`   // Extra KEY=VALUE environment variables for UploadCommand
+	OneShot               bool                       `yaml:"one_shot" toml:"one_shot"`                       // Serve just one connection, then quit. Tests are better off with the simplescptest package
+	LoginGraceTime        time.Duration              `yaml:"login_grace_time" toml:"login_grace_time"`       // How long clients have to log in before they're dropped, 0 for no limit
+	MaxConnectionTime     time.Duration              `yaml:"max_connection_time" toml:"max_connection_time"` // Close connections that have been open for this long, 0 for no limit
+	TCPKeepAlive          time.Duration              `yaml:"tcp_keepalive" toml:"tcp_keepalive"`             // How often to check the client of an idle connection is still there. 0 for Go's default (15s), negative to not check
+	ShutdownGrace         time.Duration              `yaml:"shutdown_grace" toml:"shutdown_grace"`           // How long to wait for active sessions when shutting down
+
+	passwords     map[string]string
+	hostKeys      []ssh.Signer // Loaded from PrivateKeyFile and HostKeyFiles
+	extraHostKeys []ssh.Signer // More keys of the same types as hostKeys, only advertised to clients
+	banner        string       // Read from BannerFile
+	userCAKeys    []ssh.PublicKey
+	revokedKeys   *revokedKeys
+	ipFilter      *ipFilter     // Built out of AllowCIDRs and DenyCIDRs
+	denyFiles     *fileFilter   // Built out of DenyFiles
+	hideFiles     *fileFilter   // Built out of HideFiles
+	proxyFrom     *ipFilter     // Built out of ProxyProtocolFrom
+	geoIP         *geoIPDB      // Opened from GeoIP.Database, shared by all connections
+	jwks          *jwksCache    // Keys tokens are checked with, fetched from JWT.JWKSURL
+	log           *slog.Logger  // Logger with the details of the current session
+	perms         Permission    // What the user of the current session is allowed to do
+	quotaLimit    ByteSize      // How much space the user of the current session can use
+	idleTimeout   time.Duration // How long the current session can go without any activity
+	usage         *usageTracker // Disk usage for each user, shared by all sessions
+	authLimiter   *authLimiter  // Authentication attempts for each client IP, shared by all sessions
+	bans          *banList      // Client IPs and usernames banned after failed logins, shared by all sessions
+	authFailures  *failureTrend // Failed logins over the last hour, shared by all sessions
+	conns         *connCounter  // Open connections and sessions, shared by all sessions
+	transferLog   *transferLog  // Opened from TransferLog, shared by all sessions
+	sessions      *sessionList  // Logged in sessions, shared by all sessions
+	session       *liveSession  // The current session, in sessions
+	sessionID     string        // Identifies the current session in logs and webhook events
+	username      string        // User of the current session
+	remoteHost    string        // Address the current session comes from
+
+	// Randomly generated credentials, kept so they survive a reload
+	generatedPassword string
+	generatedKey      ssh.Signer
+	// Same for the host key passphrase, if it was typed in
+	promptedPassphrase []byte
 }
 
-func newScpConfig() *scpConfig {
-	osuser, _ := user.Current()
+// NewConfig returns a Config populated with the default settings
+func NewConfig() *Config {
+	username := "scpuser"
+	if osuser, err := user.Current(); err == nil {
+		// Windows usernames come with the domain or computer name, like HOST\alice
+		username = osuser.Username[strings.LastIndex(osuser.Username, `\`)+1:]
+	}
 	userHome, _ := os.UserHomeDir()
 
-	privateKeyFile := userHome + "/.ssh/id_rsa"
-	authKeysFile := userHome + "/.ssh/authorized_keys"
-	return &scpConfig{
-		Port:           "8222",
-		User:           osuser.Username,
-		Dir:            "/",
-		PrivateKeyFile: privateKeyFile,
-		AuthKeysFile:   authKeysFile,
+	// Older versions used the user's own key as the host key. Keep doing that
+	// if it's there, so clients don't see the server's identity change
+	privateKeyFile := filepath.Join(userHome, ".ssh", "id_rsa")
+	if _, err := os.Stat(privateKeyFile); err != nil {
+		privateKeyFile = filepath.Join(userHome, ".simplescp", "host_key")
+	}
+	authKeysFile := filepath.Join(userHome, ".ssh", "authorized_keys")
+	return &Config{
+		Port:                 "8222",
+		User:                 username,
+		Dir:                  "/",
+		PrivateKeyFile:       privateKeyFile,
+		AuthKeysFile:         authKeysFile,
+		LoginGraceTime:       2 * time.Minute,
+		ShutdownGrace:        30 * time.Second,
+		UploadCommandTimeout: time.Minute,
+		LogLevel:             "info",
+		LogFormat:            "text",
+		Anonymous:            AnonymousConfig{Quota: defaultAnonymousQuota},
 	}
 }
 
@@ -55,38 +192,44 @@ func sendExitStatusCode(channel ssh.Channel, status uint8) {
 	_, err := channel.SendRequest("exit-status", false, exitStatusBuffer)
 	if err != nil {
 		// TODO: Don't we prefer to return the error here?
-		simplelog.Error.Printf("Failed to forward exit-status to client: %v", err)
+		slog.Error("Failed to forward exit-status to client", "err", err)
 	}
 }
 
-func handleSFTP(channel ssh.Channel) {
-
-	server, err := sftp.NewServer(channel)
+// Handle requests received through a channel
+func (config Config) handleRequest(ctx context.Context, channel ssh.Channel, req *ssh.Request) {
+	defer func() {
+		if r := recover(); r != nil {
+			config.logPanic("exec request", r)
+			fmt.Fprintln(channel.Stderr(), "Internal server error")
+			closeChannel(channel, 1)
+		}
+	}()
+	ok := true
+	command, err := payloadString(req.Payload)
 	if err != nil {
-		simplelog.Debug.Printf("Failed to start SFTP server: %v", err)
+		config.logger().Warn("Invalid exec request", "err", err)
+		req.Reply(false, nil)
+		channel.Close()
 		return
 	}
-	defer server.Close()
-
-	if err := server.Serve(); err == nil || err == io.EOF {
-		simplelog.Debug.Printf("SFTP server exited cleanly")
-		sendExitStatusCode(channel, 0)
-	} else {
-		simplelog.Debug.Printf("SFTP server exited with error: %v", err)
-		sendExitStatusCode(channel, 1)
+	config.logger().Debug("Payload before splitting", "payload", command)
+	s, err := shlex.Split(command)
+	if err != nil || len(s) == 0 {
+		config.logger().Info("Can't run command", "command", command, "err", err)
+		req.Reply(false, []byte("Invalid command"))
+		channel.Write([]byte("Invalid command\n"))
+		channel.Close()
+		return
 	}
 
-	channel.Close()
-}
-
-// Handle requests received through a channel
-func (config scpConfig) handleRequest(channel ssh.Channel, req *ssh.Request) {
-	ok := true
-	simplelog.Debug.Printf("Payload before splitting is %v", string(req.Payload[4:]))
-	s, err := shlex.Split(string(req.Payload[4:]))
-	if err != nil {
-		// TODO: Shouldn't we do something with this error?
-		simplelog.Error.Printf("Error when splitting payload: %v", err)
+	if len(checksumCommands[s[0]]) > 0 {
+		config.runChecksumCommand(channel, req, s)
+		return
+	}
+	if s[0] == "rsync" && len(config.Rsync) > 0 {
+		config.runRsync(channel, req, s)
+		return
 	}
 
 	// Ignore everything that's not scp
@@ -98,6 +241,23 @@ func (config scpConfig) handleRequest(channel ssh.Channel, req *ssh.Request) {
 		return
 	}
 
+	// The command's started, how it went is told through its exit status.
+	// Clients wait for this before they speak scp to us
+	req.Reply(ok, nil)
+	config.runSCP(ctx, channel, parseSCPArgs(s[1:]))
+}
+
+// The string in the payload of exec and subsystem requests, what's to be run
+func payloadString(payload []byte) (string, error) {
+	var msg struct{ Value string }
+	if err := ssh.Unmarshal(payload, &msg); err != nil {
+		return "", err
+	}
+	return msg.Value, nil
+}
+
+// Parse the options and files in scp's command line
+func parseSCPArgs(args []string) scpOptions {
 	opts := scpOptions{}
 	// TODO: Do a sanity check of options (like needing to have either -f or -t defined)
 	// TODO: Define what happens if both -t and -f are specified?
@@ -113,7 +273,7 @@ func (config scpConfig) handleRequest(channel ssh.Channel, req *ssh.Request) {
 	//  -p: Preserve modification mtime, atime and mode of files
 	parseOpts := true
 	opts.fileNames = make([]string, 0)
-	for _, elem := range s[1:] {
+	for _, elem := range args {
 		if parseOpts {
 			switch elem {
 			case "-f":
@@ -130,67 +290,88 @@ func (config scpConfig) handleRequest(channel ssh.Channel, req *ssh.Request) {
 				// Verbose mode, this is more of a local client thing
 			case "--":
 				// After finding a "--" we stop parsing for flags
-				if parseOpts {
-					parseOpts = false
-				} else {
-					opts.fileNames = append(opts.fileNames, elem)
-				}
+				parseOpts = false
 			default:
 				opts.fileNames = append(opts.fileNames, elem)
 			}
+		} else {
+			// Even if they look like flags, like "-f"
+			opts.fileNames = append(opts.fileNames, elem)
 		}
 	}
+	return opts
+}
 
-	simplelog.Debug.Printf("Called scp with %v", s[1:])
-	simplelog.Debug.Printf("Options: %v", opts)
-	simplelog.Debug.Printf("Filenames: %v", opts.fileNames)
+// Speak scp to the client on channel, as source or sink depending on opts,
+// and close it with the exit status once done or ctx is cancelled
+func (config Config) runSCP(ctx context.Context, channel ssh.Channel, opts scpOptions) {
+	config.logger().Debug("Called scp", "options", fmt.Sprintf("%+v", opts), "files", opts.fileNames)
+	channel, stopRecording := config.recordSession(channel, "scp", scpCommandLine(opts))
+	defer stopRecording()
 
 	// We're acting as source
 	if opts.From {
-		err := config.startSCPSource(channel, opts)
-		ok := true
-		if err != nil {
-			ok = false
-			req.Reply(ok, []byte(err.Error()))
-		} else {
-			req.Reply(ok, nil)
-		}
+		config.startSCPSource(ctx, channel, opts)
 	}
 
 	// We're acting as sink
 	if opts.To {
 		var statusCode uint8
-		ok := true
 		if len(opts.fileNames) != 1 {
-			simplelog.Error.Printf("Error in number of targets (ambiguous target)")
+			config.logger().Error("Error in number of targets (ambiguous target)", "files", opts.fileNames)
 			statusCode = 1
-			ok = false
 			sendErrorToClient("scp: ambiguous target", channel)
 		} else {
-			config.startSCPSink(channel, opts)
+			err := config.startSCPSink(ctx, channel, opts)
+			if err != nil {
+				statusCode = 1
+			}
 		}
 		sendExitStatusCode(channel, statusCode)
 		channel.Close()
-		req.Reply(ok, nil)
 		return
 	}
 }
 
-func (config scpConfig) handleNewChannel(newChannel ssh.NewChannel) {
+func (config Config) handleNewChannel(ctx context.Context, newChannel ssh.NewChannel) {
 	// There are different channel types, depending on what's done at the application level.
 	// scp is done over a "session" channel (as it's just used to execute "scp" on the remote side)
 	// We reject any other kind of channel as we only care about scp
-	simplelog.Debug.Printf("Channel type is %v", newChannel.ChannelType())
+	config.logger().Debug("New channel", "type", newChannel.ChannelType())
 	if newChannel.ChannelType() != "session" {
-		simplelog.Debug.Printf("Rejecting channel request for type %v", newChannel.ChannelType)
+		config.logger().Debug("Rejecting channel request", "type", newChannel.ChannelType())
 		newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
 		return
 	}
+	if !config.conns.addSession(config.username, config.MaxSessionsPerUser) {
+		config.logger().Warn("Too many sessions for user, rejecting channel", "max_sessions", config.MaxSessionsPerUser)
+		newChannel.Reject(ssh.ResourceShortage, "too many sessions for "+config.username)
+		return
+	}
+	defer config.conns.removeSession(config.username)
 	channel, requests, err := newChannel.Accept()
 	if err != nil {
-		// TODO: Don't panic here, just clean up and log error
-		panic("could not accept channel.")
+		config.logger().Error("Can't accept channel", "err", err)
+		return
 	}
+	// What's running in the channel gets to finish with what the client
+	// sent before closing it, it's cancelled after that
+	ctx, cancel := context.WithCancelCause(ctx)
+	var running sync.WaitGroup
+	defer func() {
+		running.Wait()
+		cancel(nil)
+	}()
+	channel = countChannel(channel, config.session)
+	channel = throttleChannel(channel, config.MaxRate)
+	channel, stopIdle := watchIdle(channel, config.idleTimeout, config.logger(), cancel)
+	defer stopIdle()
+	defer func() {
+		if r := recover(); r != nil {
+			config.logPanic("channel", r)
+			channel.Close()
+		}
+	}()
 
 	// Inside our channel there are several kinds of requests.
 	// We can have a request to open a shell or to set environment variables
@@ -199,8 +380,21 @@ func (config scpConfig) handleNewChannel(newChannel ssh.NewChannel) {
 		// scp does an exec, so that's all we care about
 		switch req.Type {
 		case "exec":
-			go config.handleRequest(channel, req)
+			running.Add(1)
+			go func() {
+				defer running.Done()
+				config.handleRequest(ctx, channel, req)
+			}()
 		case "shell":
+			if config.WinSCPShell {
+				req.Reply(true, nil)
+				running.Add(1)
+				go func() {
+					defer running.Done()
+					config.runShell(ctx, channel)
+				}()
+				continue
+			}
 			channel.Write([]byte("Opening a shell is not supported by this server\n"))
 			req.Reply(false, nil)
 		case "env":
@@ -209,32 +403,109 @@ func (config scpConfig) handleNewChannel(newChannel ssh.NewChannel) {
 			req.Reply(true, nil)
 		case "subsystem":
 			// SFTP
-			if string(req.Payload[4:]) == "sftp" {
-				handleSFTP(channel)
+			if name, _ := payloadString(req.Payload); name == "sftp" {
+				// Clients wait for the reply before they start speaking sftp
 				req.Reply(true, nil)
+				config.handleSFTP(channel)
 			} else {
-				req.Reply(true, nil)
+				config.logger().Debug("Rejecting unknown subsystem", "name", name)
+				req.Reply(false, nil)
 			}
 		default:
-			simplelog.Debug.Printf("Req type: %v, req payload: %v", req.Type, string(req.Payload))
+			config.logger().Debug("Ignoring request", "type", req.Type, "payload", string(req.Payload))
 			req.Reply(true, nil)
 		}
 	}
 }
 
-// Handle new connections
-func (c scpConfig) handleConn(nConn net.Conn, config *ssh.ServerConfig) {
-	_, chans, _, err := ssh.NewServerConn(nConn, config)
+// Handle new connections. Cancelling ctx closes the connection, along with
+// whatever's being transferred through it
+func (c Config) handleConn(ctx context.Context, nConn net.Conn, config *ssh.ServerConfig) {
+	start := time.Now()
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	c.sessionID = newSessionID()
+	c.log = c.logger().With("session", c.sessionID, "remote_addr", nConn.RemoteAddr().String())
+	c.remoteHost, _, _ = net.SplitHostPort(nConn.RemoteAddr().String())
+
+	if reason := c.conns.addConn(c.remoteHost, c.MaxConnections, c.MaxConnectionsPerIP); len(reason) > 0 {
+		c.log.Warn("Rejecting connection over the limits", "reason", reason)
+		rejectConn(nConn, config, reason)
+		return
+	}
+	defer c.conns.removeConn(c.remoteHost)
+
+	// Remember who they tried to log in as, in case authentication fails
+	var authUser string
+	var failedPasswords int
+	connConfig := *config
+	connConfig.AuthLogCallback = func(conn ssh.ConnMetadata, method string, err error) {
+		authUser = conn.User()
+		// Every wrong password counts. Keys don't, clients try all of theirs
+		if err != nil && c.bans != nil && (method == "password" || method == "keyboard-interactive") {
+			failedPasswords++
+			c.bans.failure(c.remoteHost, authUser, c.log)
+		}
+	}
+
+	// Clients get a limited time to log in, so they can't hold on to connections without doing it
+	if c.LoginGraceTime > 0 {
+		nConn.SetDeadline(time.Now().Add(c.LoginGraceTime))
+	}
+	sshConn, chans, reqs, err := ssh.NewServerConn(nConn, &connConfig)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		c.log.Info("Client didn't log in in time, dropping connection", "login_grace_time", c.LoginGraceTime.String())
+		return
+	}
+	if err != nil {
+		c.log.Error("Error during handshake", "err", err)
+		var authErr *ssh.ServerAuthError
+		if errors.As(err, &authErr) {
+			// Connections that never got anywhere count as a failure too
+			if c.bans != nil && failedPasswords == 0 {
+				c.bans.failure(c.remoteHost, authUser, c.log)
+			}
+			c.authFailures.add(time.Now())
+			c.notify(WebhookEvent{Event: EventAuthFailure, User: authUser})
+		}
+		return
+	}
+	nConn.SetDeadline(time.Time{})
+	stopClose := context.AfterFunc(ctx, func() { sshConn.Close() })
+	defer stopClose()
+	if c.bans != nil {
+		c.bans.success(c.remoteHost, sshConn.User())
+	}
+	c.log = c.log.With("user", sshConn.User())
+	if c.MaxConnectionTime > 0 {
+		// The timer goes off while c's still being set up for the session
+		log, maxTime := c.log, c.MaxConnectionTime
+		timer := time.AfterFunc(maxTime-time.Since(start), func() {
+			log.Info("Closing connection open for too long", "max_connection_time", maxTime.String())
+			cancel(errConnectionTime)
+		})
+		defer timer.Stop()
+	}
+	go c.handleGlobalRequests(sshConn, reqs)
+
+	// Everything in this connection is served out of the user's own directory, with their own settings
+	err = c.setupSession(sshConn.User(), sshConn.Permissions)
 	if err != nil {
-		simplelog.Error.Printf("Error during handshake: %v", err)
+		c.log.Error("Can't serve files for user", "err", err)
+		sshConn.Close()
 		return
 	}
+	c.session = c.sessions.add(c.sessionID, c.username, nConn.RemoteAddr().String(), cancel)
+	defer c.sessions.remove(c.sessionID)
+
+	c.sendHostKeys(sshConn)
 
 	// Handle any new channels
 	for newChannel := range chans {
-		go c.handleNewChannel(newChannel)
+		go c.handleNewChannel(ctx, newChannel)
 	}
-	simplelog.Debug.Printf("Finished handling connection from %q", nConn.RemoteAddr())
+	c.log.Debug("Finished handling connection")
+	c.notify(WebhookEvent{Event: EventSessionEnd, Duration: time.Since(start).Seconds()})
 }
 
 // Parse and return a ssh public key as found in an authorized keys file
@@ -243,47 +514,28 @@ func parsePubKey(pktext string) (ssh.PublicKey, error) {
 	return pub, err
 }
 
-func startServer(config *scpConfig, serverConfig *ssh.ServerConfig) {
-	// TODO: Add config option/parameter to exit after the first connection (mostly for testing)
-	listener, err := net.Listen("tcp", "0.0.0.0:"+config.Port)
-	if err != nil {
-		simplelog.Fatal.Printf("Failed to listen for connections: %q", err)
-	}
-	simplelog.Info.Printf("Listening on port %v. Accepting connections", config.Port)
-	for {
-		nConn, err := listener.Accept()
-		if err != nil {
-			simplelog.Fatal.Printf("Failed to accept incoming connection: %q", err)
-		}
-		simplelog.Info.Printf("Accepted connection from %v", nConn.RemoteAddr())
-		// TODO: Instead of this, have a method to shut down the server, maybe receiving from a channel
-		// ^ To do that server should probably wait until all goroutines are done before shutting down? (unless there's an option to force a close)
-		if config.OneShot {
-			config.handleConn(nConn, serverConfig)
-			break
-		}
-
-		go config.handleConn(nConn, serverConfig)
-	}
-}
-
-func (c scpConfig) initSSHConfig() *ssh.ServerConfig {
+func (c Config) initSSHConfig() *ssh.ServerConfig {
 	// An SSH server is represented by a ServerConfig, which holds
 	// certificate details and handles authentication of ServerConns.
-	// Setting NoClientAuth to true would allow users to connect without needing to authenticate
-	// TODO: Allow setting NoClientAuth as an option
+	// NoClientAuth lets anonymous clients in, if that's enabled
 	serverConfig := &ssh.ServerConfig{
-		PasswordCallback:  c.passwordAuth,
-		PublicKeyCallback: c.keyAuth,
+		NoClientAuth:                c.Anonymous.Enabled,
+		NoClientAuthCallback:        c.anonymousAuth,
+		PasswordCallback:            c.passwordAuth,
+		PublicKeyCallback:           c.keyAuth,
+		KeyboardInteractiveCallback: c.keyboardInteractiveAuth,
+	}
+	if len(c.banner) > 0 {
+		serverConfig.BannerCallback = func(ssh.ConnMetadata) string { return c.banner }
 	}
 
-	serverConfig.AddHostKey(c.privateKey)
+	serverConfig.KeyExchanges = c.KeyExchanges
+	serverConfig.Ciphers = c.Ciphers
+	serverConfig.MACs = c.MACs
 
-	return serverConfig
-}
+	for _, key := range c.hostKeys {
+		serverConfig.AddHostKey(key)
+	}
 
-func main() {
-	config := initSettings()
-	serverConfig := config.initSSHConfig()
-	startServer(config, serverConfig)
+	return serverConfig
 }
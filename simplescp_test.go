@@ -1,10 +1,12 @@
-package main
+package simplescp
 
 import (
+	"context"
 	"crypto/md5"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
 	"testing"
@@ -33,25 +35,41 @@ type testConf struct {
 }
 
 func (conf testConf) runCopyTest() error {
-	err := cleanupDir(conf.dst)
+	err := os.MkdirAll(conf.dst, 0755)
 	if err != nil {
 		conf.t.Fatalf("Error preparing for test: %q", err)
 	}
+	err = cleanupDir(conf.dst)
+	if err != nil {
+		conf.t.Fatalf("Error preparing for test: %q", err)
+	}
+	os.Setenv("SIMPLESCP_USER", "scpuser")
 	os.Setenv("SIMPLESCP_PASS", conf.password)
 	os.Setenv("SIMPLESCP_DIR", conf.src)
-	c := initSettings()
-	serverConfig := c.initSSHConfig()
-	c.Dir = conf.src
-	// TODO: Remove the OneShot option and add a StopServer method
-	c.OneShot = true
-	go startServer(c, serverConfig)
+	os.Setenv("SIMPLESCP_PRIVATEKEYFILE", "")
+	c, err := LoadConfig("")
+	if err != nil {
+		conf.t.Fatalf("Error loading config: %q", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:2222")
+	if err != nil {
+		conf.t.Fatalf("Error listening: %q", err)
+	}
+	server := NewServer(c)
+	go server.Serve(listener)
+	defer server.Shutdown(context.Background())
 	time.Sleep(500 * time.Millisecond)
 
 	// Look into SSH_ASKPASS to specify a binary to ask for ssh password
-	cmd := exec.Command("setsid", "-w", "scp", "-P", "2222", "scpuser@localhost:*", conf.dst)
+	// -O forces the scp protocol, recent versions of scp default to sftp
+	cmd := exec.Command("setsid", "-w", "scp", "-O",
+		"-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null",
+		"-P", "2222", "scpuser@localhost:*", conf.dst)
 	//	cmd := exec.Command("tty")
 	cmd.Env = append(cmd.Env, "SIMPLESCP_TESTPASS="+conf.password)
 	cmd.Env = append(cmd.Env, "SSH_ASKPASS=support/ssh_pass.sh")
+	cmd.Env = append(cmd.Env, "SSH_ASKPASS_REQUIRE=force")
 	cmd.Env = append(cmd.Env, "DISPLAY=totallybogus")
 
 	// TODO: maybe separate stdout and stderr here
@@ -0,0 +1,228 @@
+// Package simplescptest runs simplescp servers for tests, in the test's own
+// process and on a random port, with a host key and users made up for it. It's
+// for programs that talk to scp or sftp servers, to test them against a real
+// one:
+//
+//	func TestUpload(t *testing.T) {
+//		server := simplescptest.NewServer(t)
+//		alice := server.AddUser(t, "alice")
+//		client := server.DialSFTP(t, alice)
+//		// Upload with client...
+//		contents, err := os.ReadFile(filepath.Join(alice.Dir, "report.csv"))
+//	}
+//
+// Servers, and everything they and their users leave behind, go away when the
+// test is over.
+package simplescptest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jjch99/simplescp"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Server is a simplescp server listening on localhost, letting in the users
+// added to it
+type Server struct {
+	Addr    string            // Where it's listening, 127.0.0.1:port
+	HostKey ssh.PublicKey     // The key it identifies itself with
+	Server  *simplescp.Server // The server itself, to reload it or look at its sessions
+
+	dir   string
+	users *userStore
+}
+
+// User is an account on a Server
+type User struct {
+	Name     string
+	Password string
+	Key      ssh.Signer // Private key the user can log in with, besides the password
+	KeyFile  string     // The same key in a file, for ssh -i and the like
+	Dir      string     // The directory the user's files are in, empty to start with
+}
+
+// NewServer starts a server, stopping it when the test is over. It has no
+// users until AddUser is called. configure can change its settings before it
+// starts, they're the defaults otherwise, and it doesn't log anything unless one
+// sets a Logger
+func NewServer(tb testing.TB, configure ...func(*simplescp.Config)) *Server {
+	tb.Helper()
+	dir := tb.TempDir()
+	hostKey, err := simplescp.GenerateKeyFile(filepath.Join(dir, "ssh_host_ed25519_key"), simplescp.KeyOptions{})
+	if err != nil {
+		tb.Fatalf("Can't generate host key: %v", err)
+	}
+	s := &Server{HostKey: hostKey.PublicKey(), dir: dir, users: &userStore{users: make(map[string]simplescp.User)}}
+
+	c := simplescp.NewConfig()
+	c.Dir = filepath.Join(dir, "files")
+	if err := os.Mkdir(c.Dir, 0755); err != nil {
+		tb.Fatal(err)
+	}
+	// Everyone logs in through the user store, nobody can guess the config's user
+	c.User, c.Password = "simplescptest-"+randomString(), randomString()
+	c.PrivateKeyFile, c.AuthKeysFile, c.UserDB = filepath.Join(dir, "ssh_host_ed25519_key"), "", ""
+	c.UserStore = s.users
+	c.Logger = slog.New(slog.DiscardHandler)
+	for _, f := range configure {
+		f(c)
+	}
+	if err := c.Init(); err != nil {
+		tb.Fatalf("Can't set up server: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s.Addr = listener.Addr().String()
+	s.Server = simplescp.NewServer(c)
+	go s.Server.Serve(listener)
+	tb.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Server.Shutdown(ctx)
+	})
+	return s
+}
+
+// AddUser adds a user with a random password and key of their own, and their own
+// directory. configure can change what they're allowed to do and such, they
+// can do everything otherwise. A user that's there already is replaced
+func (s *Server) AddUser(tb testing.TB, name string, configure ...func(*simplescp.User)) *User {
+	tb.Helper()
+	home := filepath.Join(s.dir, "home", name)
+	keyFile := filepath.Join(s.dir, "keys", name)
+	for _, dir := range []string{home, filepath.Dir(keyFile)} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	// Replaced users get a new key
+	os.Remove(keyFile)
+	os.Remove(keyFile + ".pub")
+	key, err := simplescp.GenerateKeyFile(keyFile, simplescp.KeyOptions{Comment: name})
+	if err != nil {
+		tb.Fatalf("Can't generate key for %s: %v", name, err)
+	}
+	u := &User{Name: name, Password: randomString(), Key: key, KeyFile: keyFile, Dir: home}
+	// It's no secret, it just has to be quick to check
+	hash, err := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.MinCost)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	stored := simplescp.User{
+		Name:         name,
+		PasswordHash: string(hash),
+		PublicKeys:   []ssh.PublicKey{key.PublicKey()},
+		HomeDir:      home,
+		Permissions:  simplescp.PermAll,
+	}
+	for _, f := range configure {
+		f(&stored)
+	}
+	s.users.add(stored)
+	return u
+}
+
+// RemoveUser takes a user away, so they can't log in anymore. Their sessions
+// carry on until they end
+func (s *Server) RemoveUser(name string) {
+	s.users.remove(name)
+}
+
+// ClientConfig returns what a client needs to log in as u, checking it's
+// talking to this server
+func (s *Server) ClientConfig(u *User) *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:            u.Name,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(u.Key), ssh.Password(u.Password)},
+		HostKeyCallback: ssh.FixedHostKey(s.HostKey),
+	}
+}
+
+// Dial logs in as u, closing the connection when the test is over
+func (s *Server) Dial(tb testing.TB, u *User) *ssh.Client {
+	tb.Helper()
+	client, err := ssh.Dial("tcp", s.Addr, s.ClientConfig(u))
+	if err != nil {
+		tb.Fatalf("Can't log in as %s: %v", u.Name, err)
+	}
+	tb.Cleanup(func() { client.Close() })
+	return client
+}
+
+// DialSFTP logs in as u and starts sftp, closing it when the test is over
+func (s *Server) DialSFTP(tb testing.TB, u *User) *sftp.Client {
+	tb.Helper()
+	client, err := sftp.NewClient(s.Dial(tb, u))
+	if err != nil {
+		tb.Fatalf("Can't start sftp as %s: %v", u.Name, err)
+	}
+	tb.Cleanup(func() { client.Close() })
+	return client
+}
+
+// KnownHosts returns a known_hosts file with the server's host key in it, for
+// the scp and sftp commands (-o UserKnownHostsFile=...) and such
+func (s *Server) KnownHosts(tb testing.TB) string {
+	tb.Helper()
+	file := filepath.Join(s.dir, "known_hosts")
+	line := knownhosts.Line([]string{s.Addr}, s.HostKey) + "\n"
+	if err := os.WriteFile(file, []byte(line), 0600); err != nil {
+		tb.Fatal(err)
+	}
+	return file
+}
+
+// The users, changed while the server runs
+type userStore struct {
+	mu    sync.Mutex
+	users map[string]simplescp.User
+}
+
+func (s *userStore) LookupUser(username string) (*simplescp.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[username]
+	if !ok {
+		return nil, simplescp.ErrNoSuchUser
+	}
+	return &u, nil
+}
+
+func (s *userStore) add(u simplescp.User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[u.Name] = u
+}
+
+func (s *userStore) remove(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.users, name)
+}
+
+func (s *userStore) Close() error {
+	return nil
+}
+
+func randomString() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,77 @@
+package simplescptest
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jjch99/simplescp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestServer(t *testing.T) {
+	server := NewServer(t)
+	alice := server.AddUser(t, "alice")
+	bob := server.AddUser(t, "bob", func(u *simplescp.User) { u.Permissions = simplescp.PermRead | simplescp.PermList })
+
+	client := server.DialSFTP(t, alice)
+	f, err := client.Create("/report.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("a,b\n"))
+	f.Close()
+	if contents, err := os.ReadFile(filepath.Join(alice.Dir, "report.csv")); err != nil || !bytes.Equal(contents, []byte("a,b\n")) {
+		t.Errorf("Got %q, %v uploading as alice", contents, err)
+	}
+
+	// Each user has their own files and permissions
+	client = server.DialSFTP(t, bob)
+	if _, err := client.Stat("/report.csv"); err == nil {
+		t.Error("bob can see alice's files")
+	}
+	if _, err := client.Create("/mine.csv"); err == nil {
+		t.Error("bob can upload without write permission")
+	}
+
+	// Passwords work too
+	config := server.ClientConfig(alice)
+	config.Auth = []ssh.AuthMethod{ssh.Password(alice.Password)}
+	conn, err := ssh.Dial("tcp", server.Addr, config)
+	if err != nil {
+		t.Fatalf("Can't log in with alice's password: %v", err)
+	}
+	conn.Close()
+
+	hostKeys, err := knownhosts.New(server.KnownHosts(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hostKeys(server.Addr, &net.TCPAddr{}, server.HostKey); err != nil {
+		t.Errorf("Host key not in known_hosts: %v", err)
+	}
+
+	server.RemoveUser("alice")
+	if _, err := ssh.Dial("tcp", server.Addr, server.ClientConfig(alice)); err == nil {
+		t.Error("alice can log in after being removed")
+	}
+}
+
+func TestServerConfig(t *testing.T) {
+	server := NewServer(t, func(c *simplescp.Config) { c.ReadOnly = true })
+	alice := server.AddUser(t, "alice")
+	os.WriteFile(filepath.Join(alice.Dir, "file.txt"), []byte("hello"), 0644)
+	client := server.DialSFTP(t, alice)
+	if _, err := client.Stat("/file.txt"); err != nil {
+		t.Error(err)
+	}
+	if _, err := client.Create("/new.txt"); err == nil {
+		t.Error("Uploaded to a read only server")
+	}
+	if sessions := server.Server.Sessions(); len(sessions) != 1 || sessions[0].User != "alice" {
+		t.Errorf("Unexpected sessions %+v", sessions)
+	}
+}
@@ -1,16 +1,17 @@
-package main
+package simplescp
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/FranGM/simplelog"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -24,31 +25,33 @@ type controlMessage struct {
 	name    string
 	mode    os.FileMode
 	size    uint64
+	times   bool // Whether a T message with mtime and atime came before it
 	mtime   int64
 	atime   int64
 }
 
-// TODO: Cleanup, send errors on protocol errors
+// Read the next control message from the client. Warnings (1) and fatal
+// errors (2) it sends instead, when it can't send something, come with their
+// message as name
 func receiveControlMsg(channel ssh.Channel) (controlMessage, error) {
 	ctrlmsg := controlMessage{}
 
-	ctrlmsgbuf := make([]byte, 256)
-	nread, err := channel.Read(ctrlmsgbuf)
+	ctrlmsgbuf, err := readControlLine(channel)
 	if err != nil {
-		// TODO: Maybe only return it upstream if it's an EOF, otherwise handle it?
 		return ctrlmsg, err
 	}
+	nread := len(ctrlmsgbuf)
 	ctrlmsg.msgType = string(ctrlmsgbuf[0])
 
 	ctrlmsglist := strings.Split(string(ctrlmsgbuf[:nread]), " ")
-	simplelog.Debug.Printf("%v", ctrlmsglist)
+	slog.Debug("Received control message", "msg", ctrlmsglist)
 
 	// Make sure control message is valid
 	switch string(ctrlmsgbuf[0]) {
 	case "E":
 		if nread > 2 {
 			// TODO: Protocol error
-			simplelog.Error.Printf("Protocol error, got: %v", string(ctrlmsgbuf[:nread]))
+			slog.Error("Protocol error", "msg", string(ctrlmsgbuf[:nread]))
 			return ctrlmsg, errors.New("Protocol error")
 		}
 		err := sendSCPBinaryOK(channel)
@@ -56,16 +59,25 @@ func receiveControlMsg(channel ssh.Channel) (controlMessage, error) {
 	case "C":
 	case "D":
 	case "T":
+	case "\001", "\002":
+		ctrlmsg.name = strings.TrimSpace(string(ctrlmsgbuf[1:nread]))
+		return ctrlmsg, nil
 	default:
-		// TODO: We have an expected message here, report it and abort
+		slog.Error("Protocol error", "msg", string(ctrlmsgbuf[:nread]))
+		return ctrlmsg, errors.New("Protocol error")
 	}
 
 	if ctrlmsg.msgType == "T" {
-		ctrlmsg.mtime, err = strconv.ParseInt(ctrlmsglist[0][1:], 10, 64)
+		// T<mtime sec> <mtime usec> <atime sec> <atime usec>, the microseconds are always 0
+		times := strings.Fields(string(ctrlmsgbuf[1:nread]))
+		if len(times) != 4 {
+			return ctrlmsg, errors.New("Protocol error")
+		}
+		ctrlmsg.mtime, err = strconv.ParseInt(times[0], 10, 64)
 		if err != nil {
 			return ctrlmsg, errors.New("mtime.sec not delimited")
 		}
-		ctrlmsg.atime, err = strconv.ParseInt(ctrlmsglist[2], 10, 64)
+		ctrlmsg.atime, err = strconv.ParseInt(times[2], 10, 64)
 		if err != nil {
 			return ctrlmsg, errors.New("atime.sec not delimited")
 		}
@@ -75,18 +87,22 @@ func receiveControlMsg(channel ssh.Channel) (controlMessage, error) {
 		if err != nil {
 			return ctrlmsg, errors.New("Protocol error")
 		}
+		if newCtrlmsg.msgType != "C" && newCtrlmsg.msgType != "D" {
+			return ctrlmsg, errors.New("Protocol error")
+		}
 
+		newCtrlmsg.times = true
 		newCtrlmsg.mtime = ctrlmsg.mtime
 		newCtrlmsg.atime = ctrlmsg.atime
 
 		return newCtrlmsg, nil
 	}
 
-	if len(ctrlmsglist) != 3 {
+	if len(ctrlmsglist) != 3 || !strings.HasSuffix(ctrlmsglist[2], "\n") {
 		return ctrlmsg, errors.New("Protocol error")
 	}
 
-	ctrlmsg.name = ctrlmsglist[2][:len(ctrlmsglist[2])-1] // Remove trailing newline
+	ctrlmsg.name = strings.TrimSuffix(ctrlmsglist[2], "\n")
 	size, err := strconv.ParseInt(ctrlmsglist[1], 10, 64)
 	ctrlmsg.size = uint64(size)
 	if err != nil {
@@ -97,80 +113,245 @@ func receiveControlMsg(channel ssh.Channel) (controlMessage, error) {
 	if err != nil {
 		return ctrlmsg, errors.New("Protocol error")
 	}
-	sendSCPBinaryOK(channel)
+	// We'll let the client know whether we can take the file or directory once we've had a look at it
 	return ctrlmsg, nil
 }
 
-// Generate a full path out of our basedir, the directories currently in the stack, and the target
-func (config scpConfig) generatePath(dirStack []string, target string) string {
+// The longest control message we take, a C message for a file with a name
+// that's as long as they get is well under it
+const maxControlLine = 4096
+
+// Read a control message up to its newline, and nothing after it. Clients
+// don't wait for an answer to warnings before sending the next message, and
+// what comes after C messages is the file's contents
+func readControlLine(channel ssh.Channel) ([]byte, error) {
+	line := make([]byte, 0, 256)
+	b := make([]byte, 1)
+	for {
+		n, err := channel.Read(b)
+		if n == 0 {
+			if err == io.EOF && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				return line, err
+			}
+			continue
+		}
+		line = append(line, b[0])
+		if b[0] == '\n' {
+			return line, nil
+		}
+		if len(line) == maxControlLine {
+			return line, errors.New("Protocol error")
+		}
+	}
+}
+
+// Names in C and D messages should be just that, a name. Anything that could
+// take the file somewhere else, like "../../.ssh/authorized_keys", is refused.
+// It's the server side of CVE-2019-6111, where a server did that to clients
+func validSCPName(name string) bool {
+	return len(name) > 0 && name != "." && name != ".." &&
+		!strings.ContainsAny(name, "/\x00") && !strings.ContainsRune(name, filepath.Separator)
+}
+
+// Generate a full path out of our basedir, the directories currently in the stack, and the target.
+// Symlinks on the way are followed, as long as they don't point outside of basedir
+func (config Config) generatePath(dirStack []string, target string) (string, error) {
 	var fullPathList []string
-	fullPathList = append(fullPathList, config.Dir)
 	fullPathList = append(fullPathList, dirStack...)
 	fullPathList = append(fullPathList, target)
 
-	path := filepath.Clean(filepath.Join(fullPathList...))
-
-	return path
+	return config.resolvePath(filepath.Join(fullPathList...))
 }
 
-// Receive the contents of a file and store it in the right place
-func (c scpConfig) receiveFileContents(channel ssh.Channel, dirStack []string, msgctrl controlMessage, name string, preserveMode bool) error {
+// Receive the contents of a file and store it in the right place, unless ctx
+// is cancelled before it's all there
+func (c Config) receiveFileContents(ctx context.Context, channel ssh.Channel, dirStack []string, msgctrl controlMessage, name string, preserveMode bool) error {
 
-	filename := c.generatePath(dirStack, name)
+	filename, err := c.generatePath(dirStack, name)
+	if err != nil {
+		sendErrorToClient(fmt.Sprintf("scp: %s: %v", name, pathErrReason(err)), channel)
+		return err
+	}
 
-	simplelog.Debug.Printf("Filename is '%s'", filename)
-	// TODO: Make sure we're reporting the right error here if something happens
-	f, err := os.Create(filename)
+	log := c.logger().With("file", filename)
+	log.Debug("Receiving file", "size", msgctrl.size)
+
+	// Make sure the file isn't too big and fits in the user's quota before accepting it
+	err = c.checkFileSize(int64(msgctrl.size))
 	if err != nil {
-		simplelog.Error.Printf("Err is %v", err)
+		log.Info("Rejecting file over the maximum file size", "size", msgctrl.size)
+		sendErrorToClient(fmt.Sprintf("scp: %s: %v", name, err), channel)
 		return err
 	}
-	defer f.Close()
-	nread, err := io.CopyN(f, channel, int64(msgctrl.size))
-	simplelog.Debug.Printf("Transferred %d bytes", nread)
+	replaced := c.existingSize(filename)
+	growth := int64(msgctrl.size) - replaced
+	if c.stagedUploads() {
+		// The file being replaced stays until the new one is complete
+		growth = int64(msgctrl.size)
+	}
+	err = c.reserveSpace(growth)
 	if err != nil {
-		simplelog.Error.Printf("Err is %v", err)
+		sendErrorToClient(fmt.Sprintf("scp: %s: %v", name, err), channel)
 		return err
 	}
 
-	// TODO: Double check that we're doing the right thing in all cases (file already exists, file doesn't exist, etc)
-	err = f.Chmod(msgctrl.mode)
+	// TODO: Make sure we're reporting the right error here if something happens
+	fsys := c.fileSystem()
+	f, part, err := c.createUpload(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
-		simplelog.Error.Printf("Err is %v", err)
+		log.Error("Error receiving file", "err", err)
+		c.reserveSpace(-growth)
+		sendErrorToClient(fmt.Sprintf("scp: %s: %v", name, pathErrReason(err)), channel)
 		return err
 	}
-
-	if preserveMode {
-		atime := time.Unix(msgctrl.atime, 0)
-		mtime := time.Unix(msgctrl.mtime, 0)
-		err := os.Chtimes(filename, atime, mtime)
-		if err != nil {
-			simplelog.Error.Printf("Err is %v", err)
-			return err
+	complete := false
+	defer func() {
+		if !complete {
+			c.discardUpload(part, filename)
 		}
+	}()
+	defer f.Close()
+
+	// Ready to receive the file's contents
+	sendSCPBinaryOK(channel)
+	start := time.Now()
+	t := c.session.startTransfer("scp", true, filename)
+	defer c.session.endTransfer(t)
+	var w io.Writer = f
+	var sparse *sparseWriter
+	if c.isLocal() {
+		// Zeros are left as holes, so sparse files stay that way
+		sparse = &sparseWriter{f: f}
+		w = sparse
+	}
+	var r io.Reader = io.TeeReader(ctxReader{ctx, channel}, t)
+	h := c.transferChecksum()
+	if h != nil {
+		r = io.TeeReader(r, h)
+	}
+	buf := getCopyBuffer()
+	nread, err := copyAll(w, r, int64(msgctrl.size), *buf)
+	putCopyBuffer(buf)
+	err = cancelCause(ctx, err)
+	if err == nil && sparse != nil {
+		err = sparse.finish()
+	}
+	log.Info("Received file", "bytes", nread)
+	if err != nil {
+		log.Error("Error receiving file", "err", err)
+		c.transferDone("scp", true, filename, start, nread, "", false)
+		c.reserveSpace(nread - int64(msgctrl.size))
+		return err
 	}
 
 	statusbuf := make([]byte, 1)
 	_, err = channel.Read(statusbuf)
+	if cause := context.Cause(ctx); cause != nil {
+		// The file isn't kept if it was cancelled while we waited
+		err = cause
+	}
 	if err != nil {
-		simplelog.Error.Printf("Getting status error after transfer: %v", err)
+		log.Error("Error getting status after transfer", "err", err)
+		c.transferDone("scp", true, filename, start, nread, "", false)
 		return err
 	}
+
+	// Some storage backends only store the file once it's closed, so that's when we know everything went well
+	err = f.Close()
+	if err == nil && part != filename {
+		err = c.completeUpload(part, filename)
+		if err == nil {
+			c.reserveSpace(-replaced)
+		}
+	}
+	complete = err == nil
+	var checksum string
+	if complete {
+		checksum = hexSum(h)
+	}
+	c.transferDone("scp", true, filename, start, nread, checksum, complete)
+	if err != nil {
+		log.Error("Error receiving file", "err", err)
+		sendErrorToClient(fmt.Sprintf("scp: %s: %v", name, err), channel)
+		return err
+	}
+
+	// TODO: Double check that we're doing the right thing in all cases (file already exists, file doesn't exist, etc)
+	if afs, ok := fsys.(AttrFileSystem); ok {
+		err = afs.Chmod(filename, msgctrl.mode)
+		if err != nil {
+			log.Error("Error receiving file", "err", err)
+			return err
+		}
+
+		if preserveMode && msgctrl.times && c.perms.Has(PermChmod) {
+			atime := time.Unix(msgctrl.atime, 0)
+			mtime := time.Unix(msgctrl.mtime, 0)
+			err := afs.Chtimes(filename, atime, mtime)
+			if err != nil {
+				log.Error("Error receiving file", "err", err)
+				return err
+			}
+		}
+	}
+
 	sendSCPBinaryOK(channel)
+	return nil
+}
+
+// What went wrong with a file, without the operation and path that os errors
+// come with, for error messages like "scp: file: Permission denied"
+func pathErrReason(err error) error {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err
+	}
 	return err
 }
 
+// Give a directory copied with -p the same mode and times it had, once
+// everything in it has been written (which changes its modification time)
+func (config Config) setDirAttrs(dir string, msg controlMessage) {
+	afs, ok := config.fileSystem().(AttrFileSystem)
+	if !ok || !config.perms.Has(PermChmod) {
+		return
+	}
+	if err := afs.Chmod(dir, msg.mode); err != nil {
+		config.logger().Warn("Can't set directory mode", "dir", dir, "err", err)
+	}
+	if msg.times {
+		if err := afs.Chtimes(dir, time.Unix(msg.atime, 0), time.Unix(msg.mtime, 0)); err != nil {
+			config.logger().Warn("Can't set directory times", "dir", dir, "err", err)
+		}
+	}
+}
+
+// Create a directory for an upload. Users without the mkdir permission can
+// only upload to the ones already there
+func (config Config) createUploadDir(target string) error {
+	if !config.perms.Has(PermMkdir) {
+		if fi, err := config.fileSystem().Stat(target); err == nil && fi.IsDir() {
+			return nil
+		}
+		return os.ErrPermission
+	}
+	return createDir(config.fileSystem(), target)
+}
+
 // Create a directory, ignore errors if it already exists
-func createDir(target string) error {
+func createDir(fsys FileSystem, target string) error {
 	// TODO: What permissions should we use here?
 	var perm os.FileMode = 0755
-	err := os.Mkdir(target, perm)
+	err := fsys.Mkdir(target, perm)
 	if err != nil {
 		// TODO: it's easier to compare to os.ErrExist
 		if os.IsExist(err) {
-			simplelog.Warning.Printf("File already exists, big deal")
+			slog.Debug("Directory already exists, big deal", "dir", target)
 		} else {
-			simplelog.Error.Printf("%v", err)
+			slog.Error("Error creating directory", "dir", target, "err", err)
 			return err
 		}
 	}
@@ -179,92 +360,189 @@ func createDir(target string) error {
 
 // If target exists and it's a dir, put all the files in there
 // If target doesn't exist or it's a regular file:
-//   - If we only want to copy one file, use it as destination
-//   - If we want to copy more than one file, it's an error: "No such file or directory" or "Not a directory"
-func (config scpConfig) startSCPSink(channel ssh.Channel, opts scpOptions) error {
+//   - If we only want to copy one file (or directory, with -r), use it as destination
+//   - If we want to copy more than one, it's an error: "No such file or directory" or "Not a directory"
+func (config Config) startSCPSink(ctx context.Context, channel ssh.Channel, opts scpOptions) error {
 
 	// Only one target should have been specified
 	target := opts.fileNames[0]
 
+	if !config.perms.Has(PermWrite) {
+		msg := fmt.Sprintf("scp: %s: Permission denied", target)
+		sendErrorToClient(msg, channel)
+		return errors.New(msg)
+	}
+
 	// Target seems to be a directory
 	if string(target[len(target)-1]) == "/" {
 		opts.TargetIsDir = true
 	}
 
 	absTarget := filepath.Clean(filepath.Join(config.Dir, target))
-	if !strings.HasPrefix(absTarget, config.Dir) {
+	if !isWithinDir(absTarget, filepath.Clean(config.Dir)) {
 		// We're attempting to copy files outside of our working directory, so return an error
 		msg := fmt.Sprintf("scp: %s: Not a directory", target)
 		sendErrorToClient(msg, channel)
 		return errors.New(msg)
 	}
+	absTarget, err := config.resolvePath(target)
+	if err != nil {
+		sendErrorToClient(fmt.Sprintf("scp: %s: %v", target, pathErrReason(err)), channel)
+		return err
+	}
 
 	var dirStack []string
 
 	if opts.TargetIsDir {
-		err := createDir(absTarget)
+		err := config.createUploadDir(absTarget)
 		if err != nil {
+			sendErrorToClient(fmt.Sprintf("scp: %s: %v", target, pathErrReason(err)), channel)
 			return err
 		}
+	} else if fi, err := config.fileSystem().Stat(absTarget); err == nil && fi.IsDir() {
+		// Copying into a directory that's already there
+		opts.TargetIsDir = true
+	}
+	if opts.TargetIsDir {
 		dirStack = append(dirStack, target)
 	}
+	// When it's not a directory the first file or directory that comes is
+	// stored as target, there can't be any more after that
+	targetUsed := false
+	// The D messages of the directories we're in, for -p
+	var dirMsgs []controlMessage
+	// Why the last file that couldn't be received wasn't. The others are
+	// still received, like scp does, but the exit status tells
+	var failed error
 
-	simplelog.Debug.Printf("Dir stack is: %v", dirStack)
+	config.logger().Debug("Starting scp sink", "dir_stack", dirStack)
 
 	// Tell the other side we're ready to start receiving data
 	sendSCPBinaryOK(channel)
 	for {
 		ctrlmsg, err := receiveControlMsg(channel)
 
+		if cause := context.Cause(ctx); cause != nil {
+			config.logger().Info("Stopped receiving files", "reason", cause)
+			return cause
+		}
 		if err != nil {
 			if err == io.EOF {
 				// EOF is fine at this point, it just means no more files to copy
 				break
 			}
-			simplelog.Error.Printf("Got error from client: %v", err)
-			break
+			config.logger().Error("Got error from client", "err", err)
+			sendErrorToClient(fmt.Sprintf("scp: %v", err), channel)
+			return err
+		}
+
+		config.logger().Debug("Got control message", "type", ctrlmsg.msgType)
+		if ctrlmsg.msgType == "C" || ctrlmsg.msgType == "D" {
+			if !validSCPName(ctrlmsg.name) {
+				config.logger().Warn("Client sent an invalid file name", "name", ctrlmsg.name)
+				msg := fmt.Sprintf("scp: error: unexpected filename: %q", ctrlmsg.name)
+				sendErrorToClient(msg, channel)
+				return errors.New(msg)
+			}
+			if ctrlmsg.msgType == "D" && !opts.Recursive {
+				msg := "scp: error: received directory without -r"
+				sendErrorToClient(msg, channel)
+				return errors.New(msg)
+			}
+			if len(dirStack) == 0 {
+				if targetUsed {
+					msg := fmt.Sprintf("scp: %s: Not a directory", target)
+					sendErrorToClient(msg, channel)
+					return errors.New(msg)
+				}
+				targetUsed = true
+			}
 		}
 
-		simplelog.Debug.Printf("Message type: %v", ctrlmsg.msgType)
 		switch ctrlmsg.msgType {
 		case "D":
-			// TODO: Figure out how we need to behave in terms of permissions/times, etc
-			err := createDir(config.generatePath(dirStack, ctrlmsg.name))
+			// A directory copied to a target that isn't there yet becomes the target
+			name := ctrlmsg.name
+			if len(dirStack) == 0 {
+				name = target
+			}
+			// Its mode and times are set once we're done with it, with -p
+			name, err := config.sanitizePath(name)
+			if err == nil && config.deniedFile(filepath.Join(append(dirStack, name)...)) {
+				err = os.ErrPermission
+			}
+			var dir string
+			if err == nil {
+				dir, err = config.generatePath(dirStack, name)
+			}
+			if err == nil {
+				err = config.createUploadDir(dir)
+			}
 			if err != nil {
+				sendErrorToClient(fmt.Sprintf("scp: %s: %v", name, pathErrReason(err)), channel)
 				return err
 			}
-			dirStack = append(dirStack, ctrlmsg.name)
-			simplelog.Debug.Printf("dir stack is now: %v", dirStack)
+			sendSCPBinaryOK(channel)
+			dirStack = append(dirStack, name)
+			dirMsgs = append(dirMsgs, ctrlmsg)
+			config.logger().Debug("Entered directory", "dir_stack", dirStack)
 		case "E":
 			stackSize := len(dirStack)
-			if (opts.TargetIsDir && stackSize <= 1) || (!opts.TargetIsDir && stackSize <= 0) {
-				msg := "scp: Protocol Error"
-				sendErrorToClient(msg, channel)
-				return errors.New(msg)
+			if (opts.TargetIsDir && stackSize == 1) || (!opts.TargetIsDir && stackSize == 0) {
+				// Like scp does, an E with no directory left to end finishes
+				// the transfer. Clients that can't close their end to say
+				// they're done (WinSCP in a shell) need it
+				return failed
+			}
+			if opts.PreserveMode {
+				if dir, err := config.generatePath(dirStack, ""); err == nil {
+					config.setDirAttrs(dir, dirMsgs[len(dirMsgs)-1])
+				}
 			}
 			dirStack = dirStack[:len(dirStack)-1]
+			dirMsgs = dirMsgs[:len(dirMsgs)-1]
 		case "C":
-			var filename string
-			if opts.TargetIsDir {
-				filename = ctrlmsg.name
-			} else {
+			filename := ctrlmsg.name
+			if len(dirStack) == 0 {
 				filename = target
 			}
-			config.receiveFileContents(channel, dirStack, ctrlmsg, filename, opts.PreserveMode)
+			name, err := config.sanitizePath(filename)
+			if err == nil && config.deniedFile(filepath.Join(append(dirStack, name)...)) {
+				config.logger().Info("Refusing denied file", "name", name)
+				err = os.ErrPermission
+			}
+			if err != nil {
+				sendErrorToClient(fmt.Sprintf("scp: %s: %v", filename, err), channel)
+				failed = err
+				continue
+			}
+			filename = name
+			if err := config.receiveFileContents(ctx, channel, dirStack, ctrlmsg, filename, opts.PreserveMode); err != nil {
+				failed = err
+			}
+		case "\001":
+			// The client couldn't send one of the files, it goes on with the rest
+			config.logger().Warn("Client couldn't send file", "msg", ctrlmsg.name)
+			failed = errors.New(ctrlmsg.name)
+		case "\002":
+			config.logger().Error("Client gave up sending files", "msg", ctrlmsg.name)
+			return errors.New(ctrlmsg.name)
 		}
 
 		// Steps here:
 		// 1. Figure out what kind of message this is (file, directory, time, end of directory...)
 		// If it's D:
+		//   - Make sure its name is just a name
 		//   - Add a new directory to the stack
 		//   - Create the directory
 		// If it's E:
 		//   - Remove one directory from the stack
 		// If it's C:
+		//   - Make sure its name is just a name
 		//   - Receive file and store it in the current stack
 		// If it's T:
 		//   - Receive the next control message
 
 	}
-	return nil
+	return failed
 }
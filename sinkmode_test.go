@@ -0,0 +1,267 @@
+package simplescp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// An scp command running on a test server, for tests to speak the scp
+// protocol to
+type testSCP struct {
+	stdin   io.WriteCloser
+	stdout  *bufio.Reader
+	session *ssh.Session
+}
+
+// Logs into the server at addr and runs cmd, like "scp -t dir"
+func startTestSCP(t *testing.T, addr, cmd string) *testSCP {
+	t.Helper()
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "scpuser",
+		Auth:            []ssh.AuthMethod{ssh.Password("hunter2")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, _ := session.StdinPipe()
+	stdout, _ := session.StdoutPipe()
+	if err := session.Start(cmd); err != nil {
+		t.Fatal(err)
+	}
+	return &testSCP{stdin: stdin, stdout: bufio.NewReader(stdout), session: session}
+}
+
+// Reads the server's answer to the last message, an error if it isn't OK
+func (s *testSCP) ack() error {
+	code, err := s.stdout.ReadByte()
+	if err != nil {
+		return err
+	}
+	if code == 0 {
+		return nil
+	}
+	msg, _ := s.stdout.ReadString('\n')
+	return errors.New(strings.TrimSpace(msg))
+}
+
+// Sends an scp message and returns the server's answer
+func (s *testSCP) send(msg string) error {
+	if _, err := io.WriteString(s.stdin, msg); err != nil {
+		return err
+	}
+	return s.ack()
+}
+
+// Sends a file named name with contents, the way scp does
+func (s *testSCP) sendFile(name, contents string) error {
+	if err := s.send("C0644 " + strconv.Itoa(len(contents)) + " " + name + "\n"); err != nil {
+		return err
+	}
+	return s.send(contents + "\x00")
+}
+
+func TestSinkFileNames(t *testing.T) {
+	c := newTestConfig(t)
+	addr := startTestServer(t, c)
+	os.Mkdir(filepath.Join(c.Dir, "existing"), 0755)
+
+	for _, name := range []string{"../evil", "..", ".", "", "sub/evil", "/etc/evil"} {
+		scp := startTestSCP(t, addr, "scp -t existing")
+		if err := scp.ack(); err != nil {
+			t.Fatal(err)
+		}
+		if err := scp.sendFile(name, "evil"); err == nil || !strings.Contains(err.Error(), "unexpected filename") {
+			t.Errorf("File name %q not refused: %v", name, err)
+		}
+	}
+	scp := startTestSCP(t, addr, "scp -r -t existing")
+	scp.ack()
+	if err := scp.send("D0755 0 ..\n"); err == nil {
+		t.Error("Directory name .. not refused")
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(c.Dir), "evil")); err == nil {
+		t.Error("File written outside of the shared directory")
+	}
+
+	// Directories need -r
+	scp = startTestSCP(t, addr, "scp -t existing")
+	scp.ack()
+	if err := scp.send("D0755 0 dir\n"); err == nil {
+		t.Error("Directory accepted without -r")
+	}
+
+	// A file copied to a directory goes into it
+	scp = startTestSCP(t, addr, "scp -t existing")
+	scp.ack()
+	if err := scp.sendFile("file.txt", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	scp.stdin.Close()
+	scp.session.Wait()
+	if data, err := os.ReadFile(filepath.Join(c.Dir, "existing", "file.txt")); err != nil || string(data) != "hello" {
+		t.Errorf("File not copied into the directory: %q, %v", data, err)
+	}
+
+	// A directory copied to a target that isn't there becomes the target,
+	// like with scp -r dir host:newtarget
+	scp = startTestSCP(t, addr, "scp -r -t newtarget")
+	scp.ack()
+	for _, step := range []func() error{
+		func() error { return scp.send("D0755 0 dir\n") },
+		func() error { return scp.sendFile("file.txt", "hello") },
+		func() error { return scp.send("E\n") },
+	} {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// There's only one target
+	if err := scp.sendFile("other.txt", "hello"); err == nil {
+		t.Error("Second file accepted for a target that isn't a directory")
+	}
+	if data, err := os.ReadFile(filepath.Join(c.Dir, "newtarget", "file.txt")); err != nil || string(data) != "hello" {
+		t.Errorf("Directory not copied as the target: %q, %v", data, err)
+	}
+}
+
+func TestSinkPreserveTimes(t *testing.T) {
+	c := newTestConfig(t)
+	addr := startTestServer(t, c)
+
+	scp := startTestSCP(t, addr, "scp -r -p -t .")
+	scp.ack()
+	for _, step := range []func() error{
+		func() error { return scp.send("T1500000000 0 1500000001 0\n") },
+		func() error { return scp.send("D0700 0 dir\n") },
+		func() error { return scp.send("T1600000000 0 1600000001 0\n") },
+		func() error { return scp.sendFile("file.txt", "hello") },
+		func() error { return scp.send("E\n") },
+	} {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scp.stdin.Close()
+	scp.session.Wait()
+
+	for name, mtime := range map[string]int64{"dir": 1500000000, "dir/file.txt": 1600000000} {
+		fi, err := os.Stat(filepath.Join(c.Dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.ModTime().Unix() != mtime {
+			t.Errorf("%s modified at %v, expected %d", name, fi.ModTime(), mtime)
+		}
+	}
+	if fi, _ := os.Stat(filepath.Join(c.Dir, "dir")); fi.Mode().Perm() != 0700 {
+		t.Errorf("Directory has mode %v", fi.Mode())
+	}
+}
+
+// Logs written by the server, which tests can look at while it's running
+type testLogs struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *testLogs) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+func (l *testLogs) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.String()
+}
+
+func TestSinkCancelled(t *testing.T) {
+	c := newTestConfig(t)
+	c.PartialUploads = partialDelete
+	logs := &testLogs{}
+	c.Logger = slog.New(slog.NewTextHandler(logs, nil))
+	addr := startTestServer(t, c)
+
+	scp := startTestSCP(t, addr, "scp -t file.txt")
+	scp.ack()
+	if err := scp.send("C0644 10 file.txt\n"); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(scp.stdin, "hello")
+	var id string
+	for deadline := time.Now().Add(5 * time.Second); len(id) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if sessions := c.sessions.list(); len(sessions) == 1 && len(sessions[0].Transfers) == 1 && sessions[0].Transfers[0].Bytes == 5 {
+			id = sessions[0].ID
+		}
+	}
+	if len(id) == 0 {
+		t.Fatal("Upload not in progress")
+	}
+
+	// Kicked out through the admin API, the upload stops there
+	c.sessions.close(id)
+	if err := scp.session.Wait(); err == nil {
+		t.Error("Client didn't notice the session was closed")
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(c.sessions.finished()) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+	}
+	if finished := c.sessions.finished(); len(finished) != 1 || finished[0].Bytes != 5 {
+		t.Errorf("Got finished transfers %+v", finished)
+	}
+	if _, err := os.Stat(filepath.Join(c.Dir, "file.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Cancelled upload left behind: %v", err)
+	}
+	if !strings.Contains(logs.String(), `err="Session closed"`) {
+		t.Errorf("Cancelled upload not logged with the reason:\n%s", logs)
+	}
+}
+
+func TestSinkExitStatus(t *testing.T) {
+	c := newTestConfig(t)
+	addr := startTestServer(t, c)
+
+	// Files the client can't send don't stop the rest, but the command fails
+	scp := startTestSCP(t, addr, "scp -t .")
+	scp.ack()
+	io.WriteString(scp.stdin, "\x01scp: missing.txt: No such file or directory\n")
+	if err := scp.sendFile("file.txt", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	scp.stdin.Close()
+	var exitErr *ssh.ExitError
+	if err := scp.session.Wait(); !errors.As(err, &exitErr) || exitErr.ExitStatus() != 1 {
+		t.Errorf("Got %v after a file the client couldn't send, expected exit status 1", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(c.Dir, "file.txt")); string(data) != "hello" {
+		t.Errorf("File after the one that couldn't be sent has %q", data)
+	}
+
+	// Messages that aren't part of the protocol are refused
+	scp = startTestSCP(t, addr, "scp -t .")
+	scp.ack()
+	if err := scp.send("X0644 5 file.txt\n"); err == nil {
+		t.Error("Unknown message accepted")
+	}
+	if err := scp.send("C0644 5 \n"); err == nil {
+		t.Error("C message without a name accepted")
+	}
+}
@@ -1,26 +1,41 @@
-package main
+package simplescp
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
-	"syscall"
+	"sync"
+	"time"
 
-	"github.com/FranGM/simplelog"
 	"golang.org/x/crypto/ssh"
 )
 
-func (config scpConfig) startSCPSource(channel ssh.Channel, opts scpOptions) error {
+func (config Config) startSCPSource(ctx context.Context, channel ssh.Channel, opts scpOptions) error {
 	var exitStatus uint8
 	// We need to wait for client to initialize data transfer with a binary zero
 	err := checkSCPClientCode(channel)
 	if err != nil {
 		exitStatus = 1
-		simplelog.Error.Printf("Got error receiving initial status code from client: %v", err)
+		config.logger().Error("Got error receiving initial status code from client", "err", err)
 		closeChannel(channel, exitStatus)
+		return err
+	}
+
+	// Write only users can't download anything
+	if !config.perms.Has(PermRead) {
+		for _, target := range opts.fileNames {
+			msg := fmt.Sprintf("scp: %s: Permission denied", target)
+			sendErrorToClient(msg, channel)
+		}
+		closeChannel(channel, 1)
+		return errors.New("Permission denied")
 	}
 
 	for _, target := range opts.fileNames {
@@ -33,37 +48,65 @@ func (config scpConfig) startSCPSource(channel ssh.Channel, opts scpOptions) err
 		}
 
 		absTarget = filepath.Clean(absTarget)
-		if !strings.HasPrefix(absTarget, config.Dir) {
+		if !isWithinDir(absTarget, filepath.Clean(config.Dir)) {
 			// We've requested a file outside of our working directory, so deny it even exists!
 			msg := fmt.Sprintf("scp: %s: No such file or directory", target)
 			sendErrorToClient(msg, channel)
+			exitStatus = 1
 			continue
 		}
 
-		simplelog.Debug.Printf("Target is now %v - %v", absTarget, target)
-
-		fileList, err := filepath.Glob(absTarget)
+		config.logger().Debug("Resolved target", "target", target, "path", absTarget)
+
+		// Wildcards (like in scp host:'logs/*.log') are expanded here, the
+		// client doesn't have a shell on our side to do it. They're matched
+		// with paths as the client sees them, so symlinks can't take them
+		// out of our working directory
+		rel, _ := filepath.Rel(config.Dir, absTarget)
+		pattern := filepath.Join(string(filepath.Separator), rel)
+		if hasMeta(pattern) && !config.perms.Has(PermList) {
+			// Matching it would tell them what's in the directory
+			sendErrorToClient(fmt.Sprintf("scp: %s: Permission denied", target), channel)
+			exitStatus = 1
+			continue
+		}
+		matches, err := glob(jailedFS{config.fileSystem(), config}, pattern)
 		if err != nil {
-			simplelog.Error.Printf("Error when evaluating glob: %v", err)
-			// Maybe a "file not found" isn't the most appropriate error to return here?
-			msg := fmt.Sprintf("scp: %s: No such file or directory", target)
+			config.logger().Info("Invalid pattern", "target", target, "err", err)
+			msg := fmt.Sprintf("scp: %s: Invalid pattern", target)
 			sendErrorToClient(msg, channel)
+			exitStatus = 1
 			continue
 		}
 
 		// If there are no matches it needs to be reported as an error (scp: <target>: No such file or directory)
-		if len(fileList) == 0 {
+		if len(matches) == 0 {
 			msg := fmt.Sprintf("scp: %s: No such file or directory", target)
 			sendErrorToClient(msg, channel)
+			exitStatus = 1
 		}
 
-		for _, file := range fileList {
-			// FIXME: We probably don't want to stop here, just log/report an error
-			err := config.sendFileBySCP(file, channel, opts)
-			if err != nil {
-				// TODO: Need to do something with the error here
+		files := make([]string, len(matches))
+		for i, match := range matches {
+			files[i] = filepath.Join(config.Dir, match)
+		}
+		next, stop := config.prefetchSourceFiles(files, opts)
+		for sf := range next {
+			err := config.sendFileBySCP(ctx, sf, channel, opts, nil)
+			if err == nil {
+				continue
+			}
+			exitStatus = 1
+			if !errors.As(err, new(skippedFile)) {
+				// Something went wrong talking to the client, there's no point going on
+				config.logger().Error("Error sending files", "file", sf.file, "err", err)
+				stop()
+				closeChannel(channel, exitStatus)
+				return err
 			}
+			config.logger().Warn("Skipped file", "file", sf.file, "err", err)
 		}
+		stop()
 	}
 
 	closeChannel(channel, exitStatus)
@@ -79,27 +122,25 @@ func (config scpConfig) startSCPSource(channel ssh.Channel, opts scpOptions) err
 func closeChannel(channel ssh.Channel, exitStatus uint8) {
 	sendExitStatusCode(channel, exitStatus)
 	channel.Close()
-	simplelog.Info.Printf("session closed")
+	slog.Debug("session closed")
 }
 
 // Sends file modification and access times
 func sendFileTimes(fi os.FileInfo, channel ssh.Channel) error {
-	// TODO: This is not portable, need to figure out how this should behave in non-unix systems
-	f, ok := fi.Sys().(*syscall.Stat_t)
-	if !ok {
-		// TODO: Handle the error
-		// Agghh!! We're not in unix!!
-		simplelog.Error.Printf("We're not in unix")
-		return errors.New("Not in a unix system, not sure what to do")
+	var msg string
+	if mtime, atime, ok := fileTimes(fi); ok {
+		msg = fmt.Sprintf("T%d 0 %d 0\n", mtime.Sec, atime.Sec)
+	} else {
+		// Files that don't come from the local filesystem only have a modification time
+		msg = fmt.Sprintf("T%d 0 %d 0\n", fi.ModTime().Unix(), fi.ModTime().Unix())
 	}
-
-	msg := fmt.Sprintf("T%d 0 %d 0\n", getLastModification(f), getLastAccess(f))
 	err := sendSCPControlMsg(msg, channel)
 	return err
 }
 
-// Compose and send an scp control message
-func composeSCPControlMsg(fi os.FileInfo, channel ssh.Channel, opts scpOptions) error {
+// Compose and send an scp control message for the file called name (which,
+// if it's a symlink, can be different from the one fi has)
+func composeSCPControlMsg(name string, fi os.FileInfo, channel ssh.Channel, opts scpOptions) error {
 	if opts.PreserveMode {
 		err := sendFileTimes(fi, channel)
 		if err != nil {
@@ -110,18 +151,18 @@ func composeSCPControlMsg(fi os.FileInfo, channel ssh.Channel, opts scpOptions)
 	var msg string
 	if fi.IsDir() {
 		// TODO: We format mode as octal making sure it has a leading zero. What happens if sticky bit is already set?
-		msg = fmt.Sprintf("D%#o 0 %v\n", fi.Mode()&os.ModePerm, fi.Name())
+		msg = fmt.Sprintf("D%#o 0 %v\n", fi.Mode()&os.ModePerm, name)
 	} else {
-		msg = fmt.Sprintf("C%#o %d %v\n", fi.Mode()&os.ModePerm, fi.Size(), fi.Name())
+		msg = fmt.Sprintf("C%#o %d %v\n", fi.Mode()&os.ModePerm, fi.Size(), name)
 	}
 	return sendSCPControlMsg(msg, channel)
 }
 
 // Sends a scp control message and waits for the reply
 func sendSCPControlMsg(msg string, channel ssh.Channel) error {
-	simplelog.Debug.Printf("Sending control message: %q", msg[:len(msg)-1])
+	slog.Debug("Sending control message", "msg", msg[:len(msg)-1])
 	n, err := channel.Write([]byte(msg))
-	simplelog.Debug.Printf("Sent %d bytes", n)
+	slog.Debug("Sent control message", "bytes", n)
 	if err != nil {
 		return err
 	}
@@ -142,7 +183,7 @@ func checkSCPClientCode(channel ssh.Channel) error {
 		return err
 	}
 
-	simplelog.Debug.Printf("Received %d bytes from client", nread)
+	slog.Debug("Received status from client", "bytes", nread)
 
 	// A binary 0 means everything is peachy
 	if statusbuf[0] == 0 {
@@ -154,9 +195,11 @@ func checkSCPClientCode(channel ssh.Channel) error {
 	// TODO: Determine how big the buffer could/should be
 	statusmsgbuf := make([]byte, 256)
 	nread, err = channel.Read(statusmsgbuf)
-	msgSize := strings.Index(string(statusmsgbuf), "\n")
-	msg := string(statusmsgbuf)[:msgSize]
-	simplelog.Error.Printf("Got error %d from client: %v", statusbuf[0], msg)
+	if err != nil && nread == 0 {
+		return err
+	}
+	msg, _, _ := strings.Cut(string(statusmsgbuf[:nread]), "\n")
+	slog.Error("Got error from client", "code", statusbuf[0], "msg", msg)
 
 	//TODO: Return a fatal error (special type) if we've received a 2 so we can close the connection
 	return errors.New(msg)
@@ -168,83 +211,243 @@ func sendErrorToClient(msg string, channel ssh.Channel) error {
 	return err
 }
 
-// Send a file (or directory) through scp
-func (config scpConfig) sendFileBySCP(file string, channel ssh.Channel, opts scpOptions) error {
+// A file that couldn't be sent, after telling the client why. Unlike errors
+// talking to the client, the transfer can go on with the next one
+type skippedFile struct {
+	err error
+}
+
+func (s skippedFile) Error() string { return s.err.Error() }
+func (s skippedFile) Unwrap() error { return s.err }
+
+// How many files are opened (and directories listed) ahead of the one being
+// sent, at each level of a recursive download. Waiting for the client to
+// acknowledge one file is then spent on getting the next ones ready, which
+// is most of the time it takes with lots of small ones
+const sourcePrefetch = 16
+
+// sourceFile is a file about to be sent through scp, opened ahead of time
+type sourceFile struct {
+	file     string      // Full path, in our working directory
+	filename string      // Relative path, as the client sees it
+	realFile string      // Where it really is, symlinks resolved
+	f        File        // Open, unless there was an error
+	fi       os.FileInfo // What f has
+	names    []string    // What's in it to send, if it's a directory we're recursing into
+	listErr  error       // Why it couldn't be listed
+	err      error       // Why it can't be sent, for the client to be told about
+}
 
-	// Filename as the client sees it (used for error reporting purposes)
-	filename := strings.TrimPrefix(file, config.Dir)
+func (sf sourceFile) close() {
+	if sf.f != nil {
+		sf.f.Close()
+	}
+}
 
-	f, err := os.Open(file)
+// Open file to be sent through scp, listing it if it's a directory that's
+// going to be sent too
+func (config Config) openSourceFile(file string, opts scpOptions) sourceFile {
+	sf := sourceFile{file: file}
+	sf.filename, _ = filepath.Rel(config.Dir, file)
+	log := config.logger().With("file", file)
+
+	fsys := config.fileSystem()
+	realFile, err := config.resolvePath(sf.filename)
+	if err == nil && config.deniedFile(sf.filename) {
+		err = os.ErrNotExist
+	}
 	if err != nil {
-		simplelog.Error.Printf("Open failed: %q", err)
-		msg := fmt.Sprintf("scp: %s: %s", filename, err.(*os.PathError).Err)
-		sendErrorToClient(msg, channel)
-		return err
+		sf.err = err
+		return sf
+	}
+	sf.realFile = realFile
+	f, err := fsys.Open(realFile)
+	if err != nil {
+		log.Error("Open failed", "err", err)
+		sf.err = err
+		return sf
 	}
-	defer f.Close()
-
 	fi, err := f.Stat()
 	if err != nil {
-		simplelog.Error.Printf("Stat failed: %q", err)
-		msg := fmt.Sprintf("scp: %s: %s", filename, err.(*os.PathError).Err)
-		sendErrorToClient(msg, channel)
+		log.Error("Stat failed", "err", err)
+		f.Close()
+		sf.err = err
+		return sf
+	}
+	sf.f, sf.fi = f, fi
+
+	if fi.IsDir() && opts.Recursive && config.perms.Has(PermList) {
+		// TODO: Investigate if we might want to paginate this call in case there's a lot of files in there
+		entries, err := fsys.ReadDir(realFile)
+		for _, e := range entries {
+			if e.Mode()&os.ModeSymlink != 0 && config.Symlinks != "" && config.Symlinks != symlinksFollow {
+				// scp has no way of sending the links themselves
+				log.Warn("Skipping symlink", "name", e.Name(), "symlinks", config.Symlinks)
+				continue
+			}
+			if config.deniedFile(e.Name()) || config.hiddenFile(e.Name()) {
+				continue
+			}
+			sf.names = append(sf.names, e.Name())
+		}
+		sf.listErr = err
+	}
+	return sf
+}
+
+// Open files in the background, in order, up to sourcePrefetch of them ahead
+// of the ones taken from the channel returned. stop has to be called once
+// done with it, which closes those that won't be sent
+func (config Config) prefetchSourceFiles(files []string, opts scpOptions) (next <-chan sourceFile, stop func()) {
+	ch := make(chan sourceFile, sourcePrefetch)
+	done := make(chan struct{})
+	go func() {
+		defer close(ch)
+		for _, file := range files {
+			sf := config.openSourceFile(file, opts)
+			select {
+			case ch <- sf:
+			case <-done:
+				sf.close()
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			close(done)
+			for sf := range ch {
+				sf.close()
+			}
+		})
+	}
+}
+
+// Send a file (or directory, inside of the parents given) through scp, and
+// close it. Returns a skippedFile error if it (or some file in it) couldn't be
+// sent but the rest can be. Nothing more is sent once ctx is cancelled
+func (config Config) sendFileBySCP(ctx context.Context, sf sourceFile, channel ssh.Channel, opts scpOptions, parents []string) error {
+	// Filename as the client sees it (used for error reporting purposes)
+	file, filename, realFile := sf.file, sf.filename, sf.realFile
+	log := config.logger().With("file", file)
+
+	if err := context.Cause(ctx); err != nil {
+		sf.close()
 		return err
 	}
 
+	if sf.err != nil {
+		msg := fmt.Sprintf("scp: %s: %s", filename, pathErrReason(sf.err))
+		sendErrorToClient(msg, channel)
+		return skippedFile{sf.err}
+	}
+	f, fi := sf.f, sf.fi
+	defer f.Close()
+
 	if fi.IsDir() {
 		// We're trying to send a directory, this is either an error or we'll need to iterate through the directory's contents
 		if !opts.Recursive {
-			simplelog.Error.Printf("Found a dir but we're not being recursive (not a regular file): %q", file)
+			log.Error("Found a dir but we're not being recursive (not a regular file)")
 
 			msg := fmt.Sprintf("scp: %s: not a regular file", filename)
 			sendErrorToClient(msg, channel)
-			return errors.New("not a regular file")
+			return skippedFile{errors.New("not a regular file")}
 		}
-		err := composeSCPControlMsg(fi, channel, opts)
-
+		if !config.perms.Has(PermList) {
+			msg := fmt.Sprintf("scp: %s: Permission denied", filename)
+			sendErrorToClient(msg, channel)
+			return skippedFile{os.ErrPermission}
+		}
+		if slices.Contains(parents, realFile) {
+			// A symlink to a directory we're already in, we'd never finish
+			log.Warn("Found a symlink loop")
+			msg := fmt.Sprintf("scp: %s: Too many levels of symbolic links", filename)
+			sendErrorToClient(msg, channel)
+			return skippedFile{errors.New("symlink loop")}
+		}
+		err := composeSCPControlMsg(filepath.Base(file), fi, channel, opts)
 		if err != nil {
-			// TODO: React accordingly (we probably don't want to keep sending this directory now)
-			simplelog.Error.Printf("ERR is %q", err)
+			// The client won't be expecting what's in it
+			log.Error("Error sending control message", "err", err)
+			return err
 		}
-		// TODO: Investigate if we might want to paginate this call in case there's a lot of files in there
-		names, err := f.Readdirnames(0)
-		simplelog.Debug.Printf("Found the following files %v - (err is %v)", names, err)
-		for _, name := range names {
+		log.Debug("Found the following files", "files", sf.names, "err", sf.listErr)
+		files := make([]string, len(sf.names))
+		for i, name := range sf.names {
+			files[i] = filepath.Join(file, name)
+		}
+		next, stop := config.prefetchSourceFiles(files, opts)
+		defer stop()
+		var skipped error
+		parents = append(parents, realFile)
+		for child := range next {
+			name := filepath.Base(child.file)
 			// TODO: Too many recursive calls might be a problem here.
-			err := config.sendFileBySCP(filepath.Join(file, name), channel, opts)
-			if err != nil {
-				// TODO: Handle this properly (check how scp does it)
-				simplelog.Error.Printf("Got error after trying to send file: %q", err)
+			err := config.sendFileBySCP(ctx, child, channel, opts, parents)
+			if errors.As(err, new(skippedFile)) {
+				// Like scp, carry on with the rest of the directory
+				log.Warn("Skipped file", "name", name, "err", err)
+				skipped = err
+			} else if err != nil {
+				log.Error("Got error after trying to send file", "name", name, "err", err)
 				return err
 			}
 		}
 		// Signal that we've finished with this directory
-		return sendSCPControlMsg("E\n", channel)
+		if err := sendSCPControlMsg("E\n", channel); err != nil {
+			return err
+		}
+		return skipped
 	}
 	// We're just sending a regular file
-	err = composeSCPControlMsg(fi, channel, opts)
+	err := composeSCPControlMsg(filepath.Base(file), fi, channel, opts)
 	if err != nil {
 		// TODO: React accordingly
-		simplelog.Error.Printf("ERR is %q", err)
+		log.Error("Error sending control message", "err", err)
 		return err
 	}
-	err = sendFileContentsBySCP(f, channel)
-	return err
+	start := time.Now()
+	t := config.session.startTransfer("scp", false, realFile)
+	defer config.session.endTransfer(t)
+	h := config.transferChecksum()
+	n, err := sendFileContentsBySCP(ctx, f, fi.Size(), channel, h, t)
+	err = cancelCause(ctx, err)
+	var checksum string
+	if err == nil {
+		checksum = hexSum(h)
+	}
+	config.transferDone("scp", false, realFile, start, n, checksum, err == nil)
+	if err != nil {
+		log.Error("Error sending file", "err", err)
+		return err
+	}
+	log.Info("Sent file", "bytes", fi.Size())
+	return nil
 }
 
-// Does the actual data transfer of the file's contents
-func sendFileContentsBySCP(f *os.File, channel ssh.Channel) error {
-	n, err := io.Copy(channel, f)
-	simplelog.Debug.Printf("Sending content, sent %d bytes", n)
+// Does the actual data transfer of the file's contents, returns how many bytes
+// were sent. They're hashed with h as they go, if there's one, and counted
+// towards t. It stops once ctx is cancelled
+func sendFileContentsBySCP(ctx context.Context, f File, size int64, channel ssh.Channel, h hash.Hash, t *liveTransfer) (int64, error) {
+	w := io.MultiWriter(channel, t)
+	if h != nil {
+		w = io.MultiWriter(channel, h, t)
+	}
+	w = ctxWriter{ctx, w}
+	buf := getCopyBuffer()
+	defer putCopyBuffer(buf)
+	n, err := copySparse(w, f, size, *buf)
+	slog.Debug("Sending content", "bytes", n)
 	if err != nil {
-		return err
+		return n, err
 	}
 
 	// Need to send binary zero after actual data transfer to signify everything's ok
 	_, err = channel.Write([]byte("\000"))
 	if err != nil {
-		return err
+		return n, err
 	}
 
-	return checkSCPClientCode(channel)
+	return n, checkSCPClientCode(channel)
 }
@@ -0,0 +1,324 @@
+package simplescp
+
+import (
+	"errors"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Asks an scp source for the next file, returns its C message and contents.
+// Directories just come with their D or E message
+func (s *testSCP) receive() (string, string, error) {
+	s.stdin.Write([]byte{0})
+	msg, err := s.stdout.ReadString('\n')
+	if err != nil {
+		return "", "", err
+	}
+	if strings.HasPrefix(msg, "D") || strings.HasPrefix(msg, "E") {
+		return strings.TrimSpace(msg), "", nil
+	}
+	if !strings.HasPrefix(msg, "C") {
+		return "", "", errors.New(strings.TrimSpace(msg[1:]))
+	}
+	fields := strings.SplitN(strings.TrimSpace(msg), " ", 3)
+	size, _ := strconv.Atoi(fields[1])
+	s.stdin.Write([]byte{0})
+	contents := make([]byte, size+1)
+	if _, err := io.ReadFull(s.stdout, contents); err != nil {
+		return "", "", err
+	}
+	return strings.TrimSpace(msg), string(contents[:size]), nil
+}
+
+func TestSourceGlob(t *testing.T) {
+	c := newTestConfig(t)
+	for _, name := range []string{"a.log", "b.log", "c.txt", "dir/d.log"} {
+		os.MkdirAll(filepath.Join(c.Dir, filepath.Dir(name)), 0755)
+		os.WriteFile(filepath.Join(c.Dir, name), []byte(name), 0644)
+	}
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "secret.log"), []byte("secret"), 0644)
+	os.Symlink(outside, filepath.Join(c.Dir, "out"))
+	addr := startTestServer(t, c)
+
+	scp := startTestSCP(t, addr, "scp -f *.log dir/*")
+	for _, expected := range []string{"a.log", "b.log", "dir/d.log"} {
+		msg, contents, err := scp.receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg != "C0644 "+strconv.Itoa(len(expected))+" "+filepath.Base(expected) || contents != expected {
+			t.Errorf("Got %q with %q, expected %s", msg, contents, expected)
+		}
+	}
+	if _, _, err := scp.receive(); err != io.EOF {
+		t.Errorf("Got more than the matching files: %v", err)
+	}
+	if err := scp.session.Wait(); err != nil {
+		t.Error(err)
+	}
+
+	for _, pattern := range []string{"*.nothing", "out/*.log", "/../*"} {
+		scp := startTestSCP(t, addr, "scp -f "+pattern)
+		if _, _, err := scp.receive(); err == nil || !strings.Contains(err.Error(), "No such file or directory") {
+			t.Errorf("Pattern %s matched: %v", pattern, err)
+		}
+		if err := scp.session.Wait(); err == nil {
+			t.Errorf("Pattern %s without matches succeeded", pattern)
+		}
+	}
+}
+
+func TestSourceMultipleFiles(t *testing.T) {
+	c := newTestConfig(t)
+	os.WriteFile(filepath.Join(c.Dir, "-a.txt"), []byte("a"), 0644)
+	os.Mkdir(filepath.Join(c.Dir, "dir"), 0755)
+	os.WriteFile(filepath.Join(c.Dir, "dir", "b.txt"), []byte("b"), 0644)
+	os.Symlink(t.TempDir(), filepath.Join(c.Dir, "dir", "out"))
+	addr := startTestServer(t, c)
+
+	// Files that can't be sent are reported, and the rest are sent anyway
+	scp := startTestSCP(t, addr, "scp -r -f -- -a.txt missing dir")
+	var got []string
+	for i := 0; i < 6; i++ {
+		msg, _, err := scp.receive()
+		if err != nil {
+			msg = err.Error()
+		}
+		got = append(got, msg)
+	}
+	// What's in the directory can come in any order
+	slices.Sort(got[3:5])
+	expected := []string{
+		"C0644 1 -a.txt",
+		"scp: missing: No such file or directory",
+		"D0755 0 dir",
+		"C0644 1 b.txt",
+		"scp: dir/out: permission denied",
+		"E",
+	}
+	if !slices.Equal(got, expected) {
+		t.Errorf("Got %q, expected %q", got, expected)
+	}
+	if _, _, err := scp.receive(); err != io.EOF {
+		t.Errorf("Got more than the requested files: %v", err)
+	}
+	if err := scp.session.Wait(); err == nil {
+		t.Error("Transfer with missing files succeeded")
+	}
+}
+
+func TestSourcePreserveTimes(t *testing.T) {
+	c := newTestConfig(t)
+	file := filepath.Join(c.Dir, "file.txt")
+	os.WriteFile(file, []byte("hello"), 0644)
+	os.Chtimes(file, time.Unix(1500000001, 0), time.Unix(1500000000, 0))
+	addr := startTestServer(t, c)
+
+	scp := startTestSCP(t, addr, "scp -p -f file.txt")
+	scp.stdin.Write([]byte{0})
+	msg, _ := scp.stdout.ReadString('\n')
+	if msg != "T1500000000 0 1500000001 0\n" {
+		t.Errorf("Got times %q", msg)
+	}
+	if msg, contents, err := scp.receive(); err != nil || msg != "C0644 5 file.txt" || contents != "hello" {
+		t.Errorf("Got %q with %q (%v) after the times", msg, contents, err)
+	}
+}
+
+func TestSourceSymlinks(t *testing.T) {
+	for policy, expected := range map[string][]string{
+		"":               {"D0755 0 dir", "C0644 1 file.txt", "C0644 1 link.txt", "scp: dir/loop: Too many levels of symbolic links", "E"},
+		symlinksSkip:     {"D0755 0 dir", "C0644 1 file.txt", "E"},
+		symlinksPreserve: {"D0755 0 dir", "C0644 1 file.txt", "E"},
+	} {
+		c := newTestConfig(t)
+		c.Symlinks = policy
+		os.Mkdir(filepath.Join(c.Dir, "dir"), 0755)
+		os.WriteFile(filepath.Join(c.Dir, "dir", "file.txt"), []byte("a"), 0644)
+		os.Symlink("file.txt", filepath.Join(c.Dir, "dir", "link.txt"))
+		os.Symlink(".", filepath.Join(c.Dir, "dir", "loop"))
+		addr := startTestServer(t, c)
+
+		scp := startTestSCP(t, addr, "scp -r -f dir")
+		var got []string
+		for {
+			msg, _, err := scp.receive()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				msg = err.Error()
+			}
+			got = append(got, msg)
+		}
+		slices.Sort(got[1 : len(got)-1])
+		if !slices.Equal(got, expected) {
+			t.Errorf("Got %q with symlinks %q, expected %q", got, policy, expected)
+		}
+	}
+}
+
+func TestSourceTree(t *testing.T) {
+	c := newTestConfig(t)
+	expected := map[string]string{}
+	var mkTree func(dir string, depth int)
+	mkTree = func(dir string, depth int) {
+		os.MkdirAll(filepath.Join(c.Dir, dir), 0755)
+		for i := 0; i < 2*sourcePrefetch; i++ {
+			name := filepath.Join(dir, "file"+strconv.Itoa(i))
+			expected[name] = name
+			os.WriteFile(filepath.Join(c.Dir, name), []byte(name), 0644)
+		}
+		if depth > 0 {
+			for i := 0; i < 3; i++ {
+				mkTree(filepath.Join(dir, "dir"+strconv.Itoa(i)), depth-1)
+			}
+		}
+	}
+	mkTree("tree", 2)
+	addr := startTestServer(t, c)
+
+	// Files opened ahead of time still come inside of their own directory
+	scp := startTestSCP(t, addr, "scp -r -f tree")
+	got := map[string]string{}
+	var dir []string
+	for {
+		msg, contents, err := scp.receive()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		fields := strings.SplitN(msg, " ", 3)
+		switch msg[0] {
+		case 'D':
+			dir = append(dir, fields[2])
+		case 'E':
+			dir = dir[:len(dir)-1]
+		default:
+			got[filepath.Join(append(dir, fields[2])...)] = contents
+		}
+	}
+	if len(dir) != 0 {
+		t.Errorf("Directories %q weren't finished", dir)
+	}
+	if !maps.Equal(got, expected) {
+		t.Errorf("Got %d files, expected %d", len(got), len(expected))
+	}
+	if err := scp.session.Wait(); err != nil {
+		t.Error(err)
+	}
+}
+
+// bigFile is a file of any size that's made up as it's read. Reads past
+// gateAt wait for gate to be closed
+type bigFile struct {
+	size    int64
+	off     int64
+	gateAt  int64
+	gate    chan struct{}
+	maxRead int
+}
+
+func (f *bigFile) Read(p []byte) (int, error) {
+	if f.off >= f.size {
+		return 0, io.EOF
+	}
+	if f.off >= f.gateAt {
+		<-f.gate
+	}
+	f.maxRead = max(f.maxRead, len(p))
+	n := int(min(int64(len(p)), f.size-f.off))
+	for i := range p[:n] {
+		p[i] = byte(f.off + int64(i))
+	}
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *bigFile) ReadAt(p []byte, off int64) (int, error)  { return 0, errors.New("not supported") }
+func (f *bigFile) Write(p []byte) (int, error)              { return 0, os.ErrPermission }
+func (f *bigFile) WriteAt(p []byte, off int64) (int, error) { return 0, os.ErrPermission }
+func (f *bigFile) Close() error                             { return nil }
+func (f *bigFile) Stat() (os.FileInfo, error)               { return bigFileInfo{f.size}, nil }
+
+type bigFileInfo struct{ size int64 }
+
+func (fi bigFileInfo) Name() string       { return "big.bin" }
+func (fi bigFileInfo) Size() int64        { return fi.size }
+func (fi bigFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi bigFileInfo) ModTime() time.Time { return time.Now() }
+func (fi bigFileInfo) IsDir() bool        { return false }
+func (fi bigFileInfo) Sys() any           { return nil }
+
+// bigFileFS has a big.bin in every directory, and everything else it has is
+// on the local file system
+type bigFileFS struct {
+	FileSystem
+	file *bigFile
+}
+
+func (fsys bigFileFS) Open(name string) (File, error) {
+	if filepath.Base(name) == "big.bin" {
+		return fsys.file, nil
+	}
+	return fsys.FileSystem.Open(name)
+}
+
+func (fsys bigFileFS) Stat(name string) (os.FileInfo, error) {
+	if filepath.Base(name) == "big.bin" {
+		return bigFileInfo{fsys.file.size}, nil
+	}
+	return fsys.FileSystem.Stat(name)
+}
+
+func (fsys bigFileFS) Lstat(name string) (os.FileInfo, error) {
+	return fsys.Stat(name)
+}
+
+func TestSourceStreams(t *testing.T) {
+	file := &bigFile{size: 256 << 20, gateAt: 4 << 20, gate: make(chan struct{})}
+	c := newTestConfig(t)
+	c.FileSystem = bigFileFS{osFileSystem{}, file}
+	scp := startTestSCP(t, startTestServer(t, c), "scp -f big.bin")
+
+	scp.stdin.Write([]byte{0})
+	if msg, _ := scp.stdout.ReadString('\n'); msg != "C0644 268435456 big.bin\n" {
+		t.Fatalf("Unexpected C message %q", msg)
+	}
+	scp.stdin.Write([]byte{0})
+	// The start of the file arrives before the rest of it is read, so it's
+	// not all being read into memory first
+	start := make([]byte, 1<<20)
+	received := make(chan error)
+	go func() {
+		_, err := io.ReadFull(scp.stdout, start)
+		received <- err
+	}()
+	select {
+	case err := <-received:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Nothing sent before the whole file was read")
+	}
+	close(file.gate)
+	n, err := io.CopyN(io.Discard, scp.stdout, file.size-int64(len(start)))
+	if err != nil {
+		t.Fatalf("Received %d bytes: %v", n, err)
+	}
+	if start[1000] != byte(1000%256) {
+		t.Error("Unexpected file contents")
+	}
+	if file.maxRead > copyBufferSize {
+		t.Errorf("File read %d bytes at a time", file.maxRead)
+	}
+}
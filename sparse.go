@@ -0,0 +1,130 @@
+package simplescp
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// Size of the blocks checked for zeros. Holes can't be any smaller than the
+// file system's blocks anyway
+const sparseBlockSize = 4096
+
+// Zeros to send where there are holes
+var zeroBlock = make([]byte, 32*1024)
+
+// Copy the first size bytes of f to w through buf without reading the holes
+// in it (like the empty parts of VM images), just sending zeros in their place.
+// Files are streamed a buffer at a time, however big they are, and never more
+// than size bytes are sent even if they grow
+func copySparse(w io.Writer, f File, size int64, buf []byte) (int64, error) {
+	osFile, ok := f.(*os.File)
+	if !ok {
+		return copyAll(w, f, size, buf)
+	}
+	var n int64
+	for n < size {
+		start, end, err := nextData(osFile, n)
+		if err == io.EOF {
+			// It's all a hole from here on
+			start, end = size, size
+		} else if err != nil {
+			if n == 0 {
+				// Not supported by the file system, just copy it as it is
+				return copyAll(w, f, size, buf)
+			}
+			return n, err
+		}
+		start, end = min(start, size), min(end, size)
+
+		for n < start {
+			written, err := w.Write(zeroBlock[:min(int64(len(zeroBlock)), start-n)])
+			n += int64(written)
+			if err != nil {
+				return n, err
+			}
+		}
+		written, err := copyThrough(w, io.NewSectionReader(osFile, start, end-start), buf)
+		n += written
+		if err != nil {
+			return n, err
+		}
+		if written < end-start {
+			// It shrank, there's nothing else to send
+			return n, io.ErrUnexpectedEOF
+		}
+	}
+	return n, nil
+}
+
+// Copy the first size bytes of r to w through buf, failing if there aren't as
+// many as that
+func copyAll(w io.Writer, r io.Reader, size int64, buf []byte) (int64, error) {
+	n, err := copyThrough(w, io.LimitReader(r, size), buf)
+	if err == nil && n < size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Copy r to w through buf, even if r could write itself to w (files do, but
+// only make use of that for sockets, and otherwise allocate a buffer of their own)
+func copyThrough(w io.Writer, r io.Reader, buf []byte) (int64, error) {
+	return io.CopyBuffer(w, struct{ io.Reader }{r}, buf)
+}
+
+// sparseWriter writes a new file from the start, leaving holes where there
+// are only zeros so they don't take any space
+type sparseWriter struct {
+	f          io.WriterAt
+	off        int64
+	zerosAtEnd bool // Whether the last block was skipped, so the file isn't as long as it should be yet
+}
+
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		// Keep to whole blocks in the file, so holes can be left in them
+		block := min(len(p), sparseBlockSize-int(w.off%sparseBlockSize))
+		if isZeros(p[:block]) {
+			w.zerosAtEnd = true
+		} else {
+			// Write as many blocks with data as there are in one go
+			for block < len(p) {
+				next := min(len(p)-block, sparseBlockSize)
+				if isZeros(p[block : block+next]) {
+					break
+				}
+				block += next
+			}
+			if _, err := w.f.WriteAt(p[:block], w.off); err != nil {
+				return n, err
+			}
+			w.zerosAtEnd = false
+		}
+		w.off += int64(block)
+		n += block
+		p = p[block:]
+	}
+	return n, nil
+}
+
+// Make the file as long as everything written, if it ends in a hole
+func (w *sparseWriter) finish() error {
+	if !w.zerosAtEnd {
+		return nil
+	}
+	_, err := w.f.WriteAt([]byte{0}, w.off-1)
+	return err
+}
+
+func isZeros(p []byte) bool {
+	for len(p) > 0 {
+		n := min(len(p), len(zeroBlock))
+		if !bytes.Equal(p[:n], zeroBlock[:n]) {
+			return false
+		}
+		p = p[n:]
+	}
+	return true
+}
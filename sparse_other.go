@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd
+
+package simplescp
+
+import (
+	"errors"
+	"os"
+)
+
+func nextData(f *os.File, off int64) (start, end int64, err error) {
+	return 0, 0, errors.New("Finding holes isn't supported on this system")
+}
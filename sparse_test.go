@@ -0,0 +1,76 @@
+package simplescp
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSparseWriter(t *testing.T) {
+	var data []byte
+	data = append(data, bytes.Repeat([]byte("a"), 5000)...)
+	data = append(data, make([]byte, 3*sparseBlockSize)...)
+	data = append(data, bytes.Repeat([]byte("b"), 100)...)
+	data = append(data, make([]byte, 10000)...)
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := &sparseWriter{f: f}
+	// In pieces that don't line up with the blocks
+	for p := data; len(p) > 0; {
+		n := min(len(p), 3000)
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := w.finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	written, _ := os.ReadFile(f.Name())
+	if !bytes.Equal(written, data) {
+		t.Errorf("Wrote %d bytes that don't match the %d given", len(written), len(data))
+	}
+	if _, end, err := nextData(f, 0); err == nil && end >= int64(len(data)) {
+		t.Error("No holes left in the file")
+	}
+}
+
+func TestCopySparse(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.WriteAt([]byte("start"), 0)
+	f.WriteAt([]byte("middle"), 1<<20)
+	f.Truncate(3 << 20)
+
+	var buf bytes.Buffer
+	n, err := copySparse(&buf, f, 3<<20, make([]byte, 32*1024))
+	if err != nil || n != 3<<20 {
+		t.Fatalf("Copied %d bytes: %v", n, err)
+	}
+	expected, _ := os.ReadFile(f.Name())
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Error("Copy doesn't match the file")
+	}
+}
+
+func TestCopySparseSize(t *testing.T) {
+	var buf bytes.Buffer
+	// Files that grew since they were announced are cut short, and ones
+	// that shrank fail
+	if n, err := copySparse(&buf, &bigFile{size: 100, gateAt: 100}, 60, make([]byte, 16)); n != 60 || err != nil || buf.Len() != 60 {
+		t.Errorf("Copied %d bytes of a bigger file: %v", n, err)
+	}
+	if n, err := copySparse(io.Discard, &bigFile{size: 100, gateAt: 100}, 200, make([]byte, 16)); n != 100 || err != io.ErrUnexpectedEOF {
+		t.Errorf("Copied %d bytes of a smaller file: %v", n, err)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build linux || darwin || freebsd
+
+package simplescp
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Where the next data in f after off starts and ends, with SEEK_DATA and
+// SEEK_HOLE. io.EOF if there's only a hole left
+func nextData(f *os.File, off int64) (start, end int64, err error) {
+	start, err = f.Seek(off, unix.SEEK_DATA)
+	if errors.Is(err, unix.ENXIO) {
+		return 0, 0, io.EOF
+	} else if err != nil {
+		return 0, 0, err
+	}
+	end, err = f.Seek(start, unix.SEEK_HOLE)
+	return start, end, err
+}
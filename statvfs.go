@@ -0,0 +1,77 @@
+package simplescp
+
+import (
+	"github.com/pkg/sftp"
+)
+
+// Block size free space is counted in when it's down to the quota
+const quotaBlockSize = 4096
+
+// Longest file names when FileNames doesn't say otherwise
+const defaultNameMax = 255
+
+// ST_RDONLY in statvfs' flags
+const statvfsReadOnly = 1
+
+// fsSpace is how big a file system is and how much of it is free, in blocks
+// of bsize bytes and in files
+type fsSpace struct {
+	bsize  uint64
+	blocks uint64
+	bfree  uint64
+	bavail uint64
+	files  uint64
+	ffree  uint64
+}
+
+// Answer statvfs@openssh.com (what df on sshfs and the free space shown by
+// GUI clients come from). With a quota the space is the quota's, and what's
+// left of it, as long as the disk has that much room
+func (h *sftpHandler) StatVFS(r *sftp.Request) (_ *sftp.StatVFS, err error) {
+	defer h.recoverRequest(r, &err)
+	p, err := h.realPath(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	var space fsSpace
+	var diskErr error = sftp.ErrSSHFxOpUnsupported
+	if h.config.isLocal() {
+		space, diskErr = diskSpace(p)
+	}
+	if quota := int64(h.config.quotaLimit); quota > 0 && h.config.usage != nil {
+		quotaSpace := fsSpace{bsize: quotaBlockSize, blocks: uint64(quota) / quotaBlockSize}
+		free := max(quota-h.config.usage.current(h.config.fileSystem(), h.config.Dir), 0)
+		quotaSpace.bfree = uint64(free) / quotaBlockSize
+		if diskErr == nil {
+			diskFree := space.bavail * space.bsize / quotaBlockSize
+			quotaSpace.bfree = min(quotaSpace.bfree, diskFree)
+			quotaSpace.files, quotaSpace.ffree = space.files, space.ffree
+		}
+		quotaSpace.bavail = quotaSpace.bfree
+		space, diskErr = quotaSpace, nil
+	}
+	if diskErr != nil {
+		h.config.logger().Debug("Can't tell the client how much space is free", "err", diskErr)
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+
+	stat := &sftp.StatVFS{
+		Bsize:   space.bsize,
+		Frsize:  space.bsize,
+		Blocks:  space.blocks,
+		Bfree:   space.bfree,
+		Bavail:  space.bavail,
+		Files:   space.files,
+		Ffree:   space.ffree,
+		Favail:  space.ffree,
+		Namemax: defaultNameMax,
+	}
+	if h.config.FileNames.MaxLength > 0 {
+		stat.Namemax = uint64(h.config.FileNames.MaxLength)
+	}
+	if !h.config.perms.Has(PermWrite) {
+		stat.Flag |= statvfsReadOnly
+	}
+	return stat, nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+
+package simplescp
+
+import "errors"
+
+func diskSpace(p string) (fsSpace, error) {
+	return fsSpace{}, errors.New("Finding free space isn't supported on this system")
+}
@@ -0,0 +1,21 @@
+//go:build linux || darwin || freebsd
+
+package simplescp
+
+import "golang.org/x/sys/unix"
+
+// How big the file system p is on, and how much of it is free
+func diskSpace(p string) (fsSpace, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(p, &st); err != nil {
+		return fsSpace{}, err
+	}
+	return fsSpace{
+		bsize:  uint64(st.Bsize),
+		blocks: uint64(st.Blocks),
+		bfree:  uint64(st.Bfree),
+		bavail: uint64(st.Bavail),
+		files:  uint64(st.Files),
+		ffree:  uint64(st.Ffree),
+	}, nil
+}
@@ -0,0 +1,133 @@
+package simplescp
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The first file descriptor sockets are passed in, by systemd (see
+// sd_listen_fds(3)) or the simplescp we're taking over from
+const listenFDsStart = 3
+
+// Listeners for the sockets systemd passed in, if it started us through socket
+// activation. Otherwise there aren't any
+func systemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	// They're ours, programs we run (like upload commands) shouldn't pick them up
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	return fdListeners(n, names)
+}
+
+// Listeners for the n sockets we've been passed from fd 3 on, named after names
+// in errors if there are any
+func fdListeners(n int, names []string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for i := 0; i < n; i++ {
+		fd := listenFDsStart + i
+		name := "socket " + strconv.Itoa(fd)
+		if i < len(names) && len(names[i]) > 0 {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(f)
+		// FileListener has its own copy of it
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("Can't use %s: %v", name, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// Tells systemd about state changes through $NOTIFY_SOCKET, see sd_notify(3).
+// Does nothing unless the service has Type=notify
+func sdNotify(state string) error {
+	sock := os.Getenv("NOTIFY_SOCKET")
+	if len(sock) == 0 {
+		return nil
+	}
+	// Names starting with @ are abstract sockets, net takes care of those
+	conn, err := net.Dial("unixgram", sock)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// How often systemd expects to hear from us (WatchdogSec=), 0 if it doesn't
+func systemdWatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); len(pid) > 0 && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// How often the status shown by systemctl is updated, if there's no watchdog
+const systemdStatusInterval = 10 * time.Second
+
+// Lets systemd know we're ready to serve, then keeps feeding its watchdog and
+// updating the status line with the connections and sessions open, until stop
+// is closed
+func (s *Server) notifySystemd(stop <-chan struct{}) {
+	if len(os.Getenv("NOTIFY_SOCKET")) == 0 {
+		return
+	}
+	if err := sdNotify("READY=1\n" + s.systemdStatus()); err != nil {
+		s.Config().logger().Warn("Can't notify systemd", "err", err)
+		return
+	}
+	interval := systemdStatusInterval
+	watchdog := systemdWatchdogInterval()
+	if watchdog > 0 {
+		// Well before it runs out, like sd_watchdog_enabled(3) suggests
+		interval = watchdog / 2
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		state := s.systemdStatus()
+		if watchdog > 0 {
+			state = "WATCHDOG=1\n" + state
+		}
+		if err := sdNotify(state); err != nil {
+			s.Config().logger().Debug("Can't notify systemd", "err", err)
+		}
+	}
+}
+
+func (s *Server) systemdStatus() string {
+	sessions := 0
+	if conns := s.Config().conns; conns != nil {
+		sessions = conns.activeSessions()
+	}
+	return fmt.Sprintf("STATUS=Serving %d connections, %d sessions", s.activeConns(), sessions)
+}
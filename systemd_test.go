@@ -0,0 +1,104 @@
+package simplescp
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSystemdListeners(t *testing.T) {
+	// In the child process started below, with the socket as fd 3
+	if os.Getenv("SIMPLESCP_TEST_SYSTEMD") == "1" {
+		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		listeners, err := systemdListeners()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(listeners) != 1 {
+			t.Fatalf("Got %d listeners from systemd", len(listeners))
+		}
+		if len(os.Getenv("LISTEN_FDS")) > 0 {
+			t.Error("LISTEN_FDS left in the environment")
+		}
+		conn, err := listeners[0].Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("ok"))
+		conn.Close()
+		return
+	}
+
+	if listeners, err := systemdListeners(); err != nil || len(listeners) > 0 {
+		t.Errorf("Got listeners %v (%v) without socket activation", listeners, err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	f, err := listener.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSystemdListeners$")
+	cmd.Env = append(os.Environ(), "SIMPLESCP_TEST_SYSTEMD=1", "LISTEN_FDS=1", "LISTEN_FDNAMES=simplescp.socket")
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, _ := io.ReadAll(conn)
+	conn.Close()
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "ok" {
+		t.Errorf("Connection not served through the systemd socket, got %q", reply)
+	}
+}
+
+func TestNotifySystemd(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", sock)
+	t.Setenv("WATCHDOG_USEC", "100000")
+
+	c := newTestConfig(t)
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go NewServer(c).notifySystemd(stop)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	for _, expected := range []string{"READY=1", "WATCHDOG=1"} {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(buf[:n]), expected+"\n") || !strings.Contains(string(buf[:n]), "STATUS=Serving 0 connections, 0 sessions") {
+			t.Errorf("Unexpected notification %q, expected %s", buf[:n], expected)
+		}
+	}
+}
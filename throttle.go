@@ -0,0 +1,67 @@
+package simplescp
+
+import (
+	"context"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/time/rate"
+)
+
+// Biggest chunk of data we'll let through the limiter at once
+const maxThrottleBurst = 32 * 1024
+
+// throttledChannel limits the rate at which data can be sent or received through a channel.
+// Both directions share the same token bucket.
+type throttledChannel struct {
+	ssh.Channel
+	limiter *rate.Limiter
+}
+
+// Wrap channel so it doesn't go any faster than bytesPerSec. A zero rate means no limit.
+func throttleChannel(channel ssh.Channel, bytesPerSec ByteSize) ssh.Channel {
+	if bytesPerSec <= 0 {
+		return channel
+	}
+
+	burst := maxThrottleBurst
+	if int64(bytesPerSec) < int64(burst) {
+		burst = int(bytesPerSec)
+	}
+	return &throttledChannel{
+		Channel: channel,
+		limiter: rate.NewLimiter(rate.Limit(bytesPerSec), burst),
+	}
+}
+
+func (t *throttledChannel) Read(data []byte) (int, error) {
+	if len(data) > t.limiter.Burst() {
+		data = data[:t.limiter.Burst()]
+	}
+	n, err := t.Channel.Read(data)
+	if n > 0 {
+		if werr := t.limiter.WaitN(context.Background(), n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+func (t *throttledChannel) Write(data []byte) (int, error) {
+	written := 0
+	for written < len(data) {
+		chunk := data[written:]
+		if len(chunk) > t.limiter.Burst() {
+			chunk = chunk[:t.limiter.Burst()]
+		}
+		err := t.limiter.WaitN(context.Background(), len(chunk))
+		if err != nil {
+			return written, err
+		}
+		n, err := t.Channel.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,59 @@
+package simplescp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TOTP settings (RFC 6238) used by every authenticator app out there
+const (
+	totpStep   = 30 * time.Second
+	totpDigits = 6
+	totpSkew   = 1 // Steps before and after the current one that are still accepted
+)
+
+// Decode a base32 TOTP secret, as shown by authenticator apps (spaces,
+// lowercase letters and missing padding are all fine)
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid TOTP secret: %v", err)
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("invalid TOTP secret: it's empty")
+	}
+	return key, nil
+}
+
+// The code for a given time step (RFC 4226 HOTP)
+func totpCode(key []byte, step uint64) string {
+	mac := hmac.New(sha1.New, key)
+	binary.Write(mac, binary.BigEndian, step)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// Checks a code against the secret at time t, allowing for clocks being a bit off
+func checkTOTP(secret string, code string, t time.Time) bool {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return false
+	}
+	code = strings.TrimSpace(code)
+	step := uint64(t.Unix()) / uint64(totpStep/time.Second)
+	for i := -totpSkew; i <= totpSkew; i++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step+uint64(i))), []byte(code)) == 1 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package simplescp
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+func TestTOTP(t *testing.T) {
+	// Test vectors from RFC 6238, truncated to 6 digits
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, test := range tests {
+		if !checkTOTP(secret, test.code, time.Unix(test.time, 0)) {
+			t.Errorf("Code %s rejected at %d", test.code, test.time)
+		}
+	}
+	if !checkTOTP(secret, "287082", time.Unix(59+30, 0)) {
+		t.Error("Code from the previous step rejected")
+	}
+	if checkTOTP(secret, "287082", time.Unix(59+90, 0)) {
+		t.Error("Old code accepted")
+	}
+	if checkTOTP(secret, "", time.Unix(59, 0)) {
+		t.Error("Empty code accepted")
+	}
+}
+
+func TestKeyboardInteractiveAuth(t *testing.T) {
+	secret := "JBSWY3DPEHPK3PXP"
+	key, _ := decodeTOTPSecret(secret)
+	code := totpCode(key, uint64(time.Now().Unix())/30)
+
+	c := Config{User: "scpuser", TOTPSecret: secret, passwords: map[string]string{"scpuser": "hunter2"}}
+	answer := func(answers ...string) func(string, string, []string, []bool) ([]string, error) {
+		return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			a := answers[0]
+			answers = answers[1:]
+			return []string{a}, nil
+		}
+	}
+
+	tests := []struct {
+		answers  []string
+		accepted bool
+	}{
+		{[]string{"hunter2", code}, true},
+		{[]string{"hunter2", "000000"}, false},
+		{[]string{"hunter3"}, false},
+	}
+	for _, test := range tests {
+		_, err := c.keyboardInteractiveAuth(testConnMetadata{"scpuser"}, answer(test.answers...))
+		if (err == nil) != test.accepted {
+			t.Errorf("Answers %v: expected accepted %v, got error %v", test.answers, test.accepted, err)
+		}
+	}
+
+	if _, err := c.passwordAuth(testConnMetadata{"scpuser"}, []byte("hunter2")); err == nil {
+		t.Error("Password accepted without a verification code")
+	}
+	c.TOTPSecret = ""
+	if _, err := c.keyboardInteractiveAuth(testConnMetadata{"scpuser"}, answer("hunter2")); err != nil {
+		t.Errorf("Password rejected for a user without a TOTP secret: %v", err)
+	}
+}
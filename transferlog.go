@@ -0,0 +1,269 @@
+package simplescp
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// transfer describes a finished (or aborted) upload or download
+type transfer struct {
+	start      time.Time
+	end        time.Time
+	remoteHost string
+	user       string
+	protocol   string // scp or sftp
+	upload     bool
+	path       string
+	bytes      int64
+	checksum   string // Of the whole file, for complete transfers
+	complete   bool
+}
+
+// transferLog records one line per transfer, either in the classic xferlog
+// format used by ftp servers or as CSV. It's shared by all sessions.
+type transferLog struct {
+	mu     sync.Mutex
+	f      *os.File
+	path   string
+	format string
+}
+
+var csvHeader = []string{"time", "user", "remote_host", "protocol", "direction", "path", "bytes", "duration", "status", "checksum"}
+
+func openTransferLog(path string, format string) (*transferLog, error) {
+	format = strings.ToLower(format)
+	if format == "" {
+		format = "xferlog"
+	}
+	if format != "xferlog" && format != "csv" {
+		return nil, fmt.Errorf("Unknown transfer log format %q, expected xferlog or csv", format)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("Can't open transfer log: %v", err)
+	}
+	l := &transferLog{f: f, path: path, format: format}
+
+	if format == "csv" {
+		// Only start new files with a header
+		if fi, err := f.Stat(); err == nil && fi.Size() == 0 {
+			w := csv.NewWriter(f)
+			w.Write(csvHeader)
+			w.Flush()
+		}
+	}
+	return l, nil
+}
+
+func (l *transferLog) record(t transfer) error {
+	var line string
+	if l.format == "csv" {
+		line = t.csv()
+	} else {
+		line = t.xferlog()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := io.WriteString(l.f, line)
+	return err
+}
+
+// Check if the log file has been moved or removed since we opened it
+func (l *transferLog) moved() bool {
+	fi, err := os.Stat(l.path)
+	if err != nil {
+		return true
+	}
+	ofi, err := l.f.Stat()
+	return err != nil || !os.SameFile(fi, ofi)
+}
+
+func (l *transferLog) Close() error {
+	return l.f.Close()
+}
+
+// Format the transfer as an xferlog line (see xferlog(5)):
+// current-time transfer-time remote-host file-size filename transfer-type
+// special-action-flag direction access-mode username service-name
+// authentication-method authenticated-user-id completion-status
+func (t transfer) xferlog() string {
+	direction := "o"
+	if t.upload {
+		direction = "i"
+	}
+	status := "i"
+	if t.complete {
+		status = "c"
+	}
+	// Fields are separated by spaces, so they can't have any of their own
+	path := strings.Join(strings.Fields(t.path), "_")
+	seconds := int64(t.end.Sub(t.start).Round(time.Second) / time.Second)
+
+	return fmt.Sprintf("%s %d %s %d %s b _ %s r %s %s 0 * %s\n",
+		t.end.Format("Mon Jan _2 15:04:05 2006"), seconds, t.remoteHost, t.bytes, path,
+		direction, t.user, t.protocol, status)
+}
+
+// Format the transfer as a CSV record with the columns in csvHeader
+func (t transfer) csv() string {
+	direction := "download"
+	if t.upload {
+		direction = "upload"
+	}
+	status := "incomplete"
+	if t.complete {
+		status = "complete"
+	}
+
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	w.Write([]string{
+		t.end.UTC().Format(time.RFC3339),
+		t.user,
+		t.remoteHost,
+		t.protocol,
+		direction,
+		t.path,
+		strconv.FormatInt(t.bytes, 10),
+		strconv.FormatFloat(t.end.Sub(t.start).Seconds(), 'f', 3, 64),
+		status,
+		t.checksum,
+	})
+	w.Flush()
+	return b.String()
+}
+
+// Called whenever a transfer of the current session finishes. Records it in the
+// transfer log (if there's one), lets webhooks know about completed transfers and
+// runs the upload command for completed uploads. checksum is the file's, worked
+// out as it was transferred (empty if it couldn't be)
+func (c Config) transferDone(protocol string, upload bool, path string, start time.Time, bytes int64, checksum string, complete bool) {
+	duration := time.Since(start)
+	if complete {
+		event := EventDownloadComplete
+		if upload {
+			event = EventUploadComplete
+			c.runUploadCommand(protocol, path, bytes)
+		}
+		c.notify(WebhookEvent{Event: event, Protocol: protocol, Path: path, Size: bytes, Checksum: checksum, Duration: duration.Seconds()})
+	}
+
+	if c.transferLog == nil {
+		return
+	}
+	err := c.transferLog.record(transfer{
+		start:      start,
+		end:        start.Add(duration),
+		remoteHost: c.remoteHost,
+		user:       c.username,
+		protocol:   protocol,
+		upload:     upload,
+		path:       path,
+		bytes:      bytes,
+		checksum:   checksum,
+		complete:   complete,
+	})
+	if err != nil {
+		c.logger().Error("Can't write to transfer log", "file", c.TransferLog, "err", err)
+	}
+}
+
+// loggedFile is a file open through sftp that gets recorded in the transfer
+// log (and reported to webhooks) once the client closes it
+type loggedFile struct {
+	sftpFile
+	config   Config
+	path     string
+	upload   bool
+	start    time.Time
+	bytes    atomic.Int64
+	failed   atomic.Bool
+	checksum *offsetChecksum // nil if no one wants to know
+	transfer *liveTransfer
+}
+
+// Wrap a file opened through sftp so we find out when its transfer is done, if anyone's interested
+func (c Config) logFile(f sftpFile, path string, upload bool) sftpFile {
+	if c.transferLog == nil && len(c.Webhooks) == 0 && len(c.UploadCommand) == 0 && c.session == nil {
+		return f
+	}
+	l := &loggedFile{sftpFile: f, config: c, path: path, upload: upload, start: time.Now()}
+	l.transfer = c.session.startTransfer("sftp", upload, path)
+	if h := c.transferChecksum(); h != nil {
+		l.checksum = &offsetChecksum{h: h}
+	}
+	return l
+}
+
+func (f *loggedFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.sftpFile.ReadAt(p, off)
+	f.bytes.Add(int64(n))
+	f.transfer.add(int64(n))
+	if f.checksum != nil {
+		f.checksum.add(p[:n], off)
+	}
+	if err != nil && err != io.EOF {
+		f.failed.Store(true)
+	}
+	return n, err
+}
+
+func (f *loggedFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := f.sftpFile.WriteAt(p, off)
+	f.bytes.Add(int64(n))
+	f.transfer.add(int64(n))
+	if f.checksum != nil {
+		f.checksum.add(p[:n], off)
+	}
+	if err != nil {
+		f.failed.Store(true)
+	}
+	return n, err
+}
+
+// The request server lets us know when the connection's dropped with the file
+// still open, the transfer's incomplete then
+func (f *loggedFile) TransferError(err error) {
+	f.failed.Store(true)
+	if t, ok := f.sftpFile.(sftp.TransferError); ok {
+		t.TransferError(err)
+	}
+}
+
+func (f *loggedFile) Close() error {
+	err := f.sftpFile.Close()
+	f.config.session.endTransfer(f.transfer)
+	complete := err == nil && !f.failed.Load()
+	var checksum string
+	if complete && f.checksum != nil {
+		checksum = f.sum()
+	}
+	f.config.transferDone("sftp", f.upload, f.path, f.start, f.bytes.Load(), checksum, complete)
+	return err
+}
+
+// The checksum of the whole file. Clients that only transferred part of it,
+// or went back over what they'd already done, leave us reading it back
+func (f *loggedFile) sum() string {
+	if fi, err := f.config.fileSystem().Stat(f.path); err == nil {
+		if sum, ok := f.checksum.sum(fi.Size()); ok {
+			return sum
+		}
+	}
+	sum, err := f.config.fileChecksum(f.path)
+	if err != nil {
+		f.config.logger().Warn("Can't checksum file", "file", f.path, "err", err)
+	}
+	return sum
+}
@@ -0,0 +1,60 @@
+package simplescp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTransferLog(t *testing.T) {
+	end := time.Date(2020, time.March, 5, 9, 30, 15, 0, time.UTC)
+	tr := transfer{
+		start:      end.Add(-2 * time.Second),
+		end:        end,
+		remoteHost: "192.0.2.10",
+		user:       "scpuser",
+		protocol:   "scp",
+		upload:     true,
+		path:       "/srv/scp/my file.txt",
+		bytes:      1234,
+		complete:   true,
+	}
+
+	expected := "Thu Mar  5 09:30:15 2020 2 192.0.2.10 1234 /srv/scp/my_file.txt b _ i r scpuser scp 0 * c\n"
+	if line := tr.xferlog(); line != expected {
+		t.Errorf("Unexpected xferlog line:\n%q\nExpected:\n%q", line, expected)
+	}
+
+	tr.upload = false
+	tr.complete = false
+	expected = "2020-03-05T09:30:15Z,scpuser,192.0.2.10,scp,download,/srv/scp/my file.txt,1234,2.000,incomplete,\n"
+	if line := tr.csv(); line != expected {
+		t.Errorf("Unexpected csv line:\n%q\nExpected:\n%q", line, expected)
+	}
+
+	// New csv files start with a header, existing ones are appended to
+	path := filepath.Join(t.TempDir(), "xfer.csv")
+	for i := 0; i < 2; i++ {
+		l, err := openTransferLog(path, "csv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := l.record(tr); err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = "time,user,remote_host,protocol,direction,path,bytes,duration,status,checksum\n" + expected + expected
+	if string(contents) != expected {
+		t.Errorf("Unexpected transfer log contents:\n%s\nExpected:\n%s", contents, expected)
+	}
+
+	if _, err := openTransferLog(path, "json"); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,102 @@
+package simplescp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// Tells a simplescp started by Upgrade how many listening sockets it's been
+// handed, from fd 3 on. The fd right after them is where it says it's ready
+const upgradeFDsEnv = "SIMPLESCP_UPGRADE_FDS"
+
+// How long the new process has to start serving before the upgrade is given up
+const upgradeTimeout = 30 * time.Second
+
+// Upgrade starts a new simplescp, the executable at path run with args, and
+// hands it the sockets this server is listening on. It returns once the new
+// process is serving them, from then on both get new connections until this
+// server is shut down. That way the binary can be replaced without dropping
+// the listening sockets or refusing any connections.
+// If the new process doesn't start serving the upgrade is given up, and this
+// server carries on as it was.
+func (s *Server) Upgrade(path string, args ...string) (*os.Process, error) {
+	files, err := s.listenerFiles()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, errors.New("Can't upgrade: not listening")
+	}
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer ready.Close()
+
+	cmd := exec.Command(path, args...)
+	cmd.Env = append(os.Environ(), upgradeFDsEnv+"="+strconv.Itoa(len(files)))
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return nil, fmt.Errorf("Can't start new process: %v", err)
+	}
+	s.Config().logger().Info("Started new process, handing over sockets", "pid", cmd.Process.Pid, "sockets", len(files))
+
+	ready.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	if _, err := ready.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("New process didn't start serving: %v", err)
+	}
+	// Don't leave it a zombie if it exits before we do
+	go cmd.Wait()
+	return cmd.Process, nil
+}
+
+// Copies of the sockets the server is listening on
+func (s *Server) listenerFiles() ([]*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var files []*os.File
+	for _, l := range s.listeners {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return files, fmt.Errorf("Can't hand over listener on %s", l.Addr())
+		}
+		f, err := fl.File()
+		if err != nil {
+			return files, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// Listeners handed over by the simplescp we're taking over from, if it
+// started us with Upgrade. Along with the pipe to tell it when we're serving
+func upgradeListeners() ([]net.Listener, *os.File, error) {
+	n, err := strconv.Atoi(os.Getenv(upgradeFDsEnv))
+	if err != nil || n <= 0 {
+		return nil, nil, nil
+	}
+	os.Unsetenv(upgradeFDsEnv)
+	ready := os.NewFile(uintptr(listenFDsStart+n), "upgrade ready pipe")
+	listeners, err := fdListeners(n, nil)
+	if err != nil {
+		ready.Close()
+		return nil, nil, err
+	}
+	return listeners, ready, nil
+}
@@ -0,0 +1,56 @@
+package simplescp
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestUpgrade(t *testing.T) {
+	// The new process, started by Upgrade below
+	if os.Getenv("SIMPLESCP_TEST_UPGRADE") == "1" {
+		c := NewConfig()
+		c.User, c.Password, c.Dir = "scpuser", "hunter2", os.TempDir()
+		c.PrivateKeyFile, c.AuthKeysFile = "", ""
+		c.OneShot = true
+		if err := c.Init(); err != nil {
+			t.Fatal(err)
+		}
+		NewServer(c).ListenAndServe()
+		return
+	}
+
+	c := newTestConfig(t)
+	c.Port = "0"
+	c.Listen = []string{"127.0.0.1"}
+	listening := make(chan net.Addr, 1)
+	c.OnListen = func(addr net.Addr) { listening <- addr }
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(c)
+	go server.ListenAndServe()
+	addr := (<-listening).String()
+
+	t.Setenv("SIMPLESCP_TEST_UPGRADE", "1")
+	process, err := server.Upgrade(os.Args[0], "-test.run=^TestUpgrade$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer process.Kill()
+	server.Shutdown(context.Background())
+
+	// The socket's still there, served by the new process now
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "scpuser",
+		Auth:            []ssh.AuthMethod{ssh.Password("hunter2")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("Can't connect after upgrading: %v", err)
+	}
+	client.Close()
+}
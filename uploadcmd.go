@@ -0,0 +1,137 @@
+package simplescp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/flynn/go-shlex"
+)
+
+// Split the upload command into its arguments, so placeholders are expanded
+// into a single argument each no matter what the file name looks like
+func parseUploadCommand(command string) ([]string, error) {
+	args, err := shlex.Split(command)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid upload command: %v", err)
+	}
+	if len(args) == 0 {
+		return nil, errors.New("Invalid upload command: it's empty")
+	}
+	return args, nil
+}
+
+// Expand the placeholders in an upload command argument:
+//   %f: Full path of the uploaded file
+//   %d: Directory the file was uploaded to
+//   %b: File name, without the directory. As ./-name when an argument starts
+//       with one like that, so it isn't taken for an option
+//   %u: User that uploaded it
+//   %s: File size in bytes
+//   %r: Address the upload came from
+//   %%: A literal %
+func expandUploadArg(arg string, path string, user string, size int64, remoteHost string) string {
+	var b strings.Builder
+	for i := 0; i < len(arg); i++ {
+		if arg[i] != '%' || i == len(arg)-1 {
+			b.WriteByte(arg[i])
+			continue
+		}
+		i++
+		switch arg[i] {
+		case 'f':
+			b.WriteString(path)
+		case 'd':
+			b.WriteString(filepath.Dir(path))
+		case 'b':
+			name := filepath.Base(path)
+			if b.Len() == 0 && strings.HasPrefix(name, "-") {
+				name = "./" + name
+			}
+			b.WriteString(name)
+		case 'u':
+			b.WriteString(user)
+		case 's':
+			b.WriteString(strconv.FormatInt(size, 10))
+		case 'r':
+			b.WriteString(remoteHost)
+		case '%':
+			b.WriteByte('%')
+		default:
+			// Not a placeholder we know of, leave it alone
+			b.WriteByte('%')
+			b.WriteByte(arg[i])
+		}
+	}
+	return b.String()
+}
+
+// Environment for the upload command. It doesn't get to see our own settings
+// (which include passwords), just the details of the upload and UploadCommandEnv
+func (c Config) uploadCommandEnv(protocol string, path string, size int64) []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "SIMPLESCP_") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env, c.UploadCommandEnv...)
+	return append(env,
+		"SIMPLESCP_FILE="+path,
+		"SIMPLESCP_USER="+c.username,
+		"SIMPLESCP_SIZE="+strconv.FormatInt(size, 10),
+		"SIMPLESCP_REMOTE_ADDR="+c.remoteHost,
+		"SIMPLESCP_SESSION="+c.sessionID,
+		"SIMPLESCP_PROTOCOL="+protocol,
+	)
+}
+
+// Run the upload command (if there's one) for a file that's just been
+// uploaded. It runs in the background, killed if it takes longer than
+// UploadCommandTimeout
+func (c Config) runUploadCommand(protocol string, path string, size int64) {
+	if len(c.UploadCommand) == 0 {
+		return
+	}
+	args, err := parseUploadCommand(c.UploadCommand)
+	if err != nil {
+		c.logger().Error("Not running upload command", "err", err)
+		return
+	}
+	for i := range args {
+		args[i] = expandUploadArg(args[i], path, c.username, size, c.remoteHost)
+	}
+
+	go func() {
+		ctx := context.Background()
+		if c.UploadCommandTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, c.UploadCommandTimeout)
+			defer cancel()
+		}
+
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Env = c.uploadCommandEnv(protocol, path, size)
+		if c.isLocal() {
+			cmd.Dir = filepath.Dir(path)
+		}
+		log := c.logger().With("file", path, "command", args)
+		log.Debug("Running upload command")
+
+		output, err := cmd.CombinedOutput()
+		if ctx.Err() == context.DeadlineExceeded {
+			log.Error("Upload command timed out", "timeout", c.UploadCommandTimeout.String(), "output", string(output))
+			return
+		}
+		if err != nil {
+			log.Error("Upload command failed", "err", err, "output", string(output))
+			return
+		}
+		log.Debug("Upload command finished", "output", string(output))
+	}()
+}
@@ -0,0 +1,29 @@
+package simplescp
+
+import "testing"
+
+func TestExpandUploadArg(t *testing.T) {
+	for arg, expected := range map[string]string{
+		"%f":        "/srv/in/report.pdf",
+		"%d/%b":     "/srv/in/report.pdf",
+		"%u@%r:%s":  "alice@192.0.2.1:1234",
+		"100%%":     "100%",
+		"%x":        "%x",
+		"trailing%": "trailing%",
+	} {
+		if got := expandUploadArg(arg, "/srv/in/report.pdf", "alice", 1234, "192.0.2.1"); got != expected {
+			t.Errorf("%s expanded to %q, expected %q", arg, got, expected)
+		}
+	}
+
+	// Clients pick the names, which mustn't turn into options
+	for arg, expected := range map[string]string{
+		"%b":        "./-rf",
+		"--file=%b": "--file=-rf",
+		"%f":        "/srv/in/-rf",
+	} {
+		if got := expandUploadArg(arg, "/srv/in/-rf", "alice", 0, ""); got != expected {
+			t.Errorf("%s expanded to %q, expected %q", arg, got, expected)
+		}
+	}
+}
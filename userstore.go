@@ -0,0 +1,166 @@
+package simplescp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrNoSuchUser is returned by a UserStore when the requested user doesn't exist
+var ErrNoSuchUser = errors.New("no such user")
+
+// Permission is a set of operations a user is allowed to perform
+type Permission uint
+
+const (
+	PermRead    Permission = 1 << iota // Download files
+	PermWrite                          // Upload files, and change what's in them
+	PermList                           // See what's in directories
+	PermDelete                         // Remove files and directories
+	PermRename                         // Rename and move files and directories
+	PermMkdir                          // Create directories
+	PermSymlink                        // Create symlinks and hard links
+	PermChmod                          // Change modes and times
+
+	PermAll = PermRead | PermWrite | PermList | PermDelete | PermRename | PermMkdir | PermSymlink | PermChmod
+)
+
+// What read and write allow on their own, from before there were any finer
+// permissions than those two
+const (
+	permReadAll  = PermRead | PermList
+	permWriteAll = PermWrite | PermDelete | PermRename | PermMkdir | PermSymlink | PermChmod
+)
+
+var permissionNames = map[string]Permission{
+	"read":    PermRead,
+	"write":   PermWrite,
+	"list":    PermList,
+	"delete":  PermDelete,
+	"rename":  PermRename,
+	"mkdir":   PermMkdir,
+	"symlink": PermSymlink,
+	"chmod":   PermChmod,
+	"all":     PermAll,
+}
+
+// ParsePermissions parses a comma separated list of permissions (e.g.
+// "write,list"). Just read and write, without any of the finer ones, still mean
+// everything they used to: read is listing as well and write is making any
+// changes at all
+func ParsePermissions(s string) (Permission, error) {
+	var perms Permission
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		p, ok := permissionNames[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown permission %q", name)
+		}
+		perms |= p
+	}
+	if perms&^(PermRead|PermWrite) == 0 {
+		if perms.Has(PermRead) {
+			perms |= permReadAll
+		}
+		if perms.Has(PermWrite) {
+			perms |= permWriteAll
+		}
+	}
+	return perms, nil
+}
+
+// Has reports whether all the permissions in p2 are part of p
+func (p Permission) Has(p2 Permission) bool {
+	return p&p2 == p2
+}
+
+// String lists the permissions in p the way ParsePermissions takes them
+func (p Permission) String() string {
+	if p.Has(PermAll) {
+		return "all"
+	}
+	var names []string
+	for _, name := range []string{"read", "write", "list", "delete", "rename", "mkdir", "symlink", "chmod"} {
+		if p.Has(permissionNames[name]) {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// User is an account allowed to log into the server
+type User struct {
+	Name         string
+	PasswordHash string // bcrypt or argon2id hash of the user's password
+	PublicKeys   []ssh.PublicKey
+	HomeDir      string
+	Permissions  Permission
+	Quota        ByteSize      // 0 means the server's default quota applies
+	TOTPSecret   string        // Base32 secret asked for as a second factor after the password, if set
+	IdleTimeout  time.Duration // 0 means the server's default idle timeout applies
+}
+
+// UserStore looks up the accounts allowed to log into the server.
+// It's consulted at connect time, so changes are picked up without a restart.
+type UserStore interface {
+	// LookupUser returns ErrNoSuchUser if the user doesn't exist
+	LookupUser(username string) (*User, error)
+	Close() error
+}
+
+// Work out what a user is allowed to do. Users coming from the user store have
+// their own permissions, but nobody can write if the server is read only
+// (or read if it's write only).
+func (c Config) userPermissions(u *User) Permission {
+	perms := PermAll
+	if u != nil {
+		perms = u.Permissions
+	}
+	if c.ReadOnly {
+		perms &^= permWriteAll
+	}
+	if c.WriteOnly {
+		perms &^= permReadAll
+	}
+	return perms
+}
+
+// Users coming from the user store can have their own quota instead of the default one
+func (c Config) userQuota(u *User) ByteSize {
+	if u != nil && u.Quota > 0 {
+		return u.Quota
+	}
+	return c.Quota
+}
+
+// Same for how long their sessions can stay idle
+func (c Config) userIdleTimeout(u *User) time.Duration {
+	if u != nil && u.IdleTimeout > 0 {
+		return u.IdleTimeout
+	}
+	return c.IdleTimeout
+}
+
+// Checks pass against the user's password hash
+func (u *User) checkPassword(pass []byte) bool {
+	if len(u.PasswordHash) == 0 {
+		return false
+	}
+	return checkPasswordHash(u.PasswordHash, pass)
+}
+
+// Checks if key is one of the user's public keys
+func (u *User) hasKey(key ssh.PublicKey) bool {
+	for _, userKey := range u.PublicKeys {
+		if keysEqual(key, userKey) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,152 @@
+package simplescp
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	_ "modernc.org/sqlite"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS users (
+	username      TEXT PRIMARY KEY,
+	password_hash TEXT NOT NULL DEFAULT '',
+	public_keys   TEXT NOT NULL DEFAULT '',
+	home_dir      TEXT NOT NULL DEFAULT '',
+	permissions   TEXT NOT NULL DEFAULT 'read,write',
+	quota         INTEGER NOT NULL DEFAULT 0,
+	totp_secret   TEXT NOT NULL DEFAULT '',
+	idle_timeout  INTEGER NOT NULL DEFAULT 0
+)`
+
+// Columns added after the table was first created, along with their definition
+var sqliteMigrations = []struct {
+	column     string
+	definition string
+}{
+	{"quota", "INTEGER NOT NULL DEFAULT 0"},
+	{"totp_secret", "TEXT NOT NULL DEFAULT ''"},
+	{"idle_timeout", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+// SQLiteUserStore keeps users in an SQLite database, in a "users" table with the columns:
+//
+//	username: Name used to log in
+//	password_hash: bcrypt or argon2id hash of the user's password (empty disables password logins)
+//	public_keys: Public keys in authorized_keys format, one per line
+//	home_dir: Directory the user will be sharing files out of
+//	permissions: Comma separated list of permissions (read, write, all)
+//	quota: How many bytes the user can store (0 to use the server's default)
+//	totp_secret: Base32 TOTP secret asked for after the password (empty for just the password)
+//	idle_timeout: Seconds the user's sessions can go without any activity (0 to use the server's default)
+type SQLiteUserStore struct {
+	db *sql.DB
+}
+
+// OpenSQLiteUserStore opens (creating it if needed) the user database at path
+func OpenSQLiteUserStore(path string) (*SQLiteUserStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("Can't open user database: %v", err)
+	}
+
+	_, err = db.Exec(sqliteSchema)
+	if err == nil {
+		err = migrateSQLiteUserStore(db)
+	}
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Can't initialize user database: %v", err)
+	}
+	return &SQLiteUserStore{db: db}, nil
+}
+
+// Add any columns missing from databases created by older versions
+func migrateSQLiteUserStore(db *sql.DB) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info('users')")
+	if err != nil {
+		return err
+	}
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		columns[name] = true
+	}
+	rows.Close()
+
+	for _, m := range sqliteMigrations {
+		if columns[m.column] {
+			continue
+		}
+		slog.Info("Adding column to user database", "column", m.column)
+		_, err := db.Exec(fmt.Sprintf("ALTER TABLE users ADD COLUMN %s %s", m.column, m.definition))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LookupUser fetches a user from the database
+func (s *SQLiteUserStore) LookupUser(username string) (*User, error) {
+	var pubKeys, perms string
+	var idleTimeout int64
+	u := &User{Name: username}
+
+	row := s.db.QueryRow("SELECT password_hash, public_keys, home_dir, permissions, quota, totp_secret, idle_timeout FROM users WHERE username = ?", username)
+	err := row.Scan(&u.PasswordHash, &pubKeys, &u.HomeDir, &perms, &u.Quota, &u.TOTPSecret, &idleTimeout)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoSuchUser
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	u.IdleTimeout = time.Duration(idleTimeout) * time.Second
+
+	u.Permissions, err = ParsePermissions(perms)
+	if err != nil {
+		return nil, fmt.Errorf("Bad permissions for user %q: %v", username, err)
+	}
+
+	for _, line := range strings.Split(pubKeys, "\n") {
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+		pk, err := parsePubKey(line)
+		if err != nil {
+			slog.Warn("Error when parsing public key, ignoring", "user", username, "err", err)
+			continue
+		}
+		u.PublicKeys = append(u.PublicKeys, pk)
+	}
+	return u, nil
+}
+
+// AddUser adds u to the database. It fails if there's already a user by that
+// name
+func (s *SQLiteUserStore) AddUser(u *User) error {
+	var pubKeys strings.Builder
+	for _, pk := range u.PublicKeys {
+		pubKeys.Write(ssh.MarshalAuthorizedKey(pk))
+	}
+	_, err := s.db.Exec("INSERT INTO users (username, password_hash, public_keys, home_dir, permissions, quota, totp_secret, idle_timeout) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		u.Name, u.PasswordHash, pubKeys.String(), u.HomeDir, u.Permissions.String(), u.Quota, u.TOTPSecret, int64(u.IdleTimeout/time.Second))
+	if err != nil {
+		return fmt.Errorf("Can't add user %q: %v", u.Name, err)
+	}
+	return nil
+}
+
+// Close closes the underlying database
+func (s *SQLiteUserStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,101 @@
+package simplescp
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+const testPubKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIK70GIA86QaH1ye2tn8S4L3xv2+coqvxPobBur+QUVRz test@example"
+
+func TestSQLiteUserStore(t *testing.T) {
+	store, err := OpenSQLiteUserStore(filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	_, err = store.db.Exec("INSERT INTO users (username, password_hash, public_keys, home_dir, permissions, idle_timeout) VALUES (?, ?, ?, ?, ?, ?)",
+		"alice", string(hash), testPubKey+"\n", "/srv/alice", "read", 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.LookupUser("bob")
+	if err != ErrNoSuchUser {
+		t.Errorf("Expected ErrNoSuchUser, got %v", err)
+	}
+
+	u, err := store.LookupUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.checkPassword([]byte("hunter2")) || u.checkPassword([]byte("hunter3")) {
+		t.Errorf("Password check doesn't match the stored hash")
+	}
+	if len(u.PublicKeys) != 1 || u.HomeDir != "/srv/alice" || u.IdleTimeout != 5*time.Minute {
+		t.Errorf("Unexpected user %+v", u)
+	}
+	if !u.Permissions.Has(PermRead) || u.Permissions.Has(PermWrite) {
+		t.Errorf("Unexpected permissions %v", u.Permissions)
+	}
+}
+
+func TestParsePermissions(t *testing.T) {
+	p, err := ParsePermissions("read, write")
+	if err != nil || p != PermAll {
+		t.Errorf("Got %v, %v", p, err)
+	}
+	// On their own read and write still allow everything they always did
+	p, err = ParsePermissions("write")
+	if err != nil || p != permWriteAll {
+		t.Errorf("Got %v, %v for write", p, err)
+	}
+	p, err = ParsePermissions("write,list")
+	if err != nil || p != PermWrite|PermList {
+		t.Errorf("Got %v, %v for write,list", p, err)
+	}
+	_, err = ParsePermissions("read,fly")
+	if err == nil {
+		t.Errorf("Expected an error for an unknown permission")
+	}
+}
+
+func TestSQLiteUserStoreAddUser(t *testing.T) {
+	store, err := OpenSQLiteUserStore(filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	key, _ := parsePubKey(testPubKey)
+	hash, _ := HashPassword("hunter2")
+	added := &User{Name: "alice", PasswordHash: hash, PublicKeys: []ssh.PublicKey{key}, HomeDir: "/srv/alice", Permissions: permReadAll,
+		Quota: 1024 * 1024, IdleTimeout: time.Minute}
+	if err := store.AddUser(added); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddUser(&User{Name: "alice"}); err == nil {
+		t.Error("Added the same user twice")
+	}
+	u, err := store.LookupUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.checkPassword([]byte("hunter2")) || !u.hasKey(key) || u.HomeDir != "/srv/alice" || u.Permissions != permReadAll ||
+		u.Quota != 1024*1024 || u.IdleTimeout != time.Minute {
+		t.Errorf("Got %+v, expected %+v", u, added)
+	}
+}
+
+func TestPermissionString(t *testing.T) {
+	for _, p := range []Permission{PermAll, permReadAll, permWriteAll, PermWrite | PermList, PermRead | PermDelete} {
+		if parsed, err := ParsePermissions(p.String()); err != nil || parsed != p {
+			t.Errorf("%v parsed back as %v, %v", p, parsed, err)
+		}
+	}
+}
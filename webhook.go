@@ -0,0 +1,187 @@
+package simplescp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Events webhooks can be notified of
+const (
+	EventUploadComplete   = "upload_complete"
+	EventDownloadComplete = "download_complete"
+	EventAuthFailure      = "auth_failure"
+	EventSessionEnd       = "session_end"
+)
+
+var webhookEvents = map[string]bool{
+	EventUploadComplete:   true,
+	EventDownloadComplete: true,
+	EventAuthFailure:      true,
+	EventSessionEnd:       true,
+}
+
+// How many times we try to deliver an event, and how long we wait before the
+// first retry (doubled after every failed attempt)
+var (
+	webhookAttempts = 5
+	webhookBackoff  = time.Second
+)
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// Webhook is an URL that gets POSTed a JSON payload (see WebhookEvent) whenever
+// one of its events happens
+type Webhook struct {
+	URL    string   `yaml:"url" toml:"url"`
+	Events []string `yaml:"events" toml:"events"` // All of them if empty
+	// If set, payloads are signed with it and the HMAC-SHA256 is sent
+	// (hex encoded) in the X-Simplescp-Signature header
+	Secret string `yaml:"secret" toml:"secret"`
+}
+
+// WebhookEvent is the payload sent to webhooks
+type WebhookEvent struct {
+	Event      string    `json:"event"`
+	Time       time.Time `json:"time"`
+	Session    string    `json:"session,omitempty"`
+	User       string    `json:"user,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Protocol   string    `json:"protocol,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	Size       int64     `json:"size"`
+	Checksum   string    `json:"checksum,omitempty"`           // Of the file, hex encoded
+	Algorithm  string    `json:"checksum_algorithm,omitempty"` // What Checksum was worked out with, sha256 by default
+	Duration   float64   `json:"duration"`                     // In seconds
+}
+
+func (w Webhook) validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("Invalid webhook URL %q", w.URL)
+	}
+	for _, e := range w.Events {
+		if !webhookEvents[e] {
+			return fmt.Errorf("Unknown webhook event %q", e)
+		}
+	}
+	return nil
+}
+
+func (w Webhook) wants(event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Send an event to all the webhooks interested in it. Delivery happens in the
+// background so it never holds up the session
+func (c Config) notify(e WebhookEvent) {
+	var hooks []Webhook
+	for _, w := range c.Webhooks {
+		if w.wants(e.Event) {
+			hooks = append(hooks, w)
+		}
+	}
+	if len(hooks) == 0 {
+		return
+	}
+
+	e.Time = time.Now()
+	if len(e.Session) == 0 {
+		e.Session = c.sessionID
+	}
+	if len(e.User) == 0 {
+		e.User = c.username
+	}
+	if len(e.RemoteAddr) == 0 {
+		e.RemoteAddr = c.remoteHost
+	}
+
+	go func() {
+		if len(e.Path) > 0 && len(e.Checksum) == 0 {
+			sum, err := c.fileChecksum(e.Path)
+			if err != nil {
+				c.logger().Warn("Can't checksum file for webhook", "file", e.Path, "err", err)
+			}
+			e.Checksum = sum
+		}
+		if len(e.Checksum) > 0 {
+			e.Algorithm = c.checksumAlgorithm()
+		}
+		payload, err := json.Marshal(e)
+		if err != nil {
+			c.logger().Error("Can't encode webhook event", "err", err)
+			return
+		}
+		for _, w := range hooks {
+			go c.deliverWebhook(w, payload)
+		}
+	}()
+}
+
+// POST the payload to the webhook, retrying with exponential backoff
+func (c Config) deliverWebhook(w Webhook, payload []byte) {
+	log := c.logger().With("webhook", w.URL)
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := postWebhook(w, payload)
+		if err == nil {
+			log.Debug("Delivered webhook event")
+			return
+		}
+		if !retry || attempt == webhookAttempts {
+			log.Error("Giving up delivering webhook event", "attempts", attempt, "err", err)
+			return
+		}
+		log.Warn("Failed to deliver webhook event, retrying", "attempt", attempt, "backoff", backoff.String(), "err", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Do a single delivery attempt. Returns whether it's worth retrying if it failed
+func postWebhook(w Webhook, payload []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "simplescp")
+	if len(w.Secret) > 0 {
+		req.Header.Set("X-Simplescp-Signature", signPayload(w.Secret, payload))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	// Server errors and rate limiting are hopefully temporary, anything else won't get better
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("Unexpected status %q", resp.Status)
+}
+
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,68 @@
+package simplescp
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	webhookBackoff = time.Millisecond
+
+	path := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(path, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan WebhookEvent)
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail the first attempt to make sure deliveries are retried
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if sig := r.Header.Get("X-Simplescp-Signature"); sig != signPayload("s3cret", body) {
+			t.Errorf("Unexpected signature %q", sig)
+		}
+		var e WebhookEvent
+		if err := json.Unmarshal(body, &e); err != nil {
+			t.Error(err)
+		}
+		events <- e
+	}))
+	defer ts.Close()
+
+	c := Config{
+		Webhooks:   []Webhook{{URL: ts.URL, Events: []string{EventUploadComplete}, Secret: "s3cret"}},
+		username:   "scpuser",
+		remoteHost: "192.0.2.10",
+	}
+	// Not subscribed to this one
+	c.notify(WebhookEvent{Event: EventSessionEnd})
+	c.notify(WebhookEvent{Event: EventUploadComplete, Protocol: "scp", Path: path, Size: 6})
+
+	select {
+	case e := <-events:
+		if e.Event != EventUploadComplete || e.User != "scpuser" || e.RemoteAddr != "192.0.2.10" || e.Size != 6 ||
+			e.Checksum != "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03" {
+			t.Errorf("Unexpected event %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for webhook")
+	}
+	if attempts != 2 {
+		t.Errorf("Expected 2 delivery attempts, got %d", attempts)
+	}
+
+	if err := (Webhook{URL: ts.URL, Events: []string{"upload"}}).validate(); err == nil {
+		t.Error("Expected an error for an unknown event")
+	}
+}